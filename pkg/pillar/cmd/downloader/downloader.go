@@ -1214,17 +1214,18 @@ func handleSyncOp(ctx *downloaderContext, key string,
 	log.Infof("Downloading <%s> to <%s> using %v free management port\n",
 		config.DownloadURL, locFilename, config.UseFreeMgmtPorts)
 
-	var addrCount int
+	// The cheapest uplinks first
+	var addrs []net.IP
 	if config.UseFreeMgmtPorts {
-		addrCount = types.CountLocalAddrFreeNoLinkLocal(ctx.deviceNetworkStatus)
-		log.Infof("Have %d free management port addresses\n", addrCount)
+		addrs = types.AddrsUpToCost(ctx.deviceNetworkStatus, 0)
+		log.Infof("Have %d free management port addresses\n", len(addrs))
 		err = errors.New("No free IP management port addresses for download")
 	} else {
-		addrCount = types.CountLocalAddrAnyNoLinkLocal(ctx.deviceNetworkStatus)
-		log.Infof("Have %d any management port addresses\n", addrCount)
+		addrs = types.AddrsUpToCost(ctx.deviceNetworkStatus, 255)
+		log.Infof("Have %d any management port addresses\n", len(addrs))
 		err = errors.New("No IP management port addresses for download")
 	}
-	if addrCount == 0 {
+	if len(addrs) == 0 {
 		errStr = err.Error()
 	}
 	metricsUrl := config.DownloadURL
@@ -1234,21 +1235,7 @@ func handleSyncOp(ctx *downloaderContext, key string,
 	}
 
 	// Loop through all interfaces until a success
-	for addrIndex := 0; addrIndex < addrCount; addrIndex += 1 {
-		var ipSrc net.IP
-		if config.UseFreeMgmtPorts {
-			ipSrc, err = types.GetLocalAddrFreeNoLinkLocal(ctx.deviceNetworkStatus,
-				addrIndex, "")
-		} else {
-			// Note that GetLocalAddrAny has the free ones first
-			ipSrc, err = types.GetLocalAddrAnyNoLinkLocal(ctx.deviceNetworkStatus,
-				addrIndex, "")
-		}
-		if err != nil {
-			log.Errorf("GetLocalAddr failed: %s\n", err)
-			errStr = errStr + "\n" + err.Error()
-			continue
-		}
+	for _, ipSrc := range addrs {
 		ifname := types.GetMgmtPortFromAddr(ctx.deviceNetworkStatus, ipSrc)
 		log.Infof("Using IP source %v if %s transport %v\n",
 			ipSrc, ifname, config.TransportMethod)
@@ -51,6 +51,10 @@ type nimContext struct {
 	subNetworkInstanceStatus *pubsub.Subscription
 
 	networkFallbackAnyEth types.TriState
+	networkGeoDisable     bool
+	networkLinkLocal      bool
+	networkCandidates     bool
+	networkLinkLocal6     types.LinkLocal6Mode
 	fallbackPortMap       map[string]bool
 	filteredFallback      map[string]bool
 
@@ -104,6 +108,9 @@ func waitForDeviceNetworkConfigFile() string {
 		if err == nil {
 			break
 		}
+		if convertDNCFile(model, DNCFilename) {
+			break
+		}
 		// Tell the world that we have issues
 		types.UpdateLedManagerConfig(11)
 		log.Warningln(err)
@@ -676,6 +683,22 @@ func handleGlobalConfigModify(ctxArg interface{}, key string,
 			ctx.allowAppVnc = gcp.AllowAppVnc
 			iptables.UpdateVncAccess(ctx.allowAppVnc)
 		}
+		if gcp.NetworkGeoDisable != ctx.networkGeoDisable || first {
+			ctx.networkGeoDisable = gcp.NetworkGeoDisable
+			devicenetwork.SetGeoLookupDisabled(ctx.networkGeoDisable)
+		}
+		if gcp.NetworkLinkLocalInclude != ctx.networkLinkLocal || first {
+			ctx.networkLinkLocal = gcp.NetworkLinkLocalInclude
+			devicenetwork.SetLinkLocalIncluded(ctx.networkLinkLocal)
+		}
+		if gcp.NetworkCandidatesReport != ctx.networkCandidates || first {
+			ctx.networkCandidates = gcp.NetworkCandidatesReport
+			devicenetwork.SetCandidatesReported(ctx.networkCandidates)
+		}
+		if gcp.NetworkLinkLocal6 != ctx.networkLinkLocal6 || first {
+			ctx.networkLinkLocal6 = gcp.NetworkLinkLocal6
+			devicenetwork.SetLinkLocal6Mode(ctx.networkLinkLocal6)
+		}
 		if gcp.NetworkFallbackAnyEth != ctx.networkFallbackAnyEth || first {
 			ctx.networkFallbackAnyEth = gcp.NetworkFallbackAnyEth
 			updateFallbackAnyEth(ctx)
@@ -750,6 +773,34 @@ func handleNetworkInstanceDelete(ctxArg interface{}, key string,
 	log.Infof("handleNetworkInstanceDelete(%s) done\n", key)
 }
 
+// convertDNCFile writes the DeviceNetworkConfig of the model from its
+// YAML file if any. Returns true if written.
+func convertDNCFile(model string, DNCFilename string) bool {
+	for _, ext := range []string{"yaml", "yml"} {
+		filename := fmt.Sprintf("%s/%s.%s", DNCDirname, model, ext)
+		if !fileExists(filename) {
+			continue
+		}
+		config, version, err := devicenetwork.GetDeviceNetworkConfig(filename)
+		if err != nil {
+			log.Errorf("convertDNCFile: %s\n", err)
+			return false
+		}
+		if version != config.Version {
+			log.Infof("convertDNCFile: migrated %s from Version %d\n",
+				filename, version)
+		}
+		if err := devicenetwork.WriteDeviceNetworkConfig(DNCFilename, config); err != nil {
+			log.Errorf("convertDNCFile: %s\n", err)
+			return false
+		}
+		log.Infof("convertDNCFile: wrote %s from %s\n", DNCFilename,
+			filename)
+		return true
+	}
+	return false
+}
+
 func fileExists(filename string) bool {
 	_, err := os.Stat(filename)
 	return err == nil
@@ -7,6 +7,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"strings"
 
 	"os"
@@ -26,8 +27,12 @@ const (
 	agentName       = "wstunnelclient"
 	identityDirname = "/config"
 	serverFilename  = identityDirname + "/server"
+	auditFilename   = "/persist/log/wstunnel-audit.log"
 )
 
+// Record of the remote access sessions, shared by the tunnels
+var auditLog = &zedcloud.AuditLog{Path: auditFilename}
+
 // Set from Makefile
 var Version = "No version specified"
 
@@ -268,7 +273,7 @@ func scanAIConfigs(ctx *wstunnelclientContext) {
 
 	if !isTunnelRequired {
 		if ctx.wstunnelclient != nil {
-			ctx.wstunnelclient.Stop()
+			ctx.wstunnelclient.StopWithReason(zedcloud.StopReasonConfigChange)
 			ctx.wstunnelclient = nil
 		}
 		return
@@ -298,7 +303,7 @@ func scanAIConfigs(ctx *wstunnelclientContext) {
 			continue
 		}
 
-		var connected bool
+		var localAddrs []net.IP
 		for retryCount := 0; retryCount < addrCount; retryCount++ {
 			localAddr, err := types.GetLocalAddrAnyNoLinkLocal(*deviceNetworkStatus,
 				retryCount, ifname)
@@ -306,7 +311,14 @@ func scanAIConfigs(ctx *wstunnelclientContext) {
 				log.Info(err)
 				continue
 			}
+			localAddrs = append(localAddrs, localAddr)
+		}
+		// Reconnect attempts rotate through all the addresses on the port
+		wstunnelclient.LocalAddrs = localAddrs
+		wstunnelclient.AuditSink = auditLog.Record
 
+		var connected bool
+		for _, localAddr := range localAddrs {
 			proxyURL, _ := zedcloud.LookupProxy(deviceNetworkStatus,
 				ifname, destURL)
 			if err := wstunnelclient.TestConnection(proxyURL, localAddr); err != nil {
@@ -317,7 +329,16 @@ func scanAIConfigs(ctx *wstunnelclientContext) {
 			break
 		}
 		if connected == true {
-			wstunnelclient.Start()
+			errChan, err := wstunnelclient.StartNotify()
+			if err != nil {
+				log.Errorf("Could not start tunnel to %s: %v", destURL, err)
+				continue
+			}
+			go func() {
+				if err := <-errChan; err != nil {
+					log.Errorf("Tunnel to %s gave up: %v", destURL, err)
+				}
+			}()
 			ctx.wstunnelclient = wstunnelclient
 			break
 		}
@@ -673,6 +673,9 @@ func parseSystemAdapterConfig(config *zconfig.EdgeDevConfig,
 		}
 		port.IsMgmt = isUplink
 		port.Free = isFreeUplink
+		if !isFreeUplink {
+			port.Cost = 255
+		}
 
 		port.Dhcp = types.DT_NONE
 		// XXX temporary hack: if static IP 0.0.0.0 we log and
@@ -1526,6 +1529,42 @@ func parseConfigItems(config *zconfig.EdgeDevConfig, ctx *getconfigContext) {
 			}
 			newGlobalConfig.NetworkGeoRetryTime = uint32(i64)
 
+		case "network.geo.disable":
+			newBool, err := strconv.ParseBool(item.Value)
+			if err != nil {
+				log.Errorf("parseConfigItems: bad bool value %s for %s: %s\n",
+					item.Value, key, err)
+				continue
+			}
+			newGlobalConfig.NetworkGeoDisable = newBool
+
+		case "network.candidates.report":
+			newBool, err := strconv.ParseBool(item.Value)
+			if err != nil {
+				log.Errorf("parseConfigItems: bad bool value %s for %s: %s\n",
+					item.Value, key, err)
+				continue
+			}
+			newGlobalConfig.NetworkCandidatesReport = newBool
+
+		case "network.linklocal.include":
+			newBool, err := strconv.ParseBool(item.Value)
+			if err != nil {
+				log.Errorf("parseConfigItems: bad bool value %s for %s: %s\n",
+					item.Value, key, err)
+				continue
+			}
+			newGlobalConfig.NetworkLinkLocalInclude = newBool
+
+		case "network.linklocal6.mode":
+			newMode, err := types.ParseLinkLocal6Mode(item.Value)
+			if err != nil {
+				log.Errorf("parseConfigItems: bad mode value %s for %s: %s\n",
+					item.Value, key, err)
+				continue
+			}
+			newGlobalConfig.NetworkLinkLocal6 = newMode
+
 		case "timer.port.testduration":
 			i64, err := strconv.ParseInt(item.Value, 10, 32)
 			if err != nil {
@@ -9,7 +9,6 @@ import (
 	"github.com/eriknordmark/netlink"
 	"github.com/lf-edge/eve/pkg/pillar/types"
 	log "github.com/sirupsen/logrus"
-	"reflect"
 )
 
 // Returns a channel for address updates
@@ -140,8 +139,12 @@ func HandleAddressChange(ctx *DeviceNetworkContext) {
 		dnStatus = *ctx.DeviceNetworkStatus
 		status, _ := MakeDeviceNetworkStatus(*ctx.DevicePortConfig,
 			dnStatus)
+		// Also puts back those which a DHCP renew changed
+		if err := ApplyRouteMetrics(&status); err != nil {
+			log.Errorf("HandleAddressChange: %s\n", err)
+		}
 
-		if !reflect.DeepEqual(*ctx.DeviceNetworkStatus, status) {
+		if !types.EqualDeviceNetworkStatus(*ctx.DeviceNetworkStatus, status) {
 			log.Debugf("HandleAddressChange: change from %v to %v\n",
 				*ctx.DeviceNetworkStatus, status)
 			*ctx.DeviceNetworkStatus = status
@@ -154,7 +157,7 @@ func HandleAddressChange(ctx *DeviceNetworkContext) {
 		dnStatus, _ = MakeDeviceNetworkStatus(*ctx.DevicePortConfig,
 			dnStatus)
 
-		if !reflect.DeepEqual(ctx.Pending.PendDNS, dnStatus) {
+		if !types.EqualDeviceNetworkStatus(ctx.Pending.PendDNS, dnStatus) {
 			log.Debugf("HandleAddressChange pending: change from %v to %v\n",
 				ctx.Pending.PendDNS, dnStatus)
 			pingTestDNS := checkIfAllDNSPortsHaveIPAddrs(dnStatus)
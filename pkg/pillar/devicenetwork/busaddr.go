@@ -0,0 +1,80 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Report the PCI or USB address and the driver of the NIC of the ports
+
+package devicenetwork
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// bus-port[.port]...:config.interface
+var usbIntfRegexp = regexp.MustCompile(`^([0-9]+-[0-9]+(\.[0-9]+)*):[0-9]+\.[0-9]+$`)
+
+// setBusAddress sets the BusAddress and the Driver of a port from the
+// sysfs device of its interface, which the virtual ones such as the
+// bridges and the VLANs do not have
+func setBusAddress(port *types.NetworkPortStatus) {
+	device, err := filepath.EvalSymlinks(filepath.Join(sysClassNet,
+		port.IfName, "device"))
+	if os.IsNotExist(err) {
+		port.BusAddress = "virtual"
+		return
+	}
+	if err != nil {
+		log.Warnf("setBusAddress(%s) failed: %s\n", port.IfName, err)
+		return
+	}
+	uevent := readUevent(filepath.Join(device, "uevent"))
+	port.BusAddress = busAddress(device, uevent)
+	port.Driver = uevent["DRIVER"]
+	if port.Driver == "" {
+		if driver, err := filepath.EvalSymlinks(filepath.Join(device,
+			"driver")); err == nil {
+			port.Driver = filepath.Base(driver)
+		}
+	}
+}
+
+// busAddress returns "pci:" and the PCI address of device, or "usb:" and
+// the USB port path of the device of the USB interface. Empty if on
+// another bus such as a platform device.
+func busAddress(device string, uevent map[string]string) string {
+	if slot := uevent["PCI_SLOT_NAME"]; slot != "" {
+		return "pci:" + slot
+	}
+	if match := usbIntfRegexp.FindStringSubmatch(filepath.Base(device)); match != nil {
+		return "usb:" + match[1]
+	}
+	// Such as virtio0, on the PCI device of its virtio bus
+	for dir := device; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if pciAddr := filepath.Base(dir); pciAddrRegexp.MatchString(pciAddr) {
+			return "pci:" + pciAddr
+		}
+	}
+	return ""
+}
+
+// readUevent returns the KEY=value lines of the uevent file, empty if it
+// cannot be read
+func readUevent(filename string) map[string]string {
+	uevent := make(map[string]string)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return uevent
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "="); i > 0 {
+			uevent[line[:i]] = line[i+1:]
+		}
+	}
+	return uevent
+}
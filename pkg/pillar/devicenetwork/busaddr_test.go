@@ -0,0 +1,84 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+// setUevent writes the uevent of the sysfs device of ifname
+func setUevent(t *testing.T, ifname string, uevent string) {
+	device, err := filepath.EvalSymlinks(filepath.Join(sysClassNet, ifname,
+		"device"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(device, "uevent"),
+		[]byte(uevent), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBusAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldSysClassNet := sysClassNet
+	sysClassNet = filepath.Join(dir, "class", "net")
+	defer func() { sysClassNet = oldSysClassNet }()
+
+	setPciDevice(t, "eth0", "0000:02:00.0")
+	setUevent(t, "eth0", "DRIVER=e1000e\nPCI_CLASS=20000\n"+
+		"PCI_SLOT_NAME=0000:02:00.0\nMODALIAS=pci:v00008086d000010D3\n")
+	setUsbDevice(t, "eth1", "1-1:1.0")
+	setUevent(t, "eth1", "DEVTYPE=usb_interface\nDRIVER=r8152\n"+
+		"PRODUCT=bda/8153/3100\nINTERFACE=255/255/0\n")
+	// Without a uevent, the driver of the symlink
+	setUsbDevice(t, "eth2", "1-1.4:2.0")
+	driver := filepath.Join(dir, "bus", "usb", "drivers", "cdc_ether")
+	if err := os.MkdirAll(driver, 0755); err != nil {
+		t.Fatal(err)
+	}
+	device, _ := filepath.EvalSymlinks(filepath.Join(sysClassNet, "eth2", "device"))
+	if err := os.Symlink(driver, filepath.Join(device, "driver")); err != nil {
+		t.Fatal(err)
+	}
+	// On the virtio bus of a PCI device
+	setPciDevice(t, "eth3", filepath.Join("0000:00:03.0", "virtio0"))
+	setUevent(t, "eth3", "DRIVER=virtio_net\nMODALIAS=virtio:d00000001v00001AF4\n")
+	// A platform device
+	setPciDevice(t, "eth4", filepath.Join("..", "platform", "ff540000.ethernet"))
+	setUevent(t, "eth4", "DRIVER=rk_gmac-dwmac\nOF_NAME=ethernet\n")
+	// The bridges have no device
+	if err := os.MkdirAll(filepath.Join(sysClassNet, "br0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		ifname     string
+		busAddress string
+		driver     string
+	}{
+		{"eth0", "pci:0000:02:00.0", "e1000e"},
+		{"eth1", "usb:1-1", "r8152"},
+		{"eth2", "usb:1-1.4", "cdc_ether"},
+		{"eth3", "pci:0000:00:03.0", "virtio_net"},
+		{"eth4", "", "rk_gmac-dwmac"},
+		{"br0", "virtual", ""},
+	} {
+		port := types.NetworkPortStatus{IfName: test.ifname}
+		setBusAddress(&port)
+		if port.BusAddress != test.busAddress || port.Driver != test.driver {
+			t.Errorf("%s: expected %q %q, got %q %q", test.ifname, test.busAddress,
+				test.driver, port.BusAddress, port.Driver)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Find the physical interfaces which are not ports, such as USB NICs
+// plugged in, for the controller to offer to adopt them
+
+package devicenetwork
+
+import (
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Set when the candidate ports are reported, accessed atomically
+var candidatesEnabled int32
+
+// SetCandidatesReported enables or disables the Candidates of the
+// DeviceNetworkStatus. Disabled by default.
+func SetCandidatesReported(reported bool) {
+	var value int32
+	if reported {
+		value = 1
+	}
+	atomic.StoreInt32(&candidatesEnabled, value)
+	log.Infof("SetCandidatesReported(%v)\n", reported)
+}
+
+func candidatesReported() bool {
+	return atomic.LoadInt32(&candidatesEnabled) != 0
+}
+
+// candidateHwID returns the port hardware identifier of link if it is a
+// physical interface, that is a device with a bus device in sysfs. A PCI
+// device is identified by its address, the others such as the USB ones by
+// their MAC.
+func candidateHwID(link netlink.Link) (string, bool) {
+	if link.Type() != "device" {
+		return "", false
+	}
+	device, err := filepath.EvalSymlinks(filepath.Join(sysClassNet,
+		link.Attrs().Name, "device"))
+	if err != nil {
+		return "", false
+	}
+	if pciAddr := filepath.Base(device); pciAddrRegexp.MatchString(pciAddr) {
+		return "pci:" + pciAddr, true
+	}
+	if len(link.Attrs().HardwareAddr) != 6 {
+		return "", false
+	}
+	return "mac:" + link.Attrs().HardwareAddr.String(), true
+}
+
+// findCandidates returns the physical interfaces which are not ports of
+// the config, with the port patterns and hardware identifiers resolved,
+// sorted by name
+func findCandidates(config types.DevicePortConfig) ([]types.CandidatePort, error) {
+	links, err := netlinkHandle.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	var candidates []types.CandidatePort
+	for _, link := range links {
+		ifname := link.Attrs().Name
+		if lookupOnIfname(config, ifname) != nil {
+			continue
+		}
+		hwid, ok := candidateHwID(link)
+		if !ok {
+			continue
+		}
+		candidates = append(candidates, types.CandidatePort{
+			IfName:  ifname,
+			MacAddr: link.Attrs().HardwareAddr.String(),
+			HwID:    hwid,
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].IfName < candidates[j].IfName
+	})
+	return candidates, nil
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Where the statistics of the interfaces are when netlink does not give
+// them, replaced in the tests
+var sysClassNet = "/sys/class/net"
+
+// getPortCounters returns the counters of link from its netlink
+// statistics, else from sysfs
+func getPortCounters(link netlink.Link) types.PortCounters {
+	if stats := link.Attrs().Statistics; stats != nil {
+		return types.PortCounters{
+			RxBytes:  stats.RxBytes,
+			TxBytes:  stats.TxBytes,
+			RxPkts:   stats.RxPackets,
+			TxPkts:   stats.TxPackets,
+			RxErrors: stats.RxErrors,
+			TxErrors: stats.TxErrors,
+			RxDrops:  stats.RxDropped,
+			TxDrops:  stats.TxDropped,
+		}
+	}
+	ifname := link.Attrs().Name
+	var counters types.PortCounters
+	for _, counter := range []struct {
+		name  string
+		value *uint64
+	}{
+		{"rx_bytes", &counters.RxBytes},
+		{"tx_bytes", &counters.TxBytes},
+		{"rx_packets", &counters.RxPkts},
+		{"tx_packets", &counters.TxPkts},
+		{"rx_errors", &counters.RxErrors},
+		{"tx_errors", &counters.TxErrors},
+		{"rx_dropped", &counters.RxDrops},
+		{"tx_dropped", &counters.TxDrops},
+	} {
+		value, err := readSysCounter(ifname, counter.name)
+		if err != nil {
+			log.Warnf("getPortCounters(%s): %s\n", ifname, err)
+			continue
+		}
+		*counter.value = value
+	}
+	return counters
+}
+
+func readSysCounter(ifname string, name string) (uint64, error) {
+	filename := filepath.Join(sysClassNet, ifname, "statistics", name)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Bad %s: %s", filename, err)
+	}
+	return value, nil
+}
@@ -4,6 +4,7 @@
 package devicenetwork
 
 import (
+	"bytes"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -14,7 +15,10 @@ import (
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +27,56 @@ import (
 func MakeDevicePortConfig(globalConfig types.DeviceNetworkConfig) types.DevicePortConfig {
 
 	config := makeDevicePortConfig(globalConfig.Uplink, globalConfig.FreeUplinks)
+	// No DHCP on the ports with static addresses, set by ApplyStaticConfig
+	for ix := range config.Ports {
+		port := &config.Ports[ix]
+		for _, static := range globalConfig.Statics {
+			if static.IfName != port.IfName {
+				continue
+			}
+			port.Dhcp = types.DT_NONE
+			if port.Gateway == nil {
+				port.Gateway = static.Gateway
+			}
+			port.DnsServers = appendNewIPs(port.DnsServers,
+				static.DnsServers...)
+		}
+		for _, cost := range globalConfig.Costs {
+			if cost.IfName == port.IfName {
+				port.Cost = cost.Cost
+				port.Free = cost.Cost == 0
+			}
+		}
+		port.NtpServers = globalConfig.NtpServers
+		for _, ntp := range globalConfig.Ntp {
+			if ntp.IfName == port.IfName {
+				port.NtpServers = ntp.NtpServers
+			}
+		}
+		for i := range globalConfig.Wireless {
+			if globalConfig.Wireless[i].IfName == port.IfName {
+				wireless := globalConfig.Wireless[i]
+				port.Wireless = &wireless
+			}
+		}
+		for i, ifname := range globalConfig.Priority {
+			if ifname == port.IfName {
+				port.Priority = i + 1
+				break
+			}
+		}
+		for _, proxy := range globalConfig.Proxies {
+			if proxy.IfName != port.IfName {
+				continue
+			}
+			proxyConfig, err := makeProxyConfig(proxy)
+			if err != nil {
+				log.Errorf("MakeDevicePortConfig: %s\n", err)
+				continue
+			}
+			port.ProxyConfig = proxyConfig
+		}
+	}
 	// Set to higher than all zero.
 	config.TimePriority = time.Unix(2, 0)
 	return config
@@ -43,9 +97,11 @@ func makeDevicePortConfig(ports []string, free []string) types.DevicePortConfig
 	config.Ports = make([]types.NetworkPortConfig, len(ports))
 	for ix, u := range ports {
 		config.Ports[ix].IfName = u
+		config.Ports[ix].Cost = 255
 		for _, f := range free {
 			if f == u {
 				config.Ports[ix].Free = true
+				config.Ports[ix].Cost = 0
 				break
 			}
 		}
@@ -56,6 +112,18 @@ func makeDevicePortConfig(ports []string, free []string) types.DevicePortConfig
 	return config
 }
 
+// portCost returns the Cost of the port, that of the older configs
+// without one being 255 unless Free
+func portCost(port types.NetworkPortConfig) uint8 {
+	if port.Free {
+		return 0
+	}
+	if port.Cost == 0 {
+		return 255
+	}
+	return port.Cost
+}
+
 func IsProxyConfigEmpty(proxyConfig types.ProxyConfig) bool {
 	if len(proxyConfig.Proxies) == 0 &&
 		proxyConfig.Exceptions == "" &&
@@ -80,7 +148,6 @@ func VerifyDeviceNetworkStatus(status types.DeviceNetworkStatus,
 		return false, nil
 	}
 
-	serverFileName := "/config/server"
 	server, err := ioutil.ReadFile(serverFileName)
 	if err != nil {
 		log.Fatal(err)
@@ -144,121 +211,252 @@ func VerifyDeviceNetworkStatus(status types.DeviceNetworkStatus,
 	return cf, errors.New(errStr)
 }
 
+// The controller to verify the connectivity to
+var serverFileName = "/config/server"
+
+// IPv6 requires links with at least that MTU
+const minIPv6Mtu = 1280
+
 // Calculate local IP addresses to make a types.DeviceNetworkStatus
 func MakeDeviceNetworkStatus(globalConfig types.DevicePortConfig, oldStatus types.DeviceNetworkStatus) (types.DeviceNetworkStatus, error) {
+	_, globalStatus, err := makeDeviceNetworkStatus(globalConfig, oldStatus)
+	return globalStatus, err
+}
+
+// makeDeviceNetworkStatus also returns the config with the port hardware
+// identifiers resolved and the patterns expanded, whose ports are those of
+// the status
+func makeDeviceNetworkStatus(globalConfig types.DevicePortConfig, oldStatus types.DeviceNetworkStatus) (types.DevicePortConfig, types.DeviceNetworkStatus, error) {
 	var globalStatus types.DeviceNetworkStatus
-	var err error = nil
 
 	log.Infof("MakeDeviceNetworkStatus()\n")
-	globalStatus.Version = globalConfig.Version
+	// Errors of the patterns and of the ports which could not be
+	// processed
+	config, hwids, errStrs := resolvePorts(globalConfig)
+	config, patterns, patternErrStrs := expandPorts(config)
+	errStrs = append(errStrs, patternErrStrs...)
+	globalStatus.Version = config.Version
 	globalStatus.Ports = make([]types.NetworkPortStatus,
-		len(globalConfig.Ports))
-	for ix, u := range globalConfig.Ports {
-		globalStatus.Ports[ix].IfName = u.IfName
-		globalStatus.Ports[ix].Name = u.Name
-		globalStatus.Ports[ix].IsMgmt = u.IsMgmt
-		globalStatus.Ports[ix].Free = u.Free
-		globalStatus.Ports[ix].ProxyConfig = u.ProxyConfig
-		// Set fields from the config...
-		globalStatus.Ports[ix].Dhcp = u.Dhcp
-		_, subnet, _ := net.ParseCIDR(u.AddrSubnet)
-		if subnet != nil {
-			globalStatus.Ports[ix].Subnet = *subnet
-		}
-		globalStatus.Ports[ix].Gateway = u.Gateway
-		globalStatus.Ports[ix].DomainName = u.DomainName
-		globalStatus.Ports[ix].NtpServer = u.NtpServer
-		globalStatus.Ports[ix].DnsServers = u.DnsServers
-		ifindex, err := IfnameToIndex(u.IfName)
-		if err != nil {
-			errStr := fmt.Sprintf("Port %s does not exist - ignored",
-				u.IfName)
-			log.Errorf("MakeDeviceNetworkStatus: %s\n", errStr)
-			err = errors.New(errStr)
-			continue
+		len(config.Ports))
+	for ix, u := range config.Ports {
+		if err := makePortStatus(&globalStatus, ix, u, oldStatus); err != nil {
+			errStrs = append(errStrs, err.Error())
 		}
-		addrs, err := getAddrs(ifindex)
+		globalStatus.Ports[ix].Pattern = patterns[u.IfName]
+		globalStatus.Ports[ix].HwID = hwids[u.IfName]
+	}
+	if candidatesReported() {
+		candidates, err := findCandidates(config)
 		if err != nil {
-			log.Warnf("MakeDeviceNetworkStatus addrs not found %s index %d: %s\n",
-				u.IfName, ifindex, err)
-			addrs = nil
-		}
-		globalStatus.Ports[ix].AddrInfoList = make([]types.AddrInfo,
-			len(addrs))
-		for i, addr := range addrs {
-			v := "IPv4"
-			if addr.IP.To4() == nil {
-				v = "IPv6"
+			errStrs = append(errStrs,
+				fmt.Sprintf("Candidate ports not listed: %s", err))
+		}
+		globalStatus.Candidates = candidates
+	}
+	// Immediate check
+	updateDeviceNetworkGeo(time.Second, &globalStatus, cachedGeoLookup)
+	log.Infof("MakeDeviceNetworkStatus() DONE\n")
+	if len(errStrs) != 0 {
+		return config, globalStatus, errors.New(strings.Join(errStrs, "; "))
+	}
+	return config, globalStatus, nil
+}
+
+// makePortStatus sets globalStatus.Ports[ix] from the config of the port
+// and its current state, keeping the geolocation and error times of
+// oldStatus. Returns the error of a port which could not be processed.
+func makePortStatus(globalStatus *types.DeviceNetworkStatus, ix int,
+	u types.NetworkPortConfig, oldStatus types.DeviceNetworkStatus) error {
+
+	globalStatus.Ports[ix].IfName = u.IfName
+	globalStatus.Ports[ix].Name = u.Name
+	globalStatus.Ports[ix].IsMgmt = u.IsMgmt
+	globalStatus.Ports[ix].Free = u.Free
+	globalStatus.Ports[ix].Cost = portCost(u)
+	globalStatus.Ports[ix].Priority = u.Priority
+	globalStatus.Ports[ix].ProxyConfig = u.ProxyConfig
+	// Set fields from the config...
+	globalStatus.Ports[ix].Dhcp = u.Dhcp
+	_, subnet, _ := net.ParseCIDR(u.AddrSubnet)
+	if subnet != nil {
+		globalStatus.Ports[ix].Subnet = *subnet
+	}
+	globalStatus.Ports[ix].Gateway = u.Gateway
+	globalStatus.Ports[ix].DomainName = u.DomainName
+	globalStatus.Ports[ix].NtpServer = u.NtpServer
+	globalStatus.Ports[ix].DnsServers = u.DnsServers
+	link, err := netlinkHandle.LinkByName(u.IfName)
+	if err != nil {
+		errStr := fmt.Sprintf("Port %s does not exist - ignored",
+			u.IfName)
+		setPortError(&globalStatus.Ports[ix], oldStatus, errStr)
+		return errors.New(errStr)
+	}
+	// Keeps the addresses found even if some could not be listed
+	var addrsErr error
+	addrs, err := getAddrs(link)
+	if err != nil {
+		errStr := fmt.Sprintf("Port %s addresses not found: %s",
+			u.IfName, err)
+		log.Errorf("MakeDeviceNetworkStatus: %s\n", errStr)
+		addrsErr = errors.New(errStr)
+	}
+	addrs, hasLinkLocal4 := filterLinkLocal4(addrs)
+	linkLocal6 := getLinkLocal6Mode()
+	if linkLocal6 == types.LL6_EXCLUDE {
+		addrs = filterLinkLocal6(addrs)
+	}
+	sortAddrs(addrs)
+	globalStatus.Ports[ix].Up = link.Attrs().Flags&net.FlagUp != 0
+	globalStatus.Ports[ix].Carrier = hasCarrier(link)
+	setLinkSettings(&globalStatus.Ports[ix])
+	setBusAddress(&globalStatus.Ports[ix])
+	setWirelessStatus(&globalStatus.Ports[ix], u.Wireless)
+	globalStatus.Ports[ix].Counters = getPortCounters(link)
+	setVlanInfo(&globalStatus.Ports[ix], link)
+	if master := getMaster(link); master != nil {
+		// Its addresses are those of the master
+		setPortError(&globalStatus.Ports[ix], oldStatus,
+			fmt.Sprintf("Port %s is enslaved to %s", u.IfName,
+				master.Attrs().Name))
+		if masterAddrs, _ := getAddrs(master); len(masterAddrs) != 0 {
+			var ips []string
+			for _, addr := range masterAddrs {
+				ips = append(ips, addr.IP.String())
 			}
-			log.Infof("PortAddrs(%s) found %s %v\n",
-				u.IfName, v, addr.IP)
-			globalStatus.Ports[ix].AddrInfoList[i].Addr = addr.IP
+			globalStatus.Ports[ix].Warnings = append(
+				globalStatus.Ports[ix].Warnings,
+				fmt.Sprintf("Port %s master %s has addresses %s",
+					u.IfName, master.Attrs().Name,
+					strings.Join(ips, ", ")))
 		}
-		// Get DNS etc info from dhcpcd. Updates DomainName and DnsServers
-		err = GetDhcpInfo(&globalStatus.Ports[ix])
-		if err != nil {
-			errStr := fmt.Sprintf("GetDhcpInfo failed %s", err)
-			globalStatus.Ports[ix].Error = errStr
-			globalStatus.Ports[ix].ErrorTime = time.Now()
+	} else if !globalStatus.Ports[ix].Up {
+		setPortError(&globalStatus.Ports[ix], oldStatus,
+			fmt.Sprintf("Port %s is admin down", u.IfName))
+	} else if !globalStatus.Ports[ix].Carrier {
+		setPortError(&globalStatus.Ports[ix], oldStatus,
+			fmt.Sprintf("Port %s has no carrier", u.IfName))
+	} else if !hasUsableAddr(addrs) && hasLinkLocal4 &&
+		u.Dhcp == types.DT_CLIENT {
+		// The kernel or dhcpcd fell back to 169.254
+		setPortError(&globalStatus.Ports[ix], oldStatus,
+			fmt.Sprintf("Port %s DHCP failed (link-local only)", u.IfName))
+	} else if !hasUsableAddr(addrs) &&
+		(u.Dhcp == types.DT_CLIENT || u.Dhcp == types.DT_STATIC) {
+		// Only those ports are expected to have addresses
+		setPortError(&globalStatus.Ports[ix], oldStatus,
+			fmt.Sprintf("Port %s is up with no usable address", u.IfName))
+	}
+	globalStatus.Ports[ix].AddrInfoList = make([]types.AddrInfo,
+		len(addrs))
+	leases := getDhcpLeases(u.IfName)
+	netlinkAddrs := getNetlinkAddrs(link)
+	globalStatus.Ports[ix].NtpServers = makeNtpServers(u, leases)
+	for i, addr := range addrs {
+		v := "IPv4"
+		if addr.IP.To4() == nil {
+			v = "IPv6"
 		}
+		log.Infof("PortAddrs(%s) found %s %v\n",
+			u.IfName, v, addr.IP)
+		globalStatus.Ports[ix].AddrInfoList[i].Addr = addr.IP
+		if linkLocal6 == types.LL6_MARK {
+			globalStatus.Ports[ix].AddrInfoList[i].LinkLocal =
+				addr.IP.IsLinkLocalUnicast()
+		}
+		setAddrOrigin(&globalStatus.Ports[ix].AddrInfoList[i], u.IfName,
+			leases, netlinkAddrs)
+	}
+	if mac := link.Attrs().HardwareAddr; len(mac) != 0 {
+		globalStatus.Ports[ix].MacAddr = mac.String()
+	}
+	globalStatus.Ports[ix].Mtu = link.Attrs().MTU
+	if link.Attrs().MTU < minIPv6Mtu && hasIPv6Addr(addrs) {
+		warning := fmt.Sprintf("Port %s MTU %d is below the IPv6 minimum %d",
+			u.IfName, link.Attrs().MTU, minIPv6Mtu)
+		log.Warnf("MakeDeviceNetworkStatus: %s\n", warning)
+		globalStatus.Ports[ix].Warnings = append(
+			globalStatus.Ports[ix].Warnings, warning)
+	}
+	globalStatus.Ports[ix].DefaultGateway = getDefaultGateway(link,
+		netlink.FAMILY_V4)
+	globalStatus.Ports[ix].DefaultGatewayV6 = getDefaultGateway(link,
+		netlink.FAMILY_V6)
+	setIPv6RAStatus(&globalStatus.Ports[ix], link)
+	// Get DNS etc info from dhcpcd. Updates DomainName and DnsServers
+	err = GetDhcpInfo(&globalStatus.Ports[ix])
+	if err != nil {
+		errStr := fmt.Sprintf("GetDhcpInfo failed %s", err)
+		if globalStatus.Ports[ix].Error == "" {
+			setPortError(&globalStatus.Ports[ix], oldStatus, errStr)
+		} else {
+			// Keep the error which explains why the port is unusable
+			log.Errorf("MakeDeviceNetworkStatus: %s\n", errStr)
+		}
+	}
+	setDNSInfo(&globalStatus.Ports[ix])
 
-		// Attempt to get a wpad.dat file if so configured
-		// Result is updating the Pacfile
-		// We always redo this since we don't know what has changed
-		// from the previous DeviceNetworkStatus.
-		err = CheckAndGetNetworkProxy(&globalStatus,
-			&globalStatus.Ports[ix])
-		if err != nil {
-			errStr := fmt.Sprintf("GetNetworkProxy failed %s", err)
-			globalStatus.Ports[ix].Error = errStr
-			globalStatus.Ports[ix].ErrorTime = time.Now()
+	// Attempt to get a wpad.dat file if so configured
+	// Result is updating the Pacfile
+	// We always redo this since we don't know what has changed
+	// from the previous DeviceNetworkStatus.
+	err = CheckAndGetNetworkProxy(globalStatus,
+		&globalStatus.Ports[ix])
+	if err != nil {
+		errStr := fmt.Sprintf("GetNetworkProxy failed %s", err)
+		if globalStatus.Ports[ix].Error == "" {
+			setPortError(&globalStatus.Ports[ix], oldStatus, errStr)
+		} else {
+			// Keep the error which explains why the port is unusable
+			log.Errorf("MakeDeviceNetworkStatus: %s\n", errStr)
+		}
+	}
+	// Preserve the outcome of the last ProbeUplinks
+	for _, old := range oldStatus.Ports {
+		if old.IfName == u.IfName {
+			globalStatus.Ports[ix].Probe = old.Probe
+			break
 		}
 	}
 	// Preserve geo info for existing interface and IP address
-	for ui := range globalStatus.Ports {
-		u := &globalStatus.Ports[ui]
-		for i := range u.AddrInfoList {
-			// Need pointer since we are going to modify
-			ai := &u.AddrInfoList[i]
-			oai := lookupPortStatusAddr(oldStatus,
-				u.IfName, ai.Addr)
-			if oai == nil {
-				continue
-			}
-			ai.Geo = oai.Geo
-			ai.LastGeoTimestamp = oai.LastGeoTimestamp
+	for i := range globalStatus.Ports[ix].AddrInfoList {
+		// Need pointer since we are going to modify
+		ai := &globalStatus.Ports[ix].AddrInfoList[i]
+		oai := lookupPortStatusAddr(oldStatus,
+			u.IfName, ai.Addr)
+		if oai == nil {
+			continue
 		}
+		ai.Geo = oai.Geo
+		ai.LastGeoTimestamp = oai.LastGeoTimestamp
 	}
-	// Immediate check
-	UpdateDeviceNetworkGeo(time.Second, &globalStatus)
-	log.Infof("MakeDeviceNetworkStatus() DONE\n")
-	return globalStatus, err
+	return addrsErr
 }
 
-// Return all IP addresses for an ifindex
+// Return all IP addresses for a link
 // Leaves mask uninitialized
+// Returns the addresses which could be listed along with an error when
+// one of the address families could not
 // Also replaces what is in the Ifindex cache since AddrChange callbacks
 // are far from reliable.
 // If AddrChange worked reliably this would just be:
 // return IfindexToAddrs(ifindex)
-func getAddrs(ifindex int) ([]net.IPNet, error) {
+func getAddrs(link netlink.Link) ([]net.IPNet, error) {
 
 	var addrs []net.IPNet
+	var errStrs []string
 
-	link, err := netlink.LinkByIndex(ifindex)
-	if err != nil {
-		err = errors.New(fmt.Sprintf("Port in config/global does not exist: %d",
-			ifindex))
-		return addrs, err
-	}
-	addrs4, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	ifindex := link.Attrs().Index
+	addrs4, err := netlinkHandle.AddrList(link, netlink.FAMILY_V4)
 	if err != nil {
 		log.Warnf("netlink.AddrList %d V4 failed: %s", ifindex, err)
+		errStrs = append(errStrs, fmt.Sprintf("IPv4 AddrList failed: %s", err))
 		addrs4 = nil
 	}
-	addrs6, err := netlink.AddrList(link, netlink.FAMILY_V6)
+	addrs6, err := netlinkHandle.AddrList(link, netlink.FAMILY_V6)
 	if err != nil {
-		log.Warnf("netlink.AddrList %d V4 failed: %s", ifindex, err)
+		log.Warnf("netlink.AddrList %d V6 failed: %s", ifindex, err)
+		errStrs = append(errStrs, fmt.Sprintf("IPv6 AddrList failed: %s", err))
 		addrs6 = nil
 	}
 	IfindexToAddrsFlush(ifindex)
@@ -278,10 +476,188 @@ func getAddrs(ifindex int) ([]net.IPNet, error) {
 		addrs = append(addrs, ip)
 		IfindexToAddrsAdd(ifindex, ip)
 	}
+	if len(errStrs) != 0 {
+		return addrs, errors.New(strings.Join(errStrs, "; "))
+	}
 	return addrs, nil
 
 }
 
+// getDefaultGateway returns the default route of the family in the
+// default table with the lowest metric through link, nil if none
+func getDefaultGateway(link netlink.Link, family int) *types.GatewayRoute {
+	ifindex := link.Attrs().Index
+	table := types.GetDefaultRouteTable()
+	// Note that a default route is represented as nil Dst
+	filter := netlink.Route{Table: table, LinkIndex: ifindex, Dst: nil}
+	fflags := netlink.RT_FILTER_TABLE
+	fflags |= netlink.RT_FILTER_OIF
+	fflags |= netlink.RT_FILTER_DST
+	routes, err := netlinkHandle.RouteListFiltered(family, &filter, fflags)
+	if err != nil {
+		log.Warnf("getDefaultGateway(%s) RouteList failed: %v\n",
+			link.Attrs().Name, err)
+		return nil
+	}
+	var gateway *types.GatewayRoute
+	for _, rt := range routes {
+		if rt.Table != table || rt.LinkIndex != ifindex || rt.Gw == nil {
+			continue
+		}
+		if gateway == nil || rt.Priority < gateway.Metric {
+			gateway = &types.GatewayRoute{Gateway: rt.Gw, Metric: rt.Priority}
+		}
+	}
+	return gateway
+}
+
+// getMaster returns the bridge or bond the link is enslaved to, if any
+func getMaster(link netlink.Link) netlink.Link {
+	index := link.Attrs().MasterIndex
+	if index == 0 {
+		return nil
+	}
+	master, err := netlinkHandle.LinkByIndex(index)
+	if err != nil {
+		log.Warnf("getMaster(%s) index %d: %s\n", link.Attrs().Name,
+			index, err)
+		// Still enslaved
+		return &netlink.Device{LinkAttrs: netlink.LinkAttrs{
+			Name: fmt.Sprintf("index %d", index), Index: index}}
+	}
+	return master
+}
+
+// hasCarrier returns true if the operational state of link is up.
+// Links whose driver does not report it, e.g. loopback and tunnels,
+// are in the unknown state and considered to have a carrier when up.
+func hasCarrier(link netlink.Link) bool {
+	attrs := link.Attrs()
+	switch attrs.OperState {
+	case netlink.OperUp:
+		return true
+	case netlink.OperUnknown:
+		return attrs.Flags&net.FlagUp != 0
+	default:
+		return false
+	}
+}
+
+// hasIPv6Addr returns true if one of addrs is an IPv6 address
+func hasIPv6Addr(addrs []net.IPNet) bool {
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Set when the IPv4 link-local addresses are reported, accessed atomically
+var linkLocal4Included int32
+
+// SetLinkLocalIncluded includes or skips the IPv4 link-local addresses,
+// i.e. 169.254/16, in the addresses of the ports. They are skipped by
+// default since unusable to reach the controller, and can be included
+// for diagnostics.
+func SetLinkLocalIncluded(included bool) {
+	var value int32
+	if included {
+		value = 1
+	}
+	atomic.StoreInt32(&linkLocal4Included, value)
+	log.Infof("SetLinkLocalIncluded(%v)\n", included)
+}
+
+// filterLinkLocal4 returns addrs without the IPv4 link-local addresses
+// unless included, and whether it had any
+func filterLinkLocal4(addrs []net.IPNet) ([]net.IPNet, bool) {
+	included := atomic.LoadInt32(&linkLocal4Included) != 0
+	var filtered []net.IPNet
+	found := false
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil && addr.IP.IsLinkLocalUnicast() {
+			found = true
+			if !included {
+				log.Debugf("filterLinkLocal4 skipped %v\n", addr.IP)
+				continue
+			}
+		}
+		filtered = append(filtered, addr)
+	}
+	return filtered, found
+}
+
+// The types.LinkLocal6Mode, accessed atomically
+var linkLocal6Mode uint32
+
+// SetLinkLocal6Mode sets whether the IPv6 link-local addresses of the
+// ports are included, excluded, or included with LinkLocal set so that
+// the consumers can filter them. They are never geolocated.
+func SetLinkLocal6Mode(mode types.LinkLocal6Mode) {
+	atomic.StoreUint32(&linkLocal6Mode, uint32(mode))
+	log.Infof("SetLinkLocal6Mode(%s)\n", mode)
+}
+
+func getLinkLocal6Mode() types.LinkLocal6Mode {
+	return types.LinkLocal6Mode(atomic.LoadUint32(&linkLocal6Mode))
+}
+
+// filterLinkLocal6 returns addrs without the IPv6 link-local addresses
+func filterLinkLocal6(addrs []net.IPNet) []net.IPNet {
+	var filtered []net.IPNet
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil && addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		filtered = append(filtered, addr)
+	}
+	return filtered
+}
+
+// sortAddrs sorts addrs in the order of AddrInfoList since the kernel
+// does not list them in a stable order: IPv4 before IPv6, global before
+// link-local, then by address
+func sortAddrs(addrs []net.IPNet) {
+	sort.Slice(addrs, func(i, j int) bool {
+		a, b := addrs[i].IP, addrs[j].IP
+		if a4, b4 := a.To4() != nil, b.To4() != nil; a4 != b4 {
+			return a4
+		}
+		if aLL, bLL := a.IsLinkLocalUnicast(), b.IsLinkLocalUnicast(); aLL != bLL {
+			return bLL
+		}
+		return bytes.Compare(a.To16(), b.To16()) < 0
+	})
+}
+
+// hasUsableAddr returns true if one of addrs is not link-local
+func hasUsableAddr(addrs []net.IPNet) bool {
+	for _, addr := range addrs {
+		if !addr.IP.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+// setPortError sets the error of a port, keeping the ErrorTime of the
+// same error in oldStatus to tell since when the port is broken
+func setPortError(port *types.NetworkPortStatus,
+	oldStatus types.DeviceNetworkStatus, errStr string) {
+
+	log.Errorf("MakeDeviceNetworkStatus: %s\n", errStr)
+	port.Error = errStr
+	port.ErrorTime = time.Now()
+	for _, old := range oldStatus.Ports {
+		if old.IfName == port.IfName && old.Error == errStr &&
+			!old.ErrorTime.IsZero() {
+			port.ErrorTime = old.ErrorTime
+			break
+		}
+	}
+}
+
 func lookupPortStatusAddr(status types.DeviceNetworkStatus,
 	ifname string, addr net.IP) *types.AddrInfo {
 
@@ -298,9 +674,52 @@ func lookupPortStatusAddr(status types.DeviceNetworkStatus,
 	return nil
 }
 
+// At most that many geolocation lookups are in flight, each with
+// geoTimeout, so that the lookups of all the addresses take about as
+// long as one
+const (
+	maxGeoLookups = 4
+	geoTimeout    = 5 * time.Second
+)
+
+// geoLookup returns the geolocation of the address in opt, replaced in
+// the tests
+var geoLookup = ipinfo.MyIPWithOptions
+
+// Set when the geolocation is disabled, accessed atomically
+var geoDisabled int32
+
+// SetGeoLookupDisabled disables or enables the geolocation of the
+// addresses. When disabled ipinfo is never queried and Geo is zero.
+func SetGeoLookupDisabled(disabled bool) {
+	var value int32
+	if disabled {
+		value = 1
+	}
+	atomic.StoreInt32(&geoDisabled, value)
+	log.Infof("SetGeoLookupDisabled(%v)\n", disabled)
+}
+
+func geoLookupDisabled() bool {
+	return atomic.LoadInt32(&geoDisabled) != 0
+}
+
 // Returns true if anything might have changed
+// Always queries ipinfo, refreshing the geolocation cache
 func UpdateDeviceNetworkGeo(timelimit time.Duration, globalStatus *types.DeviceNetworkStatus) bool {
-	change := false
+	return updateDeviceNetworkGeo(timelimit, globalStatus, refreshGeoLookup)
+}
+
+// updateDeviceNetworkGeo updates the geolocation of the addresses last
+// updated more than timelimit ago using lookup
+func updateDeviceNetworkGeo(timelimit time.Duration, globalStatus *types.DeviceNetworkStatus,
+	lookup func(ipinfo.Options) (*ipinfo.IPInfo, error)) bool {
+	if geoLookupDisabled() {
+		return clearDeviceNetworkGeo(globalStatus)
+	}
+	// Addresses due for a lookup, infos gets their results in the
+	// same order
+	var lookups []*types.AddrInfo
 	for ui := range globalStatus.Ports {
 		u := &globalStatus.Ports[ui]
 		if globalStatus.Version >= types.DPCIsMgmt &&
@@ -318,27 +737,71 @@ func UpdateDeviceNetworkGeo(timelimit time.Duration, globalStatus *types.DeviceN
 			if timePassed < timelimit {
 				continue
 			}
-			// geoloc with short timeout
-			opt := ipinfo.Options{
-				Timeout:  5 * time.Second,
-				SourceIp: ai.Addr,
-			}
-			info, err := ipinfo.MyIPWithOptions(opt)
-			if err != nil {
-				// Ignore error
-				log.Infof("UpdateDeviceNetworkGeo MyIPInfo failed %s\n", err)
-				continue
+			lookups = append(lookups, ai)
+		}
+	}
+	infos := make([]*ipinfo.IPInfo, len(lookups))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < maxGeoLookups && w < len(lookups); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				// geoloc with short timeout
+				opt := ipinfo.Options{
+					Timeout:  geoTimeout,
+					SourceIp: lookups[j].Addr,
+				}
+				info, err := lookup(opt)
+				if err != nil {
+					// Ignore error
+					log.Infof("UpdateDeviceNetworkGeo MyIPInfo failed %s\n", err)
+					continue
+				}
+				infos[j] = info
 			}
-			// Note that if the global IP is unchanged we don't
-			// update anything.
-			if info.IP == ai.Geo.IP {
-				continue
+		}()
+	}
+	for j := range lookups {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+
+	change := false
+	for j, ai := range lookups {
+		info := infos[j]
+		if info == nil {
+			continue
+		}
+		// Note that if the global IP is unchanged we don't
+		// update anything.
+		if info.IP == ai.Geo.IP {
+			continue
+		}
+		log.Infof("UpdateDeviceNetworkGeo MyIPInfo changed from %v to %v\n",
+			ai.Geo, *info)
+		ai.Geo = *info
+		ai.LastGeoTimestamp = time.Now()
+		change = true
+	}
+	return change
+}
+
+// clearDeviceNetworkGeo zeroes the geolocation of all the addresses.
+// Returns true if any was set.
+func clearDeviceNetworkGeo(globalStatus *types.DeviceNetworkStatus) bool {
+	change := false
+	for ui := range globalStatus.Ports {
+		u := &globalStatus.Ports[ui]
+		for i := range u.AddrInfoList {
+			ai := &u.AddrInfoList[i]
+			if ai.Geo != (ipinfo.IPInfo{}) || !ai.LastGeoTimestamp.IsZero() {
+				ai.Geo = ipinfo.IPInfo{}
+				ai.LastGeoTimestamp = time.Time{}
+				change = true
 			}
-			log.Infof("UpdateDeviceNetworkGeo MyIPInfo changed from %v to %v\n",
-				ai.Geo, *info)
-			ai.Geo = *info
-			ai.LastGeoTimestamp = time.Now()
-			change = true
 		}
 	}
 	return change
@@ -0,0 +1,839 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/eriknordmark/ipinfo"
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+func TestMakeDeviceNetworkStatusMissingPort(t *testing.T) {
+	// Not management ports hence no geolocation lookups
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "lo", Name: "loopback",
+				DhcpConfig: types.DhcpConfig{Dhcp: types.DT_NONE}},
+			{IfName: "bogus0", Name: "bogus",
+				DhcpConfig: types.DhcpConfig{Dhcp: types.DT_NONE}},
+		},
+	}
+	status, err := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	if err == nil {
+		t.Fatalf("expected an error for the missing port")
+	}
+	if !strings.Contains(err.Error(), "bogus0") || strings.Contains(err.Error(), "Port lo ") {
+		t.Errorf("unexpected error %q", err)
+	}
+
+	// The status of both ports is still returned
+	if len(status.Ports) != 2 {
+		t.Fatalf("expected 2 ports, got %+v", status.Ports)
+	}
+	lo := status.Ports[0]
+	if lo.IfName != "lo" || lo.Name != "loopback" {
+		t.Errorf("unexpected loopback status %+v", lo)
+	}
+	found := false
+	for _, ai := range lo.AddrInfoList {
+		if ai.Addr.IsLoopback() {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no loopback address in %+v", lo.AddrInfoList)
+	}
+	bogus := status.Ports[1]
+	if bogus.IfName != "bogus0" || bogus.Name != "bogus" || len(bogus.AddrInfoList) != 0 {
+		t.Errorf("unexpected bogus status %+v", bogus)
+	}
+}
+
+func TestMakeDeviceNetworkStatus(t *testing.T) {
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "lo", DhcpConfig: types.DhcpConfig{Dhcp: types.DT_NONE}},
+		},
+	}
+	status, err := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(status.Ports) != 1 || len(status.Ports[0].AddrInfoList) == 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+// fakeNetlink serves links and their addresses from maps, and passes
+// the updates sent by the test to the subscribers
+type fakeNetlink struct {
+	links       map[string]netlink.Link
+	addrs       map[string][]netlink.Addr
+	routes      []netlink.Route
+	routeErr    error // returned by RouteReplace if set
+	addrUpdates chan<- netlink.AddrUpdate
+	linkUpdates chan<- netlink.LinkUpdate
+	done        <-chan struct{}
+}
+
+func newFakeNetlink() *fakeNetlink {
+	return &fakeNetlink{links: make(map[string]netlink.Link),
+		addrs: make(map[string][]netlink.Addr)}
+}
+
+func (f *fakeNetlink) LinkByName(name string) (netlink.Link, error) {
+	link, ok := f.links[name]
+	if !ok {
+		return nil, errors.New("Link not found")
+	}
+	return link, nil
+}
+
+func (f *fakeNetlink) LinkByIndex(index int) (netlink.Link, error) {
+	for _, link := range f.links {
+		if link.Attrs().Index == index {
+			return link, nil
+		}
+	}
+	return nil, errors.New("Link not found")
+}
+
+// LinkAdd adds the link with the next ifindex, down
+func (f *fakeNetlink) LinkAdd(link netlink.Link) error {
+	if _, ok := f.links[link.Attrs().Name]; ok {
+		return errors.New("File exists")
+	}
+	for _, other := range f.links {
+		if other.Attrs().Index >= link.Attrs().Index {
+			link.Attrs().Index = other.Attrs().Index + 1
+		}
+	}
+	link.Attrs().OperState = netlink.OperDown
+	f.links[link.Attrs().Name] = link
+	return nil
+}
+
+func (f *fakeNetlink) LinkDel(link netlink.Link) error {
+	if _, ok := f.links[link.Attrs().Name]; !ok {
+		return errors.New("Link not found")
+	}
+	delete(f.links, link.Attrs().Name)
+	delete(f.addrs, link.Attrs().Name)
+	return nil
+}
+
+func (f *fakeNetlink) LinkSetUp(link netlink.Link) error {
+	link, ok := f.links[link.Attrs().Name]
+	if !ok {
+		return errors.New("Link not found")
+	}
+	link.Attrs().Flags |= net.FlagUp
+	link.Attrs().OperState = netlink.OperUp
+	return nil
+}
+
+// LinkList returns the links by ifindex
+func (f *fakeNetlink) LinkList() ([]netlink.Link, error) {
+	var links []netlink.Link
+	for _, link := range f.links {
+		links = append(links, link)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Attrs().Index < links[j].Attrs().Index
+	})
+	return links, nil
+}
+
+func (f *fakeNetlink) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	var addrs []netlink.Addr
+	for _, addr := range f.addrs[link.Attrs().Name] {
+		if (addr.IP.To4() != nil) == (family == netlink.FAMILY_V4) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+func (f *fakeNetlink) AddrReplace(link netlink.Link, addr *netlink.Addr) error {
+	name := link.Attrs().Name
+	for i, other := range f.addrs[name] {
+		if other.IP.Equal(addr.IP) {
+			f.addrs[name][i] = *addr
+			return nil
+		}
+	}
+	f.addrs[name] = append(f.addrs[name], *addr)
+	return nil
+}
+
+func (f *fakeNetlink) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	name := link.Attrs().Name
+	for i, other := range f.addrs[name] {
+		if other.IP.Equal(addr.IP) {
+			f.addrs[name] = append(f.addrs[name][:i], f.addrs[name][i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("Cannot assign requested address")
+}
+
+// RouteListFiltered only filters on the link, if asked, and the family
+func (f *fakeNetlink) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	var routes []netlink.Route
+	for _, rt := range f.routes {
+		ipv4 := rt.Gw.To4() != nil
+		if (rt.LinkIndex == filter.LinkIndex || filterMask&netlink.RT_FILTER_OIF == 0) &&
+			ipv4 == (family == netlink.FAMILY_V4) {
+			routes = append(routes, rt)
+		}
+	}
+	return routes, nil
+}
+
+// RouteReplace replaces the route of the same link, family, table and
+// metric
+func (f *fakeNetlink) RouteReplace(route *netlink.Route) error {
+	if f.routeErr != nil {
+		return f.routeErr
+	}
+	if _, err := f.LinkByIndex(route.LinkIndex); err != nil {
+		return syscall.ENODEV
+	}
+	for i, rt := range f.routes {
+		if rt.LinkIndex == route.LinkIndex && rt.Table == route.Table &&
+			(rt.Gw.To4() != nil) == (route.Gw.To4() != nil) &&
+			rt.Priority == route.Priority {
+			f.routes[i] = *route
+			return nil
+		}
+	}
+	f.routes = append(f.routes, *route)
+	return nil
+}
+
+// RouteDel deletes the route of the link and gateway, of any metric
+// unless given
+func (f *fakeNetlink) RouteDel(route *netlink.Route) error {
+	for i, rt := range f.routes {
+		if rt.LinkIndex == route.LinkIndex && rt.Gw.Equal(route.Gw) &&
+			(route.Priority == 0 || rt.Priority == route.Priority) {
+			f.routes = append(f.routes[:i], f.routes[i+1:]...)
+			return nil
+		}
+	}
+	return syscall.ESRCH
+}
+
+func (f *fakeNetlink) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+	f.addrUpdates = ch
+	f.done = done
+	go func() {
+		<-done
+		close(ch)
+	}()
+	return nil
+}
+
+func (f *fakeNetlink) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	f.linkUpdates = ch
+	go func() {
+		<-done
+		close(ch)
+	}()
+	return nil
+}
+
+// setLink sets a link, with a carrier when up
+func (f *fakeNetlink) setLink(name string, index int, up bool, addrs ...string) {
+	flags := net.Flags(0)
+	operState := netlink.LinkOperState(netlink.OperDown)
+	if up {
+		flags = net.FlagUp
+		operState = netlink.OperUp
+	}
+	f.links[name] = &netlink.Device{LinkAttrs: netlink.LinkAttrs{
+		Name: name, Index: index, Flags: flags, OperState: operState}}
+	f.addrs[name] = nil
+	for _, addr := range addrs {
+		f.addrs[name] = append(f.addrs[name],
+			netlink.Addr{IPNet: &net.IPNet{IP: net.ParseIP(addr)}})
+	}
+}
+
+func TestPortErrors(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+
+	static := types.DhcpConfig{Dhcp: types.DT_STATIC}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", DhcpConfig: static},
+			{IfName: "eth1", DhcpConfig: static},
+			{IfName: "eth2", DhcpConfig: static},
+			{IfName: "eth3", DhcpConfig: types.DhcpConfig{Dhcp: types.DT_NONE}},
+		},
+	}
+	fake.setLink("eth1", 101, false, "192.168.1.10")
+	fake.setLink("eth2", 102, true, "fe80::1")
+	fake.setLink("eth3", 103, true)
+	status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	for i, expected := range []string{
+		"Port eth0 does not exist - ignored",
+		"Port eth1 is admin down",
+		"Port eth2 is up with no usable address",
+		"", // not expected to have an address
+	} {
+		port := status.Ports[i]
+		if port.Error != expected || port.ErrorTime.IsZero() != (expected == "") {
+			t.Errorf("%s: expected error %q, got %q at %v",
+				port.IfName, expected, port.Error, port.ErrorTime)
+		}
+	}
+
+	// The time of the errors which remain is kept
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	fake.setLink("eth1", 101, true, "192.168.1.10")
+	newStatus, err := MakeDeviceNetworkStatus(config, status)
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if port := newStatus.Ports[i]; port.Error != "" || !port.ErrorTime.IsZero() {
+			t.Errorf("%s: error not cleared: %q at %v",
+				port.IfName, port.Error, port.ErrorTime)
+		}
+	}
+	if port := newStatus.Ports[2]; port.Error != status.Ports[2].Error ||
+		!port.ErrorTime.Equal(status.Ports[2].ErrorTime) {
+		t.Errorf("%s: expected %q at %v, got %q at %v", port.IfName,
+			status.Ports[2].Error, status.Ports[2].ErrorTime,
+			port.Error, port.ErrorTime)
+	}
+}
+
+func TestProxyError(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+
+	static := types.DhcpConfig{Dhcp: types.DT_STATIC}
+	proxy := types.ProxyConfig{NetworkProxyEnable: true,
+		NetworkProxyURL: "http://127.0.0.1:1/wpad.dat"}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", DhcpConfig: static, ProxyConfig: proxy},
+			{IfName: "eth1", DhcpConfig: static, ProxyConfig: proxy},
+		},
+	}
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	fake.setLink("eth1", 101, false, "192.168.1.10")
+	status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	if port := status.Ports[0]; !strings.HasPrefix(port.Error,
+		"GetNetworkProxy failed") || port.ErrorTime.IsZero() {
+		t.Errorf("%s: expected a proxy error, got %q at %v",
+			port.IfName, port.Error, port.ErrorTime)
+	}
+	// The reason the port is unusable is not replaced
+	if port := status.Ports[1]; port.Error != "Port eth1 is admin down" {
+		t.Errorf("%s: expected admin down, got %q", port.IfName, port.Error)
+	}
+
+	// The time of the proxy error which remains is kept
+	newStatus, _ := MakeDeviceNetworkStatus(config, status)
+	if port := newStatus.Ports[0]; port.Error != status.Ports[0].Error ||
+		!port.ErrorTime.Equal(status.Ports[0].ErrorTime) {
+		t.Errorf("%s: expected %q at %v, got %q at %v", port.IfName,
+			status.Ports[0].Error, status.Ports[0].ErrorTime,
+			port.Error, port.ErrorTime)
+	}
+}
+
+func TestUpdateDeviceNetworkGeo(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	var mutex sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	geoLookup = func(opt ipinfo.Options) (*ipinfo.IPInfo, error) {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+		time.Sleep(delay)
+		mutex.Lock()
+		inFlight--
+		mutex.Unlock()
+		if opt.SourceIp.Equal(net.ParseIP("10.0.0.3")) {
+			return nil, errors.New("lookup failed")
+		}
+		return &ipinfo.IPInfo{IP: "global-" + opt.SourceIp.String()}, nil
+	}
+	defer func() { geoLookup = ipinfo.MyIPWithOptions }()
+
+	addrInfos := func(addrs ...string) []types.AddrInfo {
+		var infos []types.AddrInfo
+		for _, addr := range addrs {
+			infos = append(infos, types.AddrInfo{Addr: net.ParseIP(addr)})
+		}
+		return infos
+	}
+	status := types.DeviceNetworkStatus{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortStatus{
+			{IfName: "eth0", IsMgmt: true,
+				AddrInfoList: addrInfos("10.0.0.1", "fe80::1", "2001:db8::1", "10.0.0.2")},
+			{IfName: "eth1", IsMgmt: false, AddrInfoList: addrInfos("10.0.1.1")},
+			{IfName: "eth2", IsMgmt: true,
+				AddrInfoList: addrInfos("10.0.0.3", "10.0.0.4", "2001:db8::2", "10.0.0.5")},
+		},
+	}
+	start := time.Now()
+	if !UpdateDeviceNetworkGeo(time.Second, &status) {
+		t.Errorf("no change reported")
+	}
+	// 7 lookups, 4 at a time
+	if elapsed := time.Since(start); elapsed > 3*delay {
+		t.Errorf("lookups took %v", elapsed)
+	}
+	if maxInFlight > maxGeoLookups {
+		t.Errorf("%d lookups in flight", maxInFlight)
+	}
+	for _, port := range status.Ports {
+		for _, ai := range port.AddrInfoList {
+			expected := "global-" + ai.Addr.String()
+			if !port.IsMgmt || ai.Addr.IsLinkLocalUnicast() ||
+				ai.Addr.Equal(net.ParseIP("10.0.0.3")) {
+				expected = ""
+			}
+			if ai.Geo.IP != expected || ai.LastGeoTimestamp.IsZero() != (expected == "") {
+				t.Errorf("%s %s: expected %q, got %q at %v", port.IfName,
+					ai.Addr, expected, ai.Geo.IP, ai.LastGeoTimestamp)
+			}
+		}
+	}
+}
+
+func TestDefaultGateway(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "192.168.0.10", "2001:db8::10")
+	fake.setLink("eth1", 101, true, "192.168.1.10")
+	table := types.GetDefaultRouteTable()
+	fake.routes = []netlink.Route{
+		{LinkIndex: 100, Table: table, Gw: net.ParseIP("192.168.0.1"), Priority: 200},
+		{LinkIndex: 100, Table: table, Gw: net.ParseIP("192.168.0.254"), Priority: 100},
+		{LinkIndex: 100, Table: table, Gw: net.ParseIP("fe80::1"), Priority: 1024},
+		{LinkIndex: 100, Table: table + 1, Gw: net.ParseIP("192.168.0.2")},
+		{LinkIndex: 101, Table: table}, // no gateway
+	}
+	static := types.DhcpConfig{Dhcp: types.DT_STATIC}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", DhcpConfig: static},
+			{IfName: "eth1", DhcpConfig: static},
+		},
+	}
+	status, err := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	if err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	eth0 := status.Ports[0]
+	if gw := eth0.DefaultGateway; gw == nil || !gw.Gateway.Equal(net.ParseIP("192.168.0.254")) ||
+		gw.Metric != 100 {
+		t.Errorf("unexpected IPv4 gateway %+v", gw)
+	}
+	if gw := eth0.DefaultGatewayV6; gw == nil || !gw.Gateway.Equal(net.ParseIP("fe80::1")) ||
+		gw.Metric != 1024 {
+		t.Errorf("unexpected IPv6 gateway %+v", gw)
+	}
+	if eth1 := status.Ports[1]; eth1.DefaultGateway != nil || eth1.DefaultGatewayV6 != nil ||
+		eth1.Error != "" {
+		t.Errorf("unexpected gateways %+v %+v %q", eth1.DefaultGateway,
+			eth1.DefaultGatewayV6, eth1.Error)
+	}
+}
+
+func TestMacAddr(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	fake.links["eth0"].Attrs().HardwareAddr = net.HardwareAddr{0x00, 0x16, 0x3E, 0x0a, 0x0b, 0x0c}
+	fake.setLink("tun0", 101, true, "10.8.0.2") // no hardware address
+	static := types.DhcpConfig{Dhcp: types.DT_STATIC}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", DhcpConfig: static},
+			{IfName: "tun0", DhcpConfig: static},
+		},
+	}
+	status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	if mac := status.Ports[0].MacAddr; mac != "00:16:3e:0a:0b:0c" {
+		t.Errorf("unexpected MAC address %q", mac)
+	}
+	if mac := status.Ports[1].MacAddr; mac != "" {
+		t.Errorf("unexpected MAC address %q without hardware address", mac)
+	}
+
+	// A NIC swap changes the status
+	fake.links["eth0"].Attrs().HardwareAddr = net.HardwareAddr{0x00, 0x16, 0x3e, 0x0a, 0x0b, 0x0d}
+	newStatus, _ := MakeDeviceNetworkStatus(config, status)
+	if reflect.DeepEqual(status.Ports[0], newStatus.Ports[0]) {
+		t.Errorf("MAC address change not detected: %s", newStatus.Ports[0].MacAddr)
+	}
+}
+
+func TestMtu(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "192.168.0.10", "2001:db8::10")
+	fake.links["eth0"].Attrs().MTU = 1500
+	fake.setLink("tun0", 101, true, "10.8.0.2", "fe80::2")
+	fake.links["tun0"].Attrs().MTU = 1200
+	fake.setLink("tun1", 102, true, "10.9.0.2")
+	fake.links["tun1"].Attrs().MTU = 1200 // no IPv6
+	static := types.DhcpConfig{Dhcp: types.DT_STATIC}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", DhcpConfig: static},
+			{IfName: "tun0", DhcpConfig: static},
+			{IfName: "tun1", DhcpConfig: static},
+		},
+	}
+	status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	for i, expected := range []struct {
+		mtu      int
+		warnings []string
+	}{
+		{1500, nil},
+		{1200, []string{"Port tun0 MTU 1200 is below the IPv6 minimum 1280"}},
+		{1200, nil},
+	} {
+		port := status.Ports[i]
+		if port.Mtu != expected.mtu || !reflect.DeepEqual(port.Warnings, expected.warnings) ||
+			port.Error != "" {
+			t.Errorf("%s: expected MTU %d warnings %q, got %d %q %q", port.IfName,
+				expected.mtu, expected.warnings, port.Mtu, port.Warnings, port.Error)
+		}
+	}
+}
+
+func TestLinkState(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	static := types.DhcpConfig{Dhcp: types.DT_STATIC}
+	for _, test := range []struct {
+		up        bool
+		operState netlink.LinkOperState
+		addr      string
+		carrier   bool
+		err       string
+	}{
+		{false, netlink.OperDown, "192.168.0.10", false, "Port eth0 is admin down"},
+		{false, netlink.OperUnknown, "", false, "Port eth0 is admin down"},
+		{true, netlink.OperDown, "192.168.0.10", false, "Port eth0 has no carrier"},
+		{true, netlink.OperLowerLayerDown, "", false, "Port eth0 has no carrier"},
+		{true, netlink.OperDormant, "", false, "Port eth0 has no carrier"},
+		{true, netlink.OperUp, "", true, "Port eth0 is up with no usable address"},
+		{true, netlink.OperUp, "fe80::10", true, "Port eth0 is up with no usable address"},
+		{true, netlink.OperUp, "192.168.0.10", true, ""},
+		{true, netlink.OperUnknown, "10.8.0.2", true, ""}, // e.g. a tunnel
+	} {
+		if test.addr != "" {
+			fake.setLink("eth0", 100, test.up, test.addr)
+		} else {
+			fake.setLink("eth0", 100, test.up)
+		}
+		fake.links["eth0"].Attrs().OperState = test.operState
+		config := types.DevicePortConfig{
+			Version: types.DPCIsMgmt,
+			Ports:   []types.NetworkPortConfig{{IfName: "eth0", DhcpConfig: static}},
+		}
+		status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+		port := status.Ports[0]
+		if port.Up != test.up || port.Carrier != test.carrier || port.Error != test.err {
+			t.Errorf("up %v %s %q: expected carrier %v error %q, got up %v carrier %v error %q",
+				test.up, test.operState, test.addr, test.carrier, test.err,
+				port.Up, port.Carrier, port.Error)
+		}
+	}
+}
+
+func TestPortCounters(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	oldSysClassNet := sysClassNet
+	sysClassNet = "testdata/sys/class/net"
+	defer func() { sysClassNet = oldSysClassNet }()
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	fake.links["eth0"].Attrs().Statistics = &netlink.LinkStatistics{
+		RxBytes: 1000, TxBytes: 2000, RxPackets: 10, TxPackets: 20,
+		RxErrors: 1, TxErrors: 2, RxDropped: 3, TxDropped: 4}
+	fake.setLink("eth1", 101, true, "192.168.1.10") // from sysfs
+	static := types.DhcpConfig{Dhcp: types.DT_STATIC}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", DhcpConfig: static},
+			{IfName: "eth1", DhcpConfig: static},
+		},
+	}
+
+	status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	expected := types.PortCounters{RxBytes: 1000, TxBytes: 2000, RxPkts: 10,
+		TxPkts: 20, RxErrors: 1, TxErrors: 2, RxDrops: 3, TxDrops: 4}
+	if status.Ports[0].Counters != expected {
+		t.Errorf("eth0: expected %+v, got %+v", expected, status.Ports[0].Counters)
+	}
+	// The bad tx_dropped is skipped
+	expected = types.PortCounters{RxBytes: 123456, TxBytes: 654321, RxPkts: 1000,
+		TxPkts: 900, RxErrors: 3, TxErrors: 1, RxDrops: 7}
+	if status.Ports[1].Counters != expected {
+		t.Errorf("eth1: expected %+v, got %+v", expected, status.Ports[1].Counters)
+	}
+}
+
+func TestAddressChangeCounters(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	fake.links["eth0"].Attrs().Statistics = &netlink.LinkStatistics{
+		RxBytes: 1000, TxBytes: 2000}
+	static := types.DhcpConfig{Dhcp: types.DT_STATIC}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports:   []types.NetworkPortConfig{{IfName: "eth0", DhcpConfig: static}},
+	}
+	status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	ctx := DeviceNetworkContext{DevicePortConfig: &config,
+		DeviceNetworkStatus: &status}
+
+	// The counters change all the time; not worth a publish
+	fake.links["eth0"].Attrs().Statistics.RxBytes = 5000
+	HandleAddressChange(&ctx)
+	if ctx.Changed {
+		t.Errorf("published for a change of the counters")
+	}
+	fake.setLink("eth0", 100, true, "192.168.0.11")
+	fake.links["eth0"].Attrs().Statistics = &netlink.LinkStatistics{}
+	HandleAddressChange(&ctx)
+	if !ctx.Changed {
+		t.Errorf("not published for a change of the address")
+	}
+}
+
+func TestEnslavedPort(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true)
+	fake.setLink("br0", 200, true, "192.168.0.10", "fe80::10")
+	fake.links["eth0"].Attrs().MasterIndex = 200
+	fake.setLink("eth1", 101, true)
+	fake.links["eth1"].Attrs().MasterIndex = 300 // gone
+	fake.setLink("eth2", 102, true, "192.168.2.10")
+	static := types.DhcpConfig{Dhcp: types.DT_STATIC}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", DhcpConfig: static},
+			{IfName: "eth1", DhcpConfig: static},
+			{IfName: "eth2", DhcpConfig: static},
+		},
+	}
+
+	status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	port := status.Ports[0]
+	if port.Error != "Port eth0 is enslaved to br0" ||
+		!reflect.DeepEqual(port.Warnings,
+			[]string{"Port eth0 master br0 has addresses 192.168.0.10, fe80::10"}) {
+		t.Errorf("unexpected eth0 error %q warnings %q", port.Error, port.Warnings)
+	}
+	if port := status.Ports[1]; port.Error != "Port eth1 is enslaved to index 300" ||
+		len(port.Warnings) != 0 {
+		t.Errorf("unexpected eth1 error %q warnings %q", port.Error, port.Warnings)
+	}
+	if port := status.Ports[2]; port.Error != "" || len(port.Warnings) != 0 {
+		t.Errorf("unexpected eth2 error %q warnings %q", port.Error, port.Warnings)
+	}
+}
+
+func TestLinkLocalAddrs(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "169.254.10.20", "fe80::1")
+	fake.setLink("eth1", 101, true, "169.254.10.21", "192.168.1.10")
+	fake.setLink("eth2", 102, true, "169.254.10.22")
+	client := types.DhcpConfig{Dhcp: types.DT_CLIENT}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", DhcpConfig: client},
+			{IfName: "eth1", DhcpConfig: client},
+			{IfName: "eth2", DhcpConfig: types.DhcpConfig{Dhcp: types.DT_STATIC}},
+		},
+	}
+
+	for _, included := range []bool{false, true} {
+		SetLinkLocalIncluded(included)
+		status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+		for i, expected := range []struct {
+			addrs    []string
+			included []string
+			err      string
+		}{
+			{[]string{"fe80::1"}, []string{"169.254.10.20", "fe80::1"},
+				"Port eth0 DHCP failed (link-local only)"},
+			{[]string{"192.168.1.10"}, []string{"192.168.1.10", "169.254.10.21"}, ""},
+			{nil, []string{"169.254.10.22"}, "Port eth2 is up with no usable address"},
+		} {
+			port := status.Ports[i]
+			addrs := expected.addrs
+			if included {
+				addrs = expected.included
+			}
+			var found []string
+			for _, ai := range port.AddrInfoList {
+				found = append(found, ai.Addr.String())
+			}
+			if !reflect.DeepEqual(found, addrs) || port.Error != expected.err {
+				t.Errorf("%s included %t: expected %v %q, got %v %q", port.IfName,
+					included, addrs, expected.err, found, port.Error)
+			}
+		}
+	}
+	SetLinkLocalIncluded(false)
+}
+
+func TestLinkLocal6Mode(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	now := time.Now()
+	stub, restore := stubGeo(t, &now)
+	defer restore()
+	fake.setLink("eth0", 100, true, "192.168.1.10", "fe80::1", "2001:db8::1")
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", IsMgmt: true,
+				DhcpConfig: types.DhcpConfig{Dhcp: types.DT_STATIC}},
+		},
+	}
+
+	defer SetLinkLocal6Mode(types.LL6_INCLUDE)
+	for _, test := range []struct {
+		mode     types.LinkLocal6Mode
+		expected []types.AddrInfo
+	}{
+		{types.LL6_INCLUDE, []types.AddrInfo{
+			{Addr: net.ParseIP("192.168.1.10")},
+			{Addr: net.ParseIP("2001:db8::1")},
+			{Addr: net.ParseIP("fe80::1")},
+		}},
+		{types.LL6_EXCLUDE, []types.AddrInfo{
+			{Addr: net.ParseIP("192.168.1.10")},
+			{Addr: net.ParseIP("2001:db8::1")},
+		}},
+		{types.LL6_MARK, []types.AddrInfo{
+			{Addr: net.ParseIP("192.168.1.10")},
+			{Addr: net.ParseIP("2001:db8::1")},
+			{Addr: net.ParseIP("fe80::1"), LinkLocal: true},
+		}},
+	} {
+		SetLinkLocal6Mode(test.mode)
+		status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+		port := status.Ports[0]
+		var found []types.AddrInfo
+		for _, ai := range port.AddrInfoList {
+			found = append(found, types.AddrInfo{Addr: ai.Addr.To16(),
+				LinkLocal: ai.LinkLocal})
+		}
+		for i := range test.expected {
+			test.expected[i].Addr = test.expected[i].Addr.To16()
+		}
+		if !reflect.DeepEqual(found, test.expected) || port.Error != "" {
+			t.Errorf("%s: expected %+v, got %+v %q", test.mode,
+				test.expected, found, port.Error)
+		}
+		UpdateDeviceNetworkGeo(0, &status)
+		if stub.count("fe80::1") != 0 {
+			t.Errorf("%s: link-local geolocated", test.mode)
+		}
+	}
+	if stub.count("2001:db8::1") == 0 {
+		t.Errorf("global not geolocated")
+	}
+	if mode, err := types.ParseLinkLocal6Mode("mark"); err != nil || mode != types.LL6_MARK {
+		t.Errorf("unexpected mode %s: %v", mode, err)
+	}
+	if _, err := types.ParseLinkLocal6Mode("all"); err == nil {
+		t.Errorf("no error for all")
+	}
+}
+
+func TestAddrOrder(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "fe80::2", "10.0.0.10", "2001:db8::1",
+		"169.254.1.1", "fe80::1", "10.0.0.9", "192.168.1.1", "2001:db8::")
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", DhcpConfig: types.DhcpConfig{Dhcp: types.DT_STATIC}},
+		},
+	}
+	SetLinkLocalIncluded(true)
+	defer SetLinkLocalIncluded(false)
+	expected := []string{"10.0.0.9", "10.0.0.10", "192.168.1.1", "169.254.1.1",
+		"2001:db8::", "2001:db8::1", "fe80::1", "fe80::2"}
+
+	rnd := rand.New(rand.NewSource(1))
+	var first []types.AddrInfo
+	for i := 0; i < 10; i++ {
+		addrs := fake.addrs["eth0"]
+		rnd.Shuffle(len(addrs), func(a, b int) {
+			addrs[a], addrs[b] = addrs[b], addrs[a]
+		})
+		status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+		var found []string
+		for _, ai := range status.Ports[0].AddrInfoList {
+			found = append(found, ai.Addr.String())
+		}
+		if !reflect.DeepEqual(found, expected) {
+			t.Fatalf("expected %v, got %v", expected, found)
+		}
+		if first == nil {
+			first = status.Ports[0].AddrInfoList
+		} else if !reflect.DeepEqual(status.Ports[0].AddrInfoList, first) {
+			t.Errorf("expected %+v, got %+v", first, status.Ports[0].AddrInfoList)
+		}
+	}
+}
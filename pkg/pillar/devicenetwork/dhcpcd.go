@@ -28,20 +28,26 @@ func UpdateDhcpClient(newConfig, oldConfig types.DevicePortConfig) {
 	// Look for adds or changes
 	log.Infof("updateDhcpClient: new %v old %v\n",
 		newConfig, oldConfig)
+	// The hardware identifiers and the patterns are resolved as
+	// MakeDeviceNetworkStatus does, which reports their errors
+	newConfig, _, _ = resolvePorts(newConfig)
+	newConfig, _, _ = expandPorts(newConfig)
+	oldConfig, _, _ = resolvePorts(oldConfig)
+	oldConfig, _, _ = expandPorts(oldConfig)
 	for _, newU := range newConfig.Ports {
 		oldU := lookupOnIfname(oldConfig, newU.IfName)
 		if oldU == nil || oldU.Dhcp == types.DT_NONE {
 			log.Infof("updateDhcpClient: new %s\n", newU.IfName)
 			// Inactivate in case a dhcpcd is running
-			doDhcpClientActivate(newU)
+			dhcpClientActivate(newU)
 		} else {
 			log.Infof("updateDhcpClient: found old %v\n",
 				oldU)
 			if !reflect.DeepEqual(newU.DhcpConfig, oldU.DhcpConfig) {
 				log.Infof("updateDhcpClient: changed %s\n",
 					newU.IfName)
-				doDhcpClientInactivate(*oldU)
-				doDhcpClientActivate(newU)
+				dhcpClientInactivate(*oldU)
+				dhcpClientActivate(newU)
 			}
 		}
 	}
@@ -51,7 +57,7 @@ func UpdateDhcpClient(newConfig, oldConfig types.DevicePortConfig) {
 		if newU == nil || newU.Dhcp == types.DT_NONE {
 			log.Infof("updateDhcpClient: deleted %s\n",
 				oldU.IfName)
-			doDhcpClientInactivate(oldU)
+			dhcpClientInactivate(oldU)
 		} else {
 			log.Infof("updateDhcpClient: found new %v\n",
 				newU)
@@ -60,6 +66,10 @@ func UpdateDhcpClient(newConfig, oldConfig types.DevicePortConfig) {
 
 }
 
+// Replaced by the tests
+var dhcpClientActivate = doDhcpClientActivate
+var dhcpClientInactivate = doDhcpClientInactivate
+
 func doDhcpClientActivate(nuc types.NetworkPortConfig) {
 
 	log.Infof("doDhcpClientActivate(%s) dhcp %v addr %s gateway %s\n",
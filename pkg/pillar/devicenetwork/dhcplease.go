@@ -0,0 +1,445 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Read the DHCP leases of the ports from the files of the DHCP clients
+
+package devicenetwork
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// The lease files looked for, with %s the ifname: those of dhcpcd, the
+// DHCP message it got, and of ISC dhclient in its text format
+var defaultLeaseFiles = []string{
+	"/var/lib/dhcpcd/%s.lease",
+	"/var/lib/dhcpcd/%s.lease6",
+	"/var/lib/dhcpcd/dhcpcd-%s.lease",
+	"/var/lib/dhcp/dhclient.%s.leases",
+	"/var/lib/dhclient/dhclient-%s.leases",
+}
+
+// Set by SetDhcpLeaseFiles
+var leaseFiles struct {
+	sync.Mutex
+	byIfName map[string][]string
+}
+
+// SetDhcpLeaseFiles sets the lease files of ifname instead of the usual
+// ones of dhcpcd and dhclient. No filenames restores those.
+func SetDhcpLeaseFiles(ifname string, filenames ...string) {
+	leaseFiles.Lock()
+	defer leaseFiles.Unlock()
+	if leaseFiles.byIfName == nil {
+		leaseFiles.byIfName = make(map[string][]string)
+	}
+	if len(filenames) == 0 {
+		delete(leaseFiles.byIfName, ifname)
+	} else {
+		leaseFiles.byIfName[ifname] = filenames
+	}
+	log.Infof("SetDhcpLeaseFiles(%s) %v\n", ifname, filenames)
+}
+
+func getLeaseFiles(ifname string) []string {
+	leaseFiles.Lock()
+	defer leaseFiles.Unlock()
+	if filenames, ok := leaseFiles.byIfName[ifname]; ok {
+		return filenames
+	}
+	var filenames []string
+	for _, format := range defaultLeaseFiles {
+		filenames = append(filenames, fmt.Sprintf(format, ifname))
+	}
+	return filenames
+}
+
+// dhcpLease is the lease of an address
+type dhcpLease struct {
+	addr   net.IP
+	expiry time.Time // Zero if infinite
+	server string
+	wpad   string // The URL of the PAC file given in option 252
+	// Hostnames or addresses given in option 42
+	ntpServers []string
+}
+
+// getDhcpLeases returns the leases of ifname found in its lease files,
+// ignoring those which cannot be read
+func getDhcpLeases(ifname string) []dhcpLease {
+	var leases []dhcpLease
+	for _, filename := range getLeaseFiles(ifname) {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warnf("getDhcpLeases(%s): %s\n", ifname, err)
+			}
+			continue
+		}
+		var fileLeases []dhcpLease
+		if isISCLease(data) {
+			fileLeases, err = parseISCLeases(data, ifname)
+		} else {
+			var info os.FileInfo
+			if info, err = os.Stat(filename); err == nil {
+				// dhcpcd writes the file when it gets the lease
+				fileLeases, err = parseDhcpcdLease(data, info.ModTime())
+			}
+		}
+		if err != nil {
+			log.Warnf("getDhcpLeases(%s) %s: %s\n", ifname, filename, err)
+			continue
+		}
+		leases = append(leases, fileLeases...)
+	}
+	return leases
+}
+
+// IFA_F_MANAGETEMPADDR from linux/if_addr.h, set by the kernel on the
+// SLAAC addresses it makes temporary addresses for
+const ifaFManageTempAddr = 0x100
+
+// setAddrOrigin sets where the address came from, its flags, and its lease
+// if any: ApplyStaticConfig, a DHCP lease, else guessed from the netlink
+// address as classifyAddr does
+func setAddrOrigin(ai *types.AddrInfo, ifname string, leases []dhcpLease,
+	addrs map[string]netlink.Addr) {
+
+	addr, ok := addrs[ai.Addr.String()]
+	if ok {
+		ai.Flags = addr.Flags
+	}
+	if isStaticAddr(ifname, ai.Addr) {
+		ai.Origin = types.AO_STATIC
+		return
+	}
+	// The last one is the latest
+	for i := len(leases) - 1; i >= 0; i-- {
+		if leases[i].addr.Equal(ai.Addr) {
+			ai.Origin = types.AO_DHCP
+			ai.LeaseExpiry = leases[i].expiry
+			ai.DHCPServer = leases[i].server
+			return
+		}
+	}
+	if ai.Addr.IsLinkLocalUnicast() {
+		ai.Origin = types.AO_LINKLOCAL
+		return
+	}
+	if !ok {
+		ai.Origin = types.AO_UNKNOWN
+		return
+	}
+	ai.Origin = classifyAddr(addr)
+}
+
+// classifyAddr guesses the origin of a global address without a lease.
+// Those added without a lifetime are permanent, hence manual; the others
+// were added by dhcpcd for a lease it did not save, or by the kernel.
+// In IPv6 DHCPv6 gives /128 addresses, and SLAAC /64 ones from an RA
+// prefix, including the temporary ones.
+func classifyAddr(addr netlink.Addr) types.AddrOrigin {
+	if addr.Flags&syscall.IFA_F_PERMANENT != 0 {
+		return types.AO_MANUAL
+	}
+	if addr.IP.To4() != nil {
+		return types.AO_DHCP
+	}
+	if isSLAACAddr(addr) {
+		return types.AO_SLAAC
+	}
+	if ones, bits := addr.Mask.Size(); ones == 128 && bits == 128 {
+		return types.AO_DHCP
+	}
+	return types.AO_UNKNOWN
+}
+
+// isSLAACAddr returns true if addr is an IPv6 global address the kernel
+// autoconfigured from a router advertisement
+func isSLAACAddr(addr netlink.Addr) bool {
+	if addr.IPNet == nil || addr.IP.To4() != nil ||
+		addr.IP.IsLinkLocalUnicast() ||
+		addr.Flags&syscall.IFA_F_PERMANENT != 0 {
+		return false
+	}
+	if addr.Flags&(syscall.IFA_F_TEMPORARY|ifaFManageTempAddr) != 0 {
+		return true
+	}
+	ones, bits := addr.Mask.Size()
+	return ones == 64 && bits == 128
+}
+
+// getNetlinkAddrs returns the IPv4 and IPv6 addresses of link, with their
+// flags and prefix lengths, by address
+func getNetlinkAddrs(link netlink.Link) map[string]netlink.Addr {
+	addrs := make(map[string]netlink.Addr)
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		list, err := netlinkHandle.AddrList(link, family)
+		if err != nil {
+			continue
+		}
+		for _, addr := range list {
+			if addr.IPNet != nil {
+				addrs[addr.IP.String()] = addr
+			}
+		}
+	}
+	return addrs
+}
+
+func isISCLease(data []byte) bool {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		return bytes.HasPrefix(line, []byte("lease")) ||
+			bytes.HasPrefix(line, []byte("default-duid"))
+	}
+	return false
+}
+
+// parseDhcpcdLease parses the DHCPv4 or DHCPv6 message saved by dhcpcd
+// when received at mtime
+func parseDhcpcdLease(data []byte, mtime time.Time) ([]dhcpLease, error) {
+	// A BOOTP message has the magic cookie after the fixed fields
+	if len(data) >= 240 && bytes.Equal(data[236:240], []byte{99, 130, 83, 99}) {
+		return parseDhcpv4Lease(data, mtime)
+	}
+	return parseDhcpv6Lease(data, mtime)
+}
+
+func parseDhcpv4Lease(data []byte, mtime time.Time) ([]dhcpLease, error) {
+	lease := dhcpLease{addr: net.IP(append([]byte(nil), data[16:20]...))}
+	options := data[240:]
+	for len(options) > 0 {
+		code := options[0]
+		if code == 0 { // pad
+			options = options[1:]
+			continue
+		}
+		if code == 255 { // end
+			break
+		}
+		if len(options) < 2 || len(options) < 2+int(options[1]) {
+			return nil, fmt.Errorf("truncated DHCP option %d", code)
+		}
+		value := options[2 : 2+options[1]]
+		options = options[2+options[1]:]
+		switch code {
+		case 51: // lease time
+			if len(value) != 4 {
+				return nil, fmt.Errorf("bad lease time length %d", len(value))
+			}
+			if seconds := binary.BigEndian.Uint32(value); seconds != 0xffffffff {
+				lease.expiry = mtime.Add(time.Duration(seconds) * time.Second)
+			}
+		case 54: // server identifier
+			if len(value) != 4 {
+				return nil, fmt.Errorf("bad server identifier length %d", len(value))
+			}
+			lease.server = net.IP(value).String()
+		case 42: // NTP servers
+			if len(value)%4 != 0 {
+				return nil, fmt.Errorf("bad NTP servers length %d", len(value))
+			}
+			for i := 0; i < len(value); i += 4 {
+				lease.ntpServers = append(lease.ntpServers,
+					net.IP(value[i:i+4]).String())
+			}
+		case 252: // WPAD, sometimes NUL terminated
+			lease.wpad = strings.TrimRight(string(value), "\x00")
+		}
+	}
+	if lease.addr.IsUnspecified() {
+		return nil, fmt.Errorf("no address")
+	}
+	return []dhcpLease{lease}, nil
+}
+
+// DHCPv6 option codes
+const (
+	dhcpv6ServerID = 2
+	dhcpv6IANA     = 3
+	dhcpv6IAAddr   = 5
+)
+
+// dhcpv6Options returns the options in data by code
+func dhcpv6Options(data []byte) (map[uint16][][]byte, error) {
+	options := make(map[uint16][][]byte)
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated DHCPv6 option")
+		}
+		code := binary.BigEndian.Uint16(data[0:2])
+		length := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+length {
+			return nil, fmt.Errorf("truncated DHCPv6 option %d", code)
+		}
+		options[code] = append(options[code], data[4:4+length])
+		data = data[4+length:]
+	}
+	return options, nil
+}
+
+func parseDhcpv6Lease(data []byte, mtime time.Time) ([]dhcpLease, error) {
+	// The message type and transaction ID precede the options
+	if len(data) < 4 {
+		return nil, fmt.Errorf("not a DHCP message")
+	}
+	options, err := dhcpv6Options(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	server := ""
+	if ids := options[dhcpv6ServerID]; len(ids) != 0 {
+		server = hex.EncodeToString(ids[0])
+	}
+	var leases []dhcpLease
+	for _, iana := range options[dhcpv6IANA] {
+		// IAID, T1 and T2 precede the options
+		if len(iana) < 12 {
+			return nil, fmt.Errorf("truncated IA_NA")
+		}
+		iaOptions, err := dhcpv6Options(iana[12:])
+		if err != nil {
+			return nil, err
+		}
+		for _, iaaddr := range iaOptions[dhcpv6IAAddr] {
+			// The address, preferred and valid lifetimes
+			if len(iaaddr) < 24 {
+				return nil, fmt.Errorf("truncated IAADDR")
+			}
+			lease := dhcpLease{addr: net.IP(append([]byte(nil), iaaddr[0:16]...)),
+				server: server}
+			if valid := binary.BigEndian.Uint32(iaaddr[20:24]); valid != 0xffffffff {
+				lease.expiry = mtime.Add(time.Duration(valid) * time.Second)
+			}
+			leases = append(leases, lease)
+		}
+	}
+	if len(leases) == 0 {
+		return nil, fmt.Errorf("no address")
+	}
+	return leases, nil
+}
+
+// parseISCLeases parses the leases of dhclient for ifname, those in
+// the order of the file, like:
+//
+//	lease {
+//	  interface "eth0";
+//	  fixed-address 192.168.1.10;
+//	  option dhcp-server-identifier 192.168.1.1;
+//	  expire 4 2019/10/10 10:00:00;
+//	}
+func parseISCLeases(data []byte, ifname string) ([]dhcpLease, error) {
+	var leases []dhcpLease
+	var lease *dhcpLease
+	matches := true
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		switch {
+		case line == "":
+			continue
+		case line == "lease {":
+			lease = &dhcpLease{}
+			matches = true
+			continue
+		case line == "}":
+			if lease != nil && lease.addr != nil && matches {
+				leases = append(leases, *lease)
+			}
+			lease = nil
+			continue
+		case lease == nil:
+			// Such as default-duid, or the DHCPv6 leases
+			continue
+		}
+		words := strings.Fields(strings.TrimSuffix(line, ";"))
+		switch words[0] {
+		case "interface":
+			if len(words) == 2 {
+				matches = strings.Trim(words[1], `"`) == ifname
+			}
+		case "fixed-address":
+			if len(words) == 2 {
+				lease.addr = net.ParseIP(words[1])
+			}
+			if lease.addr == nil {
+				return nil, fmt.Errorf("line %d: bad address", lineNum)
+			}
+		case "option":
+			if len(words) >= 3 && words[1] == "ntp-servers" {
+				lease.ntpServers = append(lease.ntpServers,
+					strings.Split(strings.Join(words[2:], ""), ",")...)
+				break
+			}
+			if len(words) != 3 {
+				break
+			}
+			switch words[1] {
+			case "dhcp-server-identifier":
+				lease.server = words[2]
+			case "wpad", "wpad-url", "option-252", "unknown-252":
+				// Declared with option code 252 in dhclient.conf
+				lease.wpad = strings.TrimSuffix(strings.Trim(words[2], `"`),
+					`\000`)
+			}
+		case "expire":
+			expiry, err := parseISCTime(words[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNum, err)
+			}
+			lease.expiry = expiry
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// parseISCTime parses "never", "epoch <seconds>" and
+// "<weekday> <yyyy/mm/dd> <hh:mm:ss>" in UTC
+func parseISCTime(words []string) (time.Time, error) {
+	switch {
+	case len(words) == 1 && words[0] == "never":
+		return time.Time{}, nil
+	case len(words) == 2 && words[0] == "epoch":
+		seconds, err := strconv.ParseInt(words[1], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad time %q", words[1])
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	case len(words) == 3:
+		t, err := time.Parse("2006/01/02 15:04:05", words[1]+" "+words[2])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad time %q", strings.Join(words, " "))
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("bad time %q", strings.Join(words, " "))
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+func TestParseDhcpcdLease(t *testing.T) {
+	mtime := time.Date(2019, 10, 9, 10, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		filename string
+		expected []dhcpLease
+	}{
+		{"eth0.lease", []dhcpLease{{
+			addr:       net.ParseIP("192.168.1.10").To4(),
+			expiry:     mtime.Add(time.Hour),
+			server:     "192.168.1.1",
+			wpad:       "http://wpad.example.com/wpad.dat",
+			ntpServers: []string{"192.168.1.1", "192.168.1.2"},
+		}}},
+		{"eth0.lease6", []dhcpLease{{
+			addr:   net.ParseIP("2001:db8::10"),
+			expiry: mtime.Add(2 * time.Hour),
+			server: "000300010242ac110002",
+		}}},
+	} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata/leases", test.filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		leases, err := parseDhcpcdLease(data, mtime)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.filename, err)
+		} else if !reflect.DeepEqual(leases, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.filename,
+				test.expected, leases)
+		}
+		// Cut in the middle of the options
+		if _, err := parseDhcpcdLease(data[:len(data)-3], mtime); err == nil {
+			t.Errorf("%s: no error when truncated", test.filename)
+		}
+	}
+}
+
+func TestParseISCLeases(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/leases/dhclient.eth1.leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leases, err := parseISCLeases(data, "eth1")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []dhcpLease{
+		{addr: net.ParseIP("10.0.0.20"), server: "10.0.0.1",
+			expiry: time.Date(2019, 10, 9, 10, 2, 0, 0, time.UTC)},
+		{addr: net.ParseIP("10.0.0.21"), server: "10.0.0.2",
+			expiry:     time.Date(2019, 10, 9, 10, 10, 0, 0, time.UTC),
+			wpad:       "http://10.0.0.2/wpad.dat",
+			ntpServers: []string{"10.0.0.2", "ntp.example.com"}},
+	}
+	if !reflect.DeepEqual(leases, expected) {
+		t.Errorf("expected %+v, got %+v", expected, leases)
+	}
+	leases, err = parseISCLeases(data, "eth2")
+	if err != nil || len(leases) != 1 || !leases[0].expiry.IsZero() {
+		t.Errorf("eth2: unexpected %+v %v", leases, err)
+	}
+	if _, err := parseISCLeases([]byte("lease {\n  expire 3 2019/13/09 10:02:00;\n}\n"),
+		"eth1"); err == nil {
+		t.Errorf("no error for a bad time")
+	}
+}
+
+func TestAddrOrigin(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mtime := time.Date(2019, 10, 9, 10, 0, 0, 0, time.UTC)
+	for _, filename := range []string{"eth0.lease", "eth0.lease6"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata/leases", filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, filename)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	garbage := filepath.Join(dir, "garbage.lease")
+	if err := ioutil.WriteFile(garbage, []byte{1, 2}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Those which cannot be read are skipped
+	SetDhcpLeaseFiles("eth0", filepath.Join(dir, "missing.lease"), garbage,
+		filepath.Join(dir, "eth0.lease"), filepath.Join(dir, "eth0.lease6"))
+	defer SetDhcpLeaseFiles("eth0")
+	fake.setLink("eth0", 100, true, "192.168.1.10", "2001:db8::10",
+		"2001:db8::20", "2001:db8::30", "fe80::1")
+	fake.addrs["eth0"][2].Mask = net.CIDRMask(64, 128)
+	fake.addrs["eth0"][3].Flags = syscall.IFA_F_PERMANENT
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", IsMgmt: true,
+				DhcpConfig: types.DhcpConfig{Dhcp: types.DT_CLIENT}},
+		},
+	}
+	status, err := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := []types.AddrInfo{
+		{Addr: net.ParseIP("192.168.1.10"), Origin: "dhcp",
+			LeaseExpiry: mtime.Add(time.Hour), DHCPServer: "192.168.1.1"},
+		{Addr: net.ParseIP("2001:db8::10"), Origin: "dhcp",
+			LeaseExpiry: mtime.Add(2 * time.Hour), DHCPServer: "000300010242ac110002"},
+		{Addr: net.ParseIP("2001:db8::20"), Origin: "slaac"},
+		{Addr: net.ParseIP("2001:db8::30"), Origin: "manual",
+			Flags: syscall.IFA_F_PERMANENT},
+		{Addr: net.ParseIP("fe80::1"), Origin: "link-local"},
+	}
+	var found []types.AddrInfo
+	for _, ai := range status.Ports[0].AddrInfoList {
+		found = append(found, types.AddrInfo{Addr: ai.Addr.To16(),
+			Origin: ai.Origin, Flags: ai.Flags, LeaseExpiry: ai.LeaseExpiry.UTC(),
+			DHCPServer: ai.DHCPServer})
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %+v, got %+v", expected, found)
+	}
+}
+
+func TestAddrOriginFlags(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	SetDhcpLeaseFiles("eth0", "testdata/missing")
+	defer SetDhcpLeaseFiles("eth0")
+	tests := []struct {
+		addr     string
+		flags    int
+		expected types.AddrOrigin
+	}{
+		// Added by dhcpcd with the lifetime of a lease it did not save
+		{"192.168.1.10/24", 0, types.AO_DHCP},
+		{"192.168.1.11/24", syscall.IFA_F_PERMANENT, types.AO_MANUAL},
+		// DHCPv6 IA_NA
+		{"2001:db8::10/128", 0, types.AO_DHCP},
+		// From an RA prefix, the public and temporary ones
+		{"2001:db8:1::10/64", 0, types.AO_SLAAC},
+		{"2001:db8:1::11/64", ifaFManageTempAddr, types.AO_SLAAC},
+		{"2001:db8:1::abcd/64", syscall.IFA_F_TEMPORARY |
+			syscall.IFA_F_DEPRECATED, types.AO_SLAAC},
+		// ip addr add, with or without a lifetime
+		{"2001:db8:2::10/64", syscall.IFA_F_PERMANENT, types.AO_MANUAL},
+		{"2001:db8:2::11/128", syscall.IFA_F_PERMANENT, types.AO_MANUAL},
+		{"2001:db8:3::10/56", 0, types.AO_UNKNOWN},
+		{"fe80::1/64", syscall.IFA_F_PERMANENT, types.AO_LINKLOCAL},
+	}
+	fake.setLink("eth0", 100, true)
+	for _, test := range tests {
+		ip, subnet, _ := net.ParseCIDR(test.addr)
+		fake.addrs["eth0"] = append(fake.addrs["eth0"], netlink.Addr{
+			IPNet: &net.IPNet{IP: ip, Mask: subnet.Mask}, Flags: test.flags})
+	}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", IsMgmt: true,
+				DhcpConfig: types.DhcpConfig{Dhcp: types.DT_CLIENT}},
+		},
+	}
+	status, err := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	found := make(map[string]types.AddrInfo)
+	for _, ai := range status.Ports[0].AddrInfoList {
+		found[ai.Addr.String()] = ai
+	}
+	for _, test := range tests {
+		ip, _, _ := net.ParseCIDR(test.addr)
+		ai := found[ip.String()]
+		if ai.Origin != test.expected || ai.Flags != test.flags {
+			t.Errorf("%s %#x: expected %s, got %s %#x", test.addr, test.flags,
+				test.expected, ai.Origin, ai.Flags)
+		}
+	}
+}
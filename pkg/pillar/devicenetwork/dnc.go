@@ -80,6 +80,11 @@ func HandleDNCModify(ctxArg interface{}, key string, configArg interface{}) {
 		return
 	}
 	log.Infof("HandleDNCModify for %s\n", key)
+	// Still used since it might work in part
+	for _, err := range ValidateDeviceNetworkConfig(config,
+		netlinkHandle.LinkList) {
+		log.Errorf("HandleDNCModify %s: %s\n", key, err)
+	}
 	// Get old value
 	var oldConfig types.DevicePortConfig
 	c, _ := ctx.PubDevicePortConfig.Get("global")
@@ -88,6 +93,15 @@ func HandleDNCModify(ctxArg interface{}, key string, configArg interface{}) {
 	} else {
 		oldConfig = types.DevicePortConfig{}
 	}
+	if err := ApplyDeviceNetworkConfig(config); err != nil {
+		log.Errorf("HandleDNCModify: %s\n", err)
+	}
+	if err := ApplyStaticConfig(config); err != nil {
+		log.Errorf("HandleDNCModify: %s\n", err)
+	}
+	if err := ApplyWirelessConfig(config); err != nil {
+		log.Errorf("HandleDNCModify: %s\n", err)
+	}
 	*ctx.DeviceNetworkConfig = config
 	portConfig := MakeDevicePortConfig(config)
 	portConfig.Key = key
@@ -116,6 +130,15 @@ func HandleDNCDelete(ctxArg interface{}, key string, configArg interface{}) {
 	} else {
 		oldConfig = types.DevicePortConfig{}
 	}
+	if err := ApplyDeviceNetworkConfig(types.DeviceNetworkConfig{}); err != nil {
+		log.Errorf("HandleDNCDelete: %s\n", err)
+	}
+	if err := ApplyStaticConfig(types.DeviceNetworkConfig{}); err != nil {
+		log.Errorf("HandleDNCDelete: %s\n", err)
+	}
+	if err := ApplyWirelessConfig(types.DeviceNetworkConfig{}); err != nil {
+		log.Errorf("HandleDNCDelete: %s\n", err)
+	}
 	*ctx.DeviceNetworkConfig = types.DeviceNetworkConfig{}
 
 	portConfig := MakeDevicePortConfig(*ctx.DeviceNetworkConfig)
@@ -453,6 +476,9 @@ func VerifyDevicePortConfig(ctx *DeviceNetworkContext) {
 	*ctx.DevicePortConfig = pending.PendDPC
 	*ctx.DeviceNetworkStatus = pending.PendDNS
 	ctx.DeviceNetworkStatus.Testing = false
+	if err := ApplyRouteMetrics(ctx.DeviceNetworkStatus); err != nil {
+		log.Errorf("VerifyDevicePortConfig: %s\n", err)
+	}
 	*ctx.DevicePortConfigList = compressAndPublishDevicePortConfigList(ctx)
 	DoDNSUpdate(ctx)
 
@@ -690,7 +716,10 @@ func (ctx *DeviceNetworkContext) doPublishDNSForPortConfig(
 	log.Infof("doPublishDNSForPortConfig()")
 	dnStatus, _ := MakeDeviceNetworkStatus(*portConfig,
 		*ctx.DeviceNetworkStatus)
-	if !reflect.DeepEqual(*ctx.DeviceNetworkStatus, dnStatus) {
+	if err := ApplyRouteMetrics(&dnStatus); err != nil {
+		log.Errorf("doPublishDNSForPortConfig: %s\n", err)
+	}
+	if !types.EqualDeviceNetworkStatus(*ctx.DeviceNetworkStatus, dnStatus) {
 		log.Infof("doPublishDNSForPortConfig: DeviceNetworkStatus change from %v to %v\n",
 			*ctx.DeviceNetworkStatus, dnStatus)
 		*ctx.DeviceNetworkStatus = dnStatus
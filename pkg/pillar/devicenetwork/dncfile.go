@@ -0,0 +1,122 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+// GetDeviceNetworkConfig reads a DeviceNetworkConfig file in YAML if its
+// extension is .yaml or .yml, in JSON if .json, else in JSON only if it
+// starts with {. Unknown fields are errors in YAML. Returns the config
+// migrated to the latest version, and the version of the file.
+func GetDeviceNetworkConfig(filename string) (types.DeviceNetworkConfig, int, error) {
+	var config types.DeviceNetworkConfig
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return config, 0, err
+	}
+	if isYAMLFile(filename, data) {
+		err = unmarshalYAML(data, &config)
+	} else {
+		err = json.Unmarshal(data, &config)
+	}
+	version := config.Version
+	if err == nil {
+		err = migrateDeviceNetworkConfig(&config)
+	}
+	if err != nil {
+		return types.DeviceNetworkConfig{}, 0, fmt.Errorf("%s: %s", filename, err)
+	}
+	return config, version, nil
+}
+
+func isYAMLFile(filename string, data []byte) bool {
+	switch filepath.Ext(filename) {
+	case ".yaml", ".yml":
+		return true
+	case ".json":
+		return false
+	}
+	data = bytes.TrimSpace(data)
+	return len(data) == 0 || data[0] != '{'
+}
+
+// WriteDeviceNetworkConfig atomically replaces filename by config in
+// indented JSON, keeping the mode of the file if it exists. A config of
+// an older version is migrated first, and an invalid one is not written.
+func WriteDeviceNetworkConfig(filename string, config types.DeviceNetworkConfig) error {
+	switch filepath.Ext(filename) {
+	case ".yaml", ".yml":
+		return fmt.Errorf("WriteDeviceNetworkConfig(%s): YAML is not supported",
+			filename)
+	}
+	if err := migrateDeviceNetworkConfig(&config); err != nil {
+		return fmt.Errorf("WriteDeviceNetworkConfig(%s): %s", filename, err)
+	}
+	if errs := ValidateDeviceNetworkConfig(config, nil); len(errs) != 0 {
+		var errStrs []string
+		for _, err := range errs {
+			errStrs = append(errStrs, err.Error())
+		}
+		return fmt.Errorf("WriteDeviceNetworkConfig(%s): %s", filename,
+			strings.Join(errStrs, "; "))
+	}
+	b, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return fmt.Errorf("WriteDeviceNetworkConfig(%s): %s", filename, err)
+	}
+	b = append(b, '\n')
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := writeSync(filename, b, mode); err != nil {
+		return fmt.Errorf("WriteDeviceNetworkConfig(%s): %s", filename, err)
+	}
+	return nil
+}
+
+// writeSync writes b to a temporary file in the directory of filename,
+// syncs it and renames it to filename
+func writeSync(filename string, b []byte, mode os.FileMode) error {
+	dirName := filepath.Dir(filename)
+	tmpfile, err := ioutil.TempFile(dirName, filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+	if _, err := tmpfile.Write(b); err != nil {
+		return err
+	}
+	if err := tmpfile.Chmod(mode); err != nil {
+		return err
+	}
+	if err := tmpfile.Sync(); err != nil {
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpfile.Name(), filename); err != nil {
+		return err
+	}
+	// So that the rename survives a crash
+	dir, err := os.Open(dirName)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,333 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+func TestGetDeviceNetworkConfig(t *testing.T) {
+	expected, _, err := GetDeviceNetworkConfig("testdata/dnc/model.json")
+	if err != nil {
+		t.Fatalf("GetDeviceNetworkConfig failed: %v", err)
+	}
+	if len(expected.Uplink) != 4 || len(expected.Vlans) != 1 {
+		t.Fatalf("unexpected config %+v", expected)
+	}
+	// The format of model.confg is sniffed
+	for _, filename := range []string{"testdata/dnc/model.yaml", "testdata/dnc/model.confg"} {
+		config, _, err := GetDeviceNetworkConfig(filename)
+		if err != nil {
+			t.Errorf("GetDeviceNetworkConfig(%s) failed: %v", filename, err)
+		} else if !reflect.DeepEqual(config, expected) {
+			t.Errorf("%s: expected %+v, got %+v", filename, expected, config)
+		}
+	}
+	config, _, err := GetDeviceNetworkConfig("testdata/dnc/model-free.yml")
+	if err != nil || !reflect.DeepEqual(config.FreeUplinks, []string{"eth0", "wlan0"}) {
+		t.Errorf("unexpected FreeUplinks %v: %v", config.FreeUplinks, err)
+	}
+	_, _, err = GetDeviceNetworkConfig("testdata/dnc/bad.yaml")
+	if err == nil || err.Error() !=
+		`testdata/dnc/bad.yaml: line 6 column 5: unknown field "Name" in VlanConfig` {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestGetDeviceNetworkConfigVersion(t *testing.T) {
+	for _, test := range []struct {
+		filename    string
+		version     int
+		freeUplinks []string
+	}{
+		{"testdata/dnc/model.json", 0, []string{"eth0", "wlan0"}},
+		{"testdata/dnc/model-free.yml", 0, []string{"eth0", "wlan0"}},
+		{"testdata/dnc/v0.json", 0, []string{"eth0", "eth1"}},
+		{"testdata/dnc/v1.yaml", 1, []string{"eth1"}},
+		{"testdata/dnc/v1-nofree.json", 1, nil},
+	} {
+		config, version, err := GetDeviceNetworkConfig(test.filename)
+		if err != nil {
+			t.Errorf("GetDeviceNetworkConfig(%s) failed: %v", test.filename, err)
+			continue
+		}
+		if version != test.version || config.Version != latestDNCVersion() ||
+			!reflect.DeepEqual(config.FreeUplinks, test.freeUplinks) {
+			t.Errorf("%s: unexpected version %d config %+v", test.filename,
+				version, config)
+		}
+	}
+	_, _, err := GetDeviceNetworkConfig("testdata/dnc/future.json")
+	if err == nil || err.Error() !=
+		"testdata/dnc/future.json: Version 3 is newer than the supported Version 2" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestUplinkCosts(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	fake.setLink("wlan0", 101, true, "192.168.1.10")
+	fake.setLink("wwan0", 102, true, "10.0.0.10")
+	fake.setLink("sat0", 103, true, "10.1.0.10")
+
+	// The uplinks without a Cost are the most expensive, and those of
+	// the older versions get one from FreeUplinks
+	for _, test := range []struct {
+		filename string
+		costs    []types.UplinkCost
+	}{
+		{"testdata/dnc/v2-costs.yaml", []types.UplinkCost{{IfName: "eth0"},
+			{IfName: "wlan0", Cost: 10}, {IfName: "wwan0", Cost: 100}}},
+		{"testdata/dnc/v1.yaml", []types.UplinkCost{{IfName: "eth0", Cost: 255},
+			{IfName: "eth1"}}},
+		{"testdata/dnc/v0.json", []types.UplinkCost{{IfName: "eth0"},
+			{IfName: "eth1"}}},
+	} {
+		config, _, err := GetDeviceNetworkConfig(test.filename)
+		if err != nil {
+			t.Errorf("GetDeviceNetworkConfig(%s) failed: %v", test.filename, err)
+		} else if !reflect.DeepEqual(config.Costs, test.costs) {
+			t.Errorf("%s: expected %+v, got %+v", test.filename, test.costs,
+				config.Costs)
+		}
+	}
+
+	config, _, _ := GetDeviceNetworkConfig("testdata/dnc/v2-costs.yaml")
+	status, err := MakeDeviceNetworkStatus(MakeDevicePortConfig(config),
+		types.DeviceNetworkStatus{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var found []string
+	for _, port := range types.UplinksByCost(status) {
+		found = append(found, fmt.Sprintf("%s:%d:%t", port.IfName, port.Cost,
+			port.Free))
+	}
+	expected := []string{"eth0:0:true", "wlan0:10:false", "wwan0:100:false",
+		"sat0:255:false"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %v, got %v", expected, found)
+	}
+	if addrs := types.AddrsUpToCost(status, 10); len(addrs) != 2 ||
+		addrs[1].String() != "192.168.1.10" {
+		t.Errorf("unexpected addresses %v", addrs)
+	}
+
+	// A DevicePortConfig of before the costs
+	status, _ = MakeDeviceNetworkStatus(types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", IsMgmt: true, Free: true},
+			{IfName: "wwan0", IsMgmt: true},
+		}}, types.DeviceNetworkStatus{})
+	if status.Ports[0].Cost != 0 || status.Ports[1].Cost != 255 {
+		t.Errorf("unexpected costs %d %d", status.Ports[0].Cost,
+			status.Ports[1].Cost)
+	}
+}
+
+func TestUplinkPriority(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	fake.setLink("eth1", 101, true, "192.168.1.10")
+	fake.setLink("wlan0", 102, true, "192.168.2.10")
+	fake.setLink("wwan1", 103, true, "10.0.1.10")
+	fake.setLink("wwan0", 104, true, "10.0.0.10")
+
+	config := types.DeviceNetworkConfig{
+		Version:  2,
+		Uplink:   []string{"wlan0", "wwan*", "eth1", "eth0"},
+		Costs:    []types.UplinkCost{{IfName: "eth0"}, {IfName: "eth1"}},
+		Priority: []string{"wwan*", "eth0"},
+	}
+	if errs := ValidateDeviceNetworkConfig(config, nil); len(errs) != 0 {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	status, err := MakeDeviceNetworkStatus(MakeDevicePortConfig(config),
+		types.DeviceNetworkStatus{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// Those without a Priority last even if cheaper, and in their order
+	var found []string
+	for _, port := range types.OrderedUplinks(status) {
+		found = append(found, fmt.Sprintf("%s:%d", port.IfName, port.Priority))
+	}
+	expected := []string{"wwan0:1", "wwan1:1", "eth0:2", "wlan0:0", "eth1:0"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %v, got %v", expected, found)
+	}
+}
+
+func TestMigrateDeviceNetworkConfig(t *testing.T) {
+	saved := dncMigrations
+	defer func() { dncMigrations = saved }()
+	var order []int
+	dncMigrations = append(append([]func(*types.DeviceNetworkConfig) error(nil),
+		saved...), func(config *types.DeviceNetworkConfig) error {
+		order = append(order, config.Version)
+		config.Uplink = append(config.Uplink, "eth9")
+		return nil
+	}, func(config *types.DeviceNetworkConfig) error {
+		order = append(order, config.Version)
+		return errors.New("no eth9")
+	})
+
+	config := types.DeviceNetworkConfig{Uplink: []string{"eth0"}}
+	err := migrateDeviceNetworkConfig(&config)
+	if err == nil || err.Error() != "Version 3 not migrated: no eth9" {
+		t.Errorf("unexpected error %v", err)
+	}
+	// The FreeUplinks and the Costs are set before eth9 is added
+	if !reflect.DeepEqual(order, []int{2, 3}) ||
+		!reflect.DeepEqual(config.FreeUplinks, []string{"eth0"}) ||
+		!reflect.DeepEqual(config.Costs, []types.UplinkCost{{IfName: "eth0"}}) ||
+		!reflect.DeepEqual(config.Uplink, []string{"eth0", "eth9"}) {
+		t.Errorf("unexpected order %v config %+v", order, config)
+	}
+	config = types.DeviceNetworkConfig{Version: -1}
+	if err := migrateDeviceNetworkConfig(&config); err == nil ||
+		err.Error() != "bad Version -1" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestUnmarshalYAML(t *testing.T) {
+	for _, test := range []struct {
+		data     string
+		expected string
+	}{
+		{"", ""},
+		{"Uplink: eth0", "line 1 column 9: expected a sequence for []string, got a scalar"},
+		{"Uplink:\n  - eth0\n   - eth1", "line 3 column 4: unexpected indentation"},
+		{"Uplink:\n\t- eth0", "line 2 column 1: tabs are not allowed for indentation"},
+		{"Uplink: [eth0\n", "line 1 column 9: unterminated flow sequence"},
+		{"Uplink: [eth0, , eth1]", "line 1 column 16: empty flow sequence item"},
+		{"Uplink:\n- !docker*", "line 2 column 3: '!' is not supported at the start of a plain scalar, quote !docker*"},
+		{"Uplink: [eth0]\nUplink: [eth1]", `line 2 column 1: duplicate key "Uplink"`},
+		{"Uplink: [\"eth0]", "line 1 column 10: unterminated quoted scalar"},
+		{"Vlans:\n- Parent: eth0\n  VlanID: ten", `line 3 column 11: "ten" is not an integer`},
+		{"Vlans:\n- Parent: eth0\n  VlanID: '10'", `line 3 column 11: "10" is not an integer`},
+		{"Costs:\n- IfName: eth0\n  Cost: 256", `line 3 column 9: "256" is not an unsigned integer`},
+		{"Costs:\n- IfName: eth0\n  Cost: -1", `line 3 column 9: "-1" is not an unsigned integer`},
+		{"Vlans: {Parent: eth0}", "line 1 column 8: flow mappings are not supported"},
+		{"Uplink: a: b", "line 1 column 9: mapping values are not allowed here"},
+		{"Uplink: [eth0]\n---\nUplink: [eth1]", "line 2 column 1: multiple documents are not supported"},
+		{"Uplink: [eth0]\nfoo", `line 2 column 1: expected a key, got "foo"`},
+		{"- eth0", "line 1 column 1: expected a mapping for types.DeviceNetworkConfig, got a sequence"},
+		{"Statics:\n- IfName: eth0\n  Gateway: 10.0.0.1\n  DnsServers: [10.0.0.1, '8.8.8.8']", ""},
+		{"Statics:\n- IfName: eth0\n  Gateway: 10.0.0", `line 3 column 12: "10.0.0" is not a net.IP: invalid IP address: 10.0.0`},
+		{"Statics:\n- IfName: eth0\n  Gateway: [10.0.0.1]", "line 3 column 12: expected a scalar for net.IP, got a sequence"},
+		{"Proxies:\n- IfName: eth0\n  HTTPSProxy: http://proxy:3128\n  NoProxy: [.example.com, 10.0.0.0/8]", ""},
+	} {
+		var config types.DeviceNetworkConfig
+		err := unmarshalYAML([]byte(test.data), &config)
+		errStr := ""
+		if err != nil {
+			errStr = err.Error()
+		}
+		if errStr != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.data, test.expected, errStr)
+		}
+	}
+
+	// Nested sequences, nulls, escapes and comments
+	var v struct {
+		Lists   [][]string
+		Empty   []string
+		Enabled bool
+		Name    string `json:"name,omitempty"`
+	}
+	data := "lists:\n  - - a\n    - 'b''s'\n  -\n  - [\"c\\td # not a comment\"]\n" +
+		"empty: ~  # none\nenabled: true\nNAME: \"x: y\"\n"
+	if err := unmarshalYAML([]byte(data), &v); err != nil {
+		t.Fatalf("unmarshalYAML failed: %v", err)
+	}
+	if !reflect.DeepEqual(v.Lists, [][]string{{"a", "b's"}, nil, {"c\td # not a comment"}}) ||
+		v.Empty != nil || !v.Enabled || v.Name != "x: y" {
+		t.Errorf("unexpected %+v", v)
+	}
+}
+
+func TestWriteDeviceNetworkConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dncfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "model.json")
+
+	// Written as read
+	config, _, err := GetDeviceNetworkConfig("testdata/dnc/model.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteDeviceNetworkConfig(filename, config); err != nil {
+		t.Fatalf("WriteDeviceNetworkConfig failed: %v", err)
+	}
+	written, version, err := GetDeviceNetworkConfig(filename)
+	if err != nil || version != latestDNCVersion() || !reflect.DeepEqual(written, config) {
+		t.Errorf("expected %+v, got Version %d %+v: %v", config, version, written, err)
+	}
+	b, _ := ioutil.ReadFile(filename)
+	if !strings.HasPrefix(string(b), "{\n    \"Version\": 2,\n    \"Uplink\": [") {
+		t.Errorf("unexpected content %s", b)
+	}
+
+	// Keeps the mode, and a version 0 config is migrated
+	if err := os.Chmod(filename, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := types.DeviceNetworkConfig{Uplink: []string{"eth0"}}
+	if err := WriteDeviceNetworkConfig(filename, old); err != nil {
+		t.Fatalf("WriteDeviceNetworkConfig failed: %v", err)
+	}
+	written, _, _ = GetDeviceNetworkConfig(filename)
+	if written.Version != 2 || !reflect.DeepEqual(written.FreeUplinks, []string{"eth0"}) {
+		t.Errorf("unexpected config %+v", written)
+	}
+	if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected mode %v: %v", info.Mode(), err)
+	}
+
+	// Invalid configs leave the file alone
+	b, _ = ioutil.ReadFile(filename)
+	for _, test := range []struct {
+		filename string
+		config   types.DeviceNetworkConfig
+		expected string
+	}{
+		{filename, types.DeviceNetworkConfig{}, "No uplinks"},
+		{filename, types.DeviceNetworkConfig{Version: 3, Uplink: []string{"eth0"}},
+			"Version 3 is newer than the supported Version 2"},
+		{filepath.Join(dir, "model.yaml"), config, "YAML is not supported"},
+	} {
+		err := WriteDeviceNetworkConfig(test.filename, test.config)
+		expected := "WriteDeviceNetworkConfig(" + test.filename + "): " + test.expected
+		if err == nil || err.Error() != expected {
+			t.Errorf("expected %q, got %v", expected, err)
+		}
+	}
+	if after, _ := ioutil.ReadFile(filename); string(after) != string(b) {
+		t.Errorf("changed to %s", after)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("unexpected files %v", files)
+	}
+}
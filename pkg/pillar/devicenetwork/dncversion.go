@@ -0,0 +1,88 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Migrate a DeviceNetworkConfig file to the latest version
+
+package devicenetwork
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// dncMigrations[v] migrates a config of version v to version v+1. The
+// version of the files without one is 0. Add the migration here when
+// changing the format, and never change nor remove one since the files
+// of that version are still around.
+var dncMigrations = []func(config *types.DeviceNetworkConfig) error{
+	migrateDNCv0,
+	migrateDNCv1,
+}
+
+// latestDNCVersion is the version of config after the migrations
+func latestDNCVersion() int {
+	return len(dncMigrations)
+}
+
+// migrateDeviceNetworkConfig runs in order the migrations from the
+// version of config to the latest one
+func migrateDeviceNetworkConfig(config *types.DeviceNetworkConfig) error {
+	if config.Version < 0 {
+		return fmt.Errorf("bad Version %d", config.Version)
+	}
+	latest := latestDNCVersion()
+	if config.Version > latest {
+		return fmt.Errorf("Version %d is newer than the supported Version %d",
+			config.Version, latest)
+	}
+	for config.Version < latest {
+		log.Infof("migrateDeviceNetworkConfig from Version %d\n",
+			config.Version)
+		if err := dncMigrations[config.Version](config); err != nil {
+			return fmt.Errorf("Version %d not migrated: %s",
+				config.Version, err)
+		}
+		config.Version++
+	}
+	return nil
+}
+
+// migrateDNCv0 uses all the uplinks as FreeUplinks if none are listed.
+// From version 1 no FreeUplinks means none.
+func migrateDNCv0(config *types.DeviceNetworkConfig) error {
+	if len(config.FreeUplinks) == 0 {
+		config.FreeUplinks = append([]string(nil), config.Uplink...)
+	}
+	return nil
+}
+
+// migrateDNCv1 sets the Costs of the uplinks from FreeUplinks, 0 for the
+// free ones and 255 for the others
+func migrateDNCv1(config *types.DeviceNetworkConfig) error {
+	for _, ifname := range config.Uplink {
+		if strings.HasPrefix(ifname, "!") || lookupCost(*config, ifname) != nil {
+			continue
+		}
+		cost := types.UplinkCost{IfName: ifname, Cost: 255}
+		for _, free := range config.FreeUplinks {
+			if free == ifname {
+				cost.Cost = 0
+				break
+			}
+		}
+		config.Costs = append(config.Costs, cost)
+	}
+	return nil
+}
+
+func lookupCost(config types.DeviceNetworkConfig, ifname string) *types.UplinkCost {
+	for i := range config.Costs {
+		if config.Costs[i].IfName == ifname {
+			return &config.Costs[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Watch a DeviceNetworkConfig file for changes
+
+package devicenetwork
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// For how long the file is left alone after a change before reading
+	// it, so that a write in parts is read once
+	dncSettle = 100 * time.Millisecond
+	// How often the file is read when fsnotify cannot watch it
+	dncPollInterval = 5 * time.Second
+	// Replaced in the tests
+	newDNCWatcher = fsnotify.NewWatcher
+)
+
+// WatchDeviceNetworkConfig returns a channel receiving the
+// DeviceNetworkConfig read from filename by GetDeviceNetworkConfig when
+// called and then each time it changes, and one receiving the errors.
+// A config which cannot be read or is not valid is an error and is not
+// sent. The directory is watched so that replacing the file by renaming
+// another one over it is seen, and the file is read periodically if it
+// cannot be watched. Both channels are closed once ctx is done.
+func WatchDeviceNetworkConfig(ctx context.Context, filename string) (<-chan types.DeviceNetworkConfig, <-chan error) {
+	configChan := make(chan types.DeviceNetworkConfig)
+	errChan := make(chan error)
+	filename = filepath.Clean(filename)
+	w, err := newDNCWatcher()
+	if err == nil {
+		if err = w.Add(filepath.Dir(filename)); err != nil {
+			w.Close()
+			w = nil
+		}
+	}
+	if err != nil {
+		log.Warnf("WatchDeviceNetworkConfig(%s) polling since not watched: %s\n",
+			filename, err)
+	}
+
+	go func() {
+		defer close(configChan)
+		defer close(errChan)
+		// Either the watcher or the ticker is used
+		var events <-chan fsnotify.Event
+		var watchErrors <-chan error
+		var poll <-chan time.Time
+		if w != nil {
+			defer w.Close()
+			events = w.Events
+			watchErrors = w.Errors
+		} else {
+			ticker := time.NewTicker(dncPollInterval)
+			defer ticker.Stop()
+			poll = ticker.C
+		}
+		var last *types.DeviceNetworkConfig
+		lastErr := ""
+		var settle <-chan time.Time
+		// Start by reading it
+		read := true
+		for {
+			if read {
+				read = false
+				config, err := readDeviceNetworkConfig(filename)
+				if err != nil {
+					if err.Error() == lastErr {
+						continue
+					}
+					lastErr = err.Error()
+					log.Errorf("WatchDeviceNetworkConfig: %s\n", err)
+					select {
+					case errChan <- err:
+					case <-ctx.Done():
+						return
+					}
+					continue
+				}
+				lastErr = ""
+				if last != nil && reflect.DeepEqual(*last, config) {
+					continue
+				}
+				log.Infof("WatchDeviceNetworkConfig(%s) changed to %+v\n",
+					filename, config)
+				last = &config
+				select {
+				case configChan <- config:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-events:
+				if filepath.Clean(event.Name) != filename {
+					continue
+				}
+				log.Debugf("WatchDeviceNetworkConfig: %s\n", event)
+				if settle == nil {
+					settle = time.After(dncSettle)
+				}
+			case err := <-watchErrors:
+				log.Errorf("WatchDeviceNetworkConfig(%s): %s\n", filename, err)
+			case <-settle:
+				settle = nil
+				read = true
+			case <-poll:
+				read = true
+			}
+		}
+	}()
+	return configChan, errChan
+}
+
+// readDeviceNetworkConfig reads and validates the config in filename
+func readDeviceNetworkConfig(filename string) (types.DeviceNetworkConfig, error) {
+	config, _, err := GetDeviceNetworkConfig(filename)
+	if err != nil {
+		return config, err
+	}
+	if errs := ValidateDeviceNetworkConfig(config, nil); len(errs) != 0 {
+		var errStrs []string
+		for _, err := range errs {
+			errStrs = append(errStrs, err.Error())
+		}
+		return config, fmt.Errorf("%s: %s", filename,
+			strings.Join(errStrs, "; "))
+	}
+	return config, nil
+}
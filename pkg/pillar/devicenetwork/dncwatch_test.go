@@ -0,0 +1,148 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+// nextConfig returns the next config, skipping the errors of reading a
+// file in the middle of being written
+func nextConfig(t *testing.T, configChan <-chan types.DeviceNetworkConfig,
+	errChan <-chan error) types.DeviceNetworkConfig {
+
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case config := <-configChan:
+			return config
+		case err := <-errChan:
+			t.Logf("skipped error %v", err)
+		case <-timeout:
+			t.Fatalf("no config")
+		}
+	}
+}
+
+// expectNothing checks that no config is sent for a while
+func expectNothing(t *testing.T, configChan <-chan types.DeviceNetworkConfig,
+	errChan <-chan error) {
+
+	t.Helper()
+	timeout := time.After(10 * dncSettle)
+	for {
+		select {
+		case config := <-configChan:
+			t.Fatalf("unexpected config %+v", config)
+		case err := <-errChan:
+			t.Logf("skipped error %v", err)
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func writeRenamed(t *testing.T, filename, data string) {
+	t.Helper()
+	tmpname := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpname, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpname, filename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testWatchDeviceNetworkConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dncwatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "model.yaml")
+	writeRenamed(t, filename, "Uplink: [eth0]\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	configChan, errChan := WatchDeviceNetworkConfig(ctx, filename)
+
+	// Sent when called
+	config := nextConfig(t, configChan, errChan)
+	if !reflect.DeepEqual(config.Uplink, []string{"eth0"}) {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	// Rewritten in place
+	if err := ioutil.WriteFile(filename, []byte("Uplink: [eth0, eth1]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config = nextConfig(t, configChan, errChan)
+	if !reflect.DeepEqual(config.Uplink, []string{"eth0", "eth1"}) {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	// The same content and other files are not sent
+	writeRenamed(t, filename, "Uplink:\n- eth0\n- eth1\n")
+	writeRenamed(t, filepath.Join(dir, "other.yaml"), "Uplink: [eth2]\n")
+	expectNothing(t, configChan, errChan)
+
+	// Invalid content is an error
+	writeRenamed(t, filename, "Uplink: []\n")
+	select {
+	case err := <-errChan:
+		if !strings.HasSuffix(err.Error(), "model.yaml: No uplinks") {
+			t.Errorf("unexpected error %v", err)
+		}
+	case config := <-configChan:
+		t.Fatalf("unexpected config %+v", config)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no error")
+	}
+
+	// Renamed over it
+	writeRenamed(t, filename, "Uplink: [eth1]\n")
+	config = nextConfig(t, configChan, errChan)
+	if !reflect.DeepEqual(config.Uplink, []string{"eth1"}) {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	// Both closed when done
+	cancel()
+	for range configChan {
+	}
+	for range errChan {
+	}
+}
+
+func TestWatchDeviceNetworkConfig(t *testing.T) {
+	saved := dncSettle
+	dncSettle = 20 * time.Millisecond
+	defer func() { dncSettle = saved }()
+	testWatchDeviceNetworkConfig(t)
+}
+
+func TestWatchDeviceNetworkConfigPolling(t *testing.T) {
+	savedSettle, savedPoll := dncSettle, dncPollInterval
+	dncSettle = 20 * time.Millisecond
+	dncPollInterval = 20 * time.Millisecond
+	newDNCWatcher = func() (*fsnotify.Watcher, error) {
+		return nil, errors.New("no inotify")
+	}
+	defer func() {
+		dncSettle, dncPollInterval = savedSettle, savedPoll
+		newDNCWatcher = fsnotify.NewWatcher
+	}()
+	testWatchDeviceNetworkConfig(t)
+}
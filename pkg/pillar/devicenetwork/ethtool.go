@@ -0,0 +1,60 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"errors"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// Speed and duplex values of the ethtool link settings
+const (
+	ethtoolSpeedUnknown  = 0xffffffff
+	ethtoolDuplexHalf    = 0x00
+	ethtoolDuplexFull    = 0x01
+	ethtoolDuplexUnknown = 0xff
+)
+
+// linkSettings are the negotiated settings of a link
+type linkSettings struct {
+	speed  uint32 // Mbps
+	duplex uint8
+}
+
+// Returned for the interfaces without link settings e.g. virtual and
+// wireless ones
+var errEthtoolNotSupported = errors.New("ethtool link settings not supported")
+
+// ethtoolAPI queries the link settings of the interfaces, replaced by a
+// fake in the tests
+type ethtoolAPI interface {
+	LinkSettings(ifname string) (linkSettings, error)
+}
+
+var ethtoolHandle ethtoolAPI = kernelEthtool{}
+
+// setLinkSettings sets the speed and duplex of a port, leaving them
+// unknown when the interface does not report them
+func setLinkSettings(port *types.NetworkPortStatus) {
+	settings, err := ethtoolHandle.LinkSettings(port.IfName)
+	if err == errEthtoolNotSupported {
+		log.Debugf("setLinkSettings(%s): %s\n", port.IfName, err)
+		return
+	}
+	if err != nil {
+		log.Warnf("setLinkSettings(%s) failed: %s\n", port.IfName, err)
+		return
+	}
+	if settings.speed != 0 && settings.speed != ethtoolSpeedUnknown {
+		port.SpeedMbps = settings.speed
+	}
+	switch settings.duplex {
+	case ethtoolDuplexHalf:
+		port.Duplex = "half"
+	case ethtoolDuplexFull:
+		port.Duplex = "full"
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Link settings using the ethtool ioctl
+
+// This file is built only for linux
+// +build linux
+
+package devicenetwork
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	siocEthtool           = 0x8946
+	ethtoolGSet           = 0x00000001 // Legacy, before GLINKSETTINGS
+	ethtoolGLinkSettings  = 0x0000004c
+	linkModeMasksMaxNU32  = 127 // Bounded by the s8 nwords
+	ethtoolLinkModeMasksN = 3   // supported, advertising, lp_advertising
+)
+
+// struct ifreq with ifr_data
+type ethtoolIfreq struct {
+	name [syscall.IFNAMSIZ]byte
+	data unsafe.Pointer
+	_    [16]byte // Rest of the union
+}
+
+// struct ethtool_link_settings followed by room for its link modes
+type ethtoolLinkSettings struct {
+	cmd                 uint32
+	speed               uint32
+	duplex              uint8
+	port                uint8
+	phyAddress          uint8
+	autoneg             uint8
+	mdioSupport         uint8
+	ethTpMdix           uint8
+	ethTpMdixCtrl       uint8
+	linkModeMasksNwords int8
+	transceiver         uint8
+	masterSlaveCfg      uint8
+	masterSlaveState    uint8
+	rateMatching        uint8
+	reserved            [7]uint32
+	linkModeMasks       [ethtoolLinkModeMasksN * linkModeMasksMaxNU32]uint32
+}
+
+// struct ethtool_cmd
+type ethtoolCmd struct {
+	cmd           uint32
+	supported     uint32
+	advertising   uint32
+	speed         uint16
+	duplex        uint8
+	port          uint8
+	phyAddress    uint8
+	transceiver   uint8
+	autoneg       uint8
+	mdioSupport   uint8
+	maxtxpkt      uint32
+	maxrxpkt      uint32
+	speedHi       uint16
+	ethTpMdix     uint8
+	ethTpMdixCtrl uint8
+	lpAdvertising uint32
+	reserved      [2]uint32
+}
+
+// kernelEthtool asks the kernel
+type kernelEthtool struct{}
+
+func (kernelEthtool) LinkSettings(ifname string) (linkSettings, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return linkSettings{}, err
+	}
+	defer syscall.Close(fd)
+	settings, err := getLinkSettings(fd, ifname)
+	if err == errEthtoolNotSupported {
+		settings, err = getLegacyLinkSettings(fd, ifname)
+	}
+	return settings, err
+}
+
+func ethtoolIoctl(fd int, ifname string, data unsafe.Pointer) error {
+	var ifr ethtoolIfreq
+	if len(ifname) >= len(ifr.name) {
+		return fmt.Errorf("Bad ifname %s", ifname)
+	}
+	copy(ifr.name[:], ifname)
+	ifr.data = data
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd),
+		siocEthtool, uintptr(unsafe.Pointer(&ifr)))
+	switch errno {
+	case 0:
+		return nil
+	case syscall.EOPNOTSUPP:
+		return errEthtoolNotSupported
+	default:
+		return errno
+	}
+}
+
+// getLinkSettings uses ETHTOOL_GLINKSETTINGS which first tells the
+// number of words of the link modes
+func getLinkSettings(fd int, ifname string) (linkSettings, error) {
+	req := &ethtoolLinkSettings{cmd: ethtoolGLinkSettings}
+	if err := ethtoolIoctl(fd, ifname, unsafe.Pointer(req)); err != nil {
+		return linkSettings{}, err
+	}
+	nwords := -req.linkModeMasksNwords
+	if nwords <= 0 {
+		// The kernel does not do the handshake
+		return linkSettings{}, errEthtoolNotSupported
+	}
+	req = &ethtoolLinkSettings{cmd: ethtoolGLinkSettings,
+		linkModeMasksNwords: nwords}
+	if err := ethtoolIoctl(fd, ifname, unsafe.Pointer(req)); err != nil {
+		return linkSettings{}, err
+	}
+	if req.linkModeMasksNwords != nwords {
+		return linkSettings{}, fmt.Errorf("Link modes changed for %s", ifname)
+	}
+	return linkSettings{speed: req.speed, duplex: req.duplex}, nil
+}
+
+// getLegacyLinkSettings uses ETHTOOL_GSET
+func getLegacyLinkSettings(fd int, ifname string) (linkSettings, error) {
+	req := &ethtoolCmd{cmd: ethtoolGSet}
+	if err := ethtoolIoctl(fd, ifname, unsafe.Pointer(req)); err != nil {
+		return linkSettings{}, err
+	}
+	speed := uint32(req.speedHi)<<16 | uint32(req.speed)
+	return linkSettings{speed: speed, duplex: req.duplex}, nil
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+//
+// Stub file to allow compilation of ethtool.go to go thru on macos.
+// +build darwin
+
+package devicenetwork
+
+type kernelEthtool struct{}
+
+func (kernelEthtool) LinkSettings(ifname string) (linkSettings, error) {
+	return linkSettings{}, errEthtoolNotSupported
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+type fakeEthtoolResult struct {
+	settings linkSettings
+	err      error
+}
+
+// fakeEthtool serves the link settings from a map
+type fakeEthtool map[string]fakeEthtoolResult
+
+func (f fakeEthtool) LinkSettings(ifname string) (linkSettings, error) {
+	result, ok := f[ifname]
+	if !ok {
+		return linkSettings{}, syscall.ENODEV
+	}
+	return result.settings, result.err
+}
+
+func TestSetLinkSettings(t *testing.T) {
+	ethtoolHandle = fakeEthtool{
+		"eth0":  {linkSettings{speed: 1000, duplex: ethtoolDuplexFull}, nil},
+		"eth1":  {linkSettings{speed: 100, duplex: ethtoolDuplexHalf}, nil},
+		"eth2":  {linkSettings{speed: ethtoolSpeedUnknown, duplex: ethtoolDuplexUnknown}, nil},
+		"wlan0": {linkSettings{}, errEthtoolNotSupported},
+		"eth3":  {linkSettings{}, syscall.EIO},
+	}
+	defer func() { ethtoolHandle = kernelEthtool{} }()
+	for _, test := range []struct {
+		ifname string
+		speed  uint32
+		duplex string
+	}{
+		{"eth0", 1000, "full"},
+		{"eth1", 100, "half"},
+		{"eth2", 0, ""}, // no link
+		{"wlan0", 0, ""},
+		{"eth3", 0, ""},
+		{"eth4", 0, ""},
+	} {
+		port := types.NetworkPortStatus{IfName: test.ifname}
+		setLinkSettings(&port)
+		if port.SpeedMbps != test.speed || port.Duplex != test.duplex {
+			t.Errorf("%s: expected %d %q, got %d %q", test.ifname,
+				test.speed, test.duplex, port.SpeedMbps, port.Duplex)
+		}
+	}
+}
+
+func TestKernelEthtool(t *testing.T) {
+	// The loopback has no link settings
+	_, err := kernelEthtool{}.LinkSettings("lo")
+	if err != errEthtoolNotSupported {
+		t.Errorf("unexpected result for lo: %v", err)
+	}
+	if _, err := (kernelEthtool{}).LinkSettings("bogus0"); err != syscall.ENODEV {
+		t.Errorf("unexpected result for a missing interface: %v", err)
+	}
+	if _, err := (kernelEthtool{}).LinkSettings("a-much-too-long-ifname"); err == nil {
+		t.Errorf("no error for a bad ifname")
+	}
+}
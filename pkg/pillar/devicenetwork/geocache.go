@@ -0,0 +1,126 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"sync"
+	"time"
+
+	"github.com/eriknordmark/ipinfo"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultGeoCacheTTL         = 24 * time.Hour
+	defaultGeoCacheNegativeTTL = 10 * time.Minute // for failed lookups
+	geoCacheSize               = 256
+)
+
+type geoCacheEntry struct {
+	info    *ipinfo.IPInfo // nil if the lookup failed
+	err     error
+	fetched time.Time
+}
+
+// geoCache keeps the geolocation of the addresses so that making a
+// DeviceNetworkStatus does not query ipinfo again for the same addresses
+type geoCache struct {
+	mutex       sync.Mutex
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int
+	entries     map[string]geoCacheEntry // by source IP
+	now         func() time.Time         // replaced in the tests
+}
+
+var geoResults = newGeoCache()
+
+func newGeoCache() *geoCache {
+	return &geoCache{
+		ttl:         defaultGeoCacheTTL,
+		negativeTTL: defaultGeoCacheNegativeTTL,
+		size:        geoCacheSize,
+		entries:     make(map[string]geoCacheEntry),
+		now:         time.Now,
+	}
+}
+
+// SetGeoCacheTTL sets for how long the geolocation of an address is
+// kept, and that of a failed lookup. Zero sets the defaults.
+func SetGeoCacheTTL(ttl time.Duration, negativeTTL time.Duration) {
+	if ttl == 0 {
+		ttl = defaultGeoCacheTTL
+	}
+	if negativeTTL == 0 {
+		negativeTTL = defaultGeoCacheNegativeTTL
+	}
+	geoResults.mutex.Lock()
+	geoResults.ttl = ttl
+	geoResults.negativeTTL = negativeTTL
+	geoResults.mutex.Unlock()
+}
+
+// InvalidateGeoCache forgets all the cached geolocations so that the
+// next lookups query ipinfo
+func InvalidateGeoCache() {
+	geoResults.mutex.Lock()
+	geoResults.entries = make(map[string]geoCacheEntry)
+	geoResults.mutex.Unlock()
+	log.Infof("InvalidateGeoCache\n")
+}
+
+// get returns the cached result for opt if still valid
+func (c *geoCache) get(opt ipinfo.Options) (geoCacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[opt.SourceIp.String()]
+	if !ok {
+		return entry, false
+	}
+	ttl := c.ttl
+	if entry.info == nil {
+		ttl = c.negativeTTL
+	}
+	if c.now().Sub(entry.fetched) >= ttl {
+		return entry, false
+	}
+	return entry, true
+}
+
+// put records the result of a lookup, evicting the oldest entry when
+// the cache is full
+func (c *geoCache) put(opt ipinfo.Options, info *ipinfo.IPInfo, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := opt.SourceIp.String()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		oldest := ""
+		for k, entry := range c.entries {
+			if oldest == "" || entry.fetched.Before(c.entries[oldest].fetched) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = geoCacheEntry{info: info, err: err, fetched: c.now()}
+}
+
+// cachedGeoLookup returns the cached geolocation of the address in opt,
+// or looks it up and caches the result
+func cachedGeoLookup(opt ipinfo.Options) (*ipinfo.IPInfo, error) {
+	if entry, ok := geoResults.get(opt); ok {
+		log.Debugf("cachedGeoLookup(%s) cached %v %v\n",
+			opt.SourceIp, entry.info, entry.err)
+		return entry.info, entry.err
+	}
+	return refreshGeoLookup(opt)
+}
+
+// refreshGeoLookup looks up the geolocation of the address in opt and
+// caches the result
+func refreshGeoLookup(opt ipinfo.Options) (*ipinfo.IPInfo, error) {
+	info, err := geoLookup(opt)
+	geoResults.put(opt, info, err)
+	return info, err
+}
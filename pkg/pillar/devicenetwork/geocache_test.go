@@ -0,0 +1,199 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eriknordmark/ipinfo"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+// countingGeoLookup stubs geoLookup, failing for the addresses in failed
+type countingGeoLookup struct {
+	mutex  sync.Mutex
+	counts map[string]int
+	failed map[string]bool
+}
+
+func (c *countingGeoLookup) lookup(opt ipinfo.Options) (*ipinfo.IPInfo, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	addr := opt.SourceIp.String()
+	c.counts[addr]++
+	if c.failed[addr] {
+		return nil, errors.New("lookup failed")
+	}
+	return &ipinfo.IPInfo{IP: fmt.Sprintf("global-%s-%d", addr, c.counts[addr])}, nil
+}
+
+func (c *countingGeoLookup) count(addr string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.counts[addr]
+}
+
+// stubGeo replaces the geolocation provider and cache for the test,
+// with the clock of the cache at *now
+func stubGeo(t *testing.T, now *time.Time) (*countingGeoLookup, func()) {
+	stub := &countingGeoLookup{counts: make(map[string]int),
+		failed: make(map[string]bool)}
+	oldResults := geoResults
+	geoResults = newGeoCache()
+	geoResults.now = func() time.Time { return *now }
+	geoLookup = stub.lookup
+	return stub, func() {
+		geoResults = oldResults
+		geoLookup = ipinfo.MyIPWithOptions
+	}
+}
+
+func TestGeoCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	stub, restore := stubGeo(t, &now)
+	defer restore()
+	opt := func(addr string) ipinfo.Options {
+		return ipinfo.Options{SourceIp: net.ParseIP(addr)}
+	}
+	stub.failed["10.0.0.2"] = true
+
+	info, err := cachedGeoLookup(opt("10.0.0.1"))
+	if err != nil || info.IP != "global-10.0.0.1-1" {
+		t.Errorf("unexpected lookup %v %v", info, err)
+	}
+	if _, err := cachedGeoLookup(opt("10.0.0.2")); err == nil {
+		t.Errorf("expected the lookup to fail")
+	}
+	now = now.Add(defaultGeoCacheNegativeTTL - time.Second)
+	info, err = cachedGeoLookup(opt("10.0.0.1"))
+	if err != nil || info.IP != "global-10.0.0.1-1" || stub.count("10.0.0.1") != 1 {
+		t.Errorf("expected a cache hit, got %v %v", info, err)
+	}
+	if _, err := cachedGeoLookup(opt("10.0.0.2")); err == nil || stub.count("10.0.0.2") != 1 {
+		t.Errorf("expected a cached failure, got %v", err)
+	}
+
+	// Failures expire first
+	now = now.Add(time.Second)
+	cachedGeoLookup(opt("10.0.0.1"))
+	cachedGeoLookup(opt("10.0.0.2"))
+	if stub.count("10.0.0.1") != 1 || stub.count("10.0.0.2") != 2 {
+		t.Errorf("unexpected lookups %v", stub.counts)
+	}
+	now = now.Add(defaultGeoCacheTTL)
+	info, _ = cachedGeoLookup(opt("10.0.0.1"))
+	if info.IP != "global-10.0.0.1-2" {
+		t.Errorf("expected a refetch after the TTL, got %v", info)
+	}
+
+	InvalidateGeoCache()
+	if info, _ = cachedGeoLookup(opt("10.0.0.1")); info.IP != "global-10.0.0.1-3" {
+		t.Errorf("expected a refetch after the invalidation, got %v", info)
+	}
+}
+
+func TestGeoCacheSize(t *testing.T) {
+	now := time.Unix(1000, 0)
+	stub, restore := stubGeo(t, &now)
+	defer restore()
+	for i := 0; i <= geoCacheSize; i++ {
+		now = now.Add(time.Second)
+		cachedGeoLookup(ipinfo.Options{SourceIp: net.IPv4(10, 0, byte(i/256), byte(i%256))})
+	}
+	if n := len(geoResults.entries); n != geoCacheSize {
+		t.Errorf("expected %d entries, got %d", geoCacheSize, n)
+	}
+	// The oldest was evicted
+	cachedGeoLookup(ipinfo.Options{SourceIp: net.IPv4(10, 0, 0, 0)})
+	cachedGeoLookup(ipinfo.Options{SourceIp: net.IPv4(10, 0, 0, 2)})
+	if stub.count("10.0.0.0") != 2 || stub.count("10.0.0.2") != 1 {
+		t.Errorf("unexpected lookups %d %d", stub.count("10.0.0.0"), stub.count("10.0.0.2"))
+	}
+}
+
+func TestGeoCacheMakeDeviceNetworkStatus(t *testing.T) {
+	now := time.Unix(1000, 0)
+	stub, restore := stubGeo(t, &now)
+	defer restore()
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "10.0.0.1")
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", IsMgmt: true,
+				DhcpConfig: types.DhcpConfig{Dhcp: types.DT_STATIC}},
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+		if geo := status.Ports[0].AddrInfoList[0].Geo; geo.IP != "global-10.0.0.1-1" {
+			t.Errorf("unexpected geolocation %+v", geo)
+		}
+	}
+	if n := stub.count("10.0.0.1"); n != 1 {
+		t.Errorf("expected one lookup, got %d", n)
+	}
+	// The periodic update always looks up
+	status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	status.Ports[0].AddrInfoList[0].LastGeoTimestamp = time.Time{}
+	if !UpdateDeviceNetworkGeo(time.Second, &status) || stub.count("10.0.0.1") != 2 {
+		t.Errorf("expected a lookup, got %d", stub.count("10.0.0.1"))
+	}
+}
+
+func TestGeoLookupDisabled(t *testing.T) {
+	now := time.Unix(1000, 0)
+	stub, restore := stubGeo(t, &now)
+	defer restore()
+	SetGeoLookupDisabled(true)
+	defer SetGeoLookupDisabled(false)
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "10.0.0.1", "2001:db8::1")
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", IsMgmt: true,
+				DhcpConfig: types.DhcpConfig{Dhcp: types.DT_STATIC}},
+		},
+	}
+	// The geolocation from before it was disabled is dropped
+	oldStatus := types.DeviceNetworkStatus{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortStatus{
+			{IfName: "eth0", IsMgmt: true, AddrInfoList: []types.AddrInfo{
+				{Addr: net.ParseIP("10.0.0.1"), Geo: ipinfo.IPInfo{IP: "192.0.2.1"},
+					LastGeoTimestamp: now}}},
+		},
+	}
+
+	start := time.Now()
+	status, _ := MakeDeviceNetworkStatus(config, oldStatus)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("status took %v", elapsed)
+	}
+	for _, ai := range status.Ports[0].AddrInfoList {
+		if ai.Geo != (ipinfo.IPInfo{}) || !ai.LastGeoTimestamp.IsZero() {
+			t.Errorf("%s: unexpected geolocation %+v at %v", ai.Addr, ai.Geo, ai.LastGeoTimestamp)
+		}
+	}
+	if UpdateDeviceNetworkGeo(0, &status) {
+		t.Errorf("unexpected change")
+	}
+	if !UpdateDeviceNetworkGeo(0, &oldStatus) || oldStatus.Ports[0].AddrInfoList[0].Geo.IP != "" {
+		t.Errorf("geolocation not cleared: %+v", oldStatus.Ports[0].AddrInfoList[0])
+	}
+	if len(stub.counts) != 0 {
+		t.Errorf("unexpected lookups %v", stub.counts)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Report what the IPv6 router advertisements gave to the ports
+
+package devicenetwork
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// The IPv6 settings of the interfaces, where disable_ipv6 is
+var procSysNetIPv6Conf = "/proc/sys/net/ipv6/conf"
+
+// The IFLA_INET6_FLAGS of an interface, from linux/if_link.h
+const (
+	ifRARcvd      = 0x20
+	ifRAManaged   = 0x40
+	ifRAOtherConf = 0x80
+)
+
+// ipv6RALink is what the kernel kept of the router advertisements
+// received on a link: the default routes and the on-link prefix routes
+// they added, the latter with their ValidLifetime only
+type ipv6RALink struct {
+	flags    uint32 // IFLA_INET6_FLAGS
+	routers  []types.IPv6Router
+	prefixes []types.IPv6Prefix
+}
+
+// Returned when the kernel has no such link, e.g. a fake one in the tests
+var errIPv6RANoLink = errors.New("no such link")
+
+// ipv6RAAPI queries the router advertisements of the links, replaced by
+// a fake in the tests
+type ipv6RAAPI interface {
+	RA(link netlink.Link) (ipv6RALink, error)
+}
+
+var ipv6RAHandle ipv6RAAPI = kernelIPv6RA{}
+
+// setIPv6RAStatus sets the IPv6RA of a port. The preferred lifetimes of
+// the prefixes are those of the addresses autoconfigured in them, and the
+// name servers those dhcpcd wrote for the RDNSS option. Left nil if IPv6
+// is disabled on the port, or no router advertisement was received.
+func setIPv6RAStatus(port *types.NetworkPortStatus, link netlink.Link) {
+	if !ipv6Enabled(port.IfName) {
+		return
+	}
+	ra, err := ipv6RAHandle.RA(link)
+	if err == errIPv6RANoLink {
+		log.Debugf("setIPv6RAStatus(%s): %s\n", port.IfName, err)
+		return
+	}
+	if err != nil {
+		log.Warnf("setIPv6RAStatus(%s) failed: %s\n", port.IfName, err)
+		return
+	}
+	if ra.flags&ifRARcvd == 0 && len(ra.routers) == 0 && len(ra.prefixes) == 0 {
+		return
+	}
+	status := &types.IPv6RAStatus{
+		Managed:     ra.flags&ifRAManaged != 0,
+		OtherConfig: ra.flags&ifRAOtherConf != 0,
+		Routers:     ra.routers,
+		Prefixes:    ra.prefixes,
+		RDNSS:       getRDNSS(port.IfName),
+	}
+	addrs, err := netlinkHandle.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		log.Warnf("setIPv6RAStatus(%s) AddrList failed: %s\n", port.IfName, err)
+	}
+	for _, addr := range addrs {
+		if isSLAACAddr(addr) {
+			setPrefixLifetimes(status, addr)
+		}
+	}
+	sort.Slice(status.Prefixes, func(i, j int) bool {
+		return bytes.Compare(status.Prefixes[i].Prefix.IP,
+			status.Prefixes[j].Prefix.IP) < 0
+	})
+	port.IPv6RA = status
+}
+
+// setPrefixLifetimes sets the PreferredLifetime of the prefix of the
+// autoconfigured addr to the longest of its addresses, the temporary ones
+// having shorter ones. Adds the prefix if it has no on-link route.
+func setPrefixLifetimes(status *types.IPv6RAStatus, addr netlink.Addr) {
+	prefix := net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask}
+	for i := range status.Prefixes {
+		if status.Prefixes[i].Prefix.String() != prefix.String() {
+			continue
+		}
+		if uint32(addr.PreferedLft) > status.Prefixes[i].PreferredLifetime {
+			status.Prefixes[i].PreferredLifetime = uint32(addr.PreferedLft)
+		}
+		return
+	}
+	status.Prefixes = append(status.Prefixes, types.IPv6Prefix{
+		Prefix:            prefix,
+		PreferredLifetime: uint32(addr.PreferedLft),
+		ValidLifetime:     uint32(addr.ValidLft),
+	})
+}
+
+// ipv6Enabled returns true if the interface exists and has IPv6
+func ipv6Enabled(ifname string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(procSysNetIPv6Conf, ifname,
+		"disable_ipv6"))
+	return err == nil && strings.TrimSpace(string(data)) == "0"
+}
+
+// getRDNSS returns the IPv6 name servers in the resolv.conf dhcpcd writes
+// for the router advertisements of ifname
+func getRDNSS(ifname string) []net.IP {
+	var rdnss []net.IP
+	for _, pattern := range resolvConfPatterns {
+		if !strings.HasSuffix(pattern, ".ra") {
+			continue
+		}
+		servers, _, err := parseResolvConf(fmt.Sprintf(pattern, ifname))
+		if err != nil {
+			continue
+		}
+		for _, server := range servers {
+			if server.To4() == nil {
+				rdnss = append(rdnss, server)
+			}
+		}
+	}
+	return rdnss
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// The router advertisements of the links as kept by the kernel
+
+// This file is built only for linux
+//go:build linux
+// +build linux
+
+package devicenetwork
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// From linux/if_link.h and linux/rtnetlink.h
+const (
+	iflaAfSpec     = 26
+	iflaInet6Flags = 1
+	rtaPref        = 20
+	rtmFPrefix     = 0x800 // An on-link prefix route
+	// Of RTA_PREF
+	icmpv6RouterPrefMedium = 0
+	icmpv6RouterPrefHigh   = 1
+	icmpv6RouterPrefLow    = 3
+	// rta_expires is in clock ticks
+	userHz = 100
+)
+
+// kernelIPv6RA asks the kernel
+type kernelIPv6RA struct{}
+
+// RA reads the IPv6 flags of the link and its routes, as ip -6 route does
+func (kernelIPv6RA) RA(link netlink.Link) (ipv6RALink, error) {
+	ifindex := link.Attrs().Index
+	req := nl.NewNetlinkRequest(syscall.RTM_GETLINK, syscall.NLM_F_ACK)
+	ifmsg := nl.NewIfInfomsg(syscall.AF_UNSPEC)
+	ifmsg.Index = int32(ifindex)
+	req.AddData(ifmsg)
+	msgs, err := req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWLINK)
+	if err == syscall.ENODEV {
+		return ipv6RALink{}, errIPv6RANoLink
+	}
+	if err != nil {
+		return ipv6RALink{}, err
+	}
+	ifname, flags, err := parseInet6Flags(msgs)
+	if err != nil {
+		return ipv6RALink{}, err
+	}
+	if ifname != link.Attrs().Name {
+		return ipv6RALink{}, errIPv6RANoLink
+	}
+
+	req = nl.NewNetlinkRequest(syscall.RTM_GETROUTE, syscall.NLM_F_DUMP)
+	rtmsg := nl.NewRtMsg()
+	rtmsg.Family = syscall.AF_INET6
+	req.AddData(rtmsg)
+	msgs, err = req.Execute(syscall.NETLINK_ROUTE, syscall.RTM_NEWROUTE)
+	if err != nil {
+		return ipv6RALink{}, err
+	}
+	ra, err := parseRARoutes(msgs, ifindex)
+	ra.flags = flags
+	return ra, err
+}
+
+// parseInet6Flags returns the name and the IFLA_INET6_FLAGS of the
+// RTM_NEWLINK message, 0 without IPv6
+func parseInet6Flags(msgs [][]byte) (string, uint32, error) {
+	if len(msgs) != 1 || len(msgs[0]) < syscall.SizeofIfInfomsg {
+		return "", 0, fmt.Errorf("bad link message")
+	}
+	attrs, err := nl.ParseRouteAttr(msgs[0][syscall.SizeofIfInfomsg:])
+	if err != nil {
+		return "", 0, fmt.Errorf("bad link message: %s", err)
+	}
+	native := nl.NativeEndian()
+	var ifname string
+	var flags uint32
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case syscall.IFLA_IFNAME:
+			ifname = strings.TrimRight(string(attr.Value), "\x00")
+		case iflaAfSpec:
+			afs, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return "", 0, fmt.Errorf("bad IFLA_AF_SPEC: %s", err)
+			}
+			for _, af := range afs {
+				if af.Attr.Type&nlaTypeMask != syscall.AF_INET6 {
+					continue
+				}
+				inet6, err := nl.ParseRouteAttr(af.Value)
+				if err != nil {
+					return "", 0, fmt.Errorf("bad AF_INET6: %s", err)
+				}
+				for _, a := range inet6 {
+					if a.Attr.Type == iflaInet6Flags && len(a.Value) == 4 {
+						flags = native.Uint32(a.Value)
+					}
+				}
+			}
+		}
+	}
+	return ifname, flags, nil
+}
+
+// parseRARoutes returns the default routes with the protocol ra and the
+// on-link prefix routes of ifindex in the IPv6 RTM_NEWROUTE messages
+func parseRARoutes(msgs [][]byte, ifindex int) (ipv6RALink, error) {
+	var ra ipv6RALink
+	native := nl.NativeEndian()
+	for _, msg := range msgs {
+		if len(msg) < syscall.SizeofRtMsg {
+			return ra, fmt.Errorf("truncated route message")
+		}
+		rtmsg := nl.DeserializeRtMsg(msg)
+		attrs, err := nl.ParseRouteAttr(msg[syscall.SizeofRtMsg:])
+		if err != nil {
+			return ra, fmt.Errorf("bad route message: %s", err)
+		}
+		var dst, gw net.IP
+		var lifetime uint32
+		oif := -1
+		pref := -1
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_DST:
+				dst = net.IP(attr.Value)
+			case syscall.RTA_GATEWAY:
+				gw = net.IP(attr.Value)
+			case syscall.RTA_OIF:
+				oif = int(native.Uint32(attr.Value))
+			case rtaPref:
+				pref = int(attr.Value[0])
+			case syscall.RTA_CACHEINFO:
+				// rta_clntref and rta_lastuse, then rta_expires
+				if len(attr.Value) >= 12 {
+					if expires := int32(native.Uint32(attr.Value[8:12])); expires > 0 {
+						lifetime = uint32(expires / userHz)
+					}
+				}
+			}
+		}
+		if oif != ifindex {
+			continue
+		}
+		switch {
+		case rtmsg.Dst_len == 0 && gw != nil && rtmsg.Protocol == syscall.RTPROT_RA:
+			ra.routers = append(ra.routers, types.IPv6Router{
+				Addr:       gw,
+				Lifetime:   lifetime,
+				Preference: routerPreference(pref),
+			})
+		case rtmsg.Dst_len != 0 && dst != nil && rtmsg.Flags&rtmFPrefix != 0:
+			ra.prefixes = append(ra.prefixes, types.IPv6Prefix{
+				Prefix: net.IPNet{IP: dst,
+					Mask: net.CIDRMask(int(rtmsg.Dst_len), 128)},
+				ValidLifetime: lifetime,
+			})
+		}
+	}
+	return ra, nil
+}
+
+func routerPreference(pref int) string {
+	switch pref {
+	case icmpv6RouterPrefHigh:
+		return "high"
+	case icmpv6RouterPrefLow:
+		return "low"
+	case icmpv6RouterPrefMedium:
+		return "medium"
+	default:
+		return ""
+	}
+}
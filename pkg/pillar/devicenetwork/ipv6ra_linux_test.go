@@ -0,0 +1,129 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// makeRouteMessage returns a faked IPv6 RTM_NEWROUTE message, without the
+// attributes which are nil or negative
+func makeRouteMessage(dst string, protocol uint8, flags uint32, gw string,
+	oif int, pref int, expires int32) []byte {
+
+	rtmsg := nl.NewRtMsg()
+	rtmsg.Family = syscall.AF_INET6
+	rtmsg.Protocol = protocol
+	rtmsg.Flags = flags
+	var attrs []*nl.RtAttr
+	if dst != "" {
+		ip, subnet, _ := net.ParseCIDR(dst)
+		ones, _ := subnet.Mask.Size()
+		rtmsg.Dst_len = uint8(ones)
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_DST, ip.To16()))
+	}
+	if gw != "" {
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_GATEWAY,
+			net.ParseIP(gw).To16()))
+	}
+	if oif >= 0 {
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_OIF,
+			nl.Uint32Attr(uint32(oif))))
+	}
+	if pref >= 0 {
+		attrs = append(attrs, nl.NewRtAttr(rtaPref, []byte{uint8(pref)}))
+	}
+	if expires >= 0 {
+		cacheinfo := make([]byte, 32)
+		nl.NativeEndian().PutUint32(cacheinfo[8:12], uint32(expires))
+		attrs = append(attrs, nl.NewRtAttr(syscall.RTA_CACHEINFO, cacheinfo))
+	}
+	msg := rtmsg.Serialize()
+	for _, attr := range attrs {
+		msg = append(msg, attr.Serialize()...)
+	}
+	return msg
+}
+
+func TestParseRARoutes(t *testing.T) {
+	msgs := [][]byte{
+		// Learnt from the RAs on ifindex 2
+		makeRouteMessage("", syscall.RTPROT_RA, 0, "fe80::1", 2,
+			icmpv6RouterPrefMedium, 179000),
+		makeRouteMessage("", syscall.RTPROT_RA, 0, "fe80::2", 2,
+			icmpv6RouterPrefLow, 60000),
+		makeRouteMessage("2001:db8:1::/64", syscall.RTPROT_KERNEL, rtmFPrefix,
+			"", 2, icmpv6RouterPrefMedium, 2591900),
+		// The link-local prefix, a static default route and a route of
+		// another link
+		makeRouteMessage("fe80::/64", syscall.RTPROT_KERNEL, 0, "", 2,
+			icmpv6RouterPrefMedium, -1),
+		makeRouteMessage("", syscall.RTPROT_BOOT, 0, "fe80::3", 2, -1, -1),
+		makeRouteMessage("", syscall.RTPROT_RA, 0, "fe80::4", 3,
+			icmpv6RouterPrefHigh, 179000),
+		// Without an output interface, such as the unreachable ones
+		makeRouteMessage("", syscall.RTPROT_RA, 0, "fe80::5", -1, -1, -1),
+	}
+	ra, err := parseRARoutes(msgs, 2)
+	if err != nil {
+		t.Fatalf("parseRARoutes failed: %v", err)
+	}
+	_, prefix, _ := net.ParseCIDR("2001:db8:1::/64")
+	expected := ipv6RALink{
+		routers: []types.IPv6Router{
+			{Addr: net.ParseIP("fe80::1"), Lifetime: 1790, Preference: "medium"},
+			{Addr: net.ParseIP("fe80::2"), Lifetime: 600, Preference: "low"},
+		},
+		prefixes: []types.IPv6Prefix{
+			{Prefix: *prefix, ValidLifetime: 25919},
+		},
+	}
+	if !reflect.DeepEqual(ra, expected) {
+		t.Errorf("expected %+v, got %+v", expected, ra)
+	}
+	if _, err := parseRARoutes([][]byte{{10, 0}}, 2); err == nil {
+		t.Errorf("no error for a truncated message")
+	}
+}
+
+// makeLinkMessage returns a faked RTM_NEWLINK message, without AF_INET6
+// if flags is negative
+func makeLinkMessage(ifname string, flags int64) []byte {
+	msg := nl.NewIfInfomsg(syscall.AF_UNSPEC).Serialize()
+	msg = append(msg, nl.NewRtAttr(syscall.IFLA_IFNAME,
+		nl.ZeroTerminated(ifname)).Serialize()...)
+	afSpec := nl.NewRtAttr(iflaAfSpec, nil)
+	afSpec.AddRtAttr(syscall.AF_INET, []byte{0, 0, 0, 0})
+	if flags >= 0 {
+		inet6 := afSpec.AddRtAttr(syscall.AF_INET6, nil)
+		inet6.AddRtAttr(iflaInet6Flags, nl.Uint32Attr(uint32(flags)))
+	}
+	return append(msg, afSpec.Serialize()...)
+}
+
+func TestParseInet6Flags(t *testing.T) {
+	for _, test := range []struct {
+		flags    int64
+		expected uint32
+	}{
+		{ifRARcvd | ifRAManaged | ifRAOtherConf, 0xe0},
+		{0x80000000, 0x80000000}, // Only IF_READY
+		{-1, 0},
+	} {
+		ifname, flags, err := parseInet6Flags([][]byte{makeLinkMessage("eth0",
+			test.flags)})
+		if err != nil || ifname != "eth0" || flags != test.expected {
+			t.Errorf("%#x: unexpected %s %#x %v", test.flags, ifname, flags, err)
+		}
+	}
+	if _, _, err := parseInet6Flags(nil); err == nil {
+		t.Errorf("no error without a message")
+	}
+}
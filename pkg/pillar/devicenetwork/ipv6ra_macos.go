@@ -0,0 +1,18 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+//
+// Stub file to allow compilation of ipv6ra.go to go thru on macos.
+// +build darwin
+
+package devicenetwork
+
+import (
+	"github.com/eriknordmark/netlink"
+)
+
+type kernelIPv6RA struct{}
+
+func (kernelIPv6RA) RA(link netlink.Link) (ipv6RALink, error) {
+	return ipv6RALink{}, errIPv6RANoLink
+}
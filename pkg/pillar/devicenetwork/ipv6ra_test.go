@@ -0,0 +1,91 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+// fakeIPv6RA returns the router advertisements by ifname
+type fakeIPv6RA map[string]ipv6RALink
+
+func (f fakeIPv6RA) RA(link netlink.Link) (ipv6RALink, error) {
+	ra, ok := f[link.Attrs().Name]
+	if !ok {
+		return ipv6RALink{}, errIPv6RANoLink
+	}
+	return ra, nil
+}
+
+func TestIPv6RAStatus(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	oldConf := procSysNetIPv6Conf
+	procSysNetIPv6Conf = "testdata/proc/sys/net/ipv6/conf"
+	defer func() { procSysNetIPv6Conf = oldConf }()
+	SetResolvConfPaths([]string{"testdata/resolv.conf/%s.dhcp",
+		"testdata/resolv.conf/%s.ra"}, "testdata/missing")
+	defer SetResolvConfPaths(nil, "")
+
+	_, prefix1, _ := net.ParseCIDR("2001:db8:1::/64")
+	_, prefix2, _ := net.ParseCIDR("2001:db8:2::/64")
+	router := types.IPv6Router{Addr: net.ParseIP("fe80::1"), Lifetime: 1790,
+		Preference: "medium"}
+	ra := ipv6RALink{
+		flags:    ifRARcvd | ifRAOtherConf,
+		routers:  []types.IPv6Router{router},
+		prefixes: []types.IPv6Prefix{{Prefix: *prefix1, ValidLifetime: 25919}},
+	}
+	ipv6RAHandle = fakeIPv6RA{"eth0": ra, "eth1": ra, "eth2": {}}
+	defer func() { ipv6RAHandle = kernelIPv6RA{} }()
+
+	addr := func(cidr string, flags int, preferred int, valid int) netlink.Addr {
+		ip, subnet, _ := net.ParseCIDR(cidr)
+		return netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: subnet.Mask},
+			Flags: flags, PreferedLft: preferred, ValidLft: valid}
+	}
+	for i, ifname := range []string{"eth0", "eth1", "eth2", "eth3"} {
+		fake.setLink(ifname, 100+i, true)
+	}
+	fake.addrs["eth0"] = []netlink.Addr{
+		addr("2001:db8:1::10/64", 0, 14000, 25919),
+		// A temporary address, and one in a prefix without on-link flag
+		addr("2001:db8:1::abcd/64", syscall.IFA_F_SECONDARY, 3600, 25919),
+		addr("2001:db8:2::10/64", 0, 100, 200),
+		addr("fe80::10/64", syscall.IFA_F_PERMANENT, -1, -1),
+		addr("2001:db8:9::1/64", syscall.IFA_F_PERMANENT, -1, -1),
+	}
+	config := types.DevicePortConfig{Version: types.DPCIsMgmt}
+	for _, ifname := range []string{"eth0", "eth1", "eth2", "eth3"} {
+		config.Ports = append(config.Ports, types.NetworkPortConfig{
+			IfName: ifname, IsMgmt: true})
+	}
+	_, status, _ := makeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+
+	expected := &types.IPv6RAStatus{
+		OtherConfig: true,
+		Routers:     []types.IPv6Router{router},
+		Prefixes: []types.IPv6Prefix{
+			{Prefix: *prefix1, PreferredLifetime: 14000, ValidLifetime: 25919},
+			{Prefix: *prefix2, PreferredLifetime: 100, ValidLifetime: 200},
+		},
+		RDNSS: []net.IP{net.ParseIP("2001:db8::53")},
+	}
+	if !reflect.DeepEqual(status.Ports[0].IPv6RA, expected) {
+		t.Errorf("expected %+v, got %+v", expected, status.Ports[0].IPv6RA)
+	}
+	// IPv6 disabled, no router advertisement, and no IPv6 at all
+	for _, port := range status.Ports[1:] {
+		if port.IPv6RA != nil {
+			t.Errorf("%s: unexpected %+v", port.IfName, port.IPv6RA)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"github.com/eriknordmark/netlink"
+	log "github.com/sirupsen/logrus"
+)
+
+// netlinkAPI is the part of netlink used to make and watch the
+// DeviceNetworkStatus, replaced by a fake in the tests
+type netlinkAPI interface {
+	LinkByName(name string) (netlink.Link, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkSetUp(link netlink.Link) error
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrReplace(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	// The updates are sent to ch until done is closed, then ch is closed
+	AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error
+	LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error
+}
+
+// kernelNetlink asks the kernel
+type kernelNetlink struct{}
+
+func (kernelNetlink) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+
+func (kernelNetlink) LinkByIndex(index int) (netlink.Link, error) {
+	return netlink.LinkByIndex(index)
+}
+
+func (kernelNetlink) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
+func (kernelNetlink) LinkAdd(link netlink.Link) error {
+	return netlink.LinkAdd(link)
+}
+
+func (kernelNetlink) LinkDel(link netlink.Link) error {
+	return netlink.LinkDel(link)
+}
+
+func (kernelNetlink) LinkSetUp(link netlink.Link) error {
+	return netlink.LinkSetUp(link)
+}
+
+func (kernelNetlink) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return netlink.AddrList(link, family)
+}
+
+func (kernelNetlink) AddrReplace(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrReplace(link, addr)
+}
+
+func (kernelNetlink) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	return netlink.AddrDel(link, addr)
+}
+
+func (kernelNetlink) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	return netlink.RouteListFiltered(family, filter, filterMask)
+}
+
+func (kernelNetlink) RouteReplace(route *netlink.Route) error {
+	return netlink.RouteReplace(route)
+}
+
+func (kernelNetlink) RouteDel(route *netlink.Route) error {
+	return netlink.RouteDel(route)
+}
+
+var netlinkHandle netlinkAPI = kernelNetlink{}
+
+func (kernelNetlink) AddrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{}) error {
+	return addrSubscribe(ch, done, subscribeErrFunc("AddrSubscribe", done))
+}
+
+func (kernelNetlink) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	return netlink.LinkSubscribeWithOptions(ch, done,
+		netlink.LinkSubscribeOptions{
+			ErrorCallback: subscribeErrFunc("LinkSubscribe", done),
+		})
+}
+
+// subscribeErrFunc logs the errors of a subscription. Once done is
+// closed the errors are from the closed socket and dropped; the
+// receiving goroutine then returns and closes the channel.
+func subscribeErrFunc(name string, done <-chan struct{}) func(error) {
+	return func(err error) {
+		select {
+		case <-done:
+		default:
+			log.Errorf("%s failed %s\n", name, err)
+		}
+	}
+}
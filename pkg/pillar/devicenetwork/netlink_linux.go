@@ -0,0 +1,130 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// The address subscription of kernelNetlink
+
+// This file is built only for linux
+//go:build linux
+// +build linux
+
+package devicenetwork
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// How often the receive loop of addrSubscribe looks for done
+const addrSubscribeTimeout = time.Second
+
+// addrSubscribe is netlink.AddrSubscribeWithOptions with a receive loop
+// which ends once done is closed, closing its socket and ch. The one of
+// netlink retries the closed socket forever and never closes ch, and a
+// close of the socket does not return a receive already blocked in it,
+// hence the receive timeout.
+func addrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{},
+	cberr func(error)) error {
+
+	s, err := nl.Subscribe(syscall.NETLINK_ROUTE,
+		syscall.RTNLGRP_IPV4_IFADDR, syscall.RTNLGRP_IPV6_IFADDR)
+	if err != nil {
+		return err
+	}
+	timeout := syscall.NsecToTimeval(addrSubscribeTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(s.GetFd(), syscall.SOL_SOCKET,
+		syscall.SO_RCVTIMEO, &timeout); err != nil {
+		s.Close()
+		return err
+	}
+	go func() {
+		defer close(ch)
+		defer s.Close()
+		for {
+			msgs, err := s.Receive()
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err == syscall.EAGAIN {
+				continue
+			}
+			if err != nil {
+				cberr(fmt.Errorf("Receive: %v", err))
+				continue
+			}
+			for _, m := range msgs {
+				if m.Header.Type != syscall.RTM_NEWADDR &&
+					m.Header.Type != syscall.RTM_DELADDR {
+					continue
+				}
+				update, err := parseAddrUpdate(m)
+				if err != nil {
+					cberr(fmt.Errorf("could not parse address: %v", err))
+					continue
+				}
+				select {
+				case ch <- update:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// parseAddrUpdate returns the change of a RTM_NEWADDR or RTM_DELADDR
+// message, with the address picked as netlink.AddrList does.
+func parseAddrUpdate(m syscall.NetlinkMessage) (netlink.AddrUpdate, error) {
+	var update netlink.AddrUpdate
+	if len(m.Data) < syscall.SizeofIfAddrmsg {
+		return update, fmt.Errorf("short message of %d bytes",
+			len(m.Data))
+	}
+	msg := nl.DeserializeIfAddrmsg(m.Data)
+	attrs, err := nl.ParseRouteAttr(m.Data[msg.Len():])
+	if err != nil {
+		return update, err
+	}
+	update.LinkIndex = int(msg.Index)
+	update.NewAddr = m.Header.Type == syscall.RTM_NEWADDR
+	update.Flags = int(msg.Flags)
+	update.Scope = int(msg.Scope)
+	var local, dst *net.IPNet
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case syscall.IFA_ADDRESS:
+			dst = &net.IPNet{
+				IP:   attr.Value,
+				Mask: net.CIDRMask(int(msg.Prefixlen), 8*len(attr.Value)),
+			}
+		case syscall.IFA_LOCAL:
+			// With a peer the prefix is the one of the peer
+			n := 8 * len(attr.Value)
+			local = &net.IPNet{IP: attr.Value, Mask: net.CIDRMask(n, n)}
+		case netlink.IFA_FLAGS:
+			update.Flags = int(nl.NativeEndian().Uint32(attr.Value[0:4]))
+		case nl.IFA_CACHEINFO:
+			ci := nl.DeserializeIfaCacheInfo(attr.Value)
+			update.PreferedLft = int(ci.IfaPrefered)
+			update.ValidLft = int(ci.IfaValid)
+		}
+	}
+	// IPv4 sends both the local and peer address, the same without a peer
+	switch {
+	case local != nil && (dst == nil || msg.Family != syscall.AF_INET ||
+		!local.IP.Equal(dst.IP)):
+		update.LinkAddress = *local
+	case dst != nil:
+		update.LinkAddress = *dst
+	default:
+		return update, fmt.Errorf("no address for link %d", msg.Index)
+	}
+	return update, nil
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// makeAddrMessage returns a faked address message of ifindex, without
+// the addresses which are empty
+func makeAddrMessage(msgType uint16, family int, ifindex int,
+	prefixlen uint8, address string, local string) syscall.NetlinkMessage {
+
+	msg := nl.NewIfAddrmsg(family)
+	msg.Index = uint32(ifindex)
+	msg.Prefixlen = prefixlen
+	data := msg.Serialize()
+	if address != "" {
+		data = append(data, nl.NewRtAttr(syscall.IFA_ADDRESS,
+			addrBytes(family, address)).Serialize()...)
+	}
+	if local != "" {
+		data = append(data, nl.NewRtAttr(syscall.IFA_LOCAL,
+			addrBytes(family, local)).Serialize()...)
+	}
+	return syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Type: msgType},
+		Data:   data,
+	}
+}
+
+func addrBytes(family int, address string) []byte {
+	if family == syscall.AF_INET {
+		return net.ParseIP(address).To4()
+	}
+	return net.ParseIP(address).To16()
+}
+
+func TestParseAddrUpdate(t *testing.T) {
+	testMatrix := map[string]struct {
+		msg      syscall.NetlinkMessage
+		expected netlink.AddrUpdate
+		err      bool
+	}{
+		"IPv4 added": {
+			msg: makeAddrMessage(syscall.RTM_NEWADDR, syscall.AF_INET, 3,
+				24, "192.168.1.10", "192.168.1.10"),
+			expected: netlink.AddrUpdate{
+				LinkAddress: net.IPNet{IP: net.ParseIP("192.168.1.10").To4(),
+					Mask: net.CIDRMask(24, 32)},
+				LinkIndex: 3,
+				NewAddr:   true,
+			},
+		},
+		"IPv4 peer removed": {
+			msg: makeAddrMessage(syscall.RTM_DELADDR, syscall.AF_INET, 4,
+				32, "10.0.0.2", "10.0.0.1"),
+			expected: netlink.AddrUpdate{
+				LinkAddress: net.IPNet{IP: net.ParseIP("10.0.0.1").To4(),
+					Mask: net.CIDRMask(32, 32)},
+				LinkIndex: 4,
+			},
+		},
+		"IPv6 added": {
+			msg: makeAddrMessage(syscall.RTM_NEWADDR, syscall.AF_INET6, 5,
+				64, "2001:db8::10", ""),
+			expected: netlink.AddrUpdate{
+				LinkAddress: net.IPNet{IP: net.ParseIP("2001:db8::10"),
+					Mask: net.CIDRMask(64, 128)},
+				LinkIndex: 5,
+				NewAddr:   true,
+			},
+		},
+		"No address": {
+			msg: makeAddrMessage(syscall.RTM_NEWADDR, syscall.AF_INET, 6,
+				24, "", ""),
+			err: true,
+		},
+		"Short": {
+			msg: syscall.NetlinkMessage{
+				Header: syscall.NlMsghdr{Type: syscall.RTM_NEWADDR},
+				Data:   []byte{syscall.AF_INET},
+			},
+			err: true,
+		},
+	}
+
+	for testname, test := range testMatrix {
+		t.Logf("Running test case %s", testname)
+		update, err := parseAddrUpdate(test.msg)
+		if test.err {
+			if err == nil {
+				t.Errorf("Test Case %s: no error", testname)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test Case %s: error %s", testname, err)
+			continue
+		}
+		if !reflect.DeepEqual(update, test.expected) {
+			t.Errorf("Test Case %s: got %+v expected %+v",
+				testname, update, test.expected)
+		}
+	}
+}
+
+// The subscription ends and closes its channel once done is closed,
+// not reporting the errors of its closed socket
+func TestAddrSubscribeDone(t *testing.T) {
+	ch := make(chan netlink.AddrUpdate)
+	done := make(chan struct{})
+	var errs []error
+	if err := addrSubscribe(ch, done, func(err error) {
+		errs = append(errs, err)
+	}); err != nil {
+		t.Fatalf("addrSubscribe failed %s", err)
+	}
+	close(done)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if ok {
+				continue
+			}
+		case <-timeout:
+			t.Fatalf("channel not closed")
+		}
+		break
+	}
+	if len(errs) != 0 {
+		t.Errorf("errors reported %v", errs)
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+//
+// Stub file to allow compilation of netlink.go to go thru on macos.
+// +build darwin
+
+package devicenetwork
+
+import (
+	"github.com/eriknordmark/netlink"
+)
+
+func addrSubscribe(ch chan<- netlink.AddrUpdate, done <-chan struct{},
+	cberr func(error)) error {
+	return netlink.AddrSubscribe(ch, done)
+}
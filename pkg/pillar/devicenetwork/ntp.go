@@ -0,0 +1,65 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// The NTP servers of the uplinks
+
+package devicenetwork
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+// makeNtpServers returns the NTP servers of the port: those configured,
+// or else its NtpServer, and then those of its DHCP leases, each once
+func makeNtpServers(u types.NetworkPortConfig, leases []dhcpLease) []types.NtpServerInfo {
+	var servers []types.NtpServerInfo
+	seen := make(map[string]bool)
+	add := func(server string, origin string) {
+		if !seen[server] {
+			seen[server] = true
+			servers = append(servers, types.NtpServerInfo{Server: server,
+				Origin: origin})
+		}
+	}
+	for _, server := range u.NtpServers {
+		add(server, "static")
+	}
+	if len(u.NtpServers) == 0 && u.NtpServer != nil &&
+		!u.NtpServer.IsUnspecified() {
+		add(u.NtpServer.String(), "static")
+	}
+	// The last lease is the latest
+	for i := len(leases) - 1; i >= 0; i-- {
+		for _, server := range leases[i].ntpServers {
+			add(server, "dhcp")
+		}
+	}
+	return servers
+}
+
+// checkNtpServer returns why server is neither an address nor a hostname
+func checkNtpServer(server string) error {
+	if net.ParseIP(server) != nil {
+		return nil
+	}
+	if server == "" || len(server) > 253 {
+		return fmt.Errorf("not a hostname")
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(server, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' ||
+			label[len(label)-1] == '-' {
+			return fmt.Errorf("bad hostname label %q", label)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+				c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("bad character %q", c)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+func TestNtpServers(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "192.168.1.10")
+	fake.setLink("eth1", 101, true, "10.0.0.21")
+	SetDhcpLeaseFiles("eth0", "testdata/leases/eth0.lease")
+	defer SetDhcpLeaseFiles("eth0")
+	SetDhcpLeaseFiles("eth1", "testdata/leases/dhclient.eth1.leases")
+	defer SetDhcpLeaseFiles("eth1")
+
+	config := types.DeviceNetworkConfig{
+		Version:    2,
+		Uplink:     []string{"eth0", "eth1"},
+		NtpServers: []string{"pool.ntp.org"},
+		Ntp: []types.UplinkNtpConfig{
+			{IfName: "eth0", NtpServers: []string{"ntp.internal", "192.168.1.1"}},
+		},
+	}
+	status, err := MakeDeviceNetworkStatus(MakeDevicePortConfig(config),
+		types.DeviceNetworkStatus{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// Each server once, the configured ones first
+	expected := []types.NtpServerInfo{
+		{Server: "ntp.internal", Origin: "static"},
+		{Server: "192.168.1.1", Origin: "static"},
+		{Server: "192.168.1.2", Origin: "dhcp"},
+	}
+	if !reflect.DeepEqual(status.Ports[0].NtpServers, expected) {
+		t.Errorf("eth0: expected %+v, got %+v", expected, status.Ports[0].NtpServers)
+	}
+	expected = []types.NtpServerInfo{
+		{Server: "pool.ntp.org", Origin: "static"},
+		{Server: "10.0.0.2", Origin: "dhcp"},
+		{Server: "ntp.example.com", Origin: "dhcp"},
+	}
+	if !reflect.DeepEqual(status.Ports[1].NtpServers, expected) {
+		t.Errorf("eth1: expected %+v, got %+v", expected, status.Ports[1].NtpServers)
+	}
+	for ifname, expected := range map[string][]string{
+		"eth0":  {"ntp.internal", "192.168.1.1"},
+		"eth1":  {"pool.ntp.org"},
+		"wlan0": nil,
+	} {
+		if servers := types.GetNtpServers(status, ifname); !reflect.DeepEqual(servers, expected) {
+			t.Errorf("GetNtpServers(%s): expected %v, got %v", ifname, expected, servers)
+		}
+	}
+
+	// Those of DHCP without a default
+	config.NtpServers = nil
+	status, _ = MakeDeviceNetworkStatus(MakeDevicePortConfig(config),
+		types.DeviceNetworkStatus{})
+	if servers := types.GetNtpServers(status, "eth1"); !reflect.DeepEqual(servers,
+		[]string{"10.0.0.2", "ntp.example.com"}) {
+		t.Errorf("GetNtpServers(eth1): unexpected %v", servers)
+	}
+}
+
+func TestCheckNtpServer(t *testing.T) {
+	for server, ok := range map[string]bool{
+		"192.168.1.1":      true,
+		"2001:db8::1":      true,
+		"ntp.internal":     true,
+		"time-1.x.org.":    true,
+		"ntp":              true,
+		"":                 false,
+		".":                false,
+		"ntp..internal":    false,
+		"-ntp.internal":    false,
+		"ntp_1.example":    false,
+		"ntp.internal:123": false,
+	} {
+		if err := checkNtpServer(server); (err == nil) != ok {
+			t.Errorf("checkNtpServer(%q): unexpected %v", server, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Resolve the port names which are hardware identifiers, such as
+// mac:00:16:3e:0a:0b:0c and pci:0000:02:00.0, to the current interfaces
+
+package devicenetwork
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// isPortHwID returns true if the ifname of a port is a MAC or a PCI
+// address instead of a kernel name
+func isPortHwID(ifname string) bool {
+	return strings.HasPrefix(ifname, "mac:") || strings.HasPrefix(ifname, "pci:")
+}
+
+// domain:bus:slot.function
+var pciAddrRegexp = regexp.MustCompile(`^[0-9a-f]{4}:[0-9a-f]{2}:[0-1][0-9a-f]\.[0-7]$`)
+
+// checkPortHwID returns why hwid is not a valid MAC or PCI address
+func checkPortHwID(hwid string) error {
+	if strings.HasPrefix(hwid, "mac:") {
+		mac, err := net.ParseMAC(hwid[len("mac:"):])
+		if err != nil || len(mac) != 6 {
+			return fmt.Errorf("not a MAC address")
+		}
+		return nil
+	}
+	if !pciAddrRegexp.MatchString(hwid[len("pci:"):]) {
+		return fmt.Errorf("not a PCI address such as 0000:02:00.0")
+	}
+	return nil
+}
+
+// hwidMatch returns true if link has the address of the valid hwid. A
+// MAC matches the devices only, not the VLANs and bridges which have the
+// MAC of their ports.
+func hwidMatch(hwid string, link netlink.Link) bool {
+	if strings.HasPrefix(hwid, "mac:") {
+		mac, _ := net.ParseMAC(hwid[len("mac:"):])
+		return link.Type() == "device" &&
+			link.Attrs().HardwareAddr.String() == mac.String()
+	}
+	device, err := filepath.EvalSymlinks(filepath.Join(sysClassNet,
+		link.Attrs().Name, "device"))
+	return err == nil && filepath.Base(device) == hwid[len("pci:"):]
+}
+
+// resolvePorts replaces the ifname of the ports of config which are
+// hardware identifiers by that of the interface with the address, which
+// can change across reboots. Returns the identifier of each resolved
+// ifname, and an error for each identifier which is bad, ambiguous, or
+// matches no interface or a port listed by its name.
+func resolvePorts(config types.DevicePortConfig) (types.DevicePortConfig, map[string]string, []string) {
+	hwids := make(map[string]string)
+	var errStrs []string
+	listed := make(map[string]bool)
+	hasHwIDs := false
+	for _, u := range config.Ports {
+		if isPortHwID(u.IfName) {
+			hasHwIDs = true
+		} else {
+			listed[u.IfName] = true
+		}
+	}
+	if !hasHwIDs {
+		return config, hwids, nil
+	}
+	links, err := netlinkHandle.LinkList()
+	if err != nil {
+		errStr := fmt.Sprintf("Port hardware addresses not resolved: %s", err)
+		log.Errorf("resolvePorts: %s\n", errStr)
+		errStrs = append(errStrs, errStr)
+	}
+
+	resolved := config
+	resolved.Ports = nil
+	for _, u := range config.Ports {
+		if !isPortHwID(u.IfName) {
+			resolved.Ports = append(resolved.Ports, u)
+			continue
+		}
+		if err := checkPortHwID(u.IfName); err != nil {
+			errStrs = append(errStrs,
+				fmt.Sprintf("Port %s is bad: %s", u.IfName, err))
+			continue
+		}
+		var ifnames []string
+		for _, link := range links {
+			if hwidMatch(u.IfName, link) {
+				ifnames = append(ifnames, link.Attrs().Name)
+			}
+		}
+		switch {
+		case len(ifnames) == 0:
+			errStrs = append(errStrs,
+				fmt.Sprintf("Port %s matches no interface", u.IfName))
+			continue
+		case len(ifnames) > 1:
+			errStrs = append(errStrs, fmt.Sprintf("Port %s is ambiguous: %s",
+				u.IfName, strings.Join(ifnames, " ")))
+			continue
+		case listed[ifnames[0]] || hwids[ifnames[0]] != "":
+			errStrs = append(errStrs, fmt.Sprintf("Port %s is %s, already listed",
+				u.IfName, ifnames[0]))
+			continue
+		}
+		log.Infof("resolvePorts: %s is %s\n", u.IfName, ifnames[0])
+		port := u
+		port.IfName = ifnames[0]
+		if port.Name == u.IfName {
+			port.Name = ifnames[0]
+		}
+		resolved.Ports = append(resolved.Ports, port)
+		hwids[ifnames[0]] = u.IfName
+	}
+	return resolved, hwids, errStrs
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+// setPciDevice links the sysfs device of ifname to the PCI address
+func setPciDevice(t *testing.T, ifname string, pciAddr string) {
+	device := filepath.Join(sysClassNet, "..", "..", "devices", "pci0000:00", pciAddr)
+	if err := os.MkdirAll(device, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(sysClassNet, ifname)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, "device"))
+	if err := os.Symlink(device, filepath.Join(dir, "device")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolvePorts(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	dir, err := ioutil.TempDir("", "sys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldSysClassNet := sysClassNet
+	sysClassNet = filepath.Join(dir, "class", "net")
+	defer func() { sysClassNet = oldSysClassNet }()
+
+	mac0, _ := net.ParseMAC("00:16:3e:0a:0b:0c")
+	mac1, _ := net.ParseMAC("00:16:3e:0a:0b:0d")
+	dupMac, _ := net.ParseMAC("02:00:00:00:00:01")
+	setLinks := func(ifname0, ifname1 string) {
+		fake.links = make(map[string]netlink.Link)
+		fake.setLink(ifname0, 100, true, "192.168.0.10")
+		fake.links[ifname0].Attrs().HardwareAddr = mac0
+		setPciDevice(t, ifname0, "0000:02:00.0")
+		fake.setLink(ifname1, 101, true, "192.168.1.10")
+		fake.links[ifname1].Attrs().HardwareAddr = mac1
+		setPciDevice(t, ifname1, "0000:03:00.0")
+		// They have the MAC of their parent
+		fake.links["vlan100"] = &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{
+			Name: "vlan100", Index: 102, ParentIndex: 100, HardwareAddr: mac0},
+			VlanId: 100}
+		fake.links["br1"] = &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{
+			Name: "br1", Index: 103, HardwareAddr: mac1}}
+		fake.setLink("wlan0", 104, true)
+		fake.links["wlan0"].Attrs().HardwareAddr = dupMac
+		fake.setLink("wlan1", 105, true)
+		fake.links["wlan1"].Attrs().HardwareAddr = dupMac
+	}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "mac:00:16:3E:0A:0B:0C", Name: "mac:00:16:3E:0A:0B:0C", IsMgmt: true},
+			{IfName: "pci:0000:03:00.0", Name: "uplink1", IsMgmt: true},
+			{IfName: "mac:02:00:00:00:00:99"},
+			{IfName: "mac:02:00:00:00:00:01"},
+			{IfName: "pci:0000:02:00.0"},
+			{IfName: "pci:2:00.0"},
+			{IfName: "wlan1"},
+		},
+	}
+	expectedErr := "Port mac:02:00:00:00:00:99 matches no interface; " +
+		"Port mac:02:00:00:00:00:01 is ambiguous: wlan0 wlan1; " +
+		"Port pci:0000:02:00.0 is eth0, already listed; " +
+		"Port pci:2:00.0 is bad: not a PCI address such as 0000:02:00.0"
+
+	// The interfaces of the addresses swap their names
+	for _, names := range [][]string{{"eth0", "eth1"}, {"eth1", "eth0"}} {
+		setLinks(names[0], names[1])
+		status, err := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+		if err == nil || !strings.HasPrefix(err.Error(), strings.Replace(expectedErr,
+			"is eth0", "is "+names[0], 1)) {
+			t.Errorf("%v: unexpected error %v", names, err)
+		}
+		var found []string
+		for _, port := range status.Ports {
+			found = append(found, port.IfName+" "+port.Name+" "+port.HwID)
+		}
+		expected := []string{
+			names[0] + " " + names[0] + " mac:00:16:3E:0A:0B:0C",
+			names[1] + " uplink1 pci:0000:03:00.0",
+			"wlan1  ",
+		}
+		if !reflect.DeepEqual(found, expected) {
+			t.Errorf("%v: expected %q, got %q", names, expected, found)
+		}
+		if len(status.Ports) != 0 && len(status.Ports[0].AddrInfoList) != 1 {
+			t.Errorf("%v: unexpected %+v", names, status.Ports[0])
+		}
+	}
+}
+
+func TestCheckPortHwID(t *testing.T) {
+	for hwid, ok := range map[string]bool{
+		"mac:00:16:3e:0a:0b:0c": true,
+		"mac:00-16-3E-0A-0B-0C": true,
+		"mac:00:16:3e:0a:0b":    false,
+		"mac:00:00:00:00:fe:80:00:00:00:00:00:00:02:00:5e:10:00:00:00:01": false,
+		"pci:0000:02:00.0": true,
+		"pci:0000:02:1f.7": true,
+		"pci:0000:02:00.8": false,
+		"pci:02:00.0":      false,
+	} {
+		if err := checkPortHwID(hwid); (err == nil) != ok {
+			t.Errorf("checkPortHwID(%s): unexpected %v", hwid, err)
+		}
+	}
+}
+
+func TestUpdateDhcpClientHwID(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	var activated, inactivated []string
+	dhcpClientActivate = func(nuc types.NetworkPortConfig) {
+		activated = append(activated, nuc.IfName)
+	}
+	dhcpClientInactivate = func(nuc types.NetworkPortConfig) {
+		inactivated = append(inactivated, nuc.IfName)
+	}
+	defer func() {
+		dhcpClientActivate = doDhcpClientActivate
+		dhcpClientInactivate = doDhcpClientInactivate
+	}()
+	mac, _ := net.ParseMAC("00:16:3e:0a:0b:0c")
+	fake.setLink("eth1", 101, true)
+	fake.links["eth1"].Attrs().HardwareAddr = mac
+
+	client := types.DhcpConfig{Dhcp: types.DT_CLIENT}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "mac:00:16:3e:0a:0b:0c", DhcpConfig: client},
+		},
+	}
+	UpdateDhcpClient(config, types.DevicePortConfig{})
+	if !reflect.DeepEqual(activated, []string{"eth1"}) || len(inactivated) != 0 {
+		t.Errorf("added: activated %v, inactivated %v", activated, inactivated)
+	}
+	// dhcpcd runs on the same interface if listed by its name
+	activated = nil
+	renamed := config
+	renamed.Ports = []types.NetworkPortConfig{{IfName: "eth1", DhcpConfig: client}}
+	UpdateDhcpClient(renamed, config)
+	if len(activated) != 0 || len(inactivated) != 0 {
+		t.Errorf("renamed: activated %v, inactivated %v", activated, inactivated)
+	}
+	UpdateDhcpClient(types.DevicePortConfig{}, config)
+	if len(activated) != 0 || !reflect.DeepEqual(inactivated, []string{"eth1"}) {
+		t.Errorf("removed: activated %v, inactivated %v", activated, inactivated)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Expand the port names which are patterns, such as eth* and !docker*,
+// against the current interfaces
+
+package devicenetwork
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// isPortPattern returns true if the ifname of a port is a glob pattern
+// or an exclusion
+func isPortPattern(ifname string) bool {
+	return strings.HasPrefix(ifname, "!") || strings.ContainsAny(ifname, "*?[")
+}
+
+// expandPorts replaces the ports of config whose ifname is a pattern by
+// a port for each interface it matches and which is not excluded by a
+// !pattern, with the config of the pattern. Ports with a plain ifname
+// are kept and not matched by the patterns, nor are the interfaces
+// matched by an earlier pattern. Returns the pattern which matched each
+// expanded ifname, and an error for each pattern matching no interface.
+func expandPorts(config types.DevicePortConfig) (types.DevicePortConfig, map[string]string, []string) {
+	patterns := make(map[string]string)
+	var errStrs []string
+	var exclusions []string
+	hasPatterns := false
+	taken := make(map[string]bool)
+	for _, u := range config.Ports {
+		if strings.HasPrefix(u.IfName, "!") {
+			exclusions = append(exclusions, u.IfName[1:])
+		} else if isPortPattern(u.IfName) {
+			hasPatterns = true
+		} else {
+			taken[u.IfName] = true
+		}
+	}
+	if !hasPatterns && len(exclusions) == 0 {
+		return config, patterns, nil
+	}
+	var ifnames []string
+	if hasPatterns {
+		links, err := netlinkHandle.LinkList()
+		if err != nil {
+			errStr := fmt.Sprintf("Port patterns not expanded: %s", err)
+			log.Errorf("expandPorts: %s\n", errStr)
+			errStrs = append(errStrs, errStr)
+		}
+		for _, link := range links {
+			ifnames = append(ifnames, link.Attrs().Name)
+		}
+	}
+
+	expanded := config
+	expanded.Ports = nil
+	for _, u := range config.Ports {
+		if strings.HasPrefix(u.IfName, "!") {
+			continue
+		}
+		if !isPortPattern(u.IfName) {
+			expanded.Ports = append(expanded.Ports, u)
+			continue
+		}
+		if _, err := path.Match(u.IfName, ""); err != nil {
+			errStrs = append(errStrs,
+				fmt.Sprintf("Port pattern %s is bad: %s", u.IfName, err))
+			continue
+		}
+		matched := false
+		for _, ifname := range ifnames {
+			if taken[ifname] || !portMatch(u.IfName, ifname) ||
+				portExcluded(exclusions, ifname) {
+				continue
+			}
+			log.Infof("expandPorts: %s matched %s\n", u.IfName, ifname)
+			port := u
+			port.IfName = ifname
+			if port.Name == u.IfName {
+				port.Name = ifname
+			}
+			expanded.Ports = append(expanded.Ports, port)
+			patterns[ifname] = u.IfName
+			taken[ifname] = true
+			matched = true
+		}
+		if !matched {
+			errStrs = append(errStrs,
+				fmt.Sprintf("Port pattern %s matches no interface", u.IfName))
+		}
+	}
+	return expanded, patterns, errStrs
+}
+
+// portMatch returns true if ifname matches the valid pattern
+func portMatch(pattern string, ifname string) bool {
+	matched, _ := path.Match(pattern, ifname)
+	return matched
+}
+
+func portExcluded(exclusions []string, ifname string) bool {
+	for _, pattern := range exclusions {
+		if portMatch(pattern, ifname) {
+			return true
+		}
+	}
+	return false
+}
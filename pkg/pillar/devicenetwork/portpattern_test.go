@@ -0,0 +1,80 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+func TestExpandPorts(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	for i, ifname := range []string{"lo", "eth0", "eth1", "enp2s0", "eno1",
+		"docker0", "dockerbr", "wlan0"} {
+		fake.setLink(ifname, i+1, true)
+	}
+
+	for _, test := range []struct {
+		uplinks  []string
+		free     []string
+		expected []string // ifname:pattern:free
+		errStrs  []string
+	}{
+		{[]string{"eth0", "wlan0"}, nil, []string{"eth0::false", "wlan0::false"}, nil},
+		{[]string{"eth*"}, []string{"eth*"}, []string{"eth0:eth*:true", "eth1:eth*:true"}, nil},
+		// Overlapping patterns and a plain name
+		{[]string{"e*", "eth1", "en*"}, []string{"eth1"},
+			[]string{"eth0:e*:false", "enp2s0:e*:false", "eno1:e*:false", "eth1::true"},
+			[]string{"Port pattern en* matches no interface"}},
+		{[]string{"*", "!docker*", "!lo"}, nil,
+			[]string{"eth0:*:false", "eth1:*:false", "enp2s0:*:false",
+				"eno1:*:false", "wlan0:*:false"}, nil},
+		// Plain names are not excluded
+		{[]string{"docker0", "!docker*"}, nil, []string{"docker0::false"}, nil},
+		{[]string{"wwan*", "eth[", "eth0"}, nil, []string{"eth0::false"},
+			[]string{"Port pattern wwan* matches no interface",
+				"Port pattern eth[ is bad: syntax error in pattern"}},
+	} {
+		config := MakeDevicePortConfig(types.DeviceNetworkConfig{
+			Uplink: test.uplinks, FreeUplinks: test.free})
+		expanded, patterns, errStrs := expandPorts(config)
+		var ports []string
+		for _, u := range expanded.Ports {
+			ports = append(ports, fmt.Sprintf("%s:%s:%t", u.IfName,
+				patterns[u.IfName], u.Free))
+			if u.Name != u.IfName {
+				t.Errorf("%v: name %s of %s", test.uplinks, u.Name, u.IfName)
+			}
+		}
+		if !reflect.DeepEqual(ports, test.expected) || !reflect.DeepEqual(errStrs, test.errStrs) {
+			t.Errorf("%v: expected %v %q, got %v %q", test.uplinks,
+				test.expected, test.errStrs, ports, errStrs)
+		}
+	}
+}
+
+func TestMakeDeviceNetworkStatusPatterns(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	fake.setLink("eth1", 101, true, "192.168.1.10")
+	config := MakeDevicePortConfig(types.DeviceNetworkConfig{
+		Uplink: []string{"eth*", "wwan*"}})
+
+	status, err := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	if err == nil || err.Error() != "Port pattern wwan* matches no interface" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(status.Ports) != 2 || status.Ports[0].IfName != "eth0" ||
+		status.Ports[1].IfName != "eth1" || status.Ports[1].Pattern != "eth*" ||
+		len(status.Ports[1].AddrInfoList) != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
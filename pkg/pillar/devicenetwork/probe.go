@@ -0,0 +1,187 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Probe the controller through each uplink
+
+package devicenetwork
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	"github.com/lf-edge/eve/pkg/pillar/zedcloud"
+	log "github.com/sirupsen/logrus"
+)
+
+// The timeout of the probe from an address, and of all the probes when
+// the context of ProbeUplinks has no deadline
+var (
+	probeTimeout  = 5 * time.Second
+	probeDeadline = 15 * time.Second
+)
+
+// Set by SetProbeTLSConfig
+var probeTLSConfig atomic.Value
+
+// SetProbeTLSConfig sets the configuration of the TLS connections of the
+// https probes, such as the root certificates of the controller. The
+// system ones are used if nil.
+func SetProbeTLSConfig(config *tls.Config) {
+	probeTLSConfig.Store(config)
+}
+
+func getProbeTLSConfig() *tls.Config {
+	config, _ := probeTLSConfig.Load().(*tls.Config)
+	return config
+}
+
+// ProbeUplinks checks that probeURL can be reached through each uplink of
+// status, trying its addresses in turn and the uplinks in parallel, and
+// records the outcome in their Probe. An http or https probeURL is fetched
+// through the proxy of the uplink, and any response is a success; for the
+// cheaper "tcp://host:port" a connection is enough. Returns an error if
+// no uplink reached it.
+func ProbeUplinks(ctx context.Context, status *types.DeviceNetworkStatus,
+	probeURL string) error {
+
+	u, err := url.Parse(probeURL)
+	if err != nil {
+		return fmt.Errorf("ProbeUplinks: bad URL %s: %s", probeURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "tcp":
+		if u.Port() == "" {
+			return fmt.Errorf("ProbeUplinks: no port in %s", probeURL)
+		}
+	default:
+		return fmt.Errorf("ProbeUplinks: unsupported URL %s", probeURL)
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, probeDeadline)
+		defer cancel()
+	}
+	log.Infof("ProbeUplinks(%s)\n", probeURL)
+	// Looked up before the probes update the status
+	proxies := make([]*url.URL, len(status.Ports))
+	lookupErrs := make([]error, len(status.Ports))
+	if u.Scheme != "tcp" {
+		for ix, port := range status.Ports {
+			if port.IsMgmt {
+				proxies[ix], lookupErrs[ix] = zedcloud.LookupProxy(status,
+					port.IfName, probeURL)
+			}
+		}
+	}
+	var wg sync.WaitGroup
+	var reached int32
+	for ix := range status.Ports {
+		port := &status.Ports[ix]
+		if !port.IsMgmt {
+			continue
+		}
+		if lookupErrs[ix] != nil {
+			setProbeError(port, lookupErrs[ix].Error())
+			continue
+		}
+		wg.Add(1)
+		go func(proxy *url.URL) {
+			defer wg.Done()
+			if probePort(ctx, port, u, proxy) {
+				atomic.AddInt32(&reached, 1)
+			}
+		}(proxies[ix])
+	}
+	wg.Wait()
+	if reached == 0 {
+		return fmt.Errorf("ProbeUplinks: no uplink reached %s", probeURL)
+	}
+	return nil
+}
+
+// probePort tries the addresses of the port until one reaches u
+func probePort(ctx context.Context, port *types.NetworkPortStatus,
+	u *url.URL, proxy *url.URL) bool {
+
+	var errStrs []string
+	for _, ai := range port.AddrInfoList {
+		if ai.Addr.IsLinkLocalUnicast() || ai.LinkLocal {
+			continue
+		}
+		start := time.Now()
+		err := probeAddr(ctx, ai.Addr, u, proxy)
+		if err == nil {
+			port.Probe.LastProbeSuccess = time.Now()
+			port.Probe.Latency = time.Since(start)
+			port.Probe.Addr = ai.Addr
+			log.Infof("probePort(%s) reached %s from %s in %v\n",
+				port.IfName, u.Host, ai.Addr, port.Probe.Latency)
+			return true
+		}
+		errStrs = append(errStrs, fmt.Sprintf("from %s: %s", ai.Addr, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errStrs) == 0 {
+		setProbeError(port, fmt.Sprintf("Port %s has no address to probe from",
+			port.IfName))
+	} else {
+		setProbeError(port, fmt.Sprintf("Port %s did not reach %s %s",
+			port.IfName, u.Host, strings.Join(errStrs, "; ")))
+	}
+	return false
+}
+
+func setProbeError(port *types.NetworkPortStatus, errStr string) {
+	log.Warnf("probePort: %s\n", errStr)
+	port.Probe.LastProbeError = time.Now()
+	port.Probe.ProbeError = errStr
+}
+
+// probeAddr connects to u, or fetches it, from the source address addr
+func probeAddr(ctx context.Context, addr net.IP, u *url.URL, proxy *url.URL) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: addr}}
+	if u.Scheme == "tcp" {
+		conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	transport := &http.Transport{
+		DialContext:     dialer.DialContext,
+		TLSClientConfig: getProbeTLSConfig(),
+	}
+	if proxy != nil {
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	defer transport.CloseIdleConnections()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req.WithContext(ctx))
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
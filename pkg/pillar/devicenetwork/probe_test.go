@@ -0,0 +1,108 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+func makeProbeStatus() types.DeviceNetworkStatus {
+	port := func(ifname string, isMgmt bool, addrs ...string) types.NetworkPortStatus {
+		port := types.NetworkPortStatus{IfName: ifname, IsMgmt: isMgmt}
+		for _, addr := range addrs {
+			port.AddrInfoList = append(port.AddrInfoList,
+				types.AddrInfo{Addr: net.ParseIP(addr)})
+		}
+		return port
+	}
+	// 198.51.100.0/24 is not on the host so cannot be the source
+	return types.DeviceNetworkStatus{Ports: []types.NetworkPortStatus{
+		port("eth0", true, "fe80::1", "198.51.100.1", "127.0.0.1"),
+		port("eth1", true, "198.51.100.2"),
+		port("eth2", true, "fe80::2"),
+		port("eth3", false, "127.0.0.1"),
+	}}
+}
+
+func TestProbeUplinks(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Any response will do
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	SetProbeTLSConfig(server.Client().Transport.(*http.Transport).TLSClientConfig)
+	defer SetProbeTLSConfig(nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	for _, probeURL := range []string{server.URL + "/api/v1/edgedevice/ping",
+		"tcp://" + listener.Addr().String()} {
+		status := makeProbeStatus()
+		before := time.Now()
+		if err := ProbeUplinks(context.Background(), &status, probeURL); err != nil {
+			t.Errorf("%s: unexpected error %v", probeURL, err)
+		}
+		probe := status.Ports[0].Probe
+		if probe.LastProbeSuccess.Before(before) || !probe.LastProbeError.IsZero() ||
+			!probe.Addr.Equal(net.ParseIP("127.0.0.1")) || probe.Latency <= 0 {
+			t.Errorf("%s: eth0 unexpected %+v", probeURL, probe)
+		}
+		probe = status.Ports[1].Probe
+		if !probe.LastProbeSuccess.IsZero() || probe.LastProbeError.Before(before) ||
+			!strings.HasPrefix(probe.ProbeError, "Port eth1 did not reach 127.0.0.1:") ||
+			!strings.Contains(probe.ProbeError, " from 198.51.100.2: ") {
+			t.Errorf("%s: eth1 unexpected %+v", probeURL, probe)
+		}
+		if probe := status.Ports[2].Probe; probe.ProbeError != "Port eth2 has no address to probe from" {
+			t.Errorf("%s: eth2 unexpected %+v", probeURL, probe)
+		}
+		if probe := status.Ports[3].Probe; !reflect.DeepEqual(probe, types.UplinkProbe{}) {
+			t.Errorf("%s: eth3 probed %+v", probeURL, probe)
+		}
+	}
+
+	if err := ProbeUplinks(context.Background(), &types.DeviceNetworkStatus{},
+		"ftp://"+listener.Addr().String()); err == nil {
+		t.Errorf("no error for an ftp URL")
+	}
+}
+
+func TestProbeUplinksTimeout(t *testing.T) {
+	// Never answers
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	defer func(timeout time.Duration) { probeTimeout = timeout }(probeTimeout)
+	probeTimeout = 200 * time.Millisecond
+
+	status := makeProbeStatus()
+	status.Ports[1].AddrInfoList[0].Addr = net.ParseIP("127.0.0.1")
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := ProbeUplinks(ctx, &status, server.URL)
+	// In parallel
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("took %v", elapsed)
+	}
+	if err == nil || !strings.Contains(status.Ports[1].Probe.ProbeError,
+		"context deadline exceeded") {
+		t.Errorf("unexpected %v %+v", err, status.Ports[1].Probe)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+const fallbackResolvConf = "/etc/resolv.conf"
+
+// The resolv.conf written by dhcpcd for each interface, %s being the
+// ifname
+var defaultResolvConfPatterns = []string{
+	"/run/dhcpcd/resolv.conf/%s.dhcp",
+	"/run/dhcpcd/resolv.conf/%s.ra",
+	"/run/dhcpcd/resolv.conf/%s.dhcp6",
+}
+
+// Replaced using SetResolvConfPaths
+var resolvConfPatterns = defaultResolvConfPatterns
+
+// Used for all the ports when none of their files exist
+var resolvConfFallback = fallbackResolvConf
+
+// SetResolvConfPaths sets the patterns of the per interface resolv.conf
+// files, %s being replaced by the ifname, and the resolv.conf used for
+// the ports without any. Empty values set the defaults.
+func SetResolvConfPaths(patterns []string, fallback string) {
+	if len(patterns) == 0 {
+		patterns = defaultResolvConfPatterns
+	}
+	if fallback == "" {
+		fallback = fallbackResolvConf
+	}
+	resolvConfPatterns = patterns
+	resolvConfFallback = fallback
+}
+
+// parseResolvConf returns the name servers and the search domains of a
+// resolv.conf file. A domain line is used as the search domain unless
+// there is a search line.
+func parseResolvConf(filename string) ([]net.IP, []string, error) {
+	var servers []net.IP
+	var search []string
+	var domain string
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			ip := net.ParseIP(fields[1])
+			if ip == nil {
+				log.Warnf("parseResolvConf(%s) bad nameserver %s\n",
+					filename, fields[1])
+				continue
+			}
+			servers = append(servers, ip)
+		case "domain":
+			domain = fields[1]
+		case "search":
+			search = fields[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if search == nil && domain != "" {
+		search = []string{domain}
+	}
+	return servers, search, nil
+}
+
+// getDNSInfo returns the name servers and search domains of an
+// interface from its resolv.conf files, or else from the fallback one
+func getDNSInfo(ifname string) ([]net.IP, []string) {
+	var servers []net.IP
+	var search []string
+	found := false
+	for _, pattern := range resolvConfPatterns {
+		filename := fmt.Sprintf(pattern, ifname)
+		s, d, err := parseResolvConf(filename)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warnf("getDNSInfo(%s) %s\n", ifname, err)
+			}
+			continue
+		}
+		found = true
+		servers = appendNewIPs(servers, s...)
+		search = appendNewStrings(search, d...)
+	}
+	if found {
+		return servers, search
+	}
+	servers, search, err := parseResolvConf(resolvConfFallback)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("getDNSInfo(%s) %s\n", ifname, err)
+	}
+	return servers, search
+}
+
+// setDNSInfo sets the search domains of a port, and its name servers
+// unless set from the config or dhcpcd
+func setDNSInfo(port *types.NetworkPortStatus) {
+	servers, search := getDNSInfo(port.IfName)
+	log.Infof("setDNSInfo(%s) servers %v search %v\n",
+		port.IfName, servers, search)
+	port.SearchDomains = search
+	if len(port.DnsServers) == 0 {
+		port.DnsServers = servers
+	}
+}
+
+func appendNewIPs(ips []net.IP, more ...net.IP) []net.IP {
+	for _, ip := range more {
+		found := false
+		for _, other := range ips {
+			if other.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+func appendNewStrings(strs []string, more ...string) []string {
+	for _, str := range more {
+		found := false
+		for _, other := range strs {
+			if other == str {
+				found = true
+				break
+			}
+		}
+		if !found {
+			strs = append(strs, str)
+		}
+	}
+	return strs
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+func parseIPs(addrs ...string) []net.IP {
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, net.ParseIP(addr))
+	}
+	return ips
+}
+
+func TestParseResolvConf(t *testing.T) {
+	for _, test := range []struct {
+		filename string
+		servers  []net.IP
+		search   []string
+	}{
+		{"testdata/resolv.conf/eth0.dhcp", parseIPs("192.168.0.1", "192.168.0.2"),
+			[]string{"example.com", "corp.example.com"}},
+		{"testdata/resolv.conf/eth1.dhcp", parseIPs("10.1.0.1"),
+			[]string{"branch.example.net"}},
+		{"testdata/resolv.conf.fallback", parseIPs("8.8.8.8"), nil},
+	} {
+		servers, search, err := parseResolvConf(test.filename)
+		if err != nil {
+			t.Errorf("%s: %v", test.filename, err)
+		}
+		if !reflect.DeepEqual(servers, test.servers) || !reflect.DeepEqual(search, test.search) {
+			t.Errorf("%s: expected %v %v, got %v %v", test.filename,
+				test.servers, test.search, servers, search)
+		}
+	}
+	if _, _, err := parseResolvConf("testdata/missing"); err == nil {
+		t.Errorf("no error for a missing file")
+	}
+}
+
+func TestGetDNSInfo(t *testing.T) {
+	patterns := []string{"testdata/resolv.conf/%s.dhcp", "testdata/resolv.conf/%s.ra"}
+	SetResolvConfPaths(patterns, "testdata/resolv.conf.fallback")
+	defer SetResolvConfPaths(nil, "")
+
+	for _, test := range []struct {
+		ifname  string
+		servers []net.IP
+		search  []string
+	}{
+		// Merged from both files
+		{"eth0", parseIPs("192.168.0.1", "192.168.0.2", "2001:db8::53"),
+			[]string{"example.com", "corp.example.com", "v6.example.com"}},
+		{"eth1", parseIPs("10.1.0.1"), []string{"branch.example.net"}},
+		// From the fallback
+		{"eth2", parseIPs("8.8.8.8"), nil},
+	} {
+		servers, search := getDNSInfo(test.ifname)
+		if !reflect.DeepEqual(servers, test.servers) || !reflect.DeepEqual(search, test.search) {
+			t.Errorf("%s: expected %v %v, got %v %v", test.ifname,
+				test.servers, test.search, servers, search)
+		}
+	}
+
+	SetResolvConfPaths(patterns, "testdata/missing")
+	if servers, search := getDNSInfo("eth2"); servers != nil || search != nil {
+		t.Errorf("unexpected %v %v without any file", servers, search)
+	}
+}
+
+func TestSetDNSInfo(t *testing.T) {
+	SetResolvConfPaths([]string{"testdata/resolv.conf/%s.dhcp"}, "testdata/missing")
+	defer SetResolvConfPaths(nil, "")
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	fake.setLink("eth1", 101, true, "10.1.0.10")
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", DhcpConfig: types.DhcpConfig{Dhcp: types.DT_STATIC}},
+			// The configured servers are kept
+			{IfName: "eth1", DhcpConfig: types.DhcpConfig{Dhcp: types.DT_STATIC,
+				DnsServers: parseIPs("10.1.0.53")}},
+		},
+	}
+	status, _ := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	for i, expected := range []struct {
+		servers []net.IP
+		search  []string
+	}{
+		{parseIPs("192.168.0.1", "192.168.0.2"), []string{"example.com", "corp.example.com"}},
+		{parseIPs("10.1.0.53"), []string{"branch.example.net"}},
+	} {
+		port := status.Ports[i]
+		if fmt.Sprint(port.DnsServers) != fmt.Sprint(expected.servers) ||
+			!reflect.DeepEqual(port.SearchDomains, expected.search) {
+			t.Errorf("%s: expected %v %v, got %v %v", port.IfName, expected.servers,
+				expected.search, port.DnsServers, port.SearchDomains)
+		}
+	}
+}
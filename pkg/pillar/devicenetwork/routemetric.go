@@ -0,0 +1,206 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Set the metrics of the default routes of the uplinks in their order
+
+package devicenetwork
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// The metric of the default routes of the preferred uplink, those of the
+// next ones being one more each. Below the 200 + ifindex of dhcpcd.
+var routeMetricBase = 100
+
+// routeMove is the change of the metric of the default route of a port
+type routeMove struct {
+	port    *types.NetworkPortStatus
+	link    netlink.Link
+	gateway *types.GatewayRoute // With the current metric
+	metric  int
+}
+
+// ApplyRouteMetrics sets the metric of the default routes of the uplinks
+// of status in the order of OrderedUplinks, so that the kernel prefers
+// the first one, and records it in their RouteMetric and DefaultGateway.
+// Only the route with the lowest metric of each uplink and family is
+// changed. Can be called again, e.g. after a DHCP renew put back the
+// metric of dhcpcd. The routes and the links which disappear meanwhile
+// are skipped. Returns the errors of the routes which could not be
+// changed.
+func ApplyRouteMetrics(status *types.DeviceNetworkStatus) error {
+	var errStrs []string
+
+	log.Infof("ApplyRouteMetrics()\n")
+	uplinks := types.OrderedUplinks(*status)
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		var moves []*routeMove
+		for i, uplink := range uplinks {
+			port := lookupPort(status, uplink.IfName)
+			port.RouteMetric = routeMetricBase + i
+			link, err := netlinkHandle.LinkByName(port.IfName)
+			if err != nil {
+				log.Infof("ApplyRouteMetrics(%s) gone\n", port.IfName)
+				continue
+			}
+			gateway := getDefaultGateway(link, family)
+			setGateway(port, family, gateway)
+			if gateway != nil && gateway.Metric != port.RouteMetric {
+				moves = append(moves, &routeMove{port: port, link: link,
+					gateway: gateway, metric: port.RouteMetric})
+			}
+		}
+		errStrs = append(errStrs, applyRouteMoves(family, moves)...)
+	}
+	if len(errStrs) != 0 {
+		return errors.New(strings.Join(errStrs, "; "))
+	}
+	return nil
+}
+
+// applyRouteMoves changes the metrics of the routes. Since the kernel
+// replaces the default route with the same metric whatever its link, a
+// route waits for that of another port to leave its new metric, and one
+// of those waiting on each other is parked at an unused metric. Those of
+// the routes of the other ports are left alone.
+func applyRouteMoves(family int, moves []*routeMove) []string {
+	var errStrs []string
+	for len(moves) != 0 {
+		used, err := defaultRouteMetrics(family)
+		if err != nil {
+			return append(errStrs, fmt.Sprintf("Route metrics not set: %s", err))
+		}
+		var waiting []*routeMove
+		for _, move := range moves {
+			if ifindex, ok := used[move.metric]; ok {
+				if !isMoving(moves, ifindex, move.metric) {
+					errStrs = append(errStrs, fmt.Sprintf(
+						"Port %s route metric %d is used by another route",
+						move.port.IfName, move.metric))
+					continue
+				}
+				waiting = append(waiting, move)
+				continue
+			}
+			if err := moveRoute(move, family, move.metric); err != nil {
+				errStrs = append(errStrs, err.Error())
+				continue
+			}
+			used[move.metric] = move.link.Attrs().Index
+		}
+		if len(waiting) != 0 && len(waiting) == len(moves) {
+			parked := 0
+			for metric := range used {
+				if metric >= parked {
+					parked = metric + 1
+				}
+			}
+			if err := moveRoute(waiting[0], family, parked); err != nil {
+				errStrs = append(errStrs, err.Error())
+				waiting = waiting[1:]
+			}
+		}
+		moves = waiting
+	}
+	return errStrs
+}
+
+// defaultRouteMetrics returns the ifindex of the default routes of the
+// family in the default table by metric
+func defaultRouteMetrics(family int) (map[int]int, error) {
+	filter := netlink.Route{Table: types.GetDefaultRouteTable(), Dst: nil}
+	routes, err := netlinkHandle.RouteListFiltered(family, &filter,
+		netlink.RT_FILTER_TABLE|netlink.RT_FILTER_DST)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[int]int)
+	for _, rt := range routes {
+		used[rt.Priority] = rt.LinkIndex
+	}
+	return used, nil
+}
+
+// isMoving returns true if the route of the link with the metric is one
+// of the moves
+func isMoving(moves []*routeMove, ifindex int, metric int) bool {
+	for _, move := range moves {
+		if move.link.Attrs().Index == ifindex && move.gateway.Metric == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// moveRoute gives the metric to the route of the move, by adding it with
+// the metric and then deleting the old one. A route or a link which
+// disappeared is not an error.
+func moveRoute(move *routeMove, family int, metric int) error {
+	ifname := move.port.IfName
+	oldRoute := netlink.Route{
+		LinkIndex: move.link.Attrs().Index,
+		Table:     types.GetDefaultRouteTable(),
+		Gw:        move.gateway.Gateway,
+		Priority:  move.gateway.Metric,
+	}
+	newRoute := oldRoute
+	newRoute.Priority = metric
+	log.Infof("moveRoute(%s) gateway %s metric %d to %d\n", ifname,
+		move.gateway.Gateway, move.gateway.Metric, metric)
+	if err := netlinkHandle.RouteReplace(&newRoute); err != nil {
+		if err == syscall.ENODEV {
+			log.Infof("moveRoute(%s) gone\n", ifname)
+			setGateway(move.port, family, nil)
+			return nil
+		}
+		return fmt.Errorf("Port %s route metric not set: %s", ifname, err)
+	}
+	err := netlinkHandle.RouteDel(&oldRoute)
+	if err == syscall.ESRCH {
+		// Withdrawn meanwhile, e.g. by dhcpcd, and so is ours
+		log.Infof("moveRoute(%s) gateway %s gone\n", ifname,
+			move.gateway.Gateway)
+		if err := netlinkHandle.RouteDel(&newRoute); err != nil &&
+			err != syscall.ESRCH && err != syscall.ENODEV {
+			log.Warnf("moveRoute(%s) gateway %s: %s\n", ifname,
+				move.gateway.Gateway, err)
+		}
+		setGateway(move.port, family, nil)
+		return nil
+	}
+	move.gateway = &types.GatewayRoute{Gateway: move.gateway.Gateway,
+		Metric: metric}
+	setGateway(move.port, family, move.gateway)
+	if err != nil && err != syscall.ENODEV {
+		return fmt.Errorf("Port %s route metric %d not replaced: %s",
+			ifname, oldRoute.Priority, err)
+	}
+	return nil
+}
+
+func setGateway(port *types.NetworkPortStatus, family int,
+	gateway *types.GatewayRoute) {
+
+	if family == netlink.FAMILY_V4 {
+		port.DefaultGateway = gateway
+	} else {
+		port.DefaultGatewayV6 = gateway
+	}
+}
+
+func lookupPort(status *types.DeviceNetworkStatus, ifname string) *types.NetworkPortStatus {
+	for i := range status.Ports {
+		if status.Ports[i].IfName == ifname {
+			return &status.Ports[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+// routeHookNetlink counts the route replacements, fails those the kernel
+// would make over the default route of another link, and calls
+// beforeReplace first
+type routeHookNetlink struct {
+	*fakeNetlink
+	t             *testing.T
+	replaced      int
+	beforeReplace func()
+}
+
+func (r *routeHookNetlink) RouteReplace(route *netlink.Route) error {
+	r.replaced++
+	if r.beforeReplace != nil {
+		r.beforeReplace()
+	}
+	for _, rt := range r.routes {
+		if rt.LinkIndex != route.LinkIndex && rt.Priority == route.Priority &&
+			(rt.Gw.To4() != nil) == (route.Gw.To4() != nil) {
+			r.t.Errorf("route %+v replaces %+v", route, rt)
+		}
+	}
+	return r.fakeNetlink.RouteReplace(route)
+}
+
+// routeMetrics returns the metrics of the routes as ifindex/gateway/metric
+func routeMetrics(fake *fakeNetlink) []string {
+	var metrics []string
+	for _, rt := range fake.routes {
+		metrics = append(metrics, fmt.Sprintf("%d/%s/%d", rt.LinkIndex, rt.Gw,
+			rt.Priority))
+	}
+	sort.Strings(metrics)
+	return metrics
+}
+
+func TestApplyRouteMetrics(t *testing.T) {
+	fake := newFakeNetlink()
+	hook := &routeHookNetlink{fakeNetlink: fake, t: t}
+	netlinkHandle = hook
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 1, true, "192.168.0.10")
+	fake.setLink("wwan0", 2, true, "10.0.0.10")
+	fake.setLink("eth1", 3, true, "192.168.2.10")
+	table := types.GetDefaultRouteTable()
+	fake.routes = []netlink.Route{
+		{LinkIndex: 1, Table: table, Gw: net.ParseIP("192.168.0.1"), Priority: 202},
+		{LinkIndex: 1, Table: table, Gw: net.ParseIP("fe80::1"), Priority: 202},
+		{LinkIndex: 2, Table: table, Gw: net.ParseIP("10.0.0.1"), Priority: 203},
+		// Not an uplink
+		{LinkIndex: 3, Table: table, Gw: net.ParseIP("192.168.2.1"), Priority: 50},
+	}
+	status := types.DeviceNetworkStatus{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortStatus{
+			{IfName: "wwan0", IsMgmt: true, Cost: 100},
+			{IfName: "eth0", IsMgmt: true, Free: true, Priority: 1},
+			{IfName: "eth1"},
+		},
+	}
+	if err := ApplyRouteMetrics(&status); err != nil {
+		t.Fatalf("ApplyRouteMetrics failed: %v", err)
+	}
+	expected := []string{"1/192.168.0.1/100", "1/fe80::1/100", "2/10.0.0.1/101",
+		"3/192.168.2.1/50"}
+	if metrics := routeMetrics(fake); !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("expected routes %v, got %v", expected, metrics)
+	}
+	eth0, wwan0 := status.Ports[1], status.Ports[0]
+	if eth0.RouteMetric != 100 || eth0.DefaultGateway == nil ||
+		eth0.DefaultGateway.Metric != 100 || eth0.DefaultGatewayV6 == nil ||
+		eth0.DefaultGatewayV6.Metric != 100 || wwan0.RouteMetric != 101 ||
+		wwan0.DefaultGateway == nil || wwan0.DefaultGateway.Metric != 101 ||
+		status.Ports[2].RouteMetric != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// Nothing to do once set
+	hook.replaced = 0
+	if err := ApplyRouteMetrics(&status); err != nil {
+		t.Fatalf("ApplyRouteMetrics failed: %v", err)
+	}
+	if metrics := routeMetrics(fake); hook.replaced != 0 ||
+		!reflect.DeepEqual(metrics, expected) {
+		t.Errorf("%d replaced, expected routes %v, got %v", hook.replaced,
+			expected, metrics)
+	}
+
+	// Swapped, through an unused metric
+	status.Ports[0].Priority = 1
+	status.Ports[1].Priority = 2
+	if err := ApplyRouteMetrics(&status); err != nil {
+		t.Fatalf("ApplyRouteMetrics failed: %v", err)
+	}
+	expected = []string{"1/192.168.0.1/101", "1/fe80::1/101", "2/10.0.0.1/100",
+		"3/192.168.2.1/50"}
+	if metrics := routeMetrics(fake); !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("expected routes %v, got %v", expected, metrics)
+	}
+	if status.Ports[0].RouteMetric != 100 || status.Ports[0].DefaultGateway.Metric != 100 ||
+		status.Ports[1].RouteMetric != 101 || status.Ports[1].DefaultGateway.Metric != 101 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// The metric of another route is left alone
+	setMetric := func(ifindex int, metric int) {
+		for i := range fake.routes {
+			if fake.routes[i].LinkIndex == ifindex {
+				fake.routes[i].Priority = metric
+			}
+		}
+	}
+	setMetric(3, 100)
+	setMetric(2, 300)
+	err := ApplyRouteMetrics(&status)
+	if err == nil || err.Error() != "Port wwan0 route metric 100 is used by another route" {
+		t.Errorf("unexpected error %v", err)
+	}
+	expected = []string{"1/192.168.0.1/101", "1/fe80::1/101", "2/10.0.0.1/300",
+		"3/192.168.2.1/100"}
+	if metrics := routeMetrics(fake); !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("expected routes %v, got %v", expected, metrics)
+	}
+
+	// A route withdrawn meanwhile is not put back, nor a link gone
+	setMetric(3, 50)
+	hook.beforeReplace = func() {
+		hook.beforeReplace = nil
+		fake.RouteDel(&netlink.Route{LinkIndex: 2, Gw: net.ParseIP("10.0.0.1")})
+	}
+	delete(fake.links, "eth0")
+	if err := ApplyRouteMetrics(&status); err != nil {
+		t.Fatalf("ApplyRouteMetrics failed: %v", err)
+	}
+	expected = []string{"1/192.168.0.1/101", "1/fe80::1/101", "3/192.168.2.1/50"}
+	if metrics := routeMetrics(fake); !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("expected routes %v, got %v", expected, metrics)
+	}
+	if status.Ports[0].DefaultGateway != nil || status.Ports[0].RouteMetric != 100 {
+		t.Errorf("unexpected status %+v", status.Ports[0])
+	}
+}
+
+func TestAddressChangeRouteMetrics(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 1, true, "192.168.0.10")
+	fake.setLink("eth1", 2, true, "192.168.1.10")
+	table := types.GetDefaultRouteTable()
+	// As dhcpcd sets them
+	fake.routes = []netlink.Route{
+		{LinkIndex: 1, Table: table, Gw: net.ParseIP("192.168.0.1"), Priority: 202},
+		{LinkIndex: 2, Table: table, Gw: net.ParseIP("192.168.1.1"), Priority: 201},
+	}
+	static := types.DhcpConfig{Dhcp: types.DT_STATIC}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", IsMgmt: true, Free: true, DhcpConfig: static},
+			{IfName: "eth1", IsMgmt: true, Free: true, DhcpConfig: static},
+		},
+	}
+	ctx := DeviceNetworkContext{DevicePortConfig: &config,
+		DeviceNetworkStatus: &types.DeviceNetworkStatus{}}
+	HandleAddressChange(&ctx)
+	expected := []string{"1/192.168.0.1/100", "2/192.168.1.1/101"}
+	if metrics := routeMetrics(fake); !ctx.Changed || !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("expected routes %v, got %v", expected, metrics)
+	}
+	if port := ctx.DeviceNetworkStatus.Ports[0]; port.RouteMetric != 100 ||
+		port.DefaultGateway == nil || port.DefaultGateway.Metric != 100 {
+		t.Errorf("unexpected status %+v", port)
+	}
+
+	// Put back after a DHCP renew, without a change of the status
+	ctx.Changed = false
+	fake.routes[0].Priority = 202
+	HandleAddressChange(&ctx)
+	if metrics := routeMetrics(fake); ctx.Changed || !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("changed %v, expected routes %v, got %v", ctx.Changed,
+			expected, metrics)
+	}
+}
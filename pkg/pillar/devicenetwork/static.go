@@ -0,0 +1,239 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Set the static addresses of the DeviceNetworkConfig
+
+package devicenetwork
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// The static addresses and routes set, to remove those no longer in the
+// config even after a restart. Under /run since the kernel forgets them
+// when rebooting.
+var staticStateFilename = "/run/nim/static.json"
+
+// The content of staticStateFilename
+var staticApplied struct {
+	sync.Mutex
+	loaded  bool
+	statics []types.StaticConfig
+}
+
+// ApplyStaticConfig sets the addresses of the Statics of config and their
+// default routes, and removes those it set before which are no longer
+// there. Can be called again with the same config. Returns the errors of
+// those which could not be set or removed.
+func ApplyStaticConfig(config types.DeviceNetworkConfig) error {
+	var errStrs []string
+
+	log.Infof("ApplyStaticConfig()\n")
+	staticApplied.Lock()
+	defer staticApplied.Unlock()
+	if !staticApplied.loaded {
+		statics, err := readStaticState()
+		if err != nil {
+			log.Errorf("ApplyStaticConfig: %s\n", err)
+		}
+		staticApplied.statics = statics
+		staticApplied.loaded = true
+	}
+	var applied []types.StaticConfig
+	for _, old := range staticApplied.statics {
+		if static := lookupStatic(config, old.IfName, old.AddrSubnet); static != nil &&
+			static.Gateway.Equal(old.Gateway) {
+			continue
+		}
+		if err := deleteStatic(old); err != nil {
+			errStrs = append(errStrs, err.Error())
+			// Retried the next time
+			applied = append(applied, old)
+		}
+	}
+	for _, static := range config.Statics {
+		if addrSet, err := addStatic(static); err != nil {
+			errStrs = append(errStrs, err.Error())
+			// Removed later if left behind, e.g. without its route
+			if !addrSet && !wasStaticApplied(static) {
+				continue
+			}
+		}
+		applied = append(applied, static)
+	}
+	staticApplied.statics = applied
+	if err := writeStaticState(applied); err != nil {
+		errStrs = append(errStrs, err.Error())
+	}
+	if len(errStrs) != 0 {
+		return errors.New(strings.Join(errStrs, "; "))
+	}
+	return nil
+}
+
+// wasStaticApplied returns true if the previous call set static. The
+// caller holds staticApplied.
+func wasStaticApplied(static types.StaticConfig) bool {
+	for _, old := range staticApplied.statics {
+		if old.IfName == static.IfName && old.AddrSubnet == static.AddrSubnet &&
+			old.Gateway.Equal(static.Gateway) {
+			return true
+		}
+	}
+	return false
+}
+
+func lookupStatic(config types.DeviceNetworkConfig, ifname string,
+	addrSubnet string) *types.StaticConfig {
+
+	for _, static := range config.Statics {
+		if static.IfName == ifname && static.AddrSubnet == addrSubnet {
+			return &static
+		}
+	}
+	return nil
+}
+
+// isStaticAddr returns true if ApplyStaticConfig set the address of ifname
+func isStaticAddr(ifname string, ip net.IP) bool {
+	staticApplied.Lock()
+	defer staticApplied.Unlock()
+	for _, static := range staticApplied.statics {
+		if static.IfName != ifname {
+			continue
+		}
+		if addr, _, err := net.ParseCIDR(static.AddrSubnet); err == nil &&
+			addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// staticAddr returns the address of static with its prefix length
+func staticAddr(static types.StaticConfig) (*netlink.Addr, error) {
+	ip, subnet, err := net.ParseCIDR(static.AddrSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("Static %s has a bad AddrSubnet %q",
+			static.IfName, static.AddrSubnet)
+	}
+	return &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: subnet.Mask}}, nil
+}
+
+func staticRoute(link netlink.Link, static types.StaticConfig) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Table:     types.GetDefaultRouteTable(),
+		Gw:        static.Gateway,
+	}
+}
+
+// addStatic sets the address and the default route unless already set.
+// Also returns true if the address was set, even if the route was not.
+func addStatic(static types.StaticConfig) (bool, error) {
+	addr, err := staticAddr(static)
+	if err != nil {
+		return false, err
+	}
+	link, err := netlinkHandle.LinkByName(static.IfName)
+	if err != nil {
+		return false, fmt.Errorf("Static %s does not exist", static.IfName)
+	}
+	log.Infof("addStatic(%s) %s gateway %v\n", static.IfName,
+		static.AddrSubnet, static.Gateway)
+	if err := netlinkHandle.AddrReplace(link, addr); err != nil {
+		return false, fmt.Errorf("Static %s address %s not set: %s",
+			static.IfName, static.AddrSubnet, err)
+	}
+	if static.Gateway == nil {
+		return true, nil
+	}
+	if err := netlinkHandle.RouteReplace(staticRoute(link, static)); err != nil {
+		return true, fmt.Errorf("Static %s gateway %s not set: %s",
+			static.IfName, static.Gateway, err)
+	}
+	return true, nil
+}
+
+// deleteStatic removes the address and the default route, which are gone
+// with the link if it no longer exists
+func deleteStatic(static types.StaticConfig) error {
+	link, err := netlinkHandle.LinkByName(static.IfName)
+	if err != nil {
+		log.Infof("deleteStatic(%s) already gone\n", static.IfName)
+		return nil
+	}
+	log.Infof("deleteStatic(%s) %s gateway %v\n", static.IfName,
+		static.AddrSubnet, static.Gateway)
+	if static.Gateway != nil {
+		if err := netlinkHandle.RouteDel(staticRoute(link, static)); err != nil {
+			log.Warnf("deleteStatic(%s) gateway %s: %s\n", static.IfName,
+				static.Gateway, err)
+		}
+	}
+	addr, err := staticAddr(static)
+	if err != nil {
+		return err
+	}
+	family := netlink.FAMILY_V4
+	if addr.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	addrs, err := netlinkHandle.AddrList(link, family)
+	if err != nil {
+		return fmt.Errorf("Static %s address %s not removed: %s",
+			static.IfName, static.AddrSubnet, err)
+	}
+	for _, other := range addrs {
+		if !other.IP.Equal(addr.IP) {
+			continue
+		}
+		if err := netlinkHandle.AddrDel(link, addr); err != nil {
+			return fmt.Errorf("Static %s address %s not removed: %s",
+				static.IfName, static.AddrSubnet, err)
+		}
+		return nil
+	}
+	log.Infof("deleteStatic(%s) %s already gone\n", static.IfName,
+		static.AddrSubnet)
+	return nil
+}
+
+func readStaticState() ([]types.StaticConfig, error) {
+	var statics []types.StaticConfig
+
+	b, err := ioutil.ReadFile(staticStateFilename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &statics); err != nil {
+		return nil, fmt.Errorf("%s: %s", staticStateFilename, err)
+	}
+	return statics, nil
+}
+
+func writeStaticState(statics []types.StaticConfig) error {
+	b, err := json.Marshal(statics)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(staticStateFilename), 0755); err != nil {
+		return err
+	}
+	return writeSync(staticStateFilename, b, 0644)
+}
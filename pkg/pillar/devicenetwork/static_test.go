@@ -0,0 +1,137 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+func TestApplyStaticConfig(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	staticStateFilename = filepath.Join(dir, "nim", "static.json")
+	defer func() {
+		staticStateFilename = "/run/nim/static.json"
+		staticApplied.loaded = false
+		staticApplied.statics = nil
+	}()
+	fake.setLink("eth0", 1, true, "fe80::1")
+	fake.setLink("eth1", 2, true)
+	addrs := func(ifname string) []string {
+		var strs []string
+		for _, addr := range fake.addrs[ifname] {
+			strs = append(strs, addr.IP.String())
+		}
+		return strs
+	}
+	config := types.DeviceNetworkConfig{
+		Uplink: []string{"eth0", "eth1"},
+		Statics: []types.StaticConfig{
+			{IfName: "eth0", AddrSubnet: "192.168.1.10/24",
+				Gateway: net.ParseIP("192.168.1.1"), DnsServers: []net.IP{net.ParseIP("8.8.8.8")}},
+			{IfName: "eth1", AddrSubnet: "2001:db8::10/64"},
+		},
+	}
+
+	// Set, and again does nothing
+	for i := 0; i < 2; i++ {
+		if err := ApplyStaticConfig(config); err != nil {
+			t.Fatalf("ApplyStaticConfig failed: %v", err)
+		}
+		if !reflect.DeepEqual(addrs("eth0"), []string{"fe80::1", "192.168.1.10"}) ||
+			!reflect.DeepEqual(addrs("eth1"), []string{"2001:db8::10"}) {
+			t.Fatalf("unexpected addresses %v %v", addrs("eth0"), addrs("eth1"))
+		}
+		if ones, _ := fake.addrs["eth0"][1].Mask.Size(); ones != 24 ||
+			len(fake.routes) != 1 || fake.routes[0].LinkIndex != 1 ||
+			!fake.routes[0].Gw.Equal(net.ParseIP("192.168.1.1")) {
+			t.Fatalf("unexpected routes %+v", fake.routes)
+		}
+	}
+
+	// Reported as static, without DHCP
+	portConfig := MakeDevicePortConfig(config)
+	if port := portConfig.Ports[0]; port.Dhcp != types.DT_NONE ||
+		!port.Gateway.Equal(net.ParseIP("192.168.1.1")) || len(port.DnsServers) != 1 {
+		t.Errorf("unexpected port config %+v", port)
+	}
+	status, _ := MakeDeviceNetworkStatus(portConfig, types.DeviceNetworkStatus{})
+	port := status.Ports[0]
+	if len(port.AddrInfoList) != 2 || port.AddrInfoList[0].Origin != "static" ||
+		port.AddrInfoList[1].Origin != types.AO_LINKLOCAL || port.DefaultGateway == nil ||
+		!reflect.DeepEqual(port.DnsServers, []net.IP{net.ParseIP("8.8.8.8")}) {
+		t.Errorf("unexpected status %+v", port)
+	}
+
+	// A changed address replaces the old one, a removed one is removed
+	config.Statics = []types.StaticConfig{
+		{IfName: "eth0", AddrSubnet: "192.168.1.11/24", Gateway: net.ParseIP("192.168.1.1")},
+		{IfName: "eth9", AddrSubnet: "10.0.0.1/24"},
+	}
+	err = ApplyStaticConfig(config)
+	if err == nil || err.Error() != "Static eth9 does not exist" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if !reflect.DeepEqual(addrs("eth0"), []string{"fe80::1", "192.168.1.11"}) ||
+		len(addrs("eth1")) != 0 || len(fake.routes) != 1 {
+		t.Errorf("unexpected addresses %v %v routes %+v", addrs("eth0"),
+			addrs("eth1"), fake.routes)
+	}
+
+	// Kept when it fails to be set again, or set without its route, so
+	// still removed once no longer in the config
+	delete(fake.links, "eth0")
+	if err := ApplyStaticConfig(config); err == nil {
+		t.Errorf("no error for a missing eth0")
+	}
+	fake.setLink("eth0", 1, true, "fe80::1")
+	fake.routeErr = syscall.ENETUNREACH
+	config.Statics = append(config.Statics, types.StaticConfig{IfName: "eth1",
+		AddrSubnet: "10.1.0.10/24", Gateway: net.ParseIP("10.1.0.1")})
+	if err := ApplyStaticConfig(config); err == nil {
+		t.Errorf("no error for the routes not set")
+	}
+	fake.routeErr = nil
+	if !isStaticAddr("eth0", net.ParseIP("192.168.1.11")) ||
+		!isStaticAddr("eth1", net.ParseIP("10.1.0.10")) {
+		t.Errorf("not static")
+	}
+	if err := ApplyStaticConfig(types.DeviceNetworkConfig{}); err != nil {
+		t.Fatalf("ApplyStaticConfig failed: %v", err)
+	}
+	if len(addrs("eth0")) != 1 || len(addrs("eth1")) != 0 {
+		t.Errorf("unexpected addresses %v %v", addrs("eth0"), addrs("eth1"))
+	}
+	config.Statics = config.Statics[:1]
+	if err := ApplyStaticConfig(config); err != nil {
+		t.Fatalf("ApplyStaticConfig failed: %v", err)
+	}
+
+	// Removed after a restart
+	staticApplied.loaded = false
+	staticApplied.statics = nil
+	if err := ApplyStaticConfig(types.DeviceNetworkConfig{}); err != nil {
+		t.Fatalf("ApplyStaticConfig failed: %v", err)
+	}
+	if !reflect.DeepEqual(addrs("eth0"), []string{"fe80::1"}) || len(fake.routes) != 0 {
+		t.Errorf("unexpected addresses %v routes %+v", addrs("eth0"), fake.routes)
+	}
+	if isStaticAddr("eth0", net.ParseIP("192.168.1.11")) {
+		t.Errorf("still static")
+	}
+}
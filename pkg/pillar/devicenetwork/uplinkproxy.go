@@ -0,0 +1,127 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Convert the proxies of the DeviceNetworkConfig uplinks
+
+package devicenetwork
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+// makeProxyConfig returns the ProxyConfig of the port for proxy, or why
+// it is not valid
+func makeProxyConfig(proxy types.UplinkProxyConfig) (types.ProxyConfig, error) {
+	var config types.ProxyConfig
+
+	if proxy.HTTPProxy == "" && proxy.HTTPSProxy == "" && proxy.PacURL == "" &&
+		!proxy.Wpad {
+		return config, fmt.Errorf("Proxy %s has no proxy", proxy.IfName)
+	}
+	for _, p := range []struct {
+		field     string
+		rawURL    string
+		proxyType types.NetworkProxyType
+	}{
+		{"HTTPProxy", proxy.HTTPProxy, types.NPT_HTTP},
+		{"HTTPSProxy", proxy.HTTPSProxy, types.NPT_HTTPS},
+	} {
+		if p.rawURL == "" {
+			continue
+		}
+		entry, err := makeProxyEntry(p.rawURL)
+		if err != nil {
+			return config, fmt.Errorf("Proxy %s has a bad %s %q: %s",
+				proxy.IfName, p.field, p.rawURL, err)
+		}
+		entry.Type = p.proxyType
+		config.Proxies = append(config.Proxies, entry)
+	}
+	for _, host := range proxy.NoProxy {
+		if err := checkNoProxy(host); err != nil {
+			return config, fmt.Errorf("Proxy %s has a bad NoProxy %q: %s",
+				proxy.IfName, host, err)
+		}
+	}
+	config.Exceptions = strings.Join(proxy.NoProxy, ",")
+	if proxy.PacURL != "" {
+		u, err := url.Parse(proxy.PacURL)
+		if err == nil && u.Scheme != "http" && u.Scheme != "https" {
+			err = fmt.Errorf("not an http or https URL")
+		}
+		if err != nil {
+			return config, fmt.Errorf("Proxy %s has a bad PacURL %q: %s",
+				proxy.IfName, proxy.PacURL, err)
+		}
+		// Fetched like a WPAD file
+		config.NetworkProxyEnable = true
+		config.NetworkProxyURL = proxy.PacURL
+	} else if proxy.Wpad {
+		config.NetworkProxyEnable = true
+	}
+	return config, nil
+}
+
+// makeProxyEntry splits the URL of a proxy into the Server and the Port
+// of a ProxyEntry. The scheme and the user are kept in the Server unless
+// plain http.
+func makeProxyEntry(rawURL string) (types.ProxyEntry, error) {
+	var entry types.ProxyEntry
+
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return entry, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return entry, fmt.Errorf("not an http or https proxy")
+	}
+	if u.Hostname() == "" {
+		return entry, fmt.Errorf("no host")
+	}
+	if u.Path != "" && u.Path != "/" {
+		return entry, fmt.Errorf("has a path")
+	}
+	if port := u.Port(); port != "" {
+		n, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || n == 0 {
+			return entry, fmt.Errorf("bad port %s", port)
+		}
+		entry.Port = uint32(n)
+	}
+	host := u.Hostname()
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if u.Scheme == "http" && u.User == nil {
+		entry.Server = host
+	} else {
+		entry.Server = (&url.URL{Scheme: u.Scheme, User: u.User,
+			Host: host}).String()
+	}
+	return entry, nil
+}
+
+// checkNoProxy returns why host cannot be matched: a domain with an
+// optional leading dot, an address or a CIDR, possibly with a port
+func checkNoProxy(host string) error {
+	if host == "*" {
+		return nil
+	}
+	if strings.ContainsAny(host, ", \t") || host == "" {
+		return fmt.Errorf("not a host")
+	}
+	if strings.Contains(host, "/") {
+		_, _, err := net.ParseCIDR(host)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	"github.com/lf-edge/eve/pkg/pillar/zedcloud"
+)
+
+func TestUplinkProxies(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	fake.setLink("wwan0", 101, true, "10.1.0.10")
+	fake.setLink("eth1", 102, true, "192.168.1.10")
+	config := MakeDevicePortConfig(types.DeviceNetworkConfig{
+		Uplink: []string{"eth0", "wwan*", "eth1"},
+		Proxies: []types.UplinkProxyConfig{
+			{IfName: "eth0", HTTPProxy: "http://proxy:3128",
+				HTTPSProxy: "https://user:pw@proxy:3129",
+				NoProxy:    []string{"example.com", "10.0.0.0/8"}},
+			{IfName: "wwan*", HTTPSProxy: "[2001:db8::1]:8080",
+				PacURL: "http://wpad/wpad.dat"},
+		}})
+	expected := types.ProxyConfig{
+		Proxies: []types.ProxyEntry{
+			{Type: types.NPT_HTTP, Server: "proxy", Port: 3128},
+			{Type: types.NPT_HTTPS, Server: "https://user:pw@proxy", Port: 3129},
+		},
+		Exceptions: "example.com,10.0.0.0/8",
+	}
+	if !reflect.DeepEqual(config.Ports[0].ProxyConfig, expected) {
+		t.Errorf("expected %+v, got %+v", expected, config.Ports[0].ProxyConfig)
+	}
+
+	status, err := MakeDeviceNetworkStatus(config, types.DeviceNetworkStatus{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if port := status.Ports[1]; port.IfName != "wwan0" ||
+		!port.NetworkProxyEnable || port.NetworkProxyURL != "http://wpad/wpad.dat" ||
+		len(port.Proxies) != 1 || port.Proxies[0].Server != "[2001:db8::1]" {
+		t.Errorf("unexpected wwan0 %+v", port)
+	}
+	for _, test := range []struct {
+		ifname   string
+		rawURL   string
+		expected string
+	}{
+		{"eth0", "http://zedcloud.zededa.net/api", "http://proxy:3128"},
+		{"eth0", "https://zedcloud.zededa.net/api", "https://user:pw@proxy:3129"},
+		{"eth0", "https://www.example.com/api", ""},
+		{"eth0", "https://10.1.2.3/api", ""},
+		{"wwan0", "https://zedcloud.zededa.net/api", "http://[2001:db8::1]:8080"},
+		{"eth1", "https://zedcloud.zededa.net/api", ""},
+	} {
+		proxy, err := zedcloud.LookupProxy(&status, test.ifname, test.rawURL)
+		found := ""
+		if proxy != nil {
+			found = proxy.String()
+		}
+		if err != nil || found != test.expected {
+			t.Errorf("%s %s: expected %q, got %q %v", test.ifname,
+				test.rawURL, test.expected, found, err)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Check a DeviceNetworkConfig for mistakes
+
+package devicenetwork
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+// The kernel limit of IFNAMSIZ includes the terminating NUL
+const maxIfNameLen = 15
+
+// ValidateDeviceNetworkConfig returns all the problems found in config:
+// no uplinks, invalid or duplicate names, FreeUplinks which are not
+// uplinks, bad VLANs, static addresses, WiFi networks, NTP servers, costs,
+// priorities and proxies, and if linkList is not nil uplinks which do not
+// exist. The VLAN links and the patterns need not exist.
+func ValidateDeviceNetworkConfig(config types.DeviceNetworkConfig,
+	linkList func() ([]netlink.Link, error)) []error {
+
+	var errs []error
+	if len(config.Uplink) == 0 {
+		errs = append(errs, fmt.Errorf("No uplinks"))
+	}
+	uplinks := make(map[string]bool)
+	for _, ifname := range config.Uplink {
+		if isPortHwID(ifname) {
+			if err := checkPortHwID(ifname); err != nil {
+				errs = append(errs, fmt.Errorf("Uplink %q %s", ifname, err))
+			} else if uplinks[ifname] {
+				errs = append(errs, fmt.Errorf("Uplink %s is listed twice", ifname))
+			}
+		} else if err := checkIfName(ifname); err != nil {
+			errs = append(errs, fmt.Errorf("Uplink %q %s", ifname, err))
+		} else if uplinks[ifname] {
+			errs = append(errs, fmt.Errorf("Uplink %s is listed twice", ifname))
+		}
+		uplinks[ifname] = true
+	}
+	free := make(map[string]bool)
+	for _, ifname := range config.FreeUplinks {
+		if free[ifname] {
+			errs = append(errs, fmt.Errorf("FreeUplink %s is listed twice", ifname))
+		} else if !isUplink(config, ifname) {
+			errs = append(errs, fmt.Errorf("FreeUplink %s is not an uplink", ifname))
+		}
+		free[ifname] = true
+	}
+	vlans := make(map[string]bool)
+	for _, vlan := range config.Vlans {
+		ifname := vlan.LinkName()
+		if err := checkIfName(ifname); err != nil || isPortPattern(ifname) {
+			if err == nil {
+				err = fmt.Errorf("is a pattern")
+			}
+			errs = append(errs, fmt.Errorf("VLAN %q %s", ifname, err))
+		} else if vlans[ifname] {
+			errs = append(errs, fmt.Errorf("VLAN %s is listed twice", ifname))
+		}
+		if vlan.VlanID < 1 || vlan.VlanID > 4094 {
+			errs = append(errs, fmt.Errorf("VLAN %s has a bad VLAN ID %d",
+				ifname, vlan.VlanID))
+		}
+		vlans[ifname] = true
+	}
+	for _, static := range config.Statics {
+		if !isUplink(config, static.IfName) || isPortPattern(static.IfName) {
+			errs = append(errs, fmt.Errorf("Static %s is not an uplink",
+				static.IfName))
+		} else if isPortHwID(static.IfName) {
+			errs = append(errs, fmt.Errorf("Static %s is not an interface name",
+				static.IfName))
+		}
+		addr, err := staticAddr(static)
+		if err != nil {
+			errs = append(errs, err)
+		} else if static.Gateway != nil &&
+			(static.Gateway.To4() == nil) != (addr.IP.To4() == nil) {
+			errs = append(errs, fmt.Errorf("Static %s gateway %s is not in the family of %s",
+				static.IfName, static.Gateway, static.AddrSubnet))
+		}
+	}
+	wirelesses := make(map[string]bool)
+	for _, wireless := range config.Wireless {
+		errs = append(errs, checkWireless(config, wireless)...)
+		if wirelesses[wireless.IfName] {
+			errs = append(errs, fmt.Errorf("Wireless %s is listed twice",
+				wireless.IfName))
+		}
+		wirelesses[wireless.IfName] = true
+	}
+	costs := make(map[string]bool)
+	for _, cost := range config.Costs {
+		if !isListedUplink(config, cost.IfName) {
+			errs = append(errs, fmt.Errorf("Cost %s is not an uplink",
+				cost.IfName))
+		} else if costs[cost.IfName] {
+			errs = append(errs, fmt.Errorf("Cost %s is listed twice",
+				cost.IfName))
+		} else if free[cost.IfName] && cost.Cost != 0 {
+			errs = append(errs, fmt.Errorf("FreeUplink %s has Cost %d",
+				cost.IfName, cost.Cost))
+		}
+		costs[cost.IfName] = true
+	}
+	for _, server := range config.NtpServers {
+		if err := checkNtpServer(server); err != nil {
+			errs = append(errs, fmt.Errorf("NtpServers has a bad server %q: %s",
+				server, err))
+		}
+	}
+	ntps := make(map[string]bool)
+	for _, ntp := range config.Ntp {
+		if !isListedUplink(config, ntp.IfName) {
+			errs = append(errs, fmt.Errorf("Ntp %s is not an uplink",
+				ntp.IfName))
+		} else if ntps[ntp.IfName] {
+			errs = append(errs, fmt.Errorf("Ntp %s is listed twice",
+				ntp.IfName))
+		}
+		ntps[ntp.IfName] = true
+		for _, server := range ntp.NtpServers {
+			if err := checkNtpServer(server); err != nil {
+				errs = append(errs, fmt.Errorf("Ntp %s has a bad server %q: %s",
+					ntp.IfName, server, err))
+			}
+		}
+	}
+	priorities := make(map[string]bool)
+	for _, ifname := range config.Priority {
+		if !isListedUplink(config, ifname) {
+			errs = append(errs, fmt.Errorf("Priority %s is not an uplink",
+				ifname))
+		} else if priorities[ifname] {
+			errs = append(errs, fmt.Errorf("Priority %s is listed twice",
+				ifname))
+		}
+		priorities[ifname] = true
+	}
+	proxies := make(map[string]bool)
+	for _, proxy := range config.Proxies {
+		if !isListedUplink(config, proxy.IfName) {
+			errs = append(errs, fmt.Errorf("Proxy %s is not an uplink",
+				proxy.IfName))
+		} else if proxies[proxy.IfName] {
+			errs = append(errs, fmt.Errorf("Proxy %s is listed twice",
+				proxy.IfName))
+		}
+		proxies[proxy.IfName] = true
+		if _, err := makeProxyConfig(proxy); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if linkList == nil {
+		return errs
+	}
+	links, err := linkList()
+	if err != nil {
+		return append(errs, fmt.Errorf("Links not listed: %s", err))
+	}
+	exist := make(map[string]bool)
+	for _, link := range links {
+		exist[link.Attrs().Name] = true
+	}
+	for _, vlan := range config.Vlans {
+		if !exist[vlan.Parent] && !vlans[vlan.Parent] {
+			errs = append(errs, fmt.Errorf("VLAN %s parent %s does not exist",
+				vlan.LinkName(), vlan.Parent))
+		}
+	}
+	for _, ifname := range config.Uplink {
+		// Those of the hardware identifiers are checked when resolved
+		if !exist[ifname] && !vlans[ifname] && !isPortPattern(ifname) &&
+			!isPortHwID(ifname) && checkIfName(ifname) == nil {
+			errs = append(errs, fmt.Errorf("Uplink %s does not exist", ifname))
+		}
+	}
+	return errs
+}
+
+// checkIfName returns why a name or pattern is not a valid ifname
+func checkIfName(ifname string) error {
+	name := strings.TrimPrefix(ifname, "!")
+	if name == "" {
+		return fmt.Errorf("is empty")
+	}
+	if len(name) > maxIfNameLen {
+		return fmt.Errorf("is longer than %d characters", maxIfNameLen)
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("is not a name")
+	}
+	for _, r := range name {
+		if r == '/' || r == ':' || unicode.IsSpace(r) ||
+			r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return fmt.Errorf("has the invalid character %q", r)
+		}
+	}
+	if _, err := path.Match(name, ""); err != nil {
+		return fmt.Errorf("is a bad pattern: %s", err)
+	}
+	return nil
+}
+
+// isListedUplink returns true if ifname is listed in Uplink, as a name or
+// a pattern but not an exclusion
+func isListedUplink(config types.DeviceNetworkConfig, ifname string) bool {
+	for _, uplink := range config.Uplink {
+		if uplink == ifname && !strings.HasPrefix(uplink, "!") {
+			return true
+		}
+	}
+	return false
+}
+
+// isUplink returns true if ifname is an uplink or matches an uplink
+// pattern
+func isUplink(config types.DeviceNetworkConfig, ifname string) bool {
+	for _, uplink := range config.Uplink {
+		if uplink == ifname ||
+			(isPortPattern(uplink) && !strings.HasPrefix(uplink, "!") &&
+				portMatch(uplink, ifname)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWireless returns the problems of the WiFi network of an uplink
+func checkWireless(config types.DeviceNetworkConfig,
+	wireless types.WirelessConfig) []error {
+
+	var errs []error
+	ifname := wireless.IfName
+	if !isUplink(config, ifname) || isPortPattern(ifname) {
+		errs = append(errs, fmt.Errorf("Wireless %s is not an uplink", ifname))
+	} else if isPortHwID(ifname) {
+		errs = append(errs, fmt.Errorf("Wireless %s is not an interface name", ifname))
+	}
+	if wireless.SSID == "" || len(wireless.SSID) > 32 {
+		errs = append(errs, fmt.Errorf("Wireless %s has a bad SSID %q: not 1 to 32 bytes",
+			ifname, wireless.SSID))
+	}
+	switch wireless.KeyMgmt {
+	case "", "WPA-PSK", "SAE":
+		if wireless.PskFile == "" {
+			errs = append(errs, fmt.Errorf("Wireless %s has no PskFile", ifname))
+		}
+	case "NONE":
+		if wireless.PskFile != "" {
+			errs = append(errs, fmt.Errorf("Wireless %s has a PskFile without a key",
+				ifname))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("Wireless %s has a bad KeyMgmt %q",
+			ifname, wireless.KeyMgmt))
+	}
+	if code := wireless.CountryCode; code != "" && (len(code) != 2 ||
+		code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z') {
+		errs = append(errs, fmt.Errorf("Wireless %s has a bad CountryCode %q",
+			ifname, code))
+	}
+	return errs
+}
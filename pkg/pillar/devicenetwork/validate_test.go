@@ -0,0 +1,147 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+func TestValidateDeviceNetworkConfig(t *testing.T) {
+	fake := newFakeNetlink()
+	fake.setLink("eth0", 1, true)
+	fake.setLink("eth1", 2, true)
+
+	for _, test := range []struct {
+		name     string
+		config   types.DeviceNetworkConfig
+		linkList func() ([]netlink.Link, error)
+		expected []string
+	}{
+		{"valid", types.DeviceNetworkConfig{Uplink: []string{"eth0", "eth1"},
+			FreeUplinks: []string{"eth1"}}, fake.LinkList, nil},
+		{"no uplinks", types.DeviceNetworkConfig{}, nil, []string{"No uplinks"}},
+		{"duplicates", types.DeviceNetworkConfig{Uplink: []string{"eth0", "eth0"},
+			FreeUplinks: []string{"eth0", "eth0"}}, nil,
+			[]string{"Uplink eth0 is listed twice", "FreeUplink eth0 is listed twice"}},
+		{"free not uplink", types.DeviceNetworkConfig{Uplink: []string{"eth0", "wlan*"},
+			FreeUplinks: []string{"eth1", "wlan0"}}, nil,
+			[]string{"FreeUplink eth1 is not an uplink"}},
+		{"invalid names", types.DeviceNetworkConfig{Uplink: []string{"", "eth 0",
+			"averyveryverylongname", "eth0/1", "..", "eth[", "!"}}, nil,
+			[]string{`Uplink "" is empty`,
+				`Uplink "eth 0" has the invalid character ' '`,
+				`Uplink "averyveryverylongname" is longer than 15 characters`,
+				`Uplink "eth0/1" has the invalid character '/'`,
+				`Uplink ".." is not a name`,
+				`Uplink "eth[" is a bad pattern: syntax error in pattern`,
+				`Uplink "!" is empty`}},
+		{"vlans", types.DeviceNetworkConfig{Uplink: []string{"eth0.100"},
+			Vlans: []types.VlanConfig{{Parent: "eth0", VlanID: 100},
+				{Parent: "eth0", VlanID: 100}, {Parent: "eth9", VlanID: 0},
+				{Parent: "eth0", VlanID: 5, IfName: "vlan*"}}}, fake.LinkList,
+			[]string{"VLAN eth0.100 is listed twice",
+				"VLAN eth9.0 has a bad VLAN ID 0",
+				`VLAN "vlan*" is a pattern`,
+				"VLAN eth9.0 parent eth9 does not exist"}},
+		{"statics", types.DeviceNetworkConfig{Uplink: []string{"eth0", "eth*"},
+			Statics: []types.StaticConfig{
+				{IfName: "eth0", AddrSubnet: "10.0.0.5/24", Gateway: net.ParseIP("10.0.0.1")},
+				{IfName: "eth1", AddrSubnet: "10.0.1.5"},
+				{IfName: "eth*", AddrSubnet: "10.0.2.5/24"},
+				{IfName: "wlan0", AddrSubnet: "2001:db8::5/64", Gateway: net.ParseIP("10.0.0.1")},
+			}}, nil,
+			[]string{`Static eth1 has a bad AddrSubnet "10.0.1.5"`,
+				"Static eth* is not an uplink",
+				"Static wlan0 is not an uplink",
+				"Static wlan0 gateway 10.0.0.1 is not in the family of 2001:db8::5/64"}},
+		{"costs", types.DeviceNetworkConfig{Uplink: []string{"eth0", "eth1", "wwan*"},
+			FreeUplinks: []string{"eth0", "eth1"},
+			Costs: []types.UplinkCost{{IfName: "eth0"}, {IfName: "eth1", Cost: 1},
+				{IfName: "wwan*", Cost: 100}, {IfName: "wwan0", Cost: 100},
+				{IfName: "wwan*", Cost: 200}}}, nil,
+			[]string{"FreeUplink eth1 has Cost 1",
+				"Cost wwan0 is not an uplink",
+				"Cost wwan* is listed twice"}},
+		{"hardware addresses", types.DeviceNetworkConfig{
+			Uplink: []string{"mac:00:16:3e:0a:0b:0c", "pci:0000:02:00.0", "mac:bad",
+				"pci:0000:02:00.0"},
+			Statics: []types.StaticConfig{{IfName: "pci:0000:02:00.0",
+				AddrSubnet: "192.168.1.10/24"}},
+			FreeUplinks: []string{"mac:00:16:3e:0a:0b:0c"}}, nil,
+			[]string{`Uplink "mac:bad" not a MAC address`,
+				"Uplink pci:0000:02:00.0 is listed twice",
+				"Static pci:0000:02:00.0 is not an interface name"}},
+		{"wireless", types.DeviceNetworkConfig{Uplink: []string{"eth0", "wlan*"},
+			Wireless: []types.WirelessConfig{
+				{IfName: "wlan0", SSID: "office", PskFile: "/config/office.psk", CountryCode: "US"},
+				{IfName: "wlan*", SSID: "guest", KeyMgmt: "NONE"},
+				{IfName: "wlan1", SSID: strings.Repeat("x", 33), KeyMgmt: "WEP",
+					CountryCode: "us"},
+				{IfName: "wlan2", SSID: "lab", KeyMgmt: "SAE"},
+				{IfName: "wlan3", SSID: "guest", KeyMgmt: "NONE", PskFile: "/config/guest.psk"},
+				{IfName: "wlan0", SSID: "office", PskFile: "/config/office.psk"},
+			}}, nil,
+			[]string{"Wireless wlan* is not an uplink",
+				`Wireless wlan1 has a bad SSID "` + strings.Repeat("x", 33) + `": not 1 to 32 bytes`,
+				`Wireless wlan1 has a bad KeyMgmt "WEP"`,
+				`Wireless wlan1 has a bad CountryCode "us"`,
+				"Wireless wlan2 has no PskFile",
+				"Wireless wlan3 has a PskFile without a key",
+				"Wireless wlan0 is listed twice"}},
+		{"ntp", types.DeviceNetworkConfig{Uplink: []string{"eth0", "eth1"},
+			NtpServers: []string{"pool.ntp.org", "ntp server"},
+			Ntp: []types.UplinkNtpConfig{
+				{IfName: "eth0", NtpServers: []string{"10.0.0.1"}},
+				{IfName: "eth2", NtpServers: []string{"10.0.0.1"}},
+				{IfName: "eth0", NtpServers: []string{"-ntp"}},
+			}}, nil,
+			[]string{`NtpServers has a bad server "ntp server": bad character ' '`,
+				"Ntp eth2 is not an uplink",
+				"Ntp eth0 is listed twice",
+				`Ntp eth0 has a bad server "-ntp": bad hostname label "-ntp"`}},
+		{"priorities", types.DeviceNetworkConfig{Uplink: []string{"eth0", "eth1", "wwan*"},
+			Priority: []string{"eth1", "wwan*", "wwan0", "eth1"}}, nil,
+			[]string{"Priority wwan0 is not an uplink",
+				"Priority eth1 is listed twice"}},
+		{"proxies", types.DeviceNetworkConfig{Uplink: []string{"eth0", "wwan*", "!docker*"},
+			Proxies: []types.UplinkProxyConfig{
+				{IfName: "eth0", HTTPProxy: "proxy:3128",
+					HTTPSProxy: "https://user:pw@[2001:db8::1]:3129",
+					NoProxy:    []string{".example.com", "10.0.0.0/8", "*"}},
+				{IfName: "wwan*", PacURL: "http://wpad/wpad.dat"},
+				{IfName: "eth0", HTTPProxy: "socks5://proxy:1080"},
+				{IfName: "wwan0", HTTPSProxy: "proxy:0"},
+				{IfName: "!docker*", PacURL: "file:///wpad.dat"},
+				{IfName: "wwan*", NoProxy: []string{"10.0.0.0/33"}},
+			}}, nil,
+			[]string{"Proxy eth0 is listed twice",
+				`Proxy eth0 has a bad HTTPProxy "socks5://proxy:1080": not an http or https proxy`,
+				"Proxy wwan0 is not an uplink",
+				`Proxy wwan0 has a bad HTTPSProxy "proxy:0": bad port 0`,
+				"Proxy !docker* is not an uplink",
+				`Proxy !docker* has a bad PacURL "file:///wpad.dat": not an http or https URL`,
+				"Proxy wwan* is listed twice",
+				"Proxy wwan* has no proxy"}},
+		{"missing", types.DeviceNetworkConfig{Uplink: []string{"eth0", "wwan0", "en*", "!docker*"}},
+			fake.LinkList, []string{"Uplink wwan0 does not exist"}},
+		{"not listed", types.DeviceNetworkConfig{Uplink: []string{"eth0"}},
+			func() ([]netlink.Link, error) { return nil, errors.New("no netlink") },
+			[]string{"Links not listed: no netlink"}},
+	} {
+		var errStrs []string
+		for _, err := range ValidateDeviceNetworkConfig(test.config, test.linkList) {
+			errStrs = append(errStrs, err.Error())
+		}
+		if !reflect.DeepEqual(errStrs, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, errStrs)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Create and delete the VLAN links of the DeviceNetworkConfig
+
+package devicenetwork
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// The VLAN links created, to delete those no longer in the config even
+// after a restart. Under /run since the kernel forgets them when
+// rebooting.
+var vlanStateFilename = "/run/nim/vlans.json"
+
+// The content of vlanStateFilename
+var vlanApplied struct {
+	sync.Mutex
+	loaded bool
+	vlans  []types.VlanConfig
+}
+
+// ApplyDeviceNetworkConfig creates the VLAN links of config which do not
+// exist yet, and deletes those it created before which are no longer
+// there. Can be called again with the same config. Returns the errors of
+// the VLANs which could not be set or deleted.
+func ApplyDeviceNetworkConfig(config types.DeviceNetworkConfig) error {
+	var errStrs []string
+
+	log.Infof("ApplyDeviceNetworkConfig()\n")
+	vlanApplied.Lock()
+	defer vlanApplied.Unlock()
+	if !vlanApplied.loaded {
+		vlans, err := readVlanState()
+		if err != nil {
+			log.Errorf("ApplyDeviceNetworkConfig: %s\n", err)
+		}
+		vlanApplied.vlans = vlans
+		vlanApplied.loaded = true
+	}
+	var applied []types.VlanConfig
+	for _, old := range vlanApplied.vlans {
+		if lookupVlan(config, old.LinkName()) != nil {
+			continue
+		}
+		if err := deleteVlan(old); err != nil {
+			errStrs = append(errStrs, err.Error())
+			// Retried the next time
+			applied = append(applied, old)
+		}
+	}
+	for _, vlan := range config.Vlans {
+		if err := createVlan(vlan); err != nil {
+			errStrs = append(errStrs, err.Error())
+			// Deleted later if left behind, e.g. not set up
+			if !isVlanLink(vlan.LinkName()) {
+				continue
+			}
+		}
+		applied = append(applied, vlan)
+	}
+	vlanApplied.vlans = applied
+	if err := writeVlanState(applied); err != nil {
+		errStrs = append(errStrs, err.Error())
+	}
+	if len(errStrs) != 0 {
+		return errors.New(strings.Join(errStrs, "; "))
+	}
+	return nil
+}
+
+func lookupVlan(config types.DeviceNetworkConfig, ifname string) *types.VlanConfig {
+	for _, vlan := range config.Vlans {
+		if vlan.LinkName() == ifname {
+			return &vlan
+		}
+	}
+	return nil
+}
+
+// createVlan creates the VLAN link unless it exists, replacing it if
+// its parent or VLAN ID changed, and sets it up
+func createVlan(vlan types.VlanConfig) error {
+	ifname := vlan.LinkName()
+	if vlan.VlanID < 1 || vlan.VlanID > 4094 {
+		return fmt.Errorf("VLAN %s has a bad VLAN ID %d", ifname, vlan.VlanID)
+	}
+	parent, err := netlinkHandle.LinkByName(vlan.Parent)
+	if err != nil {
+		return fmt.Errorf("VLAN %s parent %s does not exist", ifname,
+			vlan.Parent)
+	}
+	if link, err := netlinkHandle.LinkByName(ifname); err == nil {
+		existing, ok := link.(*netlink.Vlan)
+		if !ok {
+			return fmt.Errorf("VLAN %s exists and is a %s link", ifname,
+				link.Type())
+		}
+		if existing.VlanId == vlan.VlanID &&
+			existing.ParentIndex == parent.Attrs().Index {
+			return setVlanUp(link)
+		}
+		log.Infof("createVlan(%s) replacing VLAN %d on index %d\n",
+			ifname, existing.VlanId, existing.ParentIndex)
+		if err := netlinkHandle.LinkDel(link); err != nil {
+			return fmt.Errorf("VLAN %s not replaced: %s", ifname, err)
+		}
+	}
+	log.Infof("createVlan(%s) VLAN %d on %s\n", ifname, vlan.VlanID,
+		vlan.Parent)
+	link := &netlink.Vlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:        ifname,
+			ParentIndex: parent.Attrs().Index,
+		},
+		VlanId: vlan.VlanID,
+	}
+	if err := netlinkHandle.LinkAdd(link); err != nil {
+		return fmt.Errorf("VLAN %s not created: %s", ifname, err)
+	}
+	return setVlanUp(link)
+}
+
+func setVlanUp(link netlink.Link) error {
+	if err := netlinkHandle.LinkSetUp(link); err != nil {
+		return fmt.Errorf("VLAN %s not set up: %s", link.Attrs().Name, err)
+	}
+	return nil
+}
+
+// deleteVlan deletes the VLAN link if it exists
+func deleteVlan(vlan types.VlanConfig) error {
+	ifname := vlan.LinkName()
+	link, err := netlinkHandle.LinkByName(ifname)
+	if err != nil {
+		log.Infof("deleteVlan(%s) already gone\n", ifname)
+		return nil
+	}
+	if _, ok := link.(*netlink.Vlan); !ok {
+		return fmt.Errorf("VLAN %s not deleted since a %s link", ifname,
+			link.Type())
+	}
+	log.Infof("deleteVlan(%s)\n", ifname)
+	if err := netlinkHandle.LinkDel(link); err != nil {
+		return fmt.Errorf("VLAN %s not deleted: %s", ifname, err)
+	}
+	return nil
+}
+
+// isVlanLink returns true if ifname exists and is a VLAN link
+func isVlanLink(ifname string) bool {
+	link, err := netlinkHandle.LinkByName(ifname)
+	if err != nil {
+		return false
+	}
+	_, ok := link.(*netlink.Vlan)
+	return ok
+}
+
+// setVlanInfo sets the parent and VLAN ID of a port which is a VLAN link
+func setVlanInfo(port *types.NetworkPortStatus, link netlink.Link) {
+	vlan, ok := link.(*netlink.Vlan)
+	if !ok {
+		return
+	}
+	port.VlanID = vlan.VlanId
+	parent, err := netlinkHandle.LinkByIndex(vlan.ParentIndex)
+	if err != nil {
+		log.Warnf("setVlanInfo(%s) parent %d: %s\n", port.IfName,
+			vlan.ParentIndex, err)
+		return
+	}
+	port.VlanParent = parent.Attrs().Name
+}
+
+func readVlanState() ([]types.VlanConfig, error) {
+	var vlans []types.VlanConfig
+
+	b, err := ioutil.ReadFile(vlanStateFilename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &vlans); err != nil {
+		return nil, fmt.Errorf("%s: %s", vlanStateFilename, err)
+	}
+	return vlans, nil
+}
+
+func writeVlanState(vlans []types.VlanConfig) error {
+	b, err := json.Marshal(vlans)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(vlanStateFilename), 0755); err != nil {
+		return err
+	}
+	return writeSync(vlanStateFilename, b, 0644)
+}
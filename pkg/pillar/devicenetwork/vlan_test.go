@@ -0,0 +1,122 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+func TestApplyDeviceNetworkConfig(t *testing.T) {
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	dir, err := ioutil.TempDir("", "vlan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vlanStateFilename = filepath.Join(dir, "nim", "vlans.json")
+	defer func() {
+		vlanStateFilename = "/run/nim/vlans.json"
+		vlanApplied.loaded = false
+		vlanApplied.vlans = nil
+	}()
+	fake.setLink("eth0", 1, true)
+	fake.setLink("eth1", 2, true)
+	fake.setLink("mgmt", 3, true) // not a VLAN link
+	config := types.DeviceNetworkConfig{
+		Uplink: []string{"eth0.100", "mgmt0"},
+		Vlans: []types.VlanConfig{
+			{Parent: "eth0", VlanID: 100},
+			{Parent: "eth1", VlanID: 200, IfName: "mgmt0"},
+		},
+	}
+
+	// Creates them, and again does nothing
+	for i := 0; i < 2; i++ {
+		if err := ApplyDeviceNetworkConfig(config); err != nil {
+			t.Fatalf("ApplyDeviceNetworkConfig failed: %v", err)
+		}
+		if len(fake.links) != 5 {
+			t.Fatalf("unexpected links %v", fake.links)
+		}
+	}
+	vlan, ok := fake.links["eth0.100"].(*netlink.Vlan)
+	if !ok || vlan.VlanId != 100 || vlan.ParentIndex != 1 || vlan.Index != 4 ||
+		vlan.OperState != netlink.OperUp {
+		t.Errorf("unexpected eth0.100 %+v", fake.links["eth0.100"])
+	}
+	if vlan, ok := fake.links["mgmt0"].(*netlink.Vlan); !ok || vlan.VlanId != 200 ||
+		vlan.ParentIndex != 2 {
+		t.Errorf("unexpected mgmt0 %+v", fake.links["mgmt0"])
+	}
+
+	// Used like any other uplink
+	fake.addrs["eth0.100"] = []netlink.Addr{
+		{IPNet: &net.IPNet{IP: net.ParseIP("10.1.0.10")}}}
+	portConfig := MakeDevicePortConfig(config)
+	status, _ := MakeDeviceNetworkStatus(portConfig, types.DeviceNetworkStatus{})
+	port := status.Ports[0]
+	if port.IfName != "eth0.100" || port.VlanParent != "eth0" || port.VlanID != 100 ||
+		port.Error != "" || len(port.AddrInfoList) != 1 {
+		t.Errorf("unexpected status %+v", port)
+	}
+	if port := status.Ports[1]; port.VlanParent != "eth1" || port.VlanID != 200 {
+		t.Errorf("unexpected status %+v", port)
+	}
+
+	// A changed VLAN ID replaces the link, a removed VLAN is deleted even
+	// after a restart
+	vlanApplied.loaded = false
+	vlanApplied.vlans = nil
+	newConfig := types.DeviceNetworkConfig{
+		Vlans: []types.VlanConfig{{Parent: "eth0", VlanID: 101, IfName: "eth0.100"}},
+	}
+	if err := ApplyDeviceNetworkConfig(newConfig); err != nil {
+		t.Fatalf("ApplyDeviceNetworkConfig failed: %v", err)
+	}
+	if vlan, ok := fake.links["eth0.100"].(*netlink.Vlan); !ok || vlan.VlanId != 101 {
+		t.Errorf("unexpected eth0.100 %+v", fake.links["eth0.100"])
+	}
+	if _, ok := fake.links["mgmt0"]; ok {
+		t.Errorf("mgmt0 not deleted")
+	}
+	vlanApplied.loaded = false
+	vlanApplied.vlans = nil
+	if err := ApplyDeviceNetworkConfig(types.DeviceNetworkConfig{}); err != nil {
+		t.Fatalf("ApplyDeviceNetworkConfig failed: %v", err)
+	}
+	if len(fake.links) != 3 {
+		t.Errorf("unexpected links %v", fake.links)
+	}
+
+	// The other links are left alone
+	badConfig := types.DeviceNetworkConfig{
+		Vlans: []types.VlanConfig{
+			{Parent: "eth0", VlanID: 10, IfName: "mgmt"},
+			{Parent: "eth9", VlanID: 10},
+			{Parent: "eth0", VlanID: 4095},
+		},
+	}
+	err = ApplyDeviceNetworkConfig(badConfig)
+	expected := "VLAN mgmt exists and is a device link; " +
+		"VLAN eth9.10 parent eth9 does not exist; " +
+		"VLAN eth0.4095 has a bad VLAN ID 4095"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected %q, got %v", expected, err)
+	}
+	if err := ApplyDeviceNetworkConfig(types.DeviceNetworkConfig{}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(fake.links) != 3 {
+		t.Errorf("unexpected links %v", fake.links)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Watch the ports for address and link changes
+
+package devicenetwork
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// For how long the changes are coalesced before making a new status,
+// so that e.g. a DHCP renew results in a single one
+var watchDebounce = 500 * time.Millisecond
+
+// statusWatcher keeps the DeviceNetworkStatus of WatchDeviceNetworkStatus
+type statusWatcher struct {
+	rawConfig types.DevicePortConfig // with the port patterns
+	config    types.DevicePortConfig // with the ports matching them
+	status    types.DeviceNetworkStatus
+	indexes   map[int]string // ifindex to ifname of the ports
+}
+
+// WatchDeviceNetworkStatus returns a channel receiving the
+// DeviceNetworkStatus for config when called and then after each
+// address or link change of its ports. Only the entries of the ports
+// which changed are made again, unless an interface matching a port
+// pattern or hardware identifier appears or disappears, or a candidate
+// port when reported. The channel is closed once ctx is done.
+func WatchDeviceNetworkStatus(ctx context.Context,
+	config types.DevicePortConfig) (<-chan types.DeviceNetworkStatus, error) {
+
+	log.Infof("WatchDeviceNetworkStatus()\n")
+	done := make(chan struct{})
+	addrChanges := make(chan netlink.AddrUpdate)
+	linkChanges := make(chan netlink.LinkUpdate)
+	if err := netlinkHandle.AddrSubscribe(addrChanges, done); err != nil {
+		close(done)
+		return nil, err
+	}
+	if err := netlinkHandle.LinkSubscribe(linkChanges, done); err != nil {
+		close(done)
+		go drainAddrChanges(addrChanges)
+		return nil, err
+	}
+	w := &statusWatcher{rawConfig: config}
+	w.rescan()
+	statusChan := make(chan types.DeviceNetworkStatus)
+	go w.run(ctx, done, addrChanges, linkChanges, statusChan)
+	return statusChan, nil
+}
+
+func (w *statusWatcher) run(ctx context.Context, done chan struct{},
+	addrChanges chan netlink.AddrUpdate, linkChanges chan netlink.LinkUpdate,
+	statusChan chan<- types.DeviceNetworkStatus) {
+
+	defer close(statusChan)
+	defer func() {
+		log.Infof("WatchDeviceNetworkStatus() done\n")
+		close(done)
+		// netlink closes them once it noticed
+		if addrChanges != nil {
+			go drainAddrChanges(addrChanges)
+		}
+		if linkChanges != nil {
+			go drainLinkChanges(linkChanges)
+		}
+	}()
+
+	// The ports to make again when debounce fires, or all of them
+	changed := make(map[string]bool)
+	rescan := false
+	var debounce <-chan time.Time
+	pending := true
+	for {
+		// Only sends when there is a new status
+		var send chan<- types.DeviceNetworkStatus
+		if pending {
+			send = statusChan
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case send <- w.status:
+			pending = false
+		case change, ok := <-addrChanges:
+			if !ok {
+				log.Errorf("WatchDeviceNetworkStatus: address updates stopped\n")
+				addrChanges = nil
+				continue
+			}
+			ifname, ok := w.indexes[change.LinkIndex]
+			if !ok {
+				continue
+			}
+			log.Debugf("WatchDeviceNetworkStatus: address change on %s\n",
+				ifname)
+			changed[ifname] = true
+		case change, ok := <-linkChanges:
+			if !ok {
+				log.Errorf("WatchDeviceNetworkStatus: link updates stopped\n")
+				linkChanges = nil
+				continue
+			}
+			ifname := change.Attrs().Name
+			removed := change.Header.Type == syscall.RTM_DELLINK
+			if lookupOnIfname(w.config, ifname) != nil {
+				log.Debugf("WatchDeviceNetworkStatus: link change on %s\n",
+					ifname)
+				w.indexes[change.Attrs().Index] = ifname
+				changed[ifname] = true
+				if removed && w.isMatchedPort(ifname) {
+					log.Infof("WatchDeviceNetworkStatus: port %s removed\n",
+						ifname)
+					rescan = true
+				}
+			} else if removed {
+				if !w.isCandidate(ifname) {
+					continue
+				}
+				log.Infof("WatchDeviceNetworkStatus: candidate %s removed\n",
+					ifname)
+				rescan = true
+			} else if w.matchesPattern(ifname) || w.matchesHwID(change.Link) {
+				log.Infof("WatchDeviceNetworkStatus: new port %s\n",
+					ifname)
+				rescan = true
+			} else if w.isNewCandidate(change.Link) {
+				log.Infof("WatchDeviceNetworkStatus: new candidate %s\n",
+					ifname)
+				rescan = true
+			} else {
+				continue
+			}
+		case <-debounce:
+			debounce = nil
+			if rescan || w.portsGone(changed) {
+				w.rescan()
+			} else {
+				w.update(changed)
+			}
+			changed = make(map[string]bool)
+			rescan = false
+			pending = true
+			continue
+		}
+		if (len(changed) != 0 || rescan) && debounce == nil {
+			debounce = time.After(watchDebounce)
+		}
+	}
+}
+
+// matchesPattern returns true if ifname matches a port pattern of the
+// config and is not excluded
+func (w *statusWatcher) matchesPattern(ifname string) bool {
+	var exclusions []string
+	matched := false
+	for _, u := range w.rawConfig.Ports {
+		if strings.HasPrefix(u.IfName, "!") {
+			exclusions = append(exclusions, u.IfName[1:])
+		} else if isPortPattern(u.IfName) && portMatch(u.IfName, ifname) {
+			matched = true
+		}
+	}
+	return matched && !portExcluded(exclusions, ifname)
+}
+
+// matchesHwID returns true if link, possibly new or renamed, has the
+// address of a port hardware identifier of the config
+func (w *statusWatcher) matchesHwID(link netlink.Link) bool {
+	for _, u := range w.rawConfig.Ports {
+		if isPortHwID(u.IfName) && checkPortHwID(u.IfName) == nil &&
+			hwidMatch(u.IfName, link) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMatchedPort returns true if the port ifname matched a pattern or a
+// hardware identifier, and so goes with its interface
+func (w *statusWatcher) isMatchedPort(ifname string) bool {
+	for _, port := range w.status.Ports {
+		if port.IfName == ifname {
+			return port.Pattern != "" || port.HwID != ""
+		}
+	}
+	return false
+}
+
+// isCandidate returns true if ifname is in the reported Candidates
+func (w *statusWatcher) isCandidate(ifname string) bool {
+	for _, candidate := range w.status.Candidates {
+		if candidate.IfName == ifname {
+			return true
+		}
+	}
+	return false
+}
+
+// isNewCandidate returns true if the candidates are reported and link is
+// a physical interface not yet in them, e.g. plugged in or renamed
+func (w *statusWatcher) isNewCandidate(link netlink.Link) bool {
+	if !candidatesReported() || w.isCandidate(link.Attrs().Name) {
+		return false
+	}
+	_, ok := candidateHwID(link)
+	return ok
+}
+
+// portsGone returns true if the interface of a changed port which
+// matched a pattern or a hardware identifier no longer exists
+func (w *statusWatcher) portsGone(changed map[string]bool) bool {
+	for _, port := range w.status.Ports {
+		if (port.Pattern == "" && port.HwID == "") || !changed[port.IfName] {
+			continue
+		}
+		if _, err := netlinkHandle.LinkByName(port.IfName); err != nil {
+			log.Infof("WatchDeviceNetworkStatus: port %s gone\n",
+				port.IfName)
+			return true
+		}
+	}
+	return false
+}
+
+// rescan resolves the port hardware identifiers and matches the port
+// patterns against the current interfaces, and makes again the status of
+// all the ports
+func (w *statusWatcher) rescan() {
+	config, status, err := makeDeviceNetworkStatus(w.rawConfig, w.status)
+	if err != nil {
+		log.Warnf("WatchDeviceNetworkStatus: %s\n", err)
+	}
+	w.config = config
+	w.status = status
+	w.indexes = make(map[int]string)
+	for _, u := range w.config.Ports {
+		if link, err := netlinkHandle.LinkByName(u.IfName); err == nil {
+			w.indexes[link.Attrs().Index] = u.IfName
+		}
+	}
+}
+
+// update makes again the entries of the changed ports. The ports are
+// copied since the previous status was sent.
+func (w *statusWatcher) update(changed map[string]bool) {
+	oldStatus := w.status
+	w.status.Ports = make([]types.NetworkPortStatus, len(oldStatus.Ports))
+	copy(w.status.Ports, oldStatus.Ports)
+	for ix, u := range w.config.Ports {
+		if !changed[u.IfName] {
+			continue
+		}
+		log.Infof("WatchDeviceNetworkStatus: updating %s\n", u.IfName)
+		w.status.Ports[ix] = types.NetworkPortStatus{}
+		if err := makePortStatus(&w.status, ix, u, oldStatus); err != nil {
+			log.Warnf("WatchDeviceNetworkStatus: %s\n", err)
+		}
+		w.status.Ports[ix].Pattern = oldStatus.Ports[ix].Pattern
+		w.status.Ports[ix].HwID = oldStatus.Ports[ix].HwID
+		// Only the new entry to leave the sent ones alone
+		portStatus := types.DeviceNetworkStatus{
+			Version: w.status.Version,
+			Ports:   w.status.Ports[ix : ix+1],
+		}
+		updateDeviceNetworkGeo(time.Second, &portStatus, cachedGeoLookup)
+	}
+}
+
+func drainAddrChanges(addrChanges <-chan netlink.AddrUpdate) {
+	for range addrChanges {
+	}
+}
+
+func drainLinkChanges(linkChanges <-chan netlink.LinkUpdate) {
+	for range linkChanges {
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	"golang.org/x/sys/unix"
+)
+
+// nextStatus returns the next status sent by the watcher
+func nextStatus(t *testing.T, statusChan <-chan types.DeviceNetworkStatus) types.DeviceNetworkStatus {
+	select {
+	case status, ok := <-statusChan:
+		if !ok {
+			t.Fatalf("status channel closed")
+		}
+		return status
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no status")
+	}
+	return types.DeviceNetworkStatus{}
+}
+
+func TestWatchDeviceNetworkStatus(t *testing.T) {
+	SetGeoLookupDisabled(true)
+	defer SetGeoLookupDisabled(false)
+	oldDebounce := watchDebounce
+	watchDebounce = 50 * time.Millisecond
+	defer func() { watchDebounce = oldDebounce }()
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	fake.setLink("eth1", 101, true, "192.168.1.10")
+	static := types.DhcpConfig{Dhcp: types.DT_STATIC}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", IsMgmt: true, DhcpConfig: static},
+			{IfName: "eth1", IsMgmt: true, DhcpConfig: static},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	statusChan, err := WatchDeviceNetworkStatus(ctx, config)
+	if err != nil {
+		t.Fatalf("WatchDeviceNetworkStatus failed: %v", err)
+	}
+	status := nextStatus(t, statusChan)
+	if len(status.Ports) != 2 || len(status.Ports[0].AddrInfoList) != 1 {
+		t.Fatalf("unexpected initial status %+v", status)
+	}
+	sent := status
+
+	// A burst of address changes gives a single status, with eth1 only
+	// made again when it changes
+	fake.setLink("eth0", 100, true, "192.168.0.10", "192.168.0.11")
+	fake.setLink("eth1", 101, false, "192.168.1.10")
+	addr := netlink.AddrUpdate{LinkIndex: 100, NewAddr: true,
+		LinkAddress: net.IPNet{IP: net.ParseIP("192.168.0.11")}}
+	for i := 0; i < 5; i++ {
+		fake.addrUpdates <- addr
+	}
+	fake.addrUpdates <- netlink.AddrUpdate{LinkIndex: 999} // not a port
+	status = nextStatus(t, statusChan)
+	if len(status.Ports[0].AddrInfoList) != 2 || !status.Ports[1].Up {
+		t.Errorf("unexpected status %+v", status)
+	}
+	select {
+	case status = <-statusChan:
+		t.Errorf("unexpected status %+v", status)
+	case <-time.After(4 * watchDebounce):
+	}
+	// The sent status is left alone
+	if len(sent.Ports[0].AddrInfoList) != 1 {
+		t.Errorf("sent status changed to %+v", sent)
+	}
+
+	fake.linkUpdates <- netlink.LinkUpdate{Link: fake.links["eth1"]}
+	fake.linkUpdates <- netlink.LinkUpdate{Link: &netlink.Device{
+		LinkAttrs: netlink.LinkAttrs{Name: "wlan0", Index: 102}}} // not a port
+	status = nextStatus(t, statusChan)
+	if status.Ports[1].Up || status.Ports[1].Error != "Port eth1 is admin down" ||
+		len(status.Ports[0].AddrInfoList) != 2 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// Unsubscribes and closes the channel
+	cancel()
+	select {
+	case _, ok := <-statusChan:
+		if ok {
+			t.Errorf("status channel not closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("status channel not closed")
+	}
+	select {
+	case <-fake.done:
+	default:
+		t.Errorf("not unsubscribed")
+	}
+}
+
+func TestWatchDeviceNetworkStatusPatterns(t *testing.T) {
+	SetGeoLookupDisabled(true)
+	defer SetGeoLookupDisabled(false)
+	oldDebounce := watchDebounce
+	watchDebounce = 10 * time.Millisecond
+	defer func() { watchDebounce = oldDebounce }()
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	config := MakeDevicePortConfig(types.DeviceNetworkConfig{
+		Uplink: []string{"eth*", "!eth9"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	statusChan, err := WatchDeviceNetworkStatus(ctx, config)
+	if err != nil {
+		t.Fatalf("WatchDeviceNetworkStatus failed: %v", err)
+	}
+	if status := nextStatus(t, statusChan); len(status.Ports) != 1 {
+		t.Fatalf("unexpected initial status %+v", status)
+	}
+
+	// A new matching interface is added, excluded ones are not
+	fake.setLink("eth9", 109, true, "192.168.9.10")
+	fake.setLink("eth1", 101, true, "192.168.1.10")
+	fake.linkUpdates <- netlink.LinkUpdate{Link: fake.links["eth9"]}
+	fake.linkUpdates <- netlink.LinkUpdate{Link: fake.links["eth1"]}
+	status := nextStatus(t, statusChan)
+	if len(status.Ports) != 2 || status.Ports[1].IfName != "eth1" ||
+		status.Ports[1].Pattern != "eth*" {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	// Its address changes are followed
+	fake.setLink("eth1", 101, true, "192.168.1.10", "192.168.1.11")
+	fake.addrUpdates <- netlink.AddrUpdate{LinkIndex: 101, NewAddr: true}
+	if status = nextStatus(t, statusChan); len(status.Ports[1].AddrInfoList) != 2 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	// and it is dropped once gone
+	link := fake.links["eth1"]
+	delete(fake.links, "eth1")
+	fake.linkUpdates <- netlink.LinkUpdate{Link: link}
+	if status = nextStatus(t, statusChan); len(status.Ports) != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestWatchDeviceNetworkStatusHwID(t *testing.T) {
+	SetGeoLookupDisabled(true)
+	defer SetGeoLookupDisabled(false)
+	oldDebounce := watchDebounce
+	watchDebounce = 10 * time.Millisecond
+	defer func() { watchDebounce = oldDebounce }()
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	mac, _ := net.ParseMAC("00:16:3e:0a:0b:0c")
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	fake.setLink("eth1", 101, true, "192.168.1.10")
+	fake.links["eth1"].Attrs().HardwareAddr = mac
+	static := types.DhcpConfig{Dhcp: types.DT_STATIC}
+	config := types.DevicePortConfig{
+		Version: types.DPCIsMgmt,
+		Ports: []types.NetworkPortConfig{
+			{IfName: "eth0", IsMgmt: true, DhcpConfig: static},
+			{IfName: "mac:00:16:3e:0a:0b:0c", IsMgmt: true, DhcpConfig: static},
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	statusChan, err := WatchDeviceNetworkStatus(ctx, config)
+	if err != nil {
+		t.Fatalf("WatchDeviceNetworkStatus failed: %v", err)
+	}
+	if status := nextStatus(t, statusChan); len(status.Ports) != 2 ||
+		status.Ports[1].HwID != "mac:00:16:3e:0a:0b:0c" {
+		t.Fatalf("unexpected initial status %+v", status)
+	}
+
+	// An address change keeps the hardware identifier of the port
+	fake.setLink("eth1", 101, true, "192.168.1.10", "192.168.1.11")
+	fake.links["eth1"].Attrs().HardwareAddr = mac
+	fake.addrUpdates <- netlink.AddrUpdate{LinkIndex: 101, NewAddr: true}
+	status := nextStatus(t, statusChan)
+	if len(status.Ports[1].AddrInfoList) != 2 ||
+		status.Ports[1].HwID != "mac:00:16:3e:0a:0b:0c" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	// so the port is dropped once its interface is gone
+	link := fake.links["eth1"]
+	delete(fake.links, "eth1")
+	fake.linkUpdates <- netlink.LinkUpdate{Link: link}
+	if status = nextStatus(t, statusChan); len(status.Ports) != 1 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+// setUsbDevice links the sysfs device of ifname to a USB interface
+func setUsbDevice(t *testing.T, ifname string, usbIntf string) {
+	device := filepath.Join(sysClassNet, "..", "..", "devices", "pci0000:00",
+		"0000:00:14.0", "usb1", "1-1", usbIntf)
+	if err := os.MkdirAll(device, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(sysClassNet, ifname)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(device, filepath.Join(dir, "device")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchDeviceNetworkStatusHotplug(t *testing.T) {
+	SetGeoLookupDisabled(true)
+	defer SetGeoLookupDisabled(false)
+	SetCandidatesReported(true)
+	defer SetCandidatesReported(false)
+	oldDebounce := watchDebounce
+	watchDebounce = 10 * time.Millisecond
+	defer func() { watchDebounce = oldDebounce }()
+	fake := newFakeNetlink()
+	netlinkHandle = fake
+	defer func() { netlinkHandle = kernelNetlink{} }()
+	dir, err := ioutil.TempDir("", "sys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldSysClassNet := sysClassNet
+	sysClassNet = filepath.Join(dir, "class", "net")
+	defer func() { sysClassNet = oldSysClassNet }()
+
+	fake.setLink("eth0", 100, true, "192.168.0.10")
+	setPciDevice(t, "eth0", "0000:02:00.0")
+	// Not physical
+	fake.setLink("lo", 1, true, "127.0.0.1")
+	config := MakeDevicePortConfig(types.DeviceNetworkConfig{
+		Uplink: []string{"eth*"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	statusChan, err := WatchDeviceNetworkStatus(ctx, config)
+	if err != nil {
+		t.Fatalf("WatchDeviceNetworkStatus failed: %v", err)
+	}
+	status := nextStatus(t, statusChan)
+	if len(status.Ports) != 1 || len(status.Candidates) != 0 {
+		t.Fatalf("unexpected initial status %+v", status)
+	}
+
+	// A USB NIC plugged in is a candidate, identified by its MAC
+	newLink := unix.NlMsghdr{Type: syscall.RTM_NEWLINK}
+	delLink := unix.NlMsghdr{Type: syscall.RTM_DELLINK}
+	mac, _ := net.ParseMAC("02:00:00:00:00:03")
+	fake.setLink("enx020000000003", 103, false)
+	fake.links["enx020000000003"].Attrs().HardwareAddr = mac
+	setUsbDevice(t, "enx020000000003", "1-1:1.0")
+	fake.linkUpdates <- netlink.LinkUpdate{Header: newLink,
+		Link: fake.links["enx020000000003"]}
+	status = nextStatus(t, statusChan)
+	expected := []types.CandidatePort{{IfName: "enx020000000003",
+		MacAddr: "02:00:00:00:00:03", HwID: "mac:02:00:00:00:00:03"}}
+	if len(status.Ports) != 1 || !reflect.DeepEqual(status.Candidates, expected) {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	// Its other link changes give no status
+	fake.setLink("enx020000000003", 103, true)
+	fake.links["enx020000000003"].Attrs().HardwareAddr = mac
+	fake.linkUpdates <- netlink.LinkUpdate{Header: newLink,
+		Link: fake.links["enx020000000003"]}
+	fake.linkUpdates <- netlink.LinkUpdate{Header: newLink, Link: fake.links["lo"]}
+	select {
+	case status = <-statusChan:
+		t.Errorf("unexpected status %+v", status)
+	case <-time.After(4 * watchDebounce):
+	}
+
+	// An interface matching the pattern is a port, not a candidate
+	fake.setLink("eth1", 101, true, "192.168.1.10")
+	setPciDevice(t, "eth1", "0000:03:00.0")
+	fake.linkUpdates <- netlink.LinkUpdate{Header: newLink, Link: fake.links["eth1"]}
+	status = nextStatus(t, statusChan)
+	if len(status.Ports) != 2 || status.Ports[1].IfName != "eth1" ||
+		!reflect.DeepEqual(status.Candidates, expected) {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	// Both are unplugged
+	for _, ifname := range []string{"enx020000000003", "eth1"} {
+		link := fake.links[ifname]
+		delete(fake.links, ifname)
+		os.RemoveAll(filepath.Join(sysClassNet, ifname))
+		fake.linkUpdates <- netlink.LinkUpdate{Header: delLink, Link: link}
+	}
+	status = nextStatus(t, statusChan)
+	if len(status.Ports) != 1 || len(status.Candidates) != 0 {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// Only reported when enabled
+	SetCandidatesReported(false)
+	fake.setLink("eth2", 102, true)
+	setPciDevice(t, "eth2", "0000:04:00.0")
+	_, status, err = makeDeviceNetworkStatus(types.DevicePortConfig{}, status)
+	if err != nil || len(status.Candidates) != 0 {
+		t.Errorf("unexpected status %+v: %v", status, err)
+	}
+	SetCandidatesReported(true)
+	_, status, err = makeDeviceNetworkStatus(types.DevicePortConfig{}, status)
+	expected = []types.CandidatePort{
+		{IfName: "eth0", MacAddr: "", HwID: "pci:0000:02:00.0"},
+		{IfName: "eth2", MacAddr: "", HwID: "pci:0000:04:00.0"},
+	}
+	if err != nil || !reflect.DeepEqual(status.Candidates, expected) {
+		t.Errorf("expected candidates %+v, got %+v: %v", expected,
+			status.Candidates, err)
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Associate the WiFi uplinks with the networks of the DeviceNetworkConfig
+
+package devicenetwork
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// The wpa_supplicant configs, <ifname>.conf, run by the wlan container.
+// Under /run since they have the PSKs.
+var wpaSupplicantDir = "/run/wlan"
+
+// The control sockets of wpa_supplicant, set as its ctrl_interface
+var wpaCtrlDir = "/run/wpa_supplicant"
+
+// How long wpa_supplicant has to answer on its control socket
+const wpaCtrlTimeout = 5 * time.Second
+
+// Returned when wpa_supplicant is not running on the interface
+var errWpaSupplicantNotRunning = errors.New("wpa_supplicant is not running")
+
+// wirelessLink is the association of a WiFi interface
+type wirelessLink struct {
+	ssid      string // Empty if not associated
+	bssid     string
+	freqMHz   uint32
+	signalDBm int32
+}
+
+// Returned for the interfaces which are not WiFi ones, or when the kernel
+// has no nl80211
+var errWirelessNotSupported = errors.New("nl80211 not supported")
+
+// wirelessAPI queries the association of the WiFi interfaces, replaced by
+// a fake in the tests
+type wirelessAPI interface {
+	Link(ifname string) (wirelessLink, error)
+}
+
+var wirelessHandle wirelessAPI = kernelWireless{}
+
+// ApplyWirelessConfig writes the wpa_supplicant config of the Wireless of
+// config, and asks wpa_supplicant to reread it. The WiFi uplinks no longer
+// there get a config without a network. Can be called again with the same
+// config. Returns the errors of those which could not be configured.
+func ApplyWirelessConfig(config types.DeviceNetworkConfig) error {
+	var errStrs []string
+
+	log.Infof("ApplyWirelessConfig()\n")
+	confs := make(map[string]string)
+	old, err := filepath.Glob(filepath.Join(wpaSupplicantDir, "*.conf"))
+	if err != nil {
+		errStrs = append(errStrs, err.Error())
+	}
+	for _, filename := range old {
+		confs[strings.TrimSuffix(filepath.Base(filename), ".conf")] =
+			makeWpaSupplicantConf(nil, "")
+	}
+	for i := range config.Wireless {
+		wireless := &config.Wireless[i]
+		psk, err := readPsk(*wireless)
+		if err != nil {
+			errStrs = append(errStrs, err.Error())
+			delete(confs, wireless.IfName)
+			continue
+		}
+		confs[wireless.IfName] = makeWpaSupplicantConf(wireless, psk)
+	}
+	for ifname, conf := range confs {
+		if err := writeWpaSupplicantConf(ifname, conf); err != nil {
+			errStrs = append(errStrs, err.Error())
+		}
+	}
+	if len(errStrs) != 0 {
+		return errors.New(strings.Join(errStrs, "; "))
+	}
+	return nil
+}
+
+// readPsk returns the passphrase or the hex PSK in the PskFile of the
+// network, empty if it has no key
+func readPsk(wireless types.WirelessConfig) (string, error) {
+	if wireless.KeyMgmt == "NONE" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(wireless.PskFile)
+	if err != nil {
+		return "", fmt.Errorf("Wireless %s PSK not read: %s", wireless.IfName, err)
+	}
+	psk := strings.TrimRight(string(data), "\r\n")
+	if err := checkPsk(psk); err != nil {
+		return "", fmt.Errorf("Wireless %s has a bad PSK in %s: %s",
+			wireless.IfName, wireless.PskFile, err)
+	}
+	return psk, nil
+}
+
+// checkPsk returns why psk is neither a passphrase of 8 to 63 printable
+// ASCII characters nor 64 hex digits
+func checkPsk(psk string) error {
+	if len(psk) == 64 {
+		if _, err := hex.DecodeString(psk); err == nil {
+			return nil
+		}
+	}
+	if len(psk) < 8 || len(psk) > 63 {
+		return fmt.Errorf("not 8 to 63 characters")
+	}
+	for _, c := range psk {
+		if c < ' ' || c > '~' {
+			return fmt.Errorf("not printable ASCII")
+		}
+	}
+	return nil
+}
+
+// makeWpaSupplicantConf returns the wpa_supplicant config for the network
+// with the key psk, without a network if nil. The SSID is in hex since it
+// can have any byte.
+func makeWpaSupplicantConf(wireless *types.WirelessConfig, psk string) string {
+	lines := []string{
+		"# Written by nim from the DeviceNetworkConfig",
+		"ctrl_interface=" + wpaCtrlDir,
+	}
+	if wireless == nil {
+		return strings.Join(lines, "\n") + "\n"
+	}
+	if wireless.CountryCode != "" {
+		lines = append(lines, "country="+wireless.CountryCode)
+	}
+	keyMgmt := wireless.KeyMgmt
+	if keyMgmt == "" {
+		keyMgmt = "WPA-PSK"
+	}
+	lines = append(lines, "network={",
+		"\tssid="+hex.EncodeToString([]byte(wireless.SSID)),
+		// Also finds the hidden ones
+		"\tscan_ssid=1",
+		"\tkey_mgmt="+keyMgmt)
+	switch {
+	case keyMgmt == "SAE":
+		lines = append(lines, fmt.Sprintf("\tsae_password=\"%s\"", psk),
+			"\tieee80211w=2")
+	case keyMgmt == "NONE":
+	case len(psk) == 64:
+		lines = append(lines, "\tpsk="+psk)
+	default:
+		lines = append(lines, fmt.Sprintf("\tpsk=\"%s\"", psk))
+	}
+	lines = append(lines, "}")
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// writeWpaSupplicantConf replaces the config of ifname if it changed, and
+// then reconfigures wpa_supplicant. Not running is fine since the wlan
+// container starts it with the new config.
+func writeWpaSupplicantConf(ifname string, conf string) error {
+	filename := filepath.Join(wpaSupplicantDir, ifname+".conf")
+	if old, err := ioutil.ReadFile(filename); err == nil && string(old) == conf {
+		return nil
+	}
+	if err := os.MkdirAll(wpaSupplicantDir, 0700); err != nil {
+		return fmt.Errorf("Wireless %s config not written: %s", ifname, err)
+	}
+	tmpfile, err := ioutil.TempFile(wpaSupplicantDir, ifname+".conf")
+	if err != nil {
+		return fmt.Errorf("Wireless %s config not written: %s", ifname, err)
+	}
+	_, err = tmpfile.WriteString(conf)
+	if closeErr := tmpfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+		return fmt.Errorf("Wireless %s config not written: %s", ifname, err)
+	}
+	log.Infof("writeWpaSupplicantConf(%s) wrote %s\n", ifname, filename)
+	err = reconfigureWpaSupplicant(ifname)
+	if err == errWpaSupplicantNotRunning {
+		log.Infof("writeWpaSupplicantConf(%s): %s\n", ifname, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Wireless %s not reconfigured: %s", ifname, err)
+	}
+	return nil
+}
+
+// reconfigureWpaSupplicant sends RECONFIGURE on the control socket of
+// wpa_supplicant for ifname
+func reconfigureWpaSupplicant(ifname string) error {
+	ctrlPath := filepath.Join(wpaCtrlDir, ifname)
+	if _, err := os.Stat(ctrlPath); os.IsNotExist(err) {
+		return errWpaSupplicantNotRunning
+	}
+	// wpa_supplicant answers to the address of the client
+	localPath := filepath.Join(os.TempDir(),
+		fmt.Sprintf("nim-wpa-%s-%d", ifname, os.Getpid()))
+	os.Remove(localPath)
+	conn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: localPath, Net: "unixgram"},
+		&net.UnixAddr{Name: ctrlPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localPath)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(wpaCtrlTimeout))
+	if _, err := conn.Write([]byte("RECONFIGURE")); err != nil {
+		return err
+	}
+	reply := make([]byte, 256)
+	n, err := conn.Read(reply)
+	if err != nil {
+		return err
+	}
+	if answer := strings.TrimSpace(string(reply[:n])); answer != "OK" {
+		return fmt.Errorf("RECONFIGURE answered %q", answer)
+	}
+	return nil
+}
+
+// isWirelessPort tells if ifname has a cfg80211 wiphy, as the WiFi
+// interfaces nl80211 knows have
+func isWirelessPort(ifname string) bool {
+	_, err := os.Stat(filepath.Join(sysClassNet, ifname, "phy80211"))
+	return err == nil
+}
+
+// setWirelessStatus sets the association of a WiFi port. Those configured
+// by ApplyWirelessConfig get an Error if there is no WiFi support. Only
+// the WiFi interfaces are asked.
+func setWirelessStatus(port *types.NetworkPortStatus,
+	wireless *types.WirelessConfig) {
+
+	link, err := wirelessLink{}, errWirelessNotSupported
+	if isWirelessPort(port.IfName) {
+		link, err = wirelessHandle.Link(port.IfName)
+	}
+	if err == errWirelessNotSupported {
+		log.Debugf("setWirelessStatus(%s): %s\n", port.IfName, err)
+		if wireless != nil {
+			port.Wireless = &types.WirelessStatus{
+				Error: fmt.Sprintf("Port %s has no WiFi support: %s",
+					port.IfName, err),
+			}
+		}
+		return
+	}
+	status := &types.WirelessStatus{}
+	port.Wireless = status
+	if err != nil {
+		log.Warnf("setWirelessStatus(%s) failed: %s\n", port.IfName, err)
+		status.Error = fmt.Sprintf("Port %s WiFi status not read: %s",
+			port.IfName, err)
+		return
+	}
+	status.SSID = link.ssid
+	status.BSSID = link.bssid
+	status.FreqMHz = link.freqMHz
+	status.SignalDBm = link.signalDBm
+	if wireless == nil {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(wpaCtrlDir, port.IfName)); err != nil {
+		status.Error = fmt.Sprintf("Port %s has no WiFi association: %s",
+			port.IfName, errWpaSupplicantNotRunning)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// The association of the WiFi interfaces using nl80211
+
+// This file is built only for linux
+//go:build linux
+// +build linux
+
+package devicenetwork
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/eriknordmark/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// From linux/nl80211.h
+const (
+	nl80211CmdGetScan             = 32
+	nl80211AttrIfindex            = 3
+	nl80211AttrBss                = 47
+	nl80211BssBssid               = 1
+	nl80211BssFrequency           = 2
+	nl80211BssInformationElements = 6
+	nl80211BssSignalMbm           = 7
+	nl80211BssStatus              = 9
+	nl80211BssStatusAssociated    = 1
+	nlaTypeMask                   = 0x3fff // Without NLA_F_NESTED
+	ieeeElementSSID               = 0
+)
+
+// The ID of the nl80211 generic netlink family, looked up until found
+var nl80211Family struct {
+	sync.Mutex
+	id uint16
+}
+
+func nl80211FamilyID() (uint16, error) {
+	nl80211Family.Lock()
+	defer nl80211Family.Unlock()
+	if nl80211Family.id == 0 {
+		family, err := netlink.GenlFamilyGet("nl80211")
+		if err != nil {
+			return 0, err
+		}
+		nl80211Family.id = family.ID
+	}
+	return nl80211Family.id, nil
+}
+
+// kernelWireless asks the kernel
+type kernelWireless struct{}
+
+// Link finds the associated BSS in the scan results, as iw link does
+func (kernelWireless) Link(ifname string) (wirelessLink, error) {
+	familyID, err := nl80211FamilyID()
+	if err != nil {
+		return wirelessLink{}, errWirelessNotSupported
+	}
+	link, err := netlinkHandle.LinkByName(ifname)
+	if err != nil {
+		return wirelessLink{}, err
+	}
+	req := nl.NewNetlinkRequest(int(familyID), syscall.NLM_F_DUMP)
+	req.AddData(&nl.Genlmsg{Command: nl80211CmdGetScan})
+	req.AddData(nl.NewRtAttr(nl80211AttrIfindex,
+		nl.Uint32Attr(uint32(link.Attrs().Index))))
+	msgs, err := req.Execute(syscall.NETLINK_GENERIC, 0)
+	switch err {
+	case nil:
+	case syscall.ENODEV, syscall.EOPNOTSUPP:
+		// Not a WiFi interface
+		return wirelessLink{}, errWirelessNotSupported
+	default:
+		return wirelessLink{}, err
+	}
+	return parseScanDump(msgs)
+}
+
+// parseScanDump returns the associated BSS of the NL80211_CMD_GET_SCAN
+// messages, an empty wirelessLink if none
+func parseScanDump(msgs [][]byte) (wirelessLink, error) {
+	native := nl.NativeEndian()
+	for _, msg := range msgs {
+		if len(msg) < nl.SizeofGenlmsg {
+			return wirelessLink{}, fmt.Errorf("truncated nl80211 message")
+		}
+		attrs, err := nl.ParseRouteAttr(msg[nl.SizeofGenlmsg:])
+		if err != nil {
+			return wirelessLink{}, fmt.Errorf("bad nl80211 message: %s", err)
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type&nlaTypeMask != nl80211AttrBss {
+				continue
+			}
+			bssAttrs, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return wirelessLink{}, fmt.Errorf("bad nl80211 BSS: %s", err)
+			}
+			var link wirelessLink
+			associated := false
+			for _, bssAttr := range bssAttrs {
+				value := bssAttr.Value
+				switch bssAttr.Attr.Type & nlaTypeMask {
+				case nl80211BssBssid:
+					link.bssid = net.HardwareAddr(value).String()
+				case nl80211BssFrequency:
+					if len(value) == 4 {
+						link.freqMHz = native.Uint32(value)
+					}
+				case nl80211BssSignalMbm:
+					if len(value) == 4 {
+						link.signalDBm = int32(native.Uint32(value)) / 100
+					}
+				case nl80211BssStatus:
+					associated = len(value) == 4 &&
+						native.Uint32(value) == nl80211BssStatusAssociated
+				case nl80211BssInformationElements:
+					link.ssid = findSSID(value)
+				}
+			}
+			if associated {
+				return link, nil
+			}
+		}
+	}
+	return wirelessLink{}, nil
+}
+
+// findSSID returns the SSID in the information elements of a BSS
+func findSSID(ies []byte) string {
+	for len(ies) >= 2 && len(ies) >= 2+int(ies[1]) {
+		if ies[0] == ieeeElementSSID {
+			return string(ies[2 : 2+ies[1]])
+		}
+		ies = ies[2+ies[1]:]
+	}
+	return ""
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// makeScanMessage returns a faked NL80211_CMD_NEW_SCAN_RESULTS message
+func makeScanMessage(bssid []byte, freq uint32, signalMbm int32, status int,
+	ies []byte) []byte {
+
+	bss := nl.NewRtAttr(nl80211AttrBss, nil)
+	bss.AddRtAttr(nl80211BssBssid, bssid)
+	bss.AddRtAttr(nl80211BssFrequency, nl.Uint32Attr(freq))
+	bss.AddRtAttr(nl80211BssSignalMbm, nl.Uint32Attr(uint32(signalMbm)))
+	if status >= 0 {
+		bss.AddRtAttr(nl80211BssStatus, nl.Uint32Attr(uint32(status)))
+	}
+	bss.AddRtAttr(nl80211BssInformationElements, ies)
+	msg := (&nl.Genlmsg{Command: 34}).Serialize()
+	msg = append(msg, nl.NewRtAttr(nl80211AttrIfindex, nl.Uint32Attr(3)).Serialize()...)
+	return append(msg, bss.Serialize()...)
+}
+
+func TestParseScanDump(t *testing.T) {
+	// An SSID then the supported rates
+	office := []byte{0, 6, 'o', 'f', 'f', 'i', 'c', 'e', 1, 2, 0x82, 0x84}
+	other := makeScanMessage([]byte{2, 0, 0, 0, 2, 0}, 2412, -8000, -1,
+		[]byte{0, 5, 'o', 't', 'h', 'e', 'r'})
+	associated := makeScanMessage([]byte{2, 0, 0, 0, 1, 0}, 5180, -5500,
+		nl80211BssStatusAssociated, office)
+
+	link, err := parseScanDump([][]byte{other, associated})
+	expected := wirelessLink{ssid: "office", bssid: "02:00:00:00:01:00",
+		freqMHz: 5180, signalDBm: -55}
+	if err != nil || link != expected {
+		t.Errorf("expected %+v, got %+v %v", expected, link, err)
+	}
+	if link, err := parseScanDump([][]byte{other}); err != nil || link != (wirelessLink{}) {
+		t.Errorf("not associated: unexpected %+v %v", link, err)
+	}
+	// A truncated SSID is skipped
+	truncated := makeScanMessage([]byte{2, 0, 0, 0, 1, 0}, 5180, -5500,
+		nl80211BssStatusAssociated, office[:5])
+	if link, err := parseScanDump([][]byte{truncated}); err != nil || link.ssid != "" {
+		t.Errorf("truncated: unexpected %+v %v", link, err)
+	}
+	if _, err := parseScanDump([][]byte{{34, 1}}); err == nil {
+		t.Errorf("no error for a truncated message")
+	}
+}
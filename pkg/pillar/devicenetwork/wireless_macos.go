@@ -0,0 +1,14 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+//
+// Stub file to allow compilation of wireless.go to go thru on macos.
+// +build darwin
+
+package devicenetwork
+
+type kernelWireless struct{}
+
+func (kernelWireless) Link(ifname string) (wirelessLink, error) {
+	return wirelessLink{}, errWirelessNotSupported
+}
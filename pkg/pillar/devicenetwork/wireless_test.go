@@ -0,0 +1,217 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+func TestMakeWpaSupplicantConf(t *testing.T) {
+	header := "# Written by nim from the DeviceNetworkConfig\nctrl_interface=/run/wpa_supplicant\n"
+	hexPsk := strings.Repeat("0123456789abcdef", 4)
+	for _, test := range []struct {
+		wireless *types.WirelessConfig
+		psk      string
+		expected string
+	}{
+		{nil, "", header},
+		{&types.WirelessConfig{IfName: "wlan0", SSID: "office", CountryCode: "NO"},
+			`pass"word`, header + "country=NO\nnetwork={\n\tssid=6f6666696365\n\tscan_ssid=1\n" +
+				"\tkey_mgmt=WPA-PSK\n\tpsk=\"pass\"word\"\n}\n"},
+		{&types.WirelessConfig{IfName: "wlan0", SSID: "office", KeyMgmt: "WPA-PSK"},
+			hexPsk, header + "network={\n\tssid=6f6666696365\n\tscan_ssid=1\n" +
+				"\tkey_mgmt=WPA-PSK\n\tpsk=" + hexPsk + "\n}\n"},
+		{&types.WirelessConfig{IfName: "wlan0", SSID: "office", KeyMgmt: "SAE"},
+			"password", header + "network={\n\tssid=6f6666696365\n\tscan_ssid=1\n" +
+				"\tkey_mgmt=SAE\n\tsae_password=\"password\"\n\tieee80211w=2\n}\n"},
+		{&types.WirelessConfig{IfName: "wlan0", SSID: "guest", KeyMgmt: "NONE"},
+			"", header + "network={\n\tssid=6775657374\n\tscan_ssid=1\n\tkey_mgmt=NONE\n}\n"},
+	} {
+		if conf := makeWpaSupplicantConf(test.wireless, test.psk); conf != test.expected {
+			t.Errorf("%+v: expected %q, got %q", test.wireless, test.expected, conf)
+		}
+	}
+}
+
+// fakeWpaSupplicant answers OK to the commands on the control socket of
+// ifname and sends them on the channel
+func fakeWpaSupplicant(t *testing.T, ifname string) (chan string, func()) {
+	conn, err := net.ListenUnixgram("unixgram",
+		&net.UnixAddr{Name: filepath.Join(wpaCtrlDir, ifname), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, addr, err := conn.ReadFromUnix(buf)
+			if err != nil {
+				return
+			}
+			commands <- string(buf[:n])
+			conn.WriteToUnix([]byte("OK\n"), addr)
+		}
+	}()
+	return commands, func() { conn.Close() }
+}
+
+func TestApplyWirelessConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wpaSupplicantDir = filepath.Join(dir, "wlan")
+	wpaCtrlDir = filepath.Join(dir, "ctrl")
+	defer func() {
+		wpaSupplicantDir = "/run/wlan"
+		wpaCtrlDir = "/run/wpa_supplicant"
+	}()
+	if err := os.Mkdir(wpaCtrlDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	pskFile := filepath.Join(dir, "office.psk")
+	if err := ioutil.WriteFile(pskFile, []byte("password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	badPskFile := filepath.Join(dir, "short.psk")
+	if err := ioutil.WriteFile(badPskFile, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	commands, stop := fakeWpaSupplicant(t, "wlan0")
+	defer stop()
+
+	// wpa_supplicant is not running on wlan1 yet
+	config := types.DeviceNetworkConfig{
+		Uplink: []string{"wlan0", "wlan1", "wlan2"},
+		Wireless: []types.WirelessConfig{
+			{IfName: "wlan0", SSID: "office", PskFile: pskFile},
+			{IfName: "wlan1", SSID: "guest", KeyMgmt: "NONE"},
+			{IfName: "wlan2", SSID: "lab", PskFile: badPskFile},
+		},
+	}
+	err = ApplyWirelessConfig(config)
+	if err == nil || err.Error() != "Wireless wlan2 has a bad PSK in "+badPskFile+
+		": not 8 to 63 characters" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if command := <-commands; command != "RECONFIGURE" {
+		t.Errorf("unexpected command %q", command)
+	}
+	for ifname, expected := range map[string]string{
+		"wlan0": "\tpsk=\"password\"\n",
+		"wlan1": "\tkey_mgmt=NONE\n",
+	} {
+		conf, err := ioutil.ReadFile(filepath.Join(wpaSupplicantDir, ifname+".conf"))
+		if err != nil || !strings.Contains(string(conf), expected) {
+			t.Errorf("%s: unexpected config %q %v", ifname, conf, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(wpaSupplicantDir, "wlan2.conf")); !os.IsNotExist(err) {
+		t.Errorf("wlan2: unexpected config %v", err)
+	}
+
+	// Not rewritten, and so wpa_supplicant is not asked again
+	config.Wireless = config.Wireless[:2]
+	if err := ApplyWirelessConfig(config); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	// Left without a network
+	if err := ApplyWirelessConfig(types.DeviceNetworkConfig{}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if command := <-commands; command != "RECONFIGURE" {
+		t.Errorf("unexpected command %q", command)
+	}
+	if len(commands) != 0 {
+		t.Errorf("unexpected commands %d", len(commands))
+	}
+	for _, ifname := range []string{"wlan0", "wlan1"} {
+		conf, err := ioutil.ReadFile(filepath.Join(wpaSupplicantDir, ifname+".conf"))
+		if err != nil || string(conf) != makeWpaSupplicantConf(nil, "") {
+			t.Errorf("%s: unexpected config %q %v", ifname, conf, err)
+		}
+	}
+}
+
+type fakeWirelessResult struct {
+	link wirelessLink
+	err  error
+}
+
+// fakeWireless serves the associations from a map
+type fakeWireless map[string]fakeWirelessResult
+
+func (f fakeWireless) Link(ifname string) (wirelessLink, error) {
+	result, ok := f[ifname]
+	if !ok {
+		return wirelessLink{}, errWirelessNotSupported
+	}
+	return result.link, result.err
+}
+
+func TestSetWirelessStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wireless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wpaCtrlDir = dir
+	defer func() { wpaCtrlDir = "/run/wpa_supplicant" }()
+	_, stop := fakeWpaSupplicant(t, "wlan0")
+	defer stop()
+	oldSysClassNet := sysClassNet
+	sysClassNet = filepath.Join(dir, "class", "net")
+	defer func() { sysClassNet = oldSysClassNet }()
+	for _, ifname := range []string{"wlan0", "wlan1", "wlan3"} {
+		if err := os.MkdirAll(filepath.Join(sysClassNet, ifname,
+			"phy80211"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wirelessHandle = fakeWireless{
+		"wlan0": {wirelessLink{ssid: "office", bssid: "02:00:00:00:01:00",
+			freqMHz: 5180, signalDBm: -55}, nil},
+		"wlan1": {wirelessLink{}, nil},
+		"wlan3": {wirelessLink{}, syscall.EIO},
+		// Not asked since not a WiFi interface
+		"eth0": {wirelessLink{}, syscall.EIO},
+	}
+	defer func() { wirelessHandle = kernelWireless{} }()
+	wireless := &types.WirelessConfig{SSID: "office"}
+	for _, test := range []struct {
+		ifname   string
+		wireless *types.WirelessConfig
+		expected *types.WirelessStatus
+	}{
+		{"wlan0", wireless, &types.WirelessStatus{SSID: "office",
+			BSSID: "02:00:00:00:01:00", FreqMHz: 5180, SignalDBm: -55}},
+		// Not associated, and not configured by ApplyWirelessConfig
+		{"wlan1", nil, &types.WirelessStatus{}},
+		{"wlan1", wireless, &types.WirelessStatus{
+			Error: "Port wlan1 has no WiFi association: wpa_supplicant is not running"}},
+		{"eth0", nil, nil},
+		{"wlan2", wireless, &types.WirelessStatus{
+			Error: "Port wlan2 has no WiFi support: nl80211 not supported"}},
+		{"wlan3", nil, &types.WirelessStatus{
+			Error: "Port wlan3 WiFi status not read: input/output error"}},
+	} {
+		port := types.NetworkPortStatus{IfName: test.ifname}
+		setWirelessStatus(&port, test.wireless)
+		if !reflect.DeepEqual(port.Wireless, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.ifname, test.expected,
+				port.Wireless)
+		}
+	}
+}
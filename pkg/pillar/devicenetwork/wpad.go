@@ -9,9 +9,14 @@ import (
 	"fmt"
 	"github.com/lf-edge/eve/pkg/pillar/types"
 	"github.com/lf-edge/eve/pkg/pillar/zedcloud"
+	"github.com/lf-edge/eve/pkg/pillar/zedpac"
 	log "github.com/sirupsen/logrus"
+	"io/ioutil"
 	"mime"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Download a wpad file if so configured
@@ -47,47 +52,164 @@ func CheckAndGetNetworkProxy(deviceNetworkStatus *types.DeviceNetworkStatus,
 		proxyConfig.Pacfile = pac
 		return nil
 	}
-	dn := status.DomainName
-	if dn == "" {
-		errStr := fmt.Sprintf("NetworkProxyEnable for %s but neither a NetworkProxyURL nor a DomainName",
+	return discoverPacFile(deviceNetworkStatus, status)
+}
+
+// How long a discovered Pacfile is used before looking for it again
+var wpadTTL = time.Hour
+
+// The last Pacfile discovered for each port
+var wpadCache struct {
+	sync.Mutex
+	byIfName map[string]types.ProxyConfig
+}
+
+// Replaced by the tests
+var fetchPacFile = getPacFile
+
+// discoverPacFile looks for a Pacfile at the URLs given by the DHCP
+// servers in option 252, else at http://wpad.<domain>/wpad.dat for the
+// DomainName and the search domains, and keeps the first one which gives
+// a proxy for the controller
+func discoverPacFile(deviceNetworkStatus *types.DeviceNetworkStatus,
+	status *types.NetworkPortStatus) error {
+
+	ifname := status.IfName
+	proxyConfig := &status.ProxyConfig
+	wpadCache.Lock()
+	cached, ok := wpadCache.byIfName[ifname]
+	wpadCache.Unlock()
+	if ok && time.Now().Before(cached.WpadExpiry) {
+		log.Infof("discoverPacFile(%s): using %s until %v\n",
+			ifname, cached.WpadURL, cached.WpadExpiry)
+		proxyConfig.Pacfile = cached.Pacfile
+		proxyConfig.WpadURL = cached.WpadURL
+		proxyConfig.WpadExpiry = cached.WpadExpiry
+		proxyConfig.PacResult = cached.PacResult
+		return nil
+	}
+	urls := wpadURLs(status)
+	if len(urls) == 0 {
+		errStr := fmt.Sprintf("NetworkProxyEnable for %s but neither a NetworkProxyURL, a WPAD DHCP option nor a DomainName",
 			ifname)
 		log.Errorln(errStr)
 		return errors.New(errStr)
 	}
-	log.Infof("CheckAndGetNetworkProxy(%s): DomainName %s\n",
-		ifname, dn)
-	// Try http://wpad.%s/wpad.dat", dn where we the leading labels
-	// in DomainName until we succeed
-	for {
-		url := fmt.Sprintf("http://wpad.%s/wpad.dat", dn)
-		pac, err := getPacFile(deviceNetworkStatus, url, ifname)
-		if err == nil {
-			proxyConfig.Pacfile = pac
-			proxyConfig.WpadURL = url
-			return nil
+	controller := controllerURL()
+	var errStrs []string
+	for _, url := range urls {
+		pac, err := fetchPacFile(deviceNetworkStatus, url, ifname)
+		if err != nil {
+			errStr := fmt.Sprintf("Failed to fetch %s for %s: %s",
+				url, ifname, err)
+			log.Warnln(errStr)
+			errStrs = append(errStrs, errStr)
+			continue
 		}
-		errStr := fmt.Sprintf("Failed to fetch %s for %s: %s",
-			url, ifname, err)
-		log.Warnln(errStr)
-		i := strings.Index(dn, ".")
-		if i == -1 {
-			log.Infof("CheckAndGetNetworkProxy(%s): no dots in DomainName %s\n",
-				ifname, dn)
-			log.Errorln(errStr)
-			return errors.New(errStr)
+		result := ""
+		if controller != "" {
+			result, err = evaluatePacFile(pac, controller)
+			if err != nil {
+				errStr := fmt.Sprintf("Bad PAC file %s for %s: %s",
+					url, ifname, err)
+				log.Warnln(errStr)
+				errStrs = append(errStrs, errStr)
+				continue
+			}
 		}
-		b := []byte(dn)
-		dn = string(b[i+1:])
-		// How many dots left? End when we have a TLD i.e., no dots
-		// since wpad.com isn't a useful place to look
-		count := strings.Count(dn, ".")
-		if count == 0 {
-			log.Infof("CheckAndGetNetworkProxy(%s): reached TLD in DomainName %s\n",
-				ifname, dn)
-			log.Errorln(errStr)
-			return errors.New(errStr)
+		log.Infof("discoverPacFile(%s): found %s giving %q\n",
+			ifname, url, result)
+		proxyConfig.Pacfile = pac
+		proxyConfig.WpadURL = url
+		proxyConfig.WpadExpiry = time.Now().Add(wpadTTL)
+		proxyConfig.PacResult = result
+		wpadCache.Lock()
+		if wpadCache.byIfName == nil {
+			wpadCache.byIfName = make(map[string]types.ProxyConfig)
+		}
+		wpadCache.byIfName[ifname] = *proxyConfig
+		wpadCache.Unlock()
+		return nil
+	}
+	errStr := strings.Join(errStrs, "; ")
+	log.Errorln(errStr)
+	return errors.New(errStr)
+}
+
+// wpadURLs returns the URLs where to look for the Pacfile of the port
+func wpadURLs(status *types.NetworkPortStatus) []string {
+	var urls []string
+	add := func(url string) {
+		for _, other := range urls {
+			if other == url {
+				return
+			}
 		}
+		urls = append(urls, url)
+	}
+	leases := getDhcpLeases(status.IfName)
+	// The last one is the latest
+	for i := len(leases) - 1; i >= 0; i-- {
+		if leases[i].wpad != "" {
+			add(leases[i].wpad)
+		}
+	}
+	domains := status.SearchDomains
+	if status.DomainName != "" {
+		domains = append([]string{status.DomainName}, domains...)
+	}
+	// Try http://wpad.<domain>/wpad.dat removing the leading labels of
+	// each domain
+	for _, dn := range domains {
+		dn = strings.TrimSuffix(dn, ".")
+		if dn == "" {
+			continue
+		}
+		add(fmt.Sprintf("http://wpad.%s/wpad.dat", dn))
+		// End when we have a TLD i.e., no dots since wpad.com isn't
+		// a useful place to look
+		for strings.Count(dn, ".") > 1 {
+			dn = dn[strings.Index(dn, ".")+1:]
+			add(fmt.Sprintf("http://wpad.%s/wpad.dat", dn))
+		}
+	}
+	return urls
+}
+
+// controllerURL returns the URL of the controller for FindProxyForURL,
+// empty if unknown
+func controllerURL() string {
+	server, err := ioutil.ReadFile(serverFileName)
+	if err != nil {
+		return ""
+	}
+	serverNameAndPort := strings.TrimSpace(string(server))
+	if serverNameAndPort == "" {
+		return ""
+	}
+	return "https://" + serverNameAndPort + "/"
+}
+
+// evaluatePacFile returns what FindProxyForURL of the base64 encoded
+// pac returns for rawURL, which needs to be parsable
+func evaluatePacFile(pac string, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	contents, err := base64.StdEncoding.DecodeString(pac)
+	if err != nil {
+		return "", err
+	}
+	result, err := zedpac.Find_proxy_sync(string(contents), rawURL,
+		u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	if _, err := zedcloud.ParsePacResult(result); err != nil {
+		return "", err
 	}
+	return result, nil
 }
 
 var ctx = zedcloud.ZedCloudContext{
@@ -0,0 +1,167 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package devicenetwork
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+const testPac = `function FindProxyForURL(url, host) {
+	if (host == "zedcloud.test.net") {
+		return "PROXY proxy.test.net:3128; DIRECT";
+	}
+	return "DIRECT";
+}`
+
+// setupWpad serves testPac, sets the controller and resets the
+// discovered Pacfiles
+func setupWpad(t *testing.T) (*httptest.Server, *int32, func()) {
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		if r.URL.Path != "/wpad.dat" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		fmt.Fprint(w, testPac)
+	}))
+	dir, err := ioutil.TempDir("", "wpad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverFileName = filepath.Join(dir, "server")
+	if err := ioutil.WriteFile(serverFileName, []byte("zedcloud.test.net\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return server, &fetches, func() {
+		server.Close()
+		os.RemoveAll(dir)
+		serverFileName = "/config/server"
+		fetchPacFile = getPacFile
+		wpadCache.Lock()
+		wpadCache.byIfName = nil
+		wpadCache.Unlock()
+	}
+}
+
+func TestDiscoverPacFileFromLease(t *testing.T) {
+	server, fetches, restore := setupWpad(t)
+	defer restore()
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	leaseFile := filepath.Join(dir, "dhclient.lo.leases")
+	lease := fmt.Sprintf("lease {\n  interface \"lo\";\n  fixed-address 127.0.0.1;\n"+
+		"  option wpad \"%s/wpad.dat\";\n  expire never;\n}\n", server.URL)
+	if err := ioutil.WriteFile(leaseFile, []byte(lease), 0644); err != nil {
+		t.Fatal(err)
+	}
+	SetDhcpLeaseFiles("lo", leaseFile)
+	defer SetDhcpLeaseFiles("lo")
+
+	// Fetched from the address of the port
+	status := types.DeviceNetworkStatus{Ports: []types.NetworkPortStatus{{
+		IfName: "lo", IsMgmt: true,
+		AddrInfoList: []types.AddrInfo{{Addr: net.ParseIP("127.0.0.1")}},
+		ProxyConfig:  types.ProxyConfig{NetworkProxyEnable: true},
+	}}}
+	port := status.Ports[0]
+	if err := CheckAndGetNetworkProxy(&status, &port); err != nil {
+		t.Fatalf("CheckAndGetNetworkProxy failed: %v", err)
+	}
+	pac, _ := base64.StdEncoding.DecodeString(port.Pacfile)
+	if string(pac) != testPac || port.WpadURL != server.URL+"/wpad.dat" ||
+		port.PacResult != "PROXY proxy.test.net:3128; DIRECT" ||
+		time.Until(port.WpadExpiry) < wpadTTL-time.Minute {
+		t.Errorf("unexpected %+v", port.ProxyConfig)
+	}
+
+	// Not fetched again until it expires
+	again := status.Ports[0]
+	if err := CheckAndGetNetworkProxy(&status, &again); err != nil ||
+		!reflect.DeepEqual(again, port) || atomic.LoadInt32(fetches) != 1 {
+		t.Errorf("unexpected %+v %v after %d fetches", again.ProxyConfig,
+			err, atomic.LoadInt32(fetches))
+	}
+	wpadCache.Lock()
+	expired := wpadCache.byIfName["lo"]
+	expired.WpadExpiry = time.Now().Add(-time.Second)
+	wpadCache.byIfName["lo"] = expired
+	wpadCache.Unlock()
+	again = status.Ports[0]
+	if err := CheckAndGetNetworkProxy(&status, &again); err != nil ||
+		again.Pacfile != port.Pacfile || !again.WpadExpiry.After(port.WpadExpiry) ||
+		atomic.LoadInt32(fetches) != 2 {
+		t.Errorf("unexpected %+v %v after %d fetches", again.ProxyConfig,
+			err, atomic.LoadInt32(fetches))
+	}
+}
+
+func TestDiscoverPacFileFromDomains(t *testing.T) {
+	_, _, restore := setupWpad(t)
+	defer restore()
+	SetDhcpLeaseFiles("eth0", "/nonexistent")
+	defer SetDhcpLeaseFiles("eth0")
+	var tried []string
+	found := "http://wpad.corp.example.com/wpad.dat"
+	fetchPacFile = func(status *types.DeviceNetworkStatus, url string,
+		ifname string) (string, error) {
+		tried = append(tried, url)
+		if url != found {
+			return "", fmt.Errorf("not found")
+		}
+		return base64.StdEncoding.EncodeToString([]byte(testPac)), nil
+	}
+	status := types.DeviceNetworkStatus{Ports: []types.NetworkPortStatus{{
+		IfName: "eth0", IsMgmt: true,
+		NetworkXObjectConfig: types.NetworkXObjectConfig{DomainName: "lab.example.net"},
+		SearchDomains:        []string{"eng.corp.example.com.", "example.net"},
+		ProxyConfig:          types.ProxyConfig{NetworkProxyEnable: true},
+	}}}
+	port := status.Ports[0]
+	if err := CheckAndGetNetworkProxy(&status, &port); err != nil {
+		t.Fatalf("CheckAndGetNetworkProxy failed: %v", err)
+	}
+	expected := []string{
+		"http://wpad.lab.example.net/wpad.dat",
+		"http://wpad.example.net/wpad.dat",
+		"http://wpad.eng.corp.example.com/wpad.dat",
+		found,
+	}
+	if !reflect.DeepEqual(tried, expected) || port.WpadURL != found {
+		t.Errorf("expected %q, tried %q, found %s", expected, tried,
+			port.WpadURL)
+	}
+
+	// A PAC file which gives no proxy for the controller is skipped
+	wpadCache.Lock()
+	wpadCache.byIfName = nil
+	wpadCache.Unlock()
+	fetchPacFile = func(status *types.DeviceNetworkStatus, url string,
+		ifname string) (string, error) {
+		return base64.StdEncoding.EncodeToString(
+			[]byte(`function FindProxyForURL(url, host) { return "PROXY"; }`)), nil
+	}
+	port = status.Ports[0]
+	if err := CheckAndGetNetworkProxy(&status, &port); err == nil ||
+		port.Pacfile != "" {
+		t.Errorf("no error for a bad PAC file, found %s", port.WpadURL)
+	}
+}
@@ -0,0 +1,504 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// A strict reader for the subset of YAML used by the DeviceNetworkConfig
+// files: block mappings and sequences, flow sequences of scalars, plain
+// and quoted scalars, and comments. Anchors, aliases, tags, multi-line
+// scalars and multiple documents are errors.
+
+package devicenetwork
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type yamlKind int
+
+const (
+	yamlScalar yamlKind = iota
+	yamlMapping
+	yamlSequence
+)
+
+var yamlKindNames = map[yamlKind]string{
+	yamlScalar:   "scalar",
+	yamlMapping:  "mapping",
+	yamlSequence: "sequence",
+}
+
+type yamlNode struct {
+	kind   yamlKind
+	value  string // of a scalar
+	quoted bool
+	keys   []*yamlNode // of a mapping
+	values []*yamlNode // of the keys of a mapping, or the items
+	line   int
+	col    int
+}
+
+// yamlError is an error at a line and column, starting at 1
+type yamlError struct {
+	line int
+	col  int
+	msg  string
+}
+
+func (e *yamlError) Error() string {
+	return fmt.Sprintf("line %d column %d: %s", e.line, e.col, e.msg)
+}
+
+func yamlErrorf(line int, col int, format string, args ...interface{}) error {
+	return &yamlError{line: line, col: col, msg: fmt.Sprintf(format, args...)}
+}
+
+// yamlLine is a line with content, without its indentation and comment
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// unmarshalYAML decodes data into the struct v points to. Its fields
+// are matched like encoding/json does, and unknown fields are errors.
+func unmarshalYAML(data []byte, v interface{}) error {
+	node, err := parseYAML(data)
+	if err != nil || node == nil {
+		return err
+	}
+	return decodeYAML(node, reflect.ValueOf(v).Elem())
+}
+
+// parseYAML returns the document of data, nil if empty
+func parseYAML(data []byte) (*yamlNode, error) {
+	lines, err := splitYAMLLines(string(data))
+	if err != nil || len(lines) == 0 {
+		return nil, err
+	}
+	p := &yamlParser{lines: lines}
+	node, err := p.parseBlock(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(lines) {
+		l := lines[p.pos]
+		return nil, yamlErrorf(l.num, l.indent+1, "unexpected %q", l.text)
+	}
+	return node, nil
+}
+
+func splitYAMLLines(data string) ([]yamlLine, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(data, "\n") {
+		num := i + 1
+		raw = strings.TrimRight(raw, "\r")
+		text := strings.TrimLeft(raw, " ")
+		indent := len(raw) - len(text)
+		if strings.HasPrefix(text, "\t") {
+			return nil, yamlErrorf(num, indent+1, "tabs are not allowed for indentation")
+		}
+		text = strings.TrimRight(stripYAMLComment(text), " \t")
+		if text == "" {
+			continue
+		}
+		if indent == 0 && (text == "---" || text == "...") {
+			if text == "---" && len(lines) == 0 {
+				continue
+			}
+			return nil, yamlErrorf(num, 1, "multiple documents are not supported")
+		}
+		lines = append(lines, yamlLine{num: num, indent: indent, text: text})
+	}
+	return lines, nil
+}
+
+// stripYAMLComment removes a # comment which is not in a quoted scalar
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func isYAMLSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// parseBlock parses the node starting at the current line, which has
+// the indent
+func (p *yamlParser) parseBlock(indent int) (*yamlNode, error) {
+	l := p.lines[p.pos]
+	if isYAMLSequenceItem(l.text) {
+		return p.parseSequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(l.text); ok {
+		return p.parseMapping(indent)
+	}
+	p.pos++
+	return parseYAMLFlow(l.text, l.num, l.indent+1)
+}
+
+func (p *yamlParser) parseSequence(indent int) (*yamlNode, error) {
+	node := &yamlNode{kind: yamlSequence, line: p.lines[p.pos].num,
+		col: indent + 1}
+	for p.pos < len(p.lines) {
+		l := &p.lines[p.pos]
+		if l.indent < indent || !isYAMLSequenceItem(l.text) {
+			break
+		}
+		if l.indent > indent {
+			return nil, yamlErrorf(l.num, l.indent+1, "unexpected indentation")
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		var item *yamlNode
+		var err error
+		if rest == "" {
+			p.pos++
+			item, err = p.parseNested(indent, l.num, l.indent+2)
+		} else {
+			// The item starts on this line, as a block at its column
+			l.indent += len(l.text) - len(rest)
+			l.text = rest
+			item, err = p.parseBlock(l.indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+		node.values = append(node.values, item)
+		if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+			l := p.lines[p.pos]
+			return nil, yamlErrorf(l.num, l.indent+1, "unexpected indentation")
+		}
+	}
+	return node, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (*yamlNode, error) {
+	node := &yamlNode{kind: yamlMapping, line: p.lines[p.pos].num,
+		col: indent + 1}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, yamlErrorf(l.num, l.indent+1, "unexpected indentation")
+		}
+		key, restCol, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, yamlErrorf(l.num, l.indent+1, "expected a key, got %q", l.text)
+		}
+		keyNode, err := parseYAMLScalar(key, l.num, l.indent+1)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range node.keys {
+			if other.value == keyNode.value {
+				return nil, yamlErrorf(l.num, l.indent+1, "duplicate key %q", key)
+			}
+		}
+		p.pos++
+		var value *yamlNode
+		rest := l.text[restCol:]
+		if rest != "" {
+			value, err = parseYAMLFlow(rest, l.num, l.indent+restCol+1)
+		} else if p.pos < len(p.lines) && p.lines[p.pos].indent == indent &&
+			isYAMLSequenceItem(p.lines[p.pos].text) {
+			// A sequence can be indented like its key
+			value, err = p.parseSequence(indent)
+		} else {
+			value, err = p.parseNested(indent, l.num, l.indent+len(l.text)+1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		node.keys = append(node.keys, keyNode)
+		node.values = append(node.values, value)
+	}
+	return node, nil
+}
+
+// parseNested parses the block on the next lines if more indented, else
+// returns a null at line and col
+func (p *yamlParser) parseNested(indent int, line int, col int) (*yamlNode, error) {
+	if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		return p.parseBlock(p.lines[p.pos].indent)
+	}
+	return &yamlNode{kind: yamlScalar, line: line, col: col}, nil
+}
+
+// splitYAMLKey returns the key of a "key: value" line and the offset of
+// the value
+func splitYAMLKey(text string) (string, int, bool) {
+	end := 0
+	if text[0] == '"' || text[0] == '\'' {
+		end = closingYAMLQuote(text)
+		if end < 0 {
+			return "", 0, false
+		}
+		end++
+	}
+	for colon := end; colon < len(text); colon++ {
+		if text[colon] != ':' ||
+			(colon+1 < len(text) && text[colon+1] != ' ') {
+			continue
+		}
+		if end != 0 && strings.TrimSpace(text[end:colon]) != "" {
+			// Something between the quoted key and the colon
+			return "", 0, false
+		}
+		key := strings.TrimSpace(text[:colon])
+		rest := colon + 1
+		for rest < len(text) && text[rest] == ' ' {
+			rest++
+		}
+		return key, rest, key != ""
+	}
+	return "", 0, false
+}
+
+// closingYAMLQuote returns the offset of the quote closing the one
+// text starts with, -1 if none
+func closingYAMLQuote(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case text[i] != quote:
+		case quote == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		default:
+			return i
+		}
+	}
+	return -1
+}
+
+// parseYAMLFlow parses a scalar or a flow sequence of scalars
+func parseYAMLFlow(text string, line int, col int) (*yamlNode, error) {
+	switch text[0] {
+	case '{':
+		if text == "{}" {
+			return &yamlNode{kind: yamlMapping, line: line, col: col}, nil
+		}
+		return nil, yamlErrorf(line, col, "flow mappings are not supported")
+	case '[':
+	default:
+		return parseYAMLScalar(text, line, col)
+	}
+	node := &yamlNode{kind: yamlSequence, line: line, col: col}
+	if !strings.HasSuffix(text, "]") {
+		return nil, yamlErrorf(line, col, "unterminated flow sequence")
+	}
+	inner := text[1 : len(text)-1]
+	if strings.TrimSpace(inner) == "" {
+		return node, nil
+	}
+	start := 0
+	for start <= len(inner) {
+		end := start
+		for end < len(inner) && inner[end] != ',' {
+			if inner[end] == '"' || inner[end] == '\'' {
+				closing := closingYAMLQuote(inner[end:])
+				if closing < 0 {
+					return nil, yamlErrorf(line, col+1+end, "unterminated quoted scalar")
+				}
+				end += closing
+			}
+			end++
+		}
+		item := strings.TrimLeft(inner[start:end], " ")
+		itemCol := col + 1 + start + len(inner[start:end]) - len(item)
+		item = strings.TrimRight(item, " ")
+		if item == "" {
+			return nil, yamlErrorf(line, itemCol, "empty flow sequence item")
+		}
+		if item[0] == '[' || item[0] == '{' {
+			return nil, yamlErrorf(line, itemCol, "nested flow collections are not supported")
+		}
+		scalar, err := parseYAMLScalar(item, line, itemCol)
+		if err != nil {
+			return nil, err
+		}
+		node.values = append(node.values, scalar)
+		start = end + 1
+	}
+	return node, nil
+}
+
+func parseYAMLScalar(text string, line int, col int) (*yamlNode, error) {
+	node := &yamlNode{kind: yamlScalar, line: line, col: col}
+	switch text[0] {
+	case '"':
+		if closingYAMLQuote(text) != len(text)-1 {
+			return nil, yamlErrorf(line, col, "bad double-quoted scalar %s", text)
+		}
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, yamlErrorf(line, col, "bad double-quoted scalar %s", text)
+		}
+		node.value = value
+		node.quoted = true
+		return node, nil
+	case '\'':
+		if closingYAMLQuote(text) != len(text)-1 {
+			return nil, yamlErrorf(line, col, "bad single-quoted scalar %s", text)
+		}
+		node.value = strings.Replace(text[1:len(text)-1], "''", "'", -1)
+		node.quoted = true
+		return node, nil
+	case '&', '*', '!', '|', '>', '%', '@', '`', ']', '}':
+		// e.g. !docker* is a tag
+		return nil, yamlErrorf(line, col, "%q is not supported at the start of a plain scalar, quote %s",
+			text[0], text)
+	}
+	if strings.Contains(text, ": ") || strings.HasSuffix(text, ":") {
+		return nil, yamlErrorf(line, col, "mapping values are not allowed here")
+	}
+	node.value = text
+	return node, nil
+}
+
+func isYAMLNull(node *yamlNode) bool {
+	if node.kind != yamlScalar || node.quoted {
+		return false
+	}
+	switch node.value {
+	case "", "~", "null", "Null", "NULL":
+		return true
+	}
+	return false
+}
+
+// decodeYAML sets v from node
+func decodeYAML(node *yamlNode, v reflect.Value) error {
+	if isYAMLNull(node) {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	// Such as net.IP, from a scalar like encoding/json from a string
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		if node.kind != yamlScalar {
+			return yamlTypeError(node, v, yamlScalar)
+		}
+		if err := u.UnmarshalText([]byte(node.value)); err != nil {
+			return yamlErrorf(node.line, node.col, "%q is not a %s: %s",
+				node.value, v.Type(), err)
+		}
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		if node.kind != yamlMapping {
+			return yamlTypeError(node, v, yamlMapping)
+		}
+		for i, key := range node.keys {
+			field, ok := yamlField(v, key.value)
+			if !ok {
+				return yamlErrorf(key.line, key.col, "unknown field %q in %s",
+					key.value, v.Type().Name())
+			}
+			if err := decodeYAML(node.values[i], field); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if node.kind != yamlSequence {
+			return yamlTypeError(node, v, yamlSequence)
+		}
+		items := reflect.MakeSlice(v.Type(), len(node.values), len(node.values))
+		for i, item := range node.values {
+			if err := decodeYAML(item, items.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(items)
+	case reflect.String:
+		if node.kind != yamlScalar {
+			return yamlTypeError(node, v, yamlScalar)
+		}
+		v.SetString(node.value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if node.kind != yamlScalar {
+			return yamlTypeError(node, v, yamlScalar)
+		}
+		n, err := strconv.ParseInt(node.value, 10, v.Type().Bits())
+		if err != nil || node.quoted {
+			return yamlErrorf(node.line, node.col, "%q is not an integer", node.value)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if node.kind != yamlScalar {
+			return yamlTypeError(node, v, yamlScalar)
+		}
+		n, err := strconv.ParseUint(node.value, 10, v.Type().Bits())
+		if err != nil || node.quoted {
+			return yamlErrorf(node.line, node.col, "%q is not an unsigned integer",
+				node.value)
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		if node.kind != yamlScalar {
+			return yamlTypeError(node, v, yamlScalar)
+		}
+		b, ok := map[string]bool{"true": true, "false": false}[node.value]
+		if !ok || node.quoted {
+			return yamlErrorf(node.line, node.col, "%q is not a boolean", node.value)
+		}
+		v.SetBool(b)
+	default:
+		return yamlErrorf(node.line, node.col, "%s is not supported", v.Type())
+	}
+	return nil
+}
+
+func yamlTypeError(node *yamlNode, v reflect.Value, expected yamlKind) error {
+	return yamlErrorf(node.line, node.col, "expected a %s for %s, got a %s",
+		yamlKindNames[expected], v.Type(), yamlKindNames[node.kind])
+}
+
+// yamlField returns the field of the struct v for key, by its json name
+// else its name, ignoring the case like encoding/json
+func yamlField(v reflect.Value, key string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if tag != "" {
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
@@ -40,10 +40,15 @@ type GlobalConfig struct {
 	// Control NIM testing behavior: In seconds
 	NetworkGeoRedoTime        uint32   // Periodic IP geolocation
 	NetworkGeoRetryTime       uint32   // Redo IP geolocation failure
+	NetworkGeoDisable         bool     // Never look up the IP geolocation
+	NetworkLinkLocalInclude   bool     // Report the IPv4 link-local addresses
+	NetworkCandidatesReport   bool     // Report the interfaces not ports
 	NetworkTestDuration       uint32   // Time we wait for DHCP to complete
 	NetworkTestInterval       uint32   // Re-test DevicePortConfig
 	NetworkTestBetterInterval uint32   // Look for better DevicePortConfig
 	NetworkFallbackAnyEth     TriState // When no connectivity try any Ethernet; XXX LTE?
+	// What to do with the IPv6 link-local addresses of the ports
+	NetworkLinkLocal6 LinkLocal6Mode
 
 	// UsbAccess
 	// Determines if Dom0 can use USB devices.
@@ -0,0 +1,245 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Compare two DeviceNetworkStatus for the changes worth publishing
+
+package types
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// StatusDiffOption makes DiffDeviceNetworkStatus compare more fields
+type StatusDiffOption int
+
+const (
+	// DiffGeo compares Geo and LastGeoTimestamp of the addresses
+	DiffGeo StatusDiffOption = iota
+	// DiffCounters compares the traffic counters, the WiFi signal levels
+	// and the lifetimes of the IPv6 router advertisements of the ports
+	DiffCounters
+	// DiffProbes compares the outcomes of the probes of the ports
+	DiffProbes
+)
+
+// EqualDeviceNetworkStatus returns true if DiffDeviceNetworkStatus finds
+// no change
+func EqualDeviceNetworkStatus(a, b DeviceNetworkStatus,
+	options ...StatusDiffOption) bool {
+
+	return len(DiffDeviceNetworkStatus(a, b, options...)) == 0
+}
+
+// DiffDeviceNetworkStatus returns the changes from a to b, one per line
+// such as "eth0: lost address 192.168.1.5". The ports and the Candidates
+// are matched by IfName and the order of the addresses is ignored. So are
+// the Geo information, the counters, the signal levels, the IPv6 lifetimes
+// and the probes, which are refreshed all the time, unless the options ask
+// for them.
+func DiffDeviceNetworkStatus(a, b DeviceNetworkStatus,
+	options ...StatusDiffOption) []string {
+
+	withGeo, withCounters, withProbes := false, false, false
+	for _, option := range options {
+		switch option {
+		case DiffGeo:
+			withGeo = true
+		case DiffCounters:
+			withCounters = true
+		case DiffProbes:
+			withProbes = true
+		}
+	}
+	var diffs []string
+	if a.Version != b.Version {
+		diffs = append(diffs, fmt.Sprintf("Version changed from %d to %d",
+			a.Version, b.Version))
+	}
+	if a.Testing != b.Testing {
+		diffs = append(diffs, fmt.Sprintf("Testing changed from %t to %t",
+			a.Testing, b.Testing))
+	}
+	// The order of the ports in both
+	var aNames, bNames []string
+	for _, aPort := range a.Ports {
+		bPort := lookupPortStatus(b, aPort.IfName)
+		if bPort == nil {
+			diffs = append(diffs, fmt.Sprintf("%s: removed", aPort.IfName))
+			continue
+		}
+		aNames = append(aNames, aPort.IfName)
+		diffs = append(diffs, diffPortStatus(aPort, *bPort, withGeo,
+			withCounters, withProbes)...)
+	}
+	for _, bPort := range b.Ports {
+		if lookupPortStatus(a, bPort.IfName) == nil {
+			diffs = append(diffs, fmt.Sprintf("%s: added", bPort.IfName))
+		} else {
+			bNames = append(bNames, bPort.IfName)
+		}
+	}
+	if !reflect.DeepEqual(aNames, bNames) {
+		diffs = append(diffs, fmt.Sprintf("Ports reordered from %v to %v",
+			aNames, bNames))
+	}
+	aCandidates := make(map[string]CandidatePort)
+	for _, candidate := range a.Candidates {
+		aCandidates[candidate.IfName] = candidate
+	}
+	for _, bCandidate := range b.Candidates {
+		aCandidate, ok := aCandidates[bCandidate.IfName]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("Candidate %s: added %s",
+				bCandidate.IfName, bCandidate.HwID))
+		} else if aCandidate != bCandidate {
+			diffs = append(diffs, fmt.Sprintf("Candidate %s: changed to %s",
+				bCandidate.IfName, bCandidate.HwID))
+		}
+		delete(aCandidates, bCandidate.IfName)
+	}
+	for _, aCandidate := range a.Candidates {
+		if _, ok := aCandidates[aCandidate.IfName]; ok {
+			diffs = append(diffs, fmt.Sprintf("Candidate %s: removed",
+				aCandidate.IfName))
+		}
+	}
+	return diffs
+}
+
+func lookupPortStatus(status DeviceNetworkStatus, ifname string) *NetworkPortStatus {
+	for i := range status.Ports {
+		if status.Ports[i].IfName == ifname {
+			return &status.Ports[i]
+		}
+	}
+	return nil
+}
+
+// diffPortStatus returns the changes from a to b of the same port
+func diffPortStatus(a, b NetworkPortStatus, withGeo, withCounters,
+	withProbes bool) []string {
+
+	var diffs []string
+	aAddrs := make(map[string]AddrInfo)
+	for _, ai := range a.AddrInfoList {
+		aAddrs[ai.Addr.String()] = ai
+	}
+	bAddrs := make(map[string]AddrInfo)
+	for _, ai := range b.AddrInfoList {
+		bAddrs[ai.Addr.String()] = ai
+	}
+	for _, addr := range sortedAddrs(aAddrs) {
+		bAI, ok := bAddrs[addr]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: lost address %s",
+				a.IfName, addr))
+		} else if withGeo && (!reflect.DeepEqual(aAddrs[addr].Geo, bAI.Geo) ||
+			!aAddrs[addr].LastGeoTimestamp.Equal(bAI.LastGeoTimestamp)) {
+			diffs = append(diffs, fmt.Sprintf("%s: address %s Geo changed to %+v",
+				a.IfName, addr, bAI.Geo))
+		}
+	}
+	for _, addr := range sortedAddrs(bAddrs) {
+		if _, ok := aAddrs[addr]; !ok {
+			diffs = append(diffs, fmt.Sprintf("%s: gained address %s",
+				a.IfName, addr))
+		}
+	}
+	if withCounters && a.Counters != b.Counters {
+		diffs = append(diffs, fmt.Sprintf("%s: Counters changed to %+v",
+			a.IfName, b.Counters))
+	}
+	if withProbes && !reflect.DeepEqual(a.Probe, b.Probe) {
+		diffs = append(diffs, fmt.Sprintf("%s: Probe changed to %+v",
+			a.IfName, b.Probe))
+	}
+	if a.Wireless != nil && b.Wireless != nil {
+		if withCounters && a.Wireless.SignalDBm != b.Wireless.SignalDBm {
+			diffs = append(diffs, fmt.Sprintf("%s: Signal changed to %d dBm",
+				a.IfName, b.Wireless.SignalDBm))
+		}
+		// Copies since shared with the callers
+		aWireless, bWireless := *a.Wireless, *b.Wireless
+		aWireless.SignalDBm, bWireless.SignalDBm = 0, 0
+		a.Wireless, b.Wireless = &aWireless, &bWireless
+	}
+	if a.IPv6RA != nil && b.IPv6RA != nil && !withCounters {
+		// Copies since shared with the callers
+		a.IPv6RA, b.IPv6RA = withoutLifetimes(*a.IPv6RA), withoutLifetimes(*b.IPv6RA)
+	}
+	// Compared above
+	a.AddrInfoList, b.AddrInfoList = nil, nil
+	a.Counters, b.Counters = PortCounters{}, PortCounters{}
+	a.Probe, b.Probe = UplinkProbe{}, UplinkProbe{}
+	return append(diffs, diffFields(a.IfName, reflect.ValueOf(a),
+		reflect.ValueOf(b))...)
+}
+
+// withoutLifetimes returns a copy of the router advertisements with the
+// lifetimes zeroed
+func withoutLifetimes(ra IPv6RAStatus) *IPv6RAStatus {
+	ra.Routers = append([]IPv6Router(nil), ra.Routers...)
+	for i := range ra.Routers {
+		ra.Routers[i].Lifetime = 0
+	}
+	ra.Prefixes = append([]IPv6Prefix(nil), ra.Prefixes...)
+	for i := range ra.Prefixes {
+		ra.Prefixes[i].PreferredLifetime = 0
+		ra.Prefixes[i].ValidLifetime = 0
+	}
+	return &ra
+}
+
+func sortedAddrs(addrs map[string]AddrInfo) []string {
+	var keys []string
+	for addr := range addrs {
+		keys = append(keys, addr)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diffFields returns the fields of the structs a and b which differ,
+// including those of the embedded structs
+func diffFields(ifname string, a, b reflect.Value) []string {
+	var diffs []string
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		aField, bField := a.Field(i), b.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			diffs = append(diffs, diffFields(ifname, aField, bField)...)
+			continue
+		}
+		if reflect.DeepEqual(aField.Interface(), bField.Interface()) {
+			continue
+		}
+		diffs = append(diffs, fmt.Sprintf("%s: %s changed from %s to %s",
+			ifname, field.Name, formatField(aField), formatField(bField)))
+	}
+	return diffs
+}
+
+func formatField(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return "none"
+		}
+		return fmt.Sprintf("%+v", v.Elem().Interface())
+	case reflect.String:
+		return fmt.Sprintf("%q", v.String())
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return "none"
+		}
+		var strs []string
+		for i := 0; i < v.Len(); i++ {
+			strs = append(strs, fmt.Sprintf("%v", v.Index(i).Interface()))
+		}
+		return "[" + strings.Join(strs, " ") + "]"
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
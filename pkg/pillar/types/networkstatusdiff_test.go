@@ -0,0 +1,186 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package types
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eriknordmark/ipinfo"
+)
+
+func makeTestStatus() DeviceNetworkStatus {
+	return DeviceNetworkStatus{
+		Version: DPCIsMgmt,
+		Ports: []NetworkPortStatus{
+			{
+				IfName: "eth0",
+				IsMgmt: true,
+				AddrInfoList: []AddrInfo{
+					{Addr: net.ParseIP("192.168.1.5")},
+					{Addr: net.ParseIP("fe80::1")},
+				},
+			},
+			{
+				IfName: "eth1",
+				AddrInfoList: []AddrInfo{
+					{Addr: net.ParseIP("10.0.0.2")},
+				},
+			},
+		},
+		Candidates: []CandidatePort{
+			{IfName: "eth2", MacAddr: "02:00:00:00:00:02", HwID: "pci:0000:03:00.0"},
+		},
+	}
+}
+
+func TestDiffDeviceNetworkStatus(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		change   func(status *DeviceNetworkStatus)
+		options  []StatusDiffOption
+		expected []string
+	}{
+		{"none", func(status *DeviceNetworkStatus) {}, nil, nil},
+		{"reordered addresses", func(status *DeviceNetworkStatus) {
+			addrs := status.Ports[0].AddrInfoList
+			addrs[0], addrs[1] = addrs[1], addrs[0]
+		}, nil, nil},
+		{"address added and removed", func(status *DeviceNetworkStatus) {
+			status.Ports[0].AddrInfoList[0].Addr = net.ParseIP("192.168.1.6")
+		}, nil, []string{
+			"eth0: lost address 192.168.1.5",
+			"eth0: gained address 192.168.1.6",
+		}},
+		{"uplink added and removed", func(status *DeviceNetworkStatus) {
+			status.Ports[1].IfName = "eth2"
+		}, nil, []string{"eth1: removed", "eth2: added"}},
+		{"reordered uplinks", func(status *DeviceNetworkStatus) {
+			status.Ports[0], status.Ports[1] = status.Ports[1], status.Ports[0]
+		}, nil, []string{"Ports reordered from [eth0 eth1] to [eth1 eth0]"}},
+		{"candidates added and removed", func(status *DeviceNetworkStatus) {
+			status.Candidates = []CandidatePort{{IfName: "enx020000000003",
+				MacAddr: "02:00:00:00:00:03", HwID: "mac:02:00:00:00:00:03"}}
+		}, nil, []string{
+			"Candidate enx020000000003: added mac:02:00:00:00:00:03",
+			"Candidate eth2: removed",
+		}},
+		{"geo only", func(status *DeviceNetworkStatus) {
+			status.Ports[1].AddrInfoList[0].Geo = ipinfo.IPInfo{IP: "10.0.0.2"}
+			status.Ports[1].AddrInfoList[0].LastGeoTimestamp = time.Now()
+		}, nil, nil},
+		{"geo included", func(status *DeviceNetworkStatus) {
+			status.Ports[1].AddrInfoList[0].Geo = ipinfo.IPInfo{City: "Oslo"}
+		}, []StatusDiffOption{DiffGeo}, []string{
+			"eth1: address 10.0.0.2 Geo changed to {IP: Hostname: City:Oslo Region: Country: Loc: Org: Postal:}",
+		}},
+		{"counters only", func(status *DeviceNetworkStatus) {
+			status.Ports[0].Counters.RxBytes = 100
+		}, nil, nil},
+		{"counters included", func(status *DeviceNetworkStatus) {
+			status.Ports[0].Counters.RxBytes = 100
+		}, []StatusDiffOption{DiffCounters}, []string{
+			"eth0: Counters changed to {RxBytes:100 TxBytes:0 RxPkts:0 TxPkts:0 RxErrors:0 TxErrors:0 RxDrops:0 TxDrops:0}",
+		}},
+		{"probes only", func(status *DeviceNetworkStatus) {
+			status.Ports[0].Probe.LastProbeSuccess = time.Now()
+		}, nil, nil},
+		{"probes included", func(status *DeviceNetworkStatus) {
+			status.Ports[1].Probe.ProbeError = "timeout"
+		}, []StatusDiffOption{DiffProbes}, []string{
+			"eth1: Probe changed to {LastProbeSuccess:0001-01-01 00:00:00 +0000 UTC LastProbeError:0001-01-01 00:00:00 +0000 UTC ProbeError:timeout Latency:0s Addr:<nil>}",
+		}},
+		{"other fields", func(status *DeviceNetworkStatus) {
+			status.Testing = true
+			status.Ports[0].Error = "no carrier"
+			status.Ports[0].DnsServers = []net.IP{net.ParseIP("8.8.8.8")}
+			status.Ports[1].DefaultGateway = &GatewayRoute{
+				Gateway: net.ParseIP("10.0.0.1")}
+		}, nil, []string{
+			"Testing changed from false to true",
+			"eth0: DnsServers changed from none to [8.8.8.8]",
+			`eth0: Error changed from "" to "no carrier"`,
+			"eth1: DefaultGateway changed from none to {Gateway:10.0.0.1 Metric:0}",
+		}},
+	} {
+		old := makeTestStatus()
+		status := makeTestStatus()
+		test.change(&status)
+		diffs := DiffDeviceNetworkStatus(old, status, test.options...)
+		if !reflect.DeepEqual(diffs, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, diffs)
+		}
+		if EqualDeviceNetworkStatus(old, status, test.options...) != (len(test.expected) == 0) {
+			t.Errorf("%s: unexpected EqualDeviceNetworkStatus", test.name)
+		}
+	}
+}
+
+func TestDiffWirelessStatus(t *testing.T) {
+	old := makeTestStatus()
+	old.Ports[1].IfName = "wlan0"
+	old.Ports[1].Wireless = &WirelessStatus{SSID: "office",
+		BSSID: "02:00:00:00:01:00", FreqMHz: 2412, SignalDBm: -60}
+	status := old
+	status.Ports = append([]NetworkPortStatus(nil), old.Ports...)
+	wireless := *old.Ports[1].Wireless
+	status.Ports[1].Wireless = &wireless
+
+	wireless.SignalDBm = -70
+	if diffs := DiffDeviceNetworkStatus(old, status); len(diffs) != 0 {
+		t.Errorf("unexpected %q", diffs)
+	}
+	expected := []string{"wlan0: Signal changed to -70 dBm"}
+	if diffs := DiffDeviceNetworkStatus(old, status, DiffCounters); !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expected %q, got %q", expected, diffs)
+	}
+	wireless.SSID = "guest"
+	expected = []string{"wlan0: Wireless changed from {SSID:office BSSID:02:00:00:00:01:00 FreqMHz:2412 SignalDBm:0 Error:} to {SSID:guest BSSID:02:00:00:00:01:00 FreqMHz:2412 SignalDBm:0 Error:}"}
+	if diffs := DiffDeviceNetworkStatus(old, status); !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expected %q, got %q", expected, diffs)
+	}
+	if old.Ports[1].Wireless.SignalDBm != -60 || wireless.SignalDBm != -70 {
+		t.Errorf("signal levels changed by the diff")
+	}
+}
+
+func TestDiffIPv6RA(t *testing.T) {
+	makeRA := func(lifetime uint32, managed bool) *IPv6RAStatus {
+		_, prefix, _ := net.ParseCIDR("2001:db8:1::/64")
+		return &IPv6RAStatus{
+			Managed: managed,
+			Routers: []IPv6Router{{Addr: net.ParseIP("fe80::1"),
+				Lifetime: lifetime, Preference: "medium"}},
+			Prefixes: []IPv6Prefix{{Prefix: *prefix,
+				PreferredLifetime: lifetime, ValidLifetime: 2 * lifetime}},
+		}
+	}
+	old := makeTestStatus()
+	old.Ports[0].IPv6RA = makeRA(1800, false)
+	status := makeTestStatus()
+	status.Ports[0].IPv6RA = makeRA(1790, false)
+
+	if diffs := DiffDeviceNetworkStatus(old, status); len(diffs) != 0 {
+		t.Errorf("unexpected %q", diffs)
+	}
+	if diffs := DiffDeviceNetworkStatus(old, status, DiffCounters); len(diffs) != 1 {
+		t.Errorf("unexpected %q", diffs)
+	}
+	status.Ports[0].IPv6RA.Managed = true
+	if diffs := DiffDeviceNetworkStatus(old, status); len(diffs) != 1 ||
+		!strings.HasPrefix(diffs[0], "eth0: IPv6RA changed from") {
+		t.Errorf("unexpected %q", diffs)
+	}
+	status.Ports[0].IPv6RA = nil
+	expected := []string{"eth0: IPv6RA changed from {Managed:false OtherConfig:false Routers:[{Addr:fe80::1 Lifetime:1800 Preference:medium}] Prefixes:[{Prefix:{IP:2001:db8:1:: Mask:ffffffffffffffff0000000000000000} PreferredLifetime:1800 ValidLifetime:3600}] RDNSS:[]} to none"}
+	if diffs := DiffDeviceNetworkStatus(old, status); !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expected %q, got %q", expected, diffs)
+	}
+	if old.Ports[0].IPv6RA.Routers[0].Lifetime != 1800 {
+		t.Errorf("lifetimes changed by the diff")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// Pick the uplinks by their cost
+
+package types
+
+import (
+	"net"
+	"sort"
+)
+
+// UplinksByCost returns the management ports of status from the cheapest
+// to the most expensive, in their order for the same Cost
+func UplinksByCost(status DeviceNetworkStatus) []NetworkPortStatus {
+	var uplinks []NetworkPortStatus
+	for _, port := range status.Ports {
+		if port.IsMgmt {
+			uplinks = append(uplinks, port)
+		}
+	}
+	sort.SliceStable(uplinks, func(i, j int) bool {
+		return uplinks[i].Cost < uplinks[j].Cost
+	})
+	return uplinks
+}
+
+// OrderedUplinks returns the management ports of status in the order to
+// try them: those with a Priority by Priority, then Cost, then IfName, and
+// then the others in their order
+func OrderedUplinks(status DeviceNetworkStatus) []NetworkPortStatus {
+	var uplinks []NetworkPortStatus
+	for _, port := range status.Ports {
+		if port.IsMgmt {
+			uplinks = append(uplinks, port)
+		}
+	}
+	sort.SliceStable(uplinks, func(i, j int) bool {
+		pi, pj := uplinks[i], uplinks[j]
+		if pi.Priority == 0 || pj.Priority == 0 {
+			return pj.Priority == 0 && pi.Priority != 0
+		}
+		if pi.Priority != pj.Priority {
+			return pi.Priority < pj.Priority
+		}
+		if pi.Cost != pj.Cost {
+			return pi.Cost < pj.Cost
+		}
+		return pi.IfName < pj.IfName
+	})
+	return uplinks
+}
+
+// AddrsUpToCost returns the addresses of the management ports of at most
+// maxCost, excluding the link-local ones, in the order of UplinksByCost.
+// An AddrsUpToCost(status, 0) only has those of the free ports.
+func AddrsUpToCost(status DeviceNetworkStatus, maxCost uint8) []net.IP {
+	var addrs []net.IP
+	for _, port := range UplinksByCost(status) {
+		if port.Cost > maxCost {
+			break
+		}
+		for _, ai := range port.AddrInfoList {
+			if ai.Addr.IsLinkLocalUnicast() || ai.LinkLocal {
+				continue
+			}
+			addrs = append(addrs, ai.Addr)
+		}
+	}
+	return addrs
+}
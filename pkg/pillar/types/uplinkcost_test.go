@@ -0,0 +1,80 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package types
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestUplinksByCost(t *testing.T) {
+	addrs := func(addrs ...string) []AddrInfo {
+		var list []AddrInfo
+		for _, addr := range addrs {
+			list = append(list, AddrInfo{Addr: net.ParseIP(addr)})
+		}
+		return list
+	}
+	status := DeviceNetworkStatus{
+		Version: DPCIsMgmt,
+		Ports: []NetworkPortStatus{
+			{IfName: "wwan0", IsMgmt: true, Cost: 100, AddrInfoList: addrs("10.0.0.10")},
+			{IfName: "eth0", IsMgmt: true, Free: true,
+				AddrInfoList: addrs("192.168.0.10", "fe80::1")},
+			{IfName: "eth1", Free: true, AddrInfoList: addrs("192.168.2.10")},
+			{IfName: "wlan0", IsMgmt: true, Cost: 100, AddrInfoList: addrs("192.168.1.10")},
+			{IfName: "sat0", IsMgmt: true, Cost: 255, AddrInfoList: addrs("10.1.0.10")},
+		},
+	}
+	var found []string
+	for _, port := range UplinksByCost(status) {
+		found = append(found, port.IfName)
+	}
+	expected := []string{"eth0", "wwan0", "wlan0", "sat0"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %v, got %v", expected, found)
+	}
+
+	// Without a Priority, as in the older configs
+	found = nil
+	for _, port := range OrderedUplinks(status) {
+		found = append(found, port.IfName)
+	}
+	expected = []string{"wwan0", "eth0", "wlan0", "sat0"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %v, got %v", expected, found)
+	}
+	status.Ports[4].Priority = 1
+	status.Ports[3].Priority = 2
+	status.Ports[0].Priority = 2
+	found = nil
+	for _, port := range OrderedUplinks(status) {
+		found = append(found, port.IfName)
+	}
+	expected = []string{"sat0", "wlan0", "wwan0", "eth0"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("expected %v, got %v", expected, found)
+	}
+
+	for _, test := range []struct {
+		maxCost  uint8
+		expected string
+	}{
+		{0, "[192.168.0.10]"},
+		{99, "[192.168.0.10]"},
+		{100, "[192.168.0.10 10.0.0.10 192.168.1.10]"},
+		{255, "[192.168.0.10 10.0.0.10 192.168.1.10 10.1.0.10]"},
+	} {
+		var found []string
+		for _, addr := range AddrsUpToCost(status, test.maxCost) {
+			found = append(found, addr.String())
+		}
+		if got := fmt.Sprint(found); got != test.expected {
+			t.Errorf("AddrsUpToCost(%d): expected %s, got %s", test.maxCost,
+				test.expected, got)
+		}
+	}
+}
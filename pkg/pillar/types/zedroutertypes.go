@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"os"
 	"strings"
@@ -135,8 +136,87 @@ func (status AppNetworkStatus) VerifyFilename(fileName string) bool {
 // XXX move to using DevicePortConfig in build?
 // XXX remove since it uses old "Uplink" terms. Need to fix build etc
 type DeviceNetworkConfig struct {
-	Uplink      []string // ifname; all uplinks
-	FreeUplinks []string // subset used for image downloads
+	// Of the file format; absent in the files of version 0
+	Version     int      `json:",omitempty"`
+	Uplink      []string // ifname or pattern like eth* and !docker*; all uplinks
+	FreeUplinks []string // subset used for image downloads, of Cost 0
+	// VLAN links to create, which can then be listed as uplinks
+	Vlans []VlanConfig `json:",omitempty"`
+	// Addresses of the uplinks without DHCP
+	Statics []StaticConfig `json:",omitempty"`
+	// Proxies of the uplinks
+	Proxies []UplinkProxyConfig `json:",omitempty"`
+	// The uplinks not listed are of Cost 0 if in FreeUplinks, else 255
+	Costs []UplinkCost `json:",omitempty"`
+	// Uplinks as listed in Uplink, in the order to try them whatever
+	// their cost; those not listed are tried last
+	Priority []string `json:",omitempty"`
+	// NTP servers of the uplinks not in Ntp, hostnames or addresses
+	NtpServers []string `json:",omitempty"`
+	// NTP servers of the uplinks, used instead of those given by DHCP
+	Ntp []UplinkNtpConfig `json:",omitempty"`
+	// WiFi networks of the uplinks
+	Wireless []WirelessConfig `json:",omitempty"`
+}
+
+// WirelessConfig is the WiFi network a wireless uplink associates with.
+// The PSK is read from PskFile so that the secret is not in the config.
+type WirelessConfig struct {
+	IfName      string // An uplink, not a pattern
+	SSID        string
+	KeyMgmt     string `json:",omitempty"` // "WPA-PSK" by default, "SAE" or "NONE"
+	PskFile     string `json:",omitempty"` // The passphrase, or the PSK in hex
+	CountryCode string `json:",omitempty"` // ISO 3166-1 alpha-2 such as "US"
+}
+
+// UplinkNtpConfig is the NTP servers of an uplink, such as an internal
+// server only reachable through it
+type UplinkNtpConfig struct {
+	IfName     string   // As listed in Uplink, which can be a pattern
+	NtpServers []string // Hostnames or addresses
+}
+
+// UplinkCost is how expensive it is to use an uplink. Those of Cost 0
+// are free, and the cheaper ones are preferred.
+type UplinkCost struct {
+	IfName string // As listed in Uplink, which can be a pattern
+	Cost   uint8
+}
+
+// UplinkProxyConfig is the proxy configuration of an uplink. When PacURL
+// is set or Wpad discovers one the PAC file decides, else HTTPProxy and HTTPSProxy are used by
+// the URLs of their scheme. Neither is used for the hosts in NoProxy.
+type UplinkProxyConfig struct {
+	IfName     string   // As listed in Uplink, which can be a pattern
+	HTTPProxy  string   `json:",omitempty"` // URL such as http://proxy:3128
+	HTTPSProxy string   `json:",omitempty"`
+	NoProxy    []string `json:",omitempty"` // Domains, addresses and CIDRs
+	PacURL     string   `json:",omitempty"`
+	Wpad       bool     `json:",omitempty"` // Discover the PacURL
+}
+
+// StaticConfig is a static address of an uplink, and its default route
+// and DNS servers
+type StaticConfig struct {
+	IfName     string
+	AddrSubnet string   // With the prefix length, like 192.168.1.10/24
+	Gateway    net.IP   `json:",omitempty"`
+	DnsServers []net.IP `json:",omitempty"`
+}
+
+// VlanConfig is a VLAN link on a parent interface
+type VlanConfig struct {
+	Parent string // ifname
+	VlanID int
+	IfName string // Parent.VlanID if empty
+}
+
+// LinkName returns the ifname of the VLAN link
+func (vlan VlanConfig) LinkName() string {
+	if vlan.IfName != "" {
+		return vlan.IfName
+	}
+	return fmt.Sprintf("%s.%d", vlan.Parent, vlan.VlanID)
 }
 
 // Array in timestamp aka priority order; first one is the most desired
@@ -273,7 +353,11 @@ type ProxyConfig struct {
 	// the various DNS suffixes until we can download a wpad.dat file
 	NetworkProxyEnable bool   // Enable WPAD
 	NetworkProxyURL    string // Complete URL i.e., with /wpad.dat
-	WpadURL            string // The URL determined from DNS
+	WpadURL            string // The URL determined from DHCP or DNS
+	// Of the Pacfile found from WpadURL, which is looked for again after
+	// WpadExpiry
+	WpadExpiry time.Time `json:",omitempty"`
+	PacResult  string    `json:",omitempty"` // FindProxyForURL of the controller
 }
 
 type DhcpConfig struct {
@@ -290,26 +374,275 @@ type NetworkPortConfig struct {
 	Name   string // New logical name set by controller/model
 	IsMgmt bool   // Used to talk to controller
 	Free   bool   // Higher priority to talk to controller since no cost
+	// Set when Free; 0 means 255 if not Free as in the older configs
+	Cost uint8 `json:",omitempty"`
+	// From 1 in the order to try the ports, 0 if tried last
+	Priority int `json:",omitempty"`
+	// Used instead of those given by DHCP
+	NtpServers []string `json:",omitempty"`
+	// Set for the WiFi ports configured by ApplyWirelessConfig
+	Wireless *WirelessConfig `json:",omitempty"`
 	DhcpConfig
 	ProxyConfig
 }
 
+// NtpServerInfo is an NTP server of a port
+type NtpServerInfo struct {
+	Server string // Hostname or address
+	Origin string // "static" or "dhcp"
+}
+
 type NetworkPortStatus struct {
 	IfName string
 	Name   string // New logical name set by controller/model
+	// The port pattern which matched IfName, empty if not a pattern
+	Pattern string `json:",omitempty"`
+	// The MAC or PCI address, such as "mac:00:16:3e:0a:0b:0c", which
+	// resolved to IfName; empty if listed by its name
+	HwID   string `json:",omitempty"`
 	IsMgmt bool   // Used to talk to controller
 	Free   bool
+	Cost   uint8 // 0 if and only if Free
+	// From 1 in the order to try the ports, 0 if tried last
+	Priority int `json:",omitempty"`
+	// The metric of the default routes set by ApplyRouteMetrics, if any
+	RouteMetric int `json:",omitempty"`
+	// The configured ones first, then those given by DHCP
+	NtpServers []NtpServerInfo `json:",omitempty"`
 	NetworkXObjectConfig
+	// IPv4 before IPv6, global before link-local, then by address
 	AddrInfoList []AddrInfo
 	ProxyConfig
-	Error     string
-	ErrorTime time.Time
+	SearchDomains []string `json:",omitempty"` // From resolv.conf
+	MacAddr       string   `json:",omitempty"` // Empty if the link has none
+	BusAddress    string   `json:",omitempty"` // "pci:0000:02:00.0", "usb:1-1.2" or "virtual"
+	Driver        string   `json:",omitempty"` // Of the NIC, empty if virtual
+	Mtu           int      `json:",omitempty"`
+	Up            bool     // Administratively
+	Carrier       bool     // Operationally up
+	SpeedMbps     uint32   `json:",omitempty"` // 0 if unknown
+	Duplex        string   `json:",omitempty"` // "full" or "half", empty if unknown
+	VlanParent    string   `json:",omitempty"` // ifname, if a VLAN link
+	VlanID        int      `json:",omitempty"`
+	Counters      PortCounters
+	// From the default routes of the port, nil if none
+	DefaultGateway   *GatewayRoute `json:",omitempty"`
+	DefaultGatewayV6 *GatewayRoute `json:",omitempty"`
+	Warnings         []string      `json:",omitempty"` // Issues which do not prevent its use
+	Error            string        `json:",omitempty"` // Why the port is not usable
+	ErrorTime        time.Time     `json:",omitempty"` // Since when Error is set
+	// Whether the controller was reached through the port
+	Probe UplinkProbe
+	// Set for the WiFi ports
+	Wireless *WirelessStatus `json:",omitempty"`
+	// From the IPv6 router advertisements, nil if none or no IPv6
+	IPv6RA *IPv6RAStatus `json:",omitempty"`
+}
+
+// IPv6RAStatus is what the kernel and dhcpcd kept of the router
+// advertisements received on a port
+type IPv6RAStatus struct {
+	Managed     bool         // M flag: the addresses are given by DHCPv6
+	OtherConfig bool         // O flag: the other settings are given by DHCPv6
+	Routers     []IPv6Router `json:",omitempty"`
+	Prefixes    []IPv6Prefix `json:",omitempty"`
+	RDNSS       []net.IP     `json:",omitempty"` // The advertised name servers
+}
+
+// IPv6Router is an advertised default router. The lifetimes are the
+// seconds left when the status was made.
+type IPv6Router struct {
+	Addr       net.IP
+	Lifetime   uint32
+	Preference string // "low", "medium" or "high"
+}
+
+// IPv6Prefix is an advertised on-link prefix
+type IPv6Prefix struct {
+	Prefix            net.IPNet
+	PreferredLifetime uint32 // 0 without an address autoconfigured in it
+	ValidLifetime     uint32
+}
+
+// WirelessStatus is the association of a WiFi port
+type WirelessStatus struct {
+	SSID      string `json:",omitempty"` // Empty if not associated
+	BSSID     string `json:",omitempty"`
+	FreqMHz   uint32 `json:",omitempty"`
+	SignalDBm int32  `json:",omitempty"`
+	Error     string `json:",omitempty"` // Such as no WiFi support
+}
+
+// UplinkProbe is the outcome of the probes of a port by ProbeUplinks
+type UplinkProbe struct {
+	LastProbeSuccess time.Time
+	LastProbeError   time.Time
+	ProbeError       string        `json:",omitempty"` // Set when LastProbeError is updated
+	Latency          time.Duration `json:",omitempty"` // Of the last success
+	Addr             net.IP        `json:",omitempty"` // The source address which worked
+}
+
+// PortCounters are the traffic counters of a port since its creation
+type PortCounters struct {
+	RxBytes  uint64
+	TxBytes  uint64
+	RxPkts   uint64
+	TxPkts   uint64
+	RxErrors uint64
+	TxErrors uint64
+	RxDrops  uint64
+	TxDrops  uint64
+}
+
+// counterDelta returns the increase of a counter from prev to cur. A
+// decrease is a wrap of a 32-bit counter if prev fits in 32 bits, or
+// else a reset of the counter.
+func counterDelta(cur uint64, prev uint64) uint64 {
+	if cur >= prev {
+		return cur - prev
+	}
+	if prev <= math.MaxUint32 {
+		return cur + (math.MaxUint32 + 1) - prev
+	}
+	return cur
+}
+
+// Delta returns the increase of the counters since prev
+func (c PortCounters) Delta(prev PortCounters) PortCounters {
+	return PortCounters{
+		RxBytes:  counterDelta(c.RxBytes, prev.RxBytes),
+		TxBytes:  counterDelta(c.TxBytes, prev.TxBytes),
+		RxPkts:   counterDelta(c.RxPkts, prev.RxPkts),
+		TxPkts:   counterDelta(c.TxPkts, prev.TxPkts),
+		RxErrors: counterDelta(c.RxErrors, prev.RxErrors),
+		TxErrors: counterDelta(c.TxErrors, prev.TxErrors),
+		RxDrops:  counterDelta(c.RxDrops, prev.RxDrops),
+		TxDrops:  counterDelta(c.TxDrops, prev.TxDrops),
+	}
+}
+
+// PortCountersDelta returns the increase of the counters of each port
+// by IfName between two snapshots of the DeviceNetworkStatus, for the
+// ports in both
+func PortCountersDelta(oldStatus DeviceNetworkStatus,
+	newStatus DeviceNetworkStatus) map[string]PortCounters {
+
+	deltas := make(map[string]PortCounters)
+	for _, port := range newStatus.Ports {
+		for _, oldPort := range oldStatus.Ports {
+			if oldPort.IfName == port.IfName {
+				deltas[port.IfName] = port.Counters.Delta(oldPort.Counters)
+				break
+			}
+		}
+	}
+	return deltas
+}
+
+// GatewayRoute is a default route of a port
+type GatewayRoute struct {
+	Gateway net.IP
+	Metric  int // The lowest is preferred
+}
+
+// MarshalJSON omits ErrorTime when it is zero which the omitempty tag
+// alone does not do for a time.Time
+func (port NetworkPortStatus) MarshalJSON() ([]byte, error) {
+	// Same fields without the methods
+	type portStatus NetworkPortStatus
+	aux := struct {
+		portStatus
+		ErrorTime *time.Time `json:",omitempty"`
+	}{portStatus: portStatus(port)}
+	if !port.ErrorTime.IsZero() {
+		aux.ErrorTime = &port.ErrorTime
+	}
+	return json.Marshal(aux)
 }
 
 type AddrInfo struct {
 	Addr             net.IP
-	Geo              ipinfo.IPInfo
-	LastGeoTimestamp time.Time
+	Geo              ipinfo.IPInfo `json:",omitempty"`
+	LastGeoTimestamp time.Time     `json:",omitempty"`
+	LinkLocal        bool          `json:",omitempty"` // Only set with LL6_MARK
+	Origin           AddrOrigin    `json:",omitempty"`
+	Flags            int           `json:",omitempty"` // IFA_F flags, for debugging
+	// From the DHCP lease; LeaseExpiry is zero if infinite
+	LeaseExpiry time.Time `json:",omitempty"`
+	DHCPServer  string    `json:",omitempty"` // Address, or DUID for DHCPv6
+}
+
+// AddrOrigin is how an address got onto its port
+type AddrOrigin string
+
+const (
+	AO_STATIC    AddrOrigin = "static"     // From the Statics of the DevicePortConfig
+	AO_DHCP      AddrOrigin = "dhcp"       // From a DHCP or DHCPv6 lease
+	AO_SLAAC     AddrOrigin = "slaac"      // Autoconfigured from an RA prefix
+	AO_LINKLOCAL AddrOrigin = "link-local" // IPv4LL or IPv6 link-local
+	AO_MANUAL    AddrOrigin = "manual"     // Added without a lifetime
+	AO_UNKNOWN   AddrOrigin = "unknown"
+)
+
+// LinkLocal6Mode is what to do with the IPv6 link-local addresses of
+// the ports
+type LinkLocal6Mode uint8
+
+const (
+	LL6_INCLUDE LinkLocal6Mode = iota // Report them like the others
+	LL6_EXCLUDE                       // Skip them
+	LL6_MARK                          // Report them with LinkLocal set
+)
+
+// ParseLinkLocal6Mode parses include, exclude or mark
+func ParseLinkLocal6Mode(value string) (LinkLocal6Mode, error) {
+	switch value {
+	case "include":
+		return LL6_INCLUDE, nil
+	case "exclude":
+		return LL6_EXCLUDE, nil
+	case "mark":
+		return LL6_MARK, nil
+	default:
+		return LL6_INCLUDE, fmt.Errorf("Bad value: %s", value)
+	}
+}
+
+func (mode LinkLocal6Mode) String() string {
+	switch mode {
+	case LL6_INCLUDE:
+		return "include"
+	case LL6_EXCLUDE:
+		return "exclude"
+	case LL6_MARK:
+		return "mark"
+	default:
+		return fmt.Sprintf("LinkLocal6Mode(%d)", uint8(mode))
+	}
+}
+
+// MarshalJSON omits Geo and LastGeoTimestamp when never looked up, e.g.
+// with the geolocation disabled, and LeaseExpiry when zero, which the
+// omitempty tags alone do not do for structs
+func (ai AddrInfo) MarshalJSON() ([]byte, error) {
+	// Same fields without the methods
+	type addrInfo AddrInfo
+	aux := struct {
+		addrInfo
+		Geo              *ipinfo.IPInfo `json:",omitempty"`
+		LastGeoTimestamp *time.Time     `json:",omitempty"`
+		LeaseExpiry      *time.Time     `json:",omitempty"`
+	}{addrInfo: addrInfo(ai)}
+	if ai.Geo != (ipinfo.IPInfo{}) {
+		aux.Geo = &ai.Geo
+	}
+	if !ai.LastGeoTimestamp.IsZero() {
+		aux.LastGeoTimestamp = &ai.LastGeoTimestamp
+	}
+	if !ai.LeaseExpiry.IsZero() {
+		aux.LeaseExpiry = &ai.LeaseExpiry
+	}
+	return json.Marshal(aux)
 }
 
 // Published to microservices which needs to know about ports and IP addresses
@@ -317,6 +650,18 @@ type DeviceNetworkStatus struct {
 	Version DevicePortConfigVersion // From DevicePortConfig
 	Testing bool                    // Ignore since it is not yet verified
 	Ports   []NetworkPortStatus
+	// The physical interfaces present which are not ports, when reported
+	Candidates []CandidatePort `json:",omitempty"`
+}
+
+// CandidatePort is a physical interface, such as a USB NIC plugged in,
+// which the config could adopt as a port
+type CandidatePort struct {
+	IfName  string
+	MacAddr string
+	// The port name to adopt it with across renames, "pci:" followed by
+	// its PCI address, else "mac:" followed by its MAC
+	HwID string
 }
 
 func (status *DeviceNetworkStatus) GetPortByName(
@@ -645,6 +990,27 @@ func GetPort(globalStatus DeviceNetworkStatus, port string) *NetworkPortStatus {
 	return nil
 }
 
+// GetNtpServers returns the NTP servers to use through the port: those
+// configured if any, else those given by DHCP
+func GetNtpServers(globalStatus DeviceNetworkStatus, port string) []string {
+	us := GetPort(globalStatus, port)
+	if us == nil {
+		return nil
+	}
+	var servers []string
+	for _, origin := range []string{"static", "dhcp"} {
+		for _, ntp := range us.NtpServers {
+			if ntp.Origin == origin {
+				servers = append(servers, ntp.Server)
+			}
+		}
+		if len(servers) != 0 {
+			break
+		}
+	}
+	return servers
+}
+
 // Given an address tell me its IfName
 func GetMgmtPortFromAddr(globalStatus DeviceNetworkStatus, addr net.IP) string {
 	for _, us := range globalStatus.Ports {
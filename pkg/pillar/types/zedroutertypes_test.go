@@ -4,8 +4,15 @@
 package types
 
 import (
+	"encoding/json"
+	"math"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/eriknordmark/ipinfo"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -43,3 +50,92 @@ func TestIsIPv6(t *testing.T) {
 	}
 	log.Infof("TestIsIPv6: DONE\n")
 }
+
+func TestNetworkPortStatusJSON(t *testing.T) {
+	port := NetworkPortStatus{IfName: "eth0"}
+	data, err := json.Marshal(port)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	if strings.Contains(string(data), `"Error`) || strings.Contains(string(data), "MacAddr") {
+		t.Errorf("Empty fields of a working port in %s", data)
+	}
+
+	port.MacAddr = "00:16:3e:00:00:01"
+	port.Error = "Port eth0 has no carrier"
+	port.ErrorTime = time.Unix(1000, 0).UTC()
+	data, err = json.Marshal(port)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	var decoded NetworkPortStatus
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal of %s failed: %s", data, err)
+	}
+	if decoded.IfName != port.IfName || decoded.MacAddr != port.MacAddr ||
+		decoded.Error != port.Error ||
+		!decoded.ErrorTime.Equal(port.ErrorTime) {
+		t.Errorf("Expected %+v, got %+v", port, decoded)
+	}
+}
+
+func TestAddrInfoJSON(t *testing.T) {
+	ai := AddrInfo{Addr: net.ParseIP("10.0.0.1")}
+	data, err := json.Marshal(ai)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	if strings.Contains(string(data), "Geo") || strings.Contains(string(data), "Lease") {
+		t.Errorf("Geo or lease fields without geolocation or lease in %s", data)
+	}
+
+	ai.Geo = ipinfo.IPInfo{IP: "192.0.2.1", City: "Somewhere"}
+	ai.LastGeoTimestamp = time.Unix(1000, 0).UTC()
+	ai.LeaseExpiry = time.Unix(2000, 0).UTC()
+	data, err = json.Marshal(ai)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+	var decoded AddrInfo
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal of %s failed: %s", data, err)
+	}
+	if !decoded.Addr.Equal(ai.Addr) || decoded.Geo != ai.Geo ||
+		!decoded.LastGeoTimestamp.Equal(ai.LastGeoTimestamp) ||
+		!decoded.LeaseExpiry.Equal(ai.LeaseExpiry) {
+		t.Errorf("Expected %+v, got %+v", ai, decoded)
+	}
+}
+
+func TestPortCountersDelta(t *testing.T) {
+	for _, test := range []struct {
+		prev     uint64
+		cur      uint64
+		expected uint64
+	}{
+		{100, 150, 50},
+		{100, 100, 0},
+		{math.MaxUint32 - 9, 5, 15},        // 32-bit wrap
+		{math.MaxUint32 + 100, 1000, 1000}, // reset
+	} {
+		delta := PortCounters{RxBytes: test.cur}.Delta(PortCounters{RxBytes: test.prev})
+		if delta.RxBytes != test.expected {
+			t.Errorf("%d to %d: expected %d, got %d", test.prev, test.cur,
+				test.expected, delta.RxBytes)
+		}
+	}
+
+	oldStatus := DeviceNetworkStatus{Ports: []NetworkPortStatus{
+		{IfName: "eth0", Counters: PortCounters{RxBytes: 100, TxPkts: 5}},
+		{IfName: "eth2", Counters: PortCounters{RxBytes: 100}},
+	}}
+	newStatus := DeviceNetworkStatus{Ports: []NetworkPortStatus{
+		{IfName: "eth0", Counters: PortCounters{RxBytes: 300, TxPkts: 7}},
+		{IfName: "eth1", Counters: PortCounters{RxBytes: 100}},
+	}}
+	deltas := PortCountersDelta(oldStatus, newStatus)
+	expected := map[string]PortCounters{"eth0": {RxBytes: 200, TxPkts: 2}}
+	if !reflect.DeepEqual(deltas, expected) {
+		t.Errorf("expected %+v, got %+v", expected, deltas)
+	}
+}
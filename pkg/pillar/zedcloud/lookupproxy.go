@@ -11,7 +11,6 @@ import (
 	"github.com/lf-edge/eve/pkg/pillar/zedpac"
 	log "github.com/sirupsen/logrus"
 	"net/url"
-	"strings"
 )
 
 func LookupProxy(status *types.DeviceNetworkStatus, ifname string,
@@ -37,6 +36,17 @@ func LookupProxy(status *types.DeviceNetworkStatus, ifname string,
 			return nil, errors.New(errStr)
 		}
 
+		// The exceptions apply to the PAC file too
+		if proxyConfig.Exceptions != "" {
+			noProxy := &config{Config: Config{NoProxy: proxyConfig.Exceptions}}
+			noProxy.init()
+			if !noProxy.useProxy(canonicalAddr(u)) {
+				log.Debugf("LookupProxy: %s is an exception on port %s",
+					rawUrl, ifname)
+				return nil, nil
+			}
+		}
+
 		// Check if we have a PAC file
 		if len(proxyConfig.Pacfile) > 0 {
 			pacFile, err := base64.StdEncoding.DecodeString(proxyConfig.Pacfile)
@@ -53,32 +63,22 @@ func LookupProxy(status *types.DeviceNetworkStatus, ifname string,
 				log.Errorf(errStr)
 				return nil, errors.New(errStr)
 			}
-			//if proxyString == "DIRECT" {
-			if strings.HasPrefix(proxyString, "DIRECT") {
-				return nil, nil
-			}
-			proxies := strings.Split(proxyString, ";")
-			if len(proxies) == 0 {
-				log.Errorf("LookupProxy: Number of proxies in PAC file result is Zero")
-				return nil, nil
-			}
-
-			// XXX Take the first proxy for now. Failing over to the next
-			// proxy should be implemented
-			proxy0 := proxies[0]
-			proxy0 = strings.Split(proxy0, " ")[1]
-			// Proxy address returned by PAC does not have the URL scheme.
-			// We prepend the scheme (http/https) of the incoming raw URL.
-			proxy0 = "http://" + proxy0
-			proxy, err := url.Parse(proxy0)
+			proxies, err := ParsePacResult(proxyString)
 			if err != nil {
 				errStr := fmt.Sprintf("LookupProxy: PAC file returned invalid proxy %s: %s",
 					proxyString, err)
 				log.Errorf(errStr)
 				return nil, errors.New(errStr)
 			}
-			log.Debugf("LookupProxy: PAC proxy being used is %s", proxy0)
-			return proxy, err
+			if len(proxies) == 0 {
+				log.Errorf("LookupProxy: No supported proxy in PAC file result %s",
+					proxyString)
+				return nil, nil
+			}
+			// XXX Take the first proxy for now. Failing over to the next
+			// proxy should be implemented
+			log.Debugf("LookupProxy: PAC proxy being used is %v", proxies[0])
+			return proxies[0], nil
 		}
 
 		config := &Config{}
@@ -0,0 +1,83 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/lf-edge/eve/pkg/pillar/types"
+)
+
+func TestLookupProxy(t *testing.T) {
+	pac := base64.StdEncoding.EncodeToString([]byte(`
+function FindProxyForURL(url, host) {
+	if (dnsDomainIs(host, ".direct.net")) {
+		return "DIRECT";
+	}
+	return "PROXY pac:8080; DIRECT";
+}`))
+	status := types.DeviceNetworkStatus{
+		Ports: []types.NetworkPortStatus{
+			{IfName: "eth0", ProxyConfig: types.ProxyConfig{
+				Proxies: []types.ProxyEntry{
+					{Type: types.NPT_HTTP, Server: "proxy", Port: 3128},
+				},
+				Exceptions: ".example.com,10.0.0.0/8,2001:db8::/32,host.net:8443",
+			}},
+			{IfName: "eth1", ProxyConfig: types.ProxyConfig{
+				Proxies: []types.ProxyEntry{
+					{Type: types.NPT_HTTP, Server: "proxy", Port: 3128},
+					{Type: types.NPT_HTTPS, Server: "https://proxy", Port: 3129},
+				},
+				Exceptions: "example.com",
+				Pacfile:    pac,
+			}},
+			{IfName: "eth2", ProxyConfig: types.ProxyConfig{
+				Proxies: []types.ProxyEntry{
+					{Type: types.NPT_HTTPS, Server: "proxy", Port: 3129},
+				},
+				Exceptions: "*",
+			}},
+		},
+	}
+	for _, test := range []struct {
+		ifname   string
+		rawURL   string
+		expected string
+	}{
+		{"eth0", "http://zedcloud.net/api", "http://proxy:3128"},
+		// Only for http
+		{"eth0", "https://zedcloud.net/api", ""},
+		// Subdomains only
+		{"eth0", "http://www.example.com/", ""},
+		{"eth0", "http://example.com/", "http://proxy:3128"},
+		{"eth0", "http://10.1.2.3/", ""},
+		{"eth0", "http://11.1.2.3/", "http://proxy:3128"},
+		{"eth0", "http://[2001:db8::5]/", ""},
+		{"eth0", "http://localhost/", ""},
+		// Only that port
+		{"eth0", "http://host.net:8443/", ""},
+		{"eth0", "http://host.net/", "http://proxy:3128"},
+		// The PAC file wins over the proxies, but not the exceptions
+		{"eth1", "https://zedcloud.net/api", "http://pac:8080"},
+		{"eth1", "https://www.direct.net/api", ""},
+		{"eth1", "https://example.com/api", ""},
+		{"eth2", "https://zedcloud.net/api", ""},
+		{"eth3", "https://zedcloud.net/api", ""},
+	} {
+		proxy, err := LookupProxy(&status, test.ifname, test.rawURL)
+		found := ""
+		if proxy != nil {
+			found = proxy.String()
+		}
+		if err != nil || found != test.expected {
+			t.Errorf("%s %s: expected %q, got %q %v", test.ifname,
+				test.rawURL, test.expected, found, err)
+		}
+	}
+	if _, err := LookupProxy(&status, "eth0", "http://a b/"); err == nil {
+		t.Errorf("no error for a malformed URL")
+	}
+}
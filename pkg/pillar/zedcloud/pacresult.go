@@ -0,0 +1,56 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ParsePacResult parses the result of FindProxyForURL, such as
+// "PROXY proxy:3128; DIRECT", into the proxies to try in order, with nil
+// for DIRECT. SOCKS proxies are skipped since they are not supported.
+func ParsePacResult(result string) ([]*url.URL, error) {
+	var proxies []*url.URL
+	found := false
+	for _, entry := range strings.Split(result, ";") {
+		words := strings.Fields(entry)
+		if len(words) == 0 {
+			continue
+		}
+		kind := strings.ToUpper(words[0])
+		if kind == "DIRECT" && len(words) == 1 {
+			proxies = append(proxies, nil)
+			found = true
+			continue
+		}
+		if len(words) != 2 {
+			return nil, fmt.Errorf("bad PAC result %q", entry)
+		}
+		if _, _, err := net.SplitHostPort(words[1]); err != nil {
+			return nil, fmt.Errorf("bad PAC result %q: %s", entry, err)
+		}
+		var scheme string
+		switch kind {
+		case "PROXY", "HTTP":
+			// The scheme is that of the proxy, not of the URL
+			scheme = "http"
+		case "HTTPS":
+			scheme = "https"
+		case "SOCKS", "SOCKS4", "SOCKS5":
+			found = true
+			continue
+		default:
+			return nil, fmt.Errorf("bad PAC result %q", entry)
+		}
+		proxies = append(proxies, &url.URL{Scheme: scheme, Host: words[1]})
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("empty PAC result %q", result)
+	}
+	return proxies, nil
+}
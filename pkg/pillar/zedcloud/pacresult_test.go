@@ -0,0 +1,52 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"testing"
+)
+
+func TestParsePacResult(t *testing.T) {
+	for _, test := range []struct {
+		result   string
+		expected []string // "" for DIRECT
+		err      string
+	}{
+		{"DIRECT", []string{""}, ""},
+		{"PROXY proxy:3128; DIRECT", []string{"http://proxy:3128", ""}, ""},
+		{" proxy a:1 ;HTTPS b:443;; HTTP [2001:db8::1]:80 ",
+			[]string{"http://a:1", "https://b:443", "http://[2001:db8::1]:80"}, ""},
+		{"SOCKS s:1080; PROXY p:8080", []string{"http://p:8080"}, ""},
+		{"SOCKS5 s:1080", nil, ""},
+		{"", nil, `empty PAC result ""`},
+		{"PROXY proxy", nil, `bad PAC result "PROXY proxy": address proxy: missing port in address`},
+		{"PROXY a:1 b:2", nil, `bad PAC result "PROXY a:1 b:2"`},
+		{"FTP f:21", nil, `bad PAC result "FTP f:21"`},
+	} {
+		proxies, err := ParsePacResult(test.result)
+		errStr := ""
+		if err != nil {
+			errStr = err.Error()
+		}
+		var found []string
+		for _, proxy := range proxies {
+			if proxy == nil {
+				found = append(found, "")
+			} else {
+				found = append(found, proxy.String())
+			}
+		}
+		if errStr != test.err || len(found) != len(test.expected) {
+			t.Errorf("%q: expected %q %q, got %q %q", test.result,
+				test.expected, test.err, found, errStr)
+			continue
+		}
+		for i := range found {
+			if found[i] != test.expected[i] {
+				t.Errorf("%q: expected %q, got %q", test.result,
+					test.expected, found)
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	auditLogMaxSize = 1024 * 1024
+)
+
+// Events of a session record
+const (
+	SessionEstablished = "established"
+	SessionEnded       = "ended"
+)
+
+// SessionRecord describes a tunnel session, a single websocket
+// connection, when it is established and again when it ends
+type SessionRecord struct {
+	Event       string    `json:"event"`
+	Server      string    `json:"server"`      // tunnel endpoint URL
+	RemoteAddr  string    `json:"remoteAddr"`  // address of the controller endpoint
+	LocalAddr   string    `json:"localAddr"`   // source address of the connection
+	Established time.Time `json:"established"` // when the websocket was established
+	Ended       time.Time `json:"ended,omitempty"`
+	Requests    uint64    `json:"requests"`         // requests read off the websocket
+	BytesIn     uint64    `json:"bytesIn"`          // request payload bytes
+	BytesOut    uint64    `json:"bytesOut"`         // payload bytes of the frames written back
+	Reason      string    `json:"reason,omitempty"` // why the session ended
+}
+
+// AuditSink receives the session records of a tunnel client. It is
+// invoked from the connection loop and should not block.
+type AuditSink func(SessionRecord)
+
+// sessionCounters measure the traffic of a websocket connection
+type sessionCounters struct {
+	mutex    sync.Mutex
+	requests uint64
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+func (c *sessionCounters) requestRead(size int) {
+	c.mutex.Lock()
+	c.requests++
+	c.bytesIn += uint64(size)
+	c.mutex.Unlock()
+}
+
+func (c *sessionCounters) frameWritten(size int) {
+	c.mutex.Lock()
+	c.bytesOut += uint64(size)
+	c.mutex.Unlock()
+}
+
+// sessionRecord returns the current record of the session of wsc
+func (wsc *WSConnection) sessionRecord(event string) SessionRecord {
+	c := &wsc.counters
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return SessionRecord{
+		Event:       event,
+		Server:      wsc.tun.DestURL,
+		RemoteAddr:  wsc.remoteAddr,
+		LocalAddr:   wsc.localAddr,
+		Established: wsc.established,
+		Requests:    c.requests,
+		BytesIn:     c.bytesIn,
+		BytesOut:    c.bytesOut,
+	}
+}
+
+// auditEstablished records the establishment of the session of wsc
+func (wsc *WSConnection) auditEstablished() {
+	if wsc.tun.AuditSink == nil {
+		return
+	}
+	wsc.tun.AuditSink(wsc.sessionRecord(SessionEstablished))
+}
+
+// auditEnded records the end of the session of wsc, because of err
+// unless the tunnel was stopped
+func (wsc *WSConnection) auditEnded(err error) {
+	if wsc.tun.AuditSink == nil {
+		return
+	}
+	record := wsc.sessionRecord(SessionEnded)
+	record.Ended = time.Now()
+	wsc.tun.mutex.Lock()
+	record.Reason = wsc.tun.stopReason
+	wsc.tun.mutex.Unlock()
+	if record.Reason == "" && err != nil {
+		record.Reason = err.Error()
+	}
+	wsc.tun.AuditSink(record)
+}
+
+// AuditLog appends session records as JSON lines to the file at Path.
+// Once the file reaches MaxSize bytes, auditLogMaxSize when zero, it is
+// renamed with a .1 suffix, replacing the previous one, and a new file
+// is started.
+type AuditLog struct {
+	Path    string
+	MaxSize int64
+
+	mutex sync.Mutex
+}
+
+// Record appends record to the audit log, use it as the AuditSink of a
+// tunnel client
+func (l *AuditLog) Record(record SessionRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Errorf("Cannot encode tunnel session record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.rotate(); err != nil {
+		log.Errorf("Cannot rotate tunnel audit log %s: %v", l.Path, err)
+	}
+	file, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Errorf("Cannot open tunnel audit log: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(line); err != nil {
+		log.Errorf("Cannot write tunnel audit log %s: %v", l.Path, err)
+	}
+}
+
+// rotate starts a new file when the current one is full
+func (l *AuditLog) rotate() error {
+	maxSize := l.MaxSize
+	if maxSize == 0 {
+		maxSize = auditLogMaxSize
+	}
+	info, err := os.Stat(l.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() < maxSize {
+		return nil
+	}
+	return os.Rename(l.Path, l.Path+".1")
+}
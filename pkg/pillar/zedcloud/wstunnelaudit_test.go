@@ -0,0 +1,124 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testAuditSink collects the session records
+type testAuditSink struct {
+	mutex   sync.Mutex
+	records []SessionRecord
+}
+
+func (s *testAuditSink) record(record SessionRecord) {
+	s.mutex.Lock()
+	s.records = append(s.records, record)
+	s.mutex.Unlock()
+}
+
+func (s *testAuditSink) get() []SessionRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]SessionRecord{}, s.records...)
+}
+
+func TestAuditSessions(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	sink := &testAuditSink{}
+	client := startTestTunnel(t, ts, relay, func(client *WSTunnelClient) {
+		client.RetryInterval = 10 * time.Millisecond
+		client.AuditSink = sink.record
+	})
+
+	// The first session carries a request and ends abruptly
+	ws := ts.waitConn(t)
+	sendRequest(t, ws, 1, "hello")
+	readFrame(t, ws)
+	// The reply is counted once written, which may be after it was read
+	client.mutex.Lock()
+	conn := client.conn
+	client.mutex.Unlock()
+	waitFor(time.Second, func() bool { return conn.sessionRecord("").BytesOut != 0 })
+	ts.dropAll()
+	if !waitFor(5*time.Second, func() bool { return len(ts.connections()) == 2 }) {
+		t.Fatalf("tunnel did not reconnect")
+	}
+	// The second one is ended by Stop
+	ts.waitConn(t)
+	waitFor(time.Second, func() bool { return len(sink.get()) == 3 })
+	client.Stop()
+	client.Wait()
+
+	records := sink.get()
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %+v", records)
+	}
+	events := []string{SessionEstablished, SessionEnded, SessionEstablished, SessionEnded}
+	for i, record := range records {
+		if record.Event != events[i] {
+			t.Errorf("record %d: expected %s, got %+v", i, events[i], record)
+		}
+		if record.Server != client.DestURL || record.RemoteAddr != ts.Listener.Addr().String() ||
+			record.LocalAddr == "" || record.Established.IsZero() {
+			t.Errorf("record %d: incomplete %+v", i, record)
+		}
+	}
+	first := records[1]
+	if first.Requests != 1 || first.BytesIn != uint64(len("hello")) ||
+		first.BytesOut != uint64(len("reply:hello")) {
+		t.Errorf("unexpected traffic %+v", first)
+	}
+	if first.Reason == "" || first.Ended.Before(first.Established) {
+		t.Errorf("unexpected end %+v", first)
+	}
+	if last := records[3]; last.Reason != StopReasonShutdown || last.Requests != 0 {
+		t.Errorf("unexpected end %+v", last)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	auditLog := &AuditLog{Path: path, MaxSize: 300}
+
+	for i := 0; i < 5; i++ {
+		auditLog.Record(SessionRecord{Event: SessionEnded, Requests: uint64(i)})
+	}
+	// Each record is above 150 bytes so a file holds two at most
+	var requests []uint64
+	for _, name := range []string{path + ".1", path} {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatalf("open %s failed: %v", name, err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record SessionRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Errorf("bad record %q: %v", scanner.Text(), err)
+			}
+			requests = append(requests, record.Requests)
+		}
+		file.Close()
+	}
+	if len(requests) != 3 || requests[0] != 2 || requests[2] != 4 {
+		t.Errorf("expected records 2 to 4, got %v", requests)
+	}
+}
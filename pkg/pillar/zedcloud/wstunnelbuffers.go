@@ -0,0 +1,51 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsBufferSize    = 100 * 1024 // websocket read and write buffers
+	minWSBufferSize = 4 * 1024
+)
+
+// validateWSBufferSizes checks the ReadBufferSize and WriteBufferSize
+// settings
+func (t *WSTunnelClient) validateWSBufferSizes() error {
+	for _, size := range []struct {
+		name  string
+		bytes int
+	}{
+		{"read", t.ReadBufferSize},
+		{"write", t.WriteBufferSize},
+	} {
+		if size.bytes != 0 && size.bytes < minWSBufferSize {
+			return fmt.Errorf("Websocket %s buffer size %d below %d bytes",
+				size.name, size.bytes, minWSBufferSize)
+		}
+	}
+	return nil
+}
+
+// wsBufferSizes returns the websocket read and write buffer sizes
+func (t *WSTunnelClient) wsBufferSizes() (int, int) {
+	read, write := t.ReadBufferSize, t.WriteBufferSize
+	if read == 0 {
+		read = wsBufferSize
+	}
+	if write == 0 {
+		write = wsBufferSize
+	}
+	return read, write
+}
+
+// setWSBufferSizes sets the buffer sizes of every dialer the client
+// builds, for the connection test and the connection attempts alike
+func (t *WSTunnelClient) setWSBufferSizes(dialer *websocket.Dialer) {
+	dialer.ReadBufferSize, dialer.WriteBufferSize = t.wsBufferSizes()
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"testing"
+)
+
+func TestWSBufferSizes(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+
+	client := newTestTunnelClient(ts)
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	status := client.Status()
+	if client.Dialer.ReadBufferSize != wsBufferSize ||
+		client.Dialer.WriteBufferSize != wsBufferSize ||
+		status.ReadBufferSize != wsBufferSize || status.WriteBufferSize != wsBufferSize {
+		t.Errorf("unexpected default sizes %+v, status %+v", client.Dialer, status)
+	}
+
+	client.ReadBufferSize = minWSBufferSize - 1
+	if err := client.TestConnection(nil, nil); err == nil {
+		t.Errorf("tested with a read buffer size of %d", client.ReadBufferSize)
+	}
+	client.ReadBufferSize = 0
+	client.WriteBufferSize = minWSBufferSize - 1
+	if _, err := client.StartNotify(); err == nil {
+		client.Stop()
+		t.Errorf("started with a write buffer size of %d", client.WriteBufferSize)
+	}
+
+	// The connection test and the connection attempts build the same
+	client.ReadBufferSize = 8 * 1024
+	client.WriteBufferSize = 16 * 1024
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	dialer, err := client.attemptDialer(nil)
+	if err != nil {
+		t.Fatalf("attemptDialer failed: %v", err)
+	}
+	for _, d := range []struct {
+		name        string
+		read, write int
+	}{
+		{"tested", client.Dialer.ReadBufferSize, client.Dialer.WriteBufferSize},
+		{"attempt", dialer.ReadBufferSize, dialer.WriteBufferSize},
+	} {
+		if d.read != 8*1024 || d.write != 16*1024 {
+			t.Errorf("%s dialer has buffer sizes %d and %d", d.name, d.read, d.write)
+		}
+	}
+	status = client.Status()
+	if status.ReadBufferSize != 8*1024 || status.WriteBufferSize != 16*1024 {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
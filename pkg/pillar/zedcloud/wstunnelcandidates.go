@@ -0,0 +1,137 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// ProxyCandidate is a way to reach the tunnel server tried by
+// TestConnectionAny: through ProxyURL, or directly when nil, from
+// LocalAddr, or any source address when nil
+type ProxyCandidate struct {
+	ProxyURL  *url.URL
+	LocalAddr net.IP
+}
+
+// String describes the candidate without the proxy password
+func (c ProxyCandidate) String() string {
+	via := "direct"
+	if c.ProxyURL != nil {
+		via = "proxy " + redactedURL(c.ProxyURL)
+	}
+	if c.LocalAddr == nil {
+		return via
+	}
+	return fmt.Sprintf("%s from %s", via, c.LocalAddr)
+}
+
+// CandidatesError is the error of TestConnectionAny when no candidate
+// passed, with the error of each candidate in the same order
+type CandidatesError struct {
+	Candidates []ProxyCandidate
+	Errs       []error
+}
+
+func (e *CandidatesError) Error() string {
+	var errStrs []string
+	for i, err := range e.Errs {
+		errStrs = append(errStrs, fmt.Sprintf("%s: %v", e.Candidates[i], err))
+	}
+	return fmt.Sprintf("All %d connection candidates failed: %s",
+		len(e.Candidates), strings.Join(errStrs, "; "))
+}
+
+// candidateResult is the outcome of testing a candidate
+type candidateResult struct {
+	index   int
+	dialer  *websocket.Dialer
+	timings PingTimings
+	err     error
+}
+
+// TestConnectionAny is TestConnection trying candidates in turn until
+// one passes, e.g. the configured proxy then a direct connection. With
+// CandidateStagger the next one is also started when the previous one
+// is still trying after that delay, and the first to pass wins while
+// the others are canceled. The client then connects as that candidate,
+// which Status reports in Candidate. When none passes the error is a
+// CandidatesError.
+func (t *WSTunnelClient) TestConnectionAny(candidates []ProxyCandidate) error {
+	if len(candidates) == 0 {
+		return fmt.Errorf("Must specify at least one connection candidate")
+	}
+	if err := t.validateConnectionTest(); err != nil {
+		return err
+	}
+	tlsConfig, err := t.tlsConfig()
+	if err != nil {
+		return err
+	}
+	parent := t.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	// Buffered so that the attempts still running when one passed end
+	// on their own once canceled
+	results := make(chan candidateResult, len(candidates))
+	next, running := 0, 0
+	start := func() {
+		index := next
+		next++
+		running++
+		log.Debugf("Testing connection to %s as candidate %s", t.Tunnel,
+			candidates[index])
+		go func() {
+			dialer, timings, err := t.testCandidate(ctx, tlsConfig,
+				candidates[index])
+			results <- candidateResult{index: index, dialer: dialer,
+				timings: timings, err: err}
+		}()
+	}
+
+	errs := make([]error, len(candidates))
+	var lastTimings PingTimings
+	start()
+	for running > 0 {
+		var stagger <-chan time.Time
+		if next < len(candidates) && t.CandidateStagger > 0 {
+			stagger = time.After(t.CandidateStagger)
+		}
+		select {
+		case <-stagger:
+			start()
+		case result := <-results:
+			running--
+			if result.err == nil {
+				cancel()
+				candidate := candidates[result.index]
+				t.recordConnectionTest(result.timings, nil)
+				t.connectionTested(result.dialer, candidate, candidate.String())
+				return nil
+			}
+			log.Warnf("Connection candidate %s failed: %v",
+				candidates[result.index], result.err)
+			errs[result.index] = result.err
+			lastTimings = result.timings
+			if next < len(candidates) {
+				start()
+			}
+		}
+	}
+	err = &CandidatesError{Candidates: candidates, Errs: errs}
+	t.recordConnectionTest(lastTimings, err)
+	return err
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionAnyDeadProxy(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	dead := newTestPlainProxy()
+	deadURL, _ := url.Parse(dead.URL)
+	dead.Close()
+
+	client := newTestTunnelClient(ts)
+	err := client.TestConnectionAny([]ProxyCandidate{
+		{ProxyURL: deadURL},
+		{},
+	})
+	if err != nil {
+		t.Fatalf("TestConnectionAny failed: %v", err)
+	}
+	status := client.Status()
+	if status.Candidate != "direct" || status.Proxy != "" || client.Dialer.Proxy != nil {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	client.Start()
+	defer client.Stop()
+	if !waitFor(5*time.Second, func() bool { return client.Status().Connected }) {
+		t.Fatalf("tunnel never connected: %+v", client.Status())
+	}
+	if status := client.Status(); status.Proxy != "" {
+		t.Errorf("tunnel went through proxy %s", status.Proxy)
+	}
+}
+
+func TestConnectionAnyDeadDirect(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	proxy := newTestPlainProxy()
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("user", "secret")
+
+	// Only the proxy reaches the server, the direct path is blackholed
+	// by giving the name of the server an address nothing listens on
+	_, port, _ := net.SplitHostPort(ts.hostPort())
+	client := newTestTunnelClient(ts)
+	client.TunnelServerName = "localhost:" + port
+	client.Tunnel = "ws://localhost:" + port
+	resolver := &stubResolver{}
+	resolver.set("127.0.0.2")
+	client.Resolver = resolver
+	err := client.TestConnectionAny([]ProxyCandidate{
+		{},
+		{ProxyURL: proxyURL},
+	})
+	if err != nil {
+		t.Fatalf("TestConnectionAny failed: %v", err)
+	}
+	status := client.Status()
+	expected := "http://user:xxxxx@" + proxyURL.Host
+	if status.Candidate != "proxy "+expected || status.Proxy != expected {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if connects := proxy.connects(); len(connects) != 1 {
+		t.Errorf("expected a ping through the proxy, got %v", connects)
+	}
+
+	client.Start()
+	defer client.Stop()
+	if !waitFor(5*time.Second, func() bool { return client.Status().Connected }) {
+		t.Fatalf("tunnel never connected: %+v", client.Status())
+	}
+	if connects := proxy.connects(); len(connects) != 2 {
+		t.Errorf("expected the tunnel through the proxy, got %v", connects)
+	}
+}
+
+func TestConnectionAnyStagger(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	// A proxy which never answers, which only gives up at DialTimeout
+	silent := silentListener(t)
+	defer silent.Close()
+	silentURL, _ := url.Parse("http://" + silent.Addr().String())
+
+	client := newTestTunnelClient(ts)
+	client.DialTimeout = 5 * time.Second
+	client.CandidateStagger = 50 * time.Millisecond
+	start := time.Now()
+	err := client.TestConnectionAny([]ProxyCandidate{
+		{ProxyURL: silentURL},
+		{},
+	})
+	if err != nil {
+		t.Fatalf("TestConnectionAny failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= client.DialTimeout {
+		t.Errorf("waited %v for the silent proxy", elapsed)
+	}
+	if status := client.Status(); status.Candidate != "direct" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestConnectionAnyAllFail(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setPingStatus(503)
+	dead := newTestPlainProxy()
+	deadURL, _ := url.Parse(dead.URL)
+	dead.Close()
+
+	client := newTestTunnelClient(ts)
+	err := client.TestConnectionAny([]ProxyCandidate{
+		{ProxyURL: deadURL},
+		{LocalAddr: net.ParseIP("127.0.0.1")},
+	})
+	candidatesErr, ok := err.(*CandidatesError)
+	if !ok || len(candidatesErr.Errs) != 2 || candidatesErr.Errs[0] == nil ||
+		candidatesErr.Errs[1] == nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !strings.Contains(err.Error(), "proxy "+deadURL.String()+": ") ||
+		!strings.Contains(err.Error(), "direct from 127.0.0.1: Ping url ") {
+		t.Errorf("unexpected error message %q", err)
+	}
+	status := client.Status()
+	if status.LastDialError != err.Error() || status.Candidate != "" ||
+		client.Dialer != nil {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if err := client.TestConnectionAny(nil); err == nil {
+		t.Errorf("no error without candidates")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The client lists the optional frame formats it supports in the
+// capabilitiesHeader of the websocket handshake, and the server echoes
+// the ones it accepts in its handshake response. Servers unaware of the
+// header don't answer it and get the legacy frame format.
+const (
+	capabilitiesHeader = "X-Tunnel-Capabilities"
+
+	capabilityChunked     = "chunked"      // responses split across continuation frames
+	capabilityGzip        = "gzip"         // gzip compressed responses
+	capabilityWideIDs     = "wide-ids"     // 8 hex digit request ids in all frames
+	capabilityErrorFrames = "error-frames" // failed requests answered with an error frame
+	capabilityControl     = "control"      // control messages in text frames from the server
+	capabilityHalfClose   = "half-close"   // end of stream flags in request and response frames
+	capabilityStreams     = "streams"      // long lived streams besides the requests
+	capabilityChecksum    = "crc32c"       // checksum trailer on every binary frame
+	capabilityDestination = "destination"  // local destination of the request in the request frames
+)
+
+// supportedCapabilities are all the capabilities the client knows
+var supportedCapabilities = []string{capabilityChunked, capabilityGzip, capabilityWideIDs,
+	capabilityErrorFrames, capabilityControl, capabilityHalfClose, capabilityStreams,
+	capabilityChecksum, capabilityDestination}
+
+// offeredCapabilities is what the client offers in the handshake
+func (t *WSTunnelClient) offeredCapabilities() []string {
+	offered := []string{capabilityChunked, capabilityWideIDs, capabilityErrorFrames,
+		capabilityControl, capabilityHalfClose, capabilityStreams, capabilityChecksum}
+	if t.CompressResponses {
+		offered = append(offered, capabilityGzip)
+	}
+	if len(t.AllowedDestinations) != 0 {
+		offered = append(offered, capabilityDestination)
+	}
+	return offered
+}
+
+// capabilities is a set of negotiated capabilities
+type capabilities map[string]bool
+
+// handshakeHeader returns the request header for the websocket handshake
+func handshakeHeader(offered []string) http.Header {
+	header := make(http.Header)
+	header.Set(capabilitiesHeader, strings.Join(offered, ","))
+	return header
+}
+
+// negotiatedCapabilities returns the offered capabilities the server
+// accepted in its handshake response.
+func negotiatedCapabilities(resp *http.Response, offered []string) capabilities {
+	caps := make(capabilities)
+	if resp == nil {
+		return caps
+	}
+	for _, value := range resp.Header[http.CanonicalHeaderKey(capabilitiesHeader)] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			for _, supported := range offered {
+				if name == supported {
+					caps[name] = true
+				}
+			}
+		}
+	}
+	return caps
+}
+
+// list returns the names of the capabilities in the order offered
+func (caps capabilities) list() []string {
+	var names []string
+	for _, name := range supportedCapabilities {
+		if caps[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// framesHaveFlags tells if response frames carry flags and a sequence
+// number after the request id, which they do with any capability that
+// changes the frame format.
+func (caps capabilities) framesHaveFlags() bool {
+	return caps[capabilityChunked] || caps[capabilityGzip] || caps[capabilityHalfClose]
+}
+
+// idLen is the number of hex digits of the request id heading frames
+func (caps capabilities) idLen() int {
+	if caps[capabilityWideIDs] {
+		return wideFrameIDLen
+	}
+	return frameIDLen
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestNegotiatedCapabilities(t *testing.T) {
+	for _, test := range []struct {
+		header []string
+		caps   []string
+	}{
+		{nil, nil},
+		{[]string{"chunked"}, []string{"chunked"}},
+		{[]string{" chunked , unknown"}, []string{"chunked"}},
+		{[]string{"unknown"}, nil},
+		{[]string{"gzip"}, nil}, // not offered
+	} {
+		resp := &http.Response{Header: make(http.Header)}
+		for _, value := range test.header {
+			resp.Header.Add(capabilitiesHeader, value)
+		}
+		caps := negotiatedCapabilities(resp, []string{capabilityChunked}).list()
+		if !reflect.DeepEqual(caps, test.caps) {
+			t.Errorf("%q: expected %v, got %v", test.header, test.caps, caps)
+		}
+	}
+	if len(negotiatedCapabilities(nil, supportedCapabilities)) != 0 {
+		t.Errorf("capabilities without a response")
+	}
+}
+
+// testChunk is a frame of a chunked response
+type testChunk struct {
+	id    int
+	flags int
+	seq   int
+	data  []byte
+}
+
+func readChunk(t *testing.T, ws *websocket.Conn) testChunk {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read frame failed: %v", err)
+	}
+	var chunk testChunk
+	if messageType != websocket.BinaryMessage || len(data) < 10 {
+		t.Fatalf("unexpected frame %d %q", messageType, data)
+	}
+	if _, err := fmt.Sscanf(string(data[:10]), "%04x%02x%04x",
+		&chunk.id, &chunk.flags, &chunk.seq); err != nil {
+		t.Fatalf("bad chunk header %q: %v", data[:10], err)
+	}
+	chunk.data = data[10:]
+	return chunk
+}
+
+// readChunkedResponse reassembles a chunked response and returns the
+// number of frames it took
+func readChunkedResponse(t *testing.T, ws *websocket.Conn, id int) ([]byte, int) {
+	var response []byte
+	for seq := 0; ; seq++ {
+		chunk := readChunk(t, ws)
+		if chunk.id != id || chunk.seq != seq {
+			t.Fatalf("expected chunk %d of %d, got %d of %d",
+				seq, id, chunk.seq, chunk.id)
+		}
+		response = append(response, chunk.data...)
+		if chunk.flags&frameFlagMore == 0 {
+			return response, seq + 1
+		}
+	}
+}
+
+func TestChunkedResponse(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 5*1024*1024/16)
+	relay := newTestRelay(t, func(req string) []byte {
+		if req == "large" {
+			return large
+		}
+		return echoRelay(req)
+	})
+	defer relay.Close()
+
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityChunked)
+	client := startTestTunnel(t, ts, relay, nil)
+	defer client.Stop()
+	ws := ts.waitConn(t)
+	if !waitFor(5*time.Second, func() bool {
+		return reflect.DeepEqual(client.Status().Capabilities, []string{capabilityChunked})
+	}) {
+		t.Fatalf("chunked capability not negotiated: %+v", client.Status())
+	}
+
+	sendRequest(t, ws, 1, "large")
+	response, frames := readChunkedResponse(t, ws, 1)
+	if !bytes.Equal(response, large) {
+		t.Errorf("reassembled %d bytes, expected %d", len(response), len(large))
+	}
+	if expected := len(large) / maxFrameSize; frames != expected {
+		t.Errorf("expected %d frames, got %d", expected, frames)
+	}
+
+	// Small responses take a single frame
+	sendRequest(t, ws, 2, "small")
+	response, frames = readChunkedResponse(t, ws, 2)
+	if frames != 1 || string(response) != "reply:small" {
+		t.Errorf("unexpected small response %q in %d frames", response, frames)
+	}
+}
+
+func TestLegacyLargeResponse(t *testing.T) {
+	large := []byte(strings.Repeat("x", 1024*1024))
+	relay := newTestRelay(t, func(req string) []byte { return large })
+	defer relay.Close()
+
+	// The server does not accept the chunked capability
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	client := startTestTunnel(t, ts, relay, nil)
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	sendRequest(t, ws, 3, "large")
+	frame := readFrame(t, ws)
+	if frame.id != 3 || frame.payload != string(large) {
+		t.Errorf("unexpected response of %d bytes", len(frame.payload))
+	}
+	if caps := client.Status().Capabilities; len(caps) != 0 {
+		t.Errorf("unexpected capabilities %v", caps)
+	}
+}
+
+func TestWideRequestIDs(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityWideIDs)
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+
+	client := startTestTunnel(t, ts, relay, nil)
+	defer client.Stop()
+	ws := ts.waitConn(t)
+	if !waitFor(5*time.Second, func() bool {
+		return reflect.DeepEqual(client.Status().Capabilities, []string{capabilityWideIDs})
+	}) {
+		t.Fatalf("wide-ids not negotiated: %+v", client.Status())
+	}
+
+	for _, id := range []requestID{0x7fff, 0xffff, 0x10000, 0xfffffffe} {
+		request := formatFrameID(id, wideFrameIDLen) + "hello"
+		if err := ws.WriteMessage(websocket.BinaryMessage, []byte(request)); err != nil {
+			t.Fatalf("write request %#x failed: %v", id, err)
+		}
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("read response %#x failed: %v", id, err)
+		}
+		expected := formatFrameID(id, wideFrameIDLen) + "reply:hello"
+		if string(data) != expected {
+			t.Errorf("expected %q, got %q", expected, data)
+		}
+	}
+}
+
+func TestErrorFramesCapability(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	unreachable := listener.Addr().String()
+	listener.Close()
+
+	for _, test := range []struct {
+		serverCaps  string
+		caps        []string
+		errorFrames bool
+	}{
+		{"", nil, false},
+		{capabilityChunked, []string{capabilityChunked}, false},
+		{"future-feature, " + capabilityErrorFrames,
+			[]string{capabilityErrorFrames}, true},
+	} {
+		ts := newTestTunnelServer(t)
+		ts.setCapabilities(test.serverCaps)
+		client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+			client.LocalRelayServer = unreachable
+			client.LocalAttempts = 1
+		})
+		ws := ts.waitConn(t)
+		if !waitFor(5*time.Second, func() bool {
+			return reflect.DeepEqual(client.Status().Capabilities, test.caps)
+		}) {
+			t.Errorf("%q: expected capabilities %v, got %v", test.serverCaps,
+				test.caps, client.Status().Capabilities)
+		}
+
+		sendRequest(t, ws, 1, "hello")
+		ws.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		messageType, data, err := ws.ReadMessage()
+		if test.errorFrames {
+			if err != nil || messageType != websocket.TextMessage {
+				t.Errorf("%q: expected an error frame, got %d %q %v",
+					test.serverCaps, messageType, data, err)
+			}
+		} else if err == nil {
+			t.Errorf("%q: unexpected frame %d %q", test.serverCaps, messageType, data)
+		}
+		client.Stop()
+		ts.Close()
+	}
+}
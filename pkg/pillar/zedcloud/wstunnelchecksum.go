@@ -0,0 +1,92 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// With the crc32c capability every binary frame, in both directions,
+// ends with a trailer of 8 hex digits holding the CRC32C (Castagnoli)
+// of the rest of the frame, header included. A request frame which does
+// not match is dropped and answered with a corrupt error frame so the
+// server can retransmit it, provided it accepts error frames.
+const checksumLen = 8
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// verifyFrame reads a binary frame and checks its trailer. It returns
+// the reader of the frame without the trailer, or nil when it was
+// corrupt and has been dropped.
+func (wsc *WSConnection) verifyFrame(r io.Reader) (io.Reader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= checksumLen {
+		body, trailer := data[:len(data)-checksumLen], data[len(data)-checksumLen:]
+		sum, err := strconv.ParseUint(string(trailer), 16, 32)
+		if err == nil && uint32(sum) == crc32.Checksum(body, castagnoli) {
+			return bytes.NewReader(body), nil
+		}
+	}
+	wsc.corruptFrame(data)
+	return nil, nil
+}
+
+// corruptFrame counts a frame which failed its checksum and asks the
+// server to retransmit it when its request id is readable
+func (wsc *WSConnection) corruptFrame(data []byte) {
+	wsc.tun.mutex.Lock()
+	wsc.tun.stats.CorruptFrames++
+	wsc.tun.mutex.Unlock()
+	idLen := wsc.caps.idLen()
+	if len(data) < idLen || data[0] == streamFramePrefix {
+		log.Errorf("Dropping corrupt frame of %d bytes", len(data))
+		return
+	}
+	id, err := strconv.ParseUint(string(data[:idLen]), 16, 4*idLen)
+	if err != nil {
+		log.Errorf("Dropping corrupt frame of %d bytes", len(data))
+		return
+	}
+	log.Errorf("[id=%d] Dropping corrupt frame of %d bytes", id, len(data))
+	wsc.writeErrorMessage(requestID(id), frameErrorCorrupt, "frame checksum mismatch")
+}
+
+// checksumWriter writes a binary frame and its checksum trailer on Close
+type checksumWriter struct {
+	w   io.WriteCloser
+	crc hash.Hash32
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	c.crc.Write(p)
+	return c.w.Write(p)
+}
+
+func (c *checksumWriter) Close() error {
+	if _, err := fmt.Fprintf(c.w, "%08x", c.crc.Sum32()); err != nil {
+		return err
+	}
+	return c.w.Close()
+}
+
+// frameWriter returns the writer of a frame of messageType on w, which
+// adds the checksum trailer to binary frames with the crc32c capability
+func (wsc *WSConnection) frameWriter(w io.WriteCloser, messageType int) io.WriteCloser {
+	if messageType != websocket.BinaryMessage || !wsc.caps[capabilityChecksum] {
+		return w
+	}
+	return &checksumWriter{w: w, crc: crc32.New(castagnoli)}
+}
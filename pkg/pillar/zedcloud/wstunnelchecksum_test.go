@@ -0,0 +1,100 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withChecksum appends the checksum trailer to frame
+func withChecksum(frame string) []byte {
+	return []byte(fmt.Sprintf("%s%08x", frame, crc32.Checksum([]byte(frame), castagnoli)))
+}
+
+func TestFakeFrameChecksum(t *testing.T) {
+	client := newFakeTunnel()
+	defer close(client.exitChan)
+	ws := newFakeWSConn()
+	wsc := newWSConnection(ws, client)
+	wsc.caps[capabilityChecksum] = true
+	wsc.caps[capabilityErrorFrames] = true
+
+	local, relay := net.Pipe()
+	defer relay.Close()
+	target := client.LocalRelayServer
+	client.relayPool().idle[target] = []*relayConn{{Conn: local, target: target}}
+	received := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := relay.Read(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+			relay.Write(append([]byte("reply:"), buf[:n]...))
+		}
+	}()
+	go wsc.handleRequests()
+	defer ws.Close()
+
+	// A flipped byte is detected and the frame dropped with a NAK
+	corrupt := withChecksum("002bhello")
+	corrupt[5] ^= 0x20
+	ws.incoming <- fakeFrame{messageType: websocket.BinaryMessage, data: corrupt}
+	if !waitFor(5*time.Second, func() bool { return len(ws.writtenFrames()) == 1 }) {
+		t.Fatalf("no error frame written")
+	}
+	frame := ws.writtenFrames()[0]
+	if frame.messageType != websocket.TextMessage ||
+		string(frame.data[:4]) != "002b" ||
+		frameErrorCode(testFrame{messageType: frame.messageType,
+			payload: string(frame.data[4:])}) != frameErrorCorrupt {
+		t.Errorf("expected corrupt error frame, got %q", frame.data)
+	}
+	if corrupted := client.GetStats().CorruptFrames; corrupted != 1 {
+		t.Errorf("expected 1 corrupt frame, got %d", corrupted)
+	}
+
+	// Valid frames still flow, with a checksum on the response
+	ws.incoming <- fakeFrame{messageType: websocket.BinaryMessage,
+		data: withChecksum("002bhello")}
+	if !waitFor(5*time.Second, func() bool { return len(ws.writtenFrames()) == 2 }) {
+		t.Fatalf("no response written")
+	}
+	if req := <-received; req != "hello" {
+		t.Errorf("relay received %q", req)
+	}
+	select {
+	case req := <-received:
+		t.Errorf("relay received the corrupt request too: %q", req)
+	default:
+	}
+	frame = ws.writtenFrames()[1]
+	if string(frame.data) != string(withChecksum("002breply:hello")) {
+		t.Errorf("unexpected response frame %q", frame.data)
+	}
+	if corrupted := client.GetStats().CorruptFrames; corrupted != 1 {
+		t.Errorf("valid frame counted as corrupt")
+	}
+}
+
+func TestFrameChecksumNotNegotiated(t *testing.T) {
+	client := newFakeTunnel()
+	defer close(client.exitChan)
+	ws := newFakeWSConn()
+	wsc := newWSConnection(ws, client)
+	wsc.writeResponseMessage(1, bytes.NewBufferString("payload"))
+	frames := ws.writtenFrames()
+	if len(frames) != 1 || string(frames[0].data) != "0001payload" {
+		t.Errorf("expected no trailer, got %v", frames)
+	}
+}
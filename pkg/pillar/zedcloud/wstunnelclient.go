@@ -6,6 +6,7 @@ package zedcloud
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -21,7 +22,12 @@ import (
 )
 
 const (
-	maxRetryAttempts = 50
+	maxRetryAttempts   = 50
+	retryInterval      = 30 * time.Second
+	dialTimeout        = 30 * time.Second
+	responseReadWindow = 500 * time.Millisecond
+	requestQueueSize   = 16
+	wsReadLimit        = 100 * 1024 * 1024 // largest frame read off the websocket
 )
 
 // WSTunnelClient represents a persistent tunnel that can cycle through many websockets.
@@ -32,25 +38,346 @@ type WSTunnelClient struct {
 	TunnelServerName string            // hostname[:port] string representation of remote tunnel server
 	Tunnel           string            // websocket server to connect to (ws[s]://hostname[:port])
 	DestURL          string            // formatted websocket endpoint URL
-	LocalRelayServer string            // local server to send received requests to
+	LocalRelayServer string            // local server to send received requests to, changed with SetLocalRelay once started
 	Timeout          time.Duration     // timeout on websocket
+	PingInterval     time.Duration     // between websocket pings, Timeout/3 when zero
+	RequestRateLimit float64           // requests forwarded per second at most, zero for no limit
 	Connected        bool              // true when we have an active connection to remote server
 	Dialer           *websocket.Dialer // dialer connection initialized & tested for success
-	exitChan         chan struct{}     // channel to tell the tunnel goroutines to end
-	conn             *WSConnection     // reference to remote websocket connection
-	retryOnFailCount int               // no of times the ws connection attempts have continuously failed
-	requestSentChan  chan struct{}     // channel to inform that a new request was written to local relay
+	TLSConfig        *tls.Config       // TLS configuration for the tunnel, loaded with GetTlsConfig when nil
+	RetryInterval    time.Duration     // delay between websocket connection attempts
+	DialTimeout      time.Duration     // limit for each connection attempt, including TLS and websocket handshakes
+	ReconnectDelay   time.Duration     // delay before redialing after a clean close by the server, reconnectDelay when zero
+	MaxRetryAttempts int               // consecutive failed attempts before giving up, maxRetryAttempts when zero
+	StabilityWindow  time.Duration     // a connection up for that long resets the failed attempts, stabilityWindow when zero
+
+	// Delay before redialing after the server rejected an attempt as
+	// already connected, alreadyConnectedDelay when zero
+	AlreadyConnectedDelay time.Duration
+
+	// Client certificate presented on the tunnel handshake. When
+	// GetClientCertificate is set it is invoked on every handshake instead,
+	// which allows the key to live behind a TPM and renewed certificates
+	// to be picked up on reconnect.
+	ClientCert           *tls.Certificate
+	GetClientCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+
+	// Server name sent in SNI and verified against the server certificate
+	// when it differs from the dialed host, e.g. when the controller is
+	// reached through a literal IP address or a local alias.
+	TLSServerNameOverride string
+
+	// TLS configuration for the connection to an https:// proxy, which
+	// is verified against the system roots when nil.
+	ProxyTLSConfig *tls.Config
+
+	// Interval at which the ping url is probed in the background, zero
+	// disables probing. With ProbeFailureReconnect set, probeFailureLimit
+	// consecutive failures force a reconnect of the tunnel.
+	ProbeInterval         time.Duration
+	ProbeFailureReconnect bool
+
+	// Limits of the pool of connections to the local relay: at most
+	// RelayMaxIdle are kept for reuse and closed after RelayIdleTimeout,
+	// and no more than RelayMaxActive are used at once, zero being no limit.
+	RelayMaxIdle     int
+	RelayMaxActive   int
+	RelayIdleTimeout time.Duration
+
+	// Interval at which the local relay is checked in the background by
+	// connecting to it, zero disables checking. Its health only changes
+	// after RelayCheckThreshold checks in a row, relayCheckThreshold when
+	// zero, and with RelayCheckReport set the changes are reported to the
+	// server in control messages.
+	RelayCheckInterval  time.Duration
+	RelayCheckThreshold int
+	RelayCheckReport    bool
+
+	// Most requests read off the websocket and not yet answered, zero for
+	// no limit, and what happens to those beyond.
+	MaxInflightRequests int
+	InflightPolicy      InflightPolicy
+	InflightQueueSize   int // requests held by InflightQueue, requestQueueSize when zero
+
+	// Limit for connecting to the local relay, localDialTimeout when zero.
+	// Requests which can't be relayed in time get an error frame.
+	LocalDialTimeout time.Duration
+
+	// Attempts at relaying a request when connecting or writing to the
+	// local relay fails, localAttempts when zero, e.g. while the relay
+	// restarts. The delays between attempts grow through LocalRetryDelays
+	// and then stay at the last one, localRetryDelays when empty.
+	LocalAttempts    int
+	LocalRetryDelays []time.Duration
+
+	// With DetectDuplicates a request whose id was read among the last
+	// DuplicateWindow requests, duplicateWindow when zero, is not
+	// forwarded again, e.g. when the server retransmits it. It gets the
+	// response sent the first time again when still kept, and a
+	// duplicate error frame otherwise.
+	DetectDuplicates bool
+	DuplicateWindow  int
+
+	// Requests which can't be forwarded as the local relay refuses the
+	// connections, e.g. while it is upgraded, are held until it is back,
+	// up to MaxPending requests and MaxPendingBytes of payload,
+	// pendingBytes when zero, for at most MaxPendingAge, pendingAge when
+	// zero. They then get an error frame. They are not held when
+	// MaxPending is zero.
+	MaxPending      int
+	MaxPendingBytes int
+	MaxPendingAge   time.Duration
+
+	// Local relay targets the server may reach through the tunnel, as
+	// hostOrIP:port or unix:path patterns in path.Match syntax such as
+	// "127.0.0.1:*". Requests to any other target get an error frame and
+	// no connection is opened. Any target is allowed when empty. When set
+	// the server may also pick the target of each request among them, see
+	// wstunneldestination.go.
+	AllowedDestinations []string
+
+	// Socket options of the connections to the local relay, which keep
+	// the system defaults when zero. LocalNoDelay sets TCP_NODELAY so
+	// small writes such as keystrokes are sent right away, and the buffer
+	// sizes set SO_SNDBUF and SO_RCVBUF in bytes.
+	LocalNoDelay       bool
+	LocalSendBuffer    int
+	LocalReceiveBuffer int
+
+	// Largest response payload sent in a single frame when the server
+	// supports chunked responses, maxFrameSize when zero
+	MaxFrameSize int
+
+	// Size of the buffers the responses are read from the local relay
+	// into, streamBufferSize when zero. Between minResponseBufferSize and
+	// the websocket read limit.
+	ResponseBufferSize int
+
+	// Most bytes of response forwarded for a request, zero for no limit.
+	// The relay connection of a longer response is reset and the server
+	// told the response was truncated.
+	MaxResponseBytes int
+
+	// Debug logs show the first PayloadLogLimit bytes of the payloads,
+	// payloadLogLimit when zero, instead of only their length when
+	// PayloadLogging is set. Leave it off in production.
+	PayloadLogging  bool
+	PayloadLogLimit int
+
+	// Gzip response payloads of CompressThreshold bytes or more, when the
+	// server supports it and it makes them smaller. The threshold is
+	// compressThreshold when zero.
+	CompressResponses bool
+	CompressThreshold int
+
+	// Time the local relay is given to start answering a request before
+	// a timeout error frame is returned for it. Zero keeps the legacy
+	// behavior of silently dropping requests that get no response.
+	RequestTimeout time.Duration
+
+	// Sizes of the websocket read and write buffers in bytes,
+	// wsBufferSize when zero and at least minWSBufferSize, e.g. smaller
+	// on memory constrained devices carrying small requests.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Candidate source addresses tried in turn on every connection attempt,
+	// starting with the last one that worked. LocalAddrProvider, when set,
+	// is consulted before each attempt instead of LocalAddrs.
+	LocalAddrs        []net.IP
+	LocalAddrProvider func() []net.IP
+
+	// Resolver used to look up the tunnel server before every attempt,
+	// net.DefaultResolver when nil. Answers are cached for ResolverCacheTTL
+	// and flushed as soon as a connection attempt fails.
+	Resolver         HostResolver
+	ResolverCacheTTL time.Duration
+	hostCache        hostCache
+
+	// Invoked every LivenessInterval, livenessInterval when zero, for as
+	// long as the connection loop and the request forwarding loop keep
+	// making progress, e.g. to stroke a watchdog. It is never invoked
+	// concurrently with itself.
+	LivenessFunc     func()
+	LivenessInterval time.Duration
+	liveness         livenessMonitor
+
+	// Consulted before every connection attempt for the proxy to go
+	// through, nil meaning a direct connection. The last known proxy, the
+	// one the connection test went through at first, is used when it
+	// fails. Without it all attempts use the last known proxy.
+	ProxyProvider func() (*url.URL, error)
+
+	// With CandidateStagger set, TestConnectionAny also tries the next
+	// candidate when the previous one did not succeed within that delay,
+	// rather than only once it failed.
+	CandidateStagger time.Duration
+
+	// With IdleTimeout set, a websocket which carried no request for that
+	// long is closed and the client turns dormant: it pokes the ping url
+	// every DormantPokeInterval, dormantPokeInterval when zero, and only
+	// reconnects once the server signals demand in the response to a
+	// poke, or after DormantInterval, dormantInterval when zero.
+	IdleTimeout         time.Duration
+	DormantPokeInterval time.Duration
+	DormantInterval     time.Duration
+
+	// Receives a record of every websocket connection when it is
+	// established and when it ends, e.g. AuditLog.Record.
+	AuditSink AuditSink
+
+	proxyURL   *url.URL      // last known proxy, protected by mutex
+	exitChan   chan struct{} // channel to tell the tunnel goroutines to end
+	ctx        context.Context
+	cancel     context.CancelFunc // cancels ctx, aborting connection attempts in progress
+	lifecycle  sync.Mutex         // serializes Start and Stop
+	state      tunnelState        // protected by lifecycle
+	relaysOnce sync.Once
+	relays     *relayPool     // connections to the local relay
+	wg         sync.WaitGroup // goroutines of the running session
+	conn       *WSConnection  // reference to remote websocket connection
+	retries    retryState     // consecutive connection failures, protected by mutex
+
+	mutex           sync.Mutex // protects the status fields below
+	localAddr       net.IP     // source address used by the current connection attempt
+	preferredAddr   net.IP     // last source address a connection succeeded from
+	resolvedAddrs   []net.IP   // addresses the server name last resolved to
+	stats           WSTunnelStats
+	terminalErr     error         // reason the connection loop gave up, if it did
+	statusChanged   chan struct{} // closed when Connected, dormant, sessionConflict, relayHealth or terminalErr change
+	lastDialErr     error         // error of the last connection attempt
+	lastPing        PingTimings   // of the last TestConnection
+	testedCandidate string        // which candidate passed TestConnectionAny
+	attemptProxyURL *url.URL      // proxy of the current or last attempt
+	capabilities    []string
+	relayChanged    time.Time // when SetLocalRelay changed LocalRelayServer
+	stopReason      string    // reason given to StopWithReason
+	dormant         bool      // idle websocket closed, waiting for demand
+	relayErr        error     // permanent error connecting to the local relay
+	sessionConflict bool      // last attempt rejected as already connected
+	relayHealth     relayHealthState
+	debugEvents     []debugEvent // state changes, oldest first
+	debugErrors     []debugEvent // error messages, oldest first
+	interceptors    []Interceptor
+}
+
+// tunnelState tells whether the session of a tunnel client is running
+type tunnelState int
+
+const (
+	tunnelIdle    tunnelState = iota // never started
+	tunnelRunning                    // started, possibly given up reconnecting
+	tunnelStopped                    // stopped, may be started again
+)
+
+// WSTunnelStatus is a point in time snapshot of the tunnel client state
+type WSTunnelStatus struct {
+	Connected        bool
+	DestURL          string
+	Capabilities     []string // negotiated with the server for the current connection
+	LocalAddr        net.IP   // source address of the current or last attempt
+	PreferredAddr    net.IP   // source address tried first on the next attempt
+	ResolvedAddrs    []net.IP
+	TLSServerName    string // TLSServerNameOverride if set
+	RetryOnFailCount int
+	TerminalError    string      // why the client stopped reconnecting
+	LastPing         PingTimings // of the last TestConnection
+	Candidate        string      // which candidate passed TestConnectionAny, empty after TestConnection
+	Proxy            string      // proxy of the current or last attempt, empty when direct
+	TLS              *TLSDetails // of the current connection, nil without TLS
+	Dormant          bool        // disconnected after IdleTimeout until demanded
+	AlreadyConnected bool        // last attempt rejected while the server holds an earlier session
+
+	ResponseBufferSize int // bytes read from the local relay at a time
+
+	// Local server the requests are sent to, when SetLocalRelay last
+	// changed it and the error making it unreachable as configured, if
+	// any, until a request reaches it
+	LocalRelay        string
+	LocalRelayChanged time.Time
+	LocalRelayError   string
+	LocalRelayHealth  RelayHealth // found by the checker with RelayCheckInterval
+
+	// Error of the last connection attempt and whether it was due to
+	// the proxy or the tunnel server
+	LastDialError     string
+	LastDialErrorKind DialErrorKind
+
+	ReadBufferSize  int // of the websocket
+	WriteBufferSize int
+}
+
+// wsConn is the part of *websocket.Conn used by WSConnection, which
+// allows the frame handling to be exercised without a real websocket.
+type wsConn interface {
+	NextReader() (messageType int, r io.Reader, err error)
+	NextWriter(messageType int) (io.WriteCloser, error)
+	WriteControl(messageType int, data []byte, deadline time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	SetReadLimit(limit int64)
+	SetPongHandler(h func(appData string) error)
+	Close() error
 }
 
 // WSConnection represents a single websocket connection
 type WSConnection struct {
-	ws              *websocket.Conn // websocket connection
-	tun             *WSTunnelClient // link back to tunnel
-	localConnection net.Conn        // connection to local relay
+	ws        wsConn             // websocket connection
+	tun       *WSTunnelClient    // link back to tunnel
+	requests  chan tunnelRequest // requests waiting to be forwarded to local relay
+	done      chan struct{}      // closed when the websocket read loop ends
+	idled     chan struct{}      // closed when closed for IdleTimeout
+	idleTimer *time.Timer        // nil without IdleTimeout
+	caps      capabilities       // negotiated in the websocket handshake
+	tls       *TLSDetails        // negotiated in the TLS handshake, nil without TLS
+
+	established time.Time // when the websocket handshake completed
+	remoteAddr  string
+	localAddr   string
+	subprotocol string // negotiated in the websocket handshake, if any
+	counters    sessionCounters
+
+	pendingMutex sync.Mutex
+	pending      map[requestID]time.Time // when each unanswered request was read
+	queued       []tunnelRequest         // pending requests over the inflight limit
+
+	recent recentRequests // with DetectDuplicates
+	parked parkedRequests // with MaxPending, only used by forwardRequests
+
+	streamsMutex sync.Mutex
+	streams      map[streamID]*tunnelStream // open streams, with the streams capability
+
+	pingMutex sync.Mutex
+	pingSeq   uint64 // sequence number of the last ping sent
+	pongSeq   uint64 // highest sequence number of the pongs received
+
+	// writeMutex allows a single goroutine to send a response or error
+	// frame at a time
+	writeMutex sync.Mutex
+}
+
+// tunnelRequest is a request read off the websocket
+type tunnelRequest struct {
+	id      requestID
+	payload []byte
+	eof     bool   // the server is done sending, half-close the relay connection
+	dest    string // destination from the frame, empty for LocalRelayServer
 }
 
-var wsWriterMutex sync.Mutex // mutex to allow a single goroutine to send a response at a time
-var connMutex sync.Mutex     // mutex to allow a single goroutine to check and re-initialize connection if required
+func newWSConnection(ws wsConn, tun *WSTunnelClient) *WSConnection {
+	return &WSConnection{
+		ws:       ws,
+		tun:      tun,
+		requests: make(chan tunnelRequest, requestQueueLen(tun)),
+		done:     make(chan struct{}),
+		idled:    make(chan struct{}),
+		pending:  make(map[requestID]time.Time),
+		streams:  make(map[streamID]*tunnelStream),
+		caps:     make(capabilities),
+
+		established: time.Now(),
+	}
+}
 
 // InitializeTunnelClient returns a websocket tunnel client configured with the
 // requested remote and local servers.
@@ -60,6 +387,7 @@ func InitializeTunnelClient(serverName string, localRelay string) *WSTunnelClien
 		Tunnel:           "wss://" + serverName,
 		LocalRelayServer: localRelay,
 		Timeout:          30 * time.Second,
+		RetryInterval:    retryInterval,
 	}
 
 	return &tunnelClient
@@ -67,18 +395,78 @@ func InitializeTunnelClient(serverName string, localRelay string) *WSTunnelClien
 
 // Start triggers workflow to establish the websocket
 // session with remote tunnel server
+//
+// Deprecated: Start does not report failures, use StartNotify.
 func (t *WSTunnelClient) Start() {
-	go func() {
-		t.startSession()
-		<-make(chan struct{}, 0)
-	}()
+	if _, err := t.StartNotify(); err != nil {
+		log.Errorf("Cannot start tunnel client: %v", err)
+	}
+}
+
+// StartNotify triggers workflow to establish the websocket session with
+// remote tunnel server. It fails at once if the client is not ready to
+// be started, i.e. TestConnection did not succeed, or if it is already
+// running. The returned channel delivers the error which made the client
+// give up reconnecting, if any, and is closed once the client stops
+// trying. A client which gave up must be stopped before being started
+// again.
+func (t *WSTunnelClient) StartNotify() (<-chan error, error) {
+	if t.Dialer == nil || t.DestURL == "" {
+		return nil, fmt.Errorf("Tunnel client to %s started without a successful connection test",
+			t.TunnelServerName)
+	}
+	if t.LocalRelayServer == "" {
+		return nil, fmt.Errorf("Must specify local relay server hostOrIP:port")
+	}
+	if err := validateDestinations(t.AllowedDestinations); err != nil {
+		return nil, err
+	}
+	if err := validateResponseBufferSize(t.ResponseBufferSize); err != nil {
+		return nil, err
+	}
+	if err := t.validateWSBufferSizes(); err != nil {
+		return nil, err
+	}
+	t.lifecycle.Lock()
+	defer t.lifecycle.Unlock()
+	switch t.state {
+	case tunnelRunning:
+		return nil, fmt.Errorf("Tunnel client to %s already running", t.TunnelServerName)
+	case tunnelStopped:
+		// The goroutines of the previous session use its channels
+		t.wg.Wait()
+	}
+	t.state = tunnelRunning
+	return t.startSession(), nil
 }
 
 // TestConnection validates the configured parameters for correctness
 // and further attempts an actual connection request to confirm
 // if the client can successfully connect to remote backend server.
 func (t *WSTunnelClient) TestConnection(proxyURL *url.URL, localAddr net.IP) error {
+	if err := t.validateConnectionTest(); err != nil {
+		return err
+	}
+
+	log.Debugf("Testing connection to %s on local address: %v, proxy: %v", t.Tunnel, localAddr, proxyURL)
 
+	tlsConfig, err := t.tlsConfig()
+	if err != nil {
+		return err
+	}
+	candidate := ProxyCandidate{ProxyURL: proxyURL, LocalAddr: localAddr}
+	dialer, timings, err := t.testCandidate(t.ctx, tlsConfig, candidate)
+	t.recordConnectionTest(timings, err)
+	if err != nil {
+		return err
+	}
+	t.connectionTested(dialer, candidate, "")
+	return nil
+}
+
+// validateConnectionTest checks and normalizes the settings used by
+// TestConnection
+func (t *WSTunnelClient) validateConnectionTest() error {
 	if t.Tunnel == "" {
 		return fmt.Errorf("Must specify tunnel server ws://hostname:port")
 	}
@@ -87,146 +475,775 @@ func (t *WSTunnelClient) TestConnection(proxyURL *url.URL, localAddr net.IP) err
 	}
 	t.Tunnel = strings.TrimSuffix(t.Tunnel, "/")
 
-	if t.LocalRelayServer == "" {
-		return fmt.Errorf("Must specify local relay server hostOrIP:port")
+	localRelay, err := validateLocalRelay(t.LocalRelayServer)
+	if err != nil {
+		return err
 	}
-	if strings.HasPrefix(t.LocalRelayServer, "http://") && strings.HasPrefix(t.LocalRelayServer, "https://") {
-		return fmt.Errorf("Local server relay must not begin with http:// or https://")
+	t.LocalRelayServer = localRelay
+
+	if t.TLSServerNameOverride != "" && !isValidHostname(t.TLSServerNameOverride) {
+		return fmt.Errorf("Invalid TLS server name override: %s", t.TLSServerNameOverride)
 	}
-	t.LocalRelayServer = strings.TrimSuffix(t.LocalRelayServer, "/")
+	return t.validateWSBufferSizes()
+}
 
-	log.Debugf("Testing connection to %s on local address: %v, proxy: %v", t.Tunnel, localAddr, proxyURL)
+// testCandidate pings the server as candidate within parent, returning
+// the dialer it used
+func (t *WSTunnelClient) testCandidate(parent context.Context, tlsConfig *tls.Config,
+	candidate ProxyCandidate) (*websocket.Dialer, PingTimings, error) {
 
-	tlsConfig, err := GetTlsConfig(t.TunnelServerName, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
 	dialer := &websocket.Dialer{
-		ReadBufferSize:  100 * 1024,
-		WriteBufferSize: 100 * 1024,
 		TLSClientConfig: tlsConfig,
-		NetDial: func(network, addr string) (net.Conn, error) {
-			localTCPAddr := net.TCPAddr{IP: localAddr}
-			netDialer := &net.Dialer{LocalAddr: &localTCPAddr}
-			return netDialer.DialContext(context.Background(), network, addr)
-		},
-	}
-	if proxyURL != nil {
-		dialer.Proxy = http.ProxyURL(proxyURL)
+		NetDialContext:  t.netDial(candidate.ProxyURL, candidate.LocalAddr),
+		Proxy:           proxyFunc(candidate.ProxyURL),
 	}
+	t.setWSBufferSizes(dialer)
+	ctx, cancel := t.attemptContextFrom(parent)
+	defer cancel()
+	timings, _, err := t.pingDemandContext(ctx, dialer)
+	return dialer, timings, err
+}
+
+// recordConnectionTest remembers the outcome of a connection test
+func (t *WSTunnelClient) recordConnectionTest(timings PingTimings, err error) {
+	t.recordDialError(err)
+	t.mutex.Lock()
+	t.lastPing = timings
+	t.mutex.Unlock()
+}
+
+// connectionTested configures the client to connect with the dialer
+// and as the candidate which passed the connection test, described by
+// name when picked by TestConnectionAny
+func (t *WSTunnelClient) connectionTested(dialer *websocket.Dialer,
+	candidate ProxyCandidate, name string) {
+
+	url := fmt.Sprintf("%s/api/v1/edgedevice/connection/tunnel", t.Tunnel)
+	t.DestURL = url
+	t.Dialer = dialer
+	t.mutex.Lock()
+	t.proxyURL = candidate.ProxyURL
+	t.attemptProxyURL = candidate.ProxyURL
+	t.localAddr = candidate.LocalAddr
+	t.preferredAddr = candidate.LocalAddr
+	t.testedCandidate = name
+	t.mutex.Unlock()
+	log.Infof("Connection test succeeded for url: %s on local address: %v, proxy: %v",
+		url, candidate.LocalAddr, candidate.ProxyURL)
+}
+
+// ping performs a handshake with the ping url using dialer. The server
+// answers it with a plain 200 OK rather than upgrading the connection.
+func (t *WSTunnelClient) ping(dialer *websocket.Dialer) (PingTimings, error) {
+	timings, _, err := t.pingDemand(dialer)
+	return timings, err
+}
+
+// pingDemand is ping also telling whether the server demands the tunnel
+// in the response
+func (t *WSTunnelClient) pingDemand(dialer *websocket.Dialer) (PingTimings, bool, error) {
+	ctx, cancel := t.attemptContext()
+	defer cancel()
+	return t.pingDemandContext(ctx, dialer)
+}
+
+// pingDemandContext is pingDemand within the attempt context ctx
+func (t *WSTunnelClient) pingDemandContext(ctx context.Context,
+	dialer *websocket.Dialer) (PingTimings, bool, error) {
 
 	pingURL := fmt.Sprintf("%s/api/v1/edgedevice/connection/ping", t.Tunnel)
 	log.Debugf("Testing connection to ping url: %s", pingURL)
-	_, resp, err := dialer.Dial(pingURL, nil)
+	ctx, timings := tracePing(ctx)
+	ws, resp, err := dialer.DialContext(ctx, pingURL, nil)
+	timings.done()
+	if ws != nil {
+		ws.Close()
+	}
+	if resp == nil {
+		return timings.PingTimings, false, err
+	}
+	resp.Body.Close()
+	demand := demanded(resp.Header.Get(demandHeader))
 
-	log.Debugf("Read ping response status code: %v for ping url: %s", resp.StatusCode, pingURL)
+	log.Debugf("Read ping response status code: %v for ping url: %s in %v",
+		resp.StatusCode, pingURL, timings.Total)
 
 	if resp.StatusCode == http.StatusOK {
-		url := fmt.Sprintf("%s/api/v1/edgedevice/connection/tunnel", t.Tunnel)
-		t.DestURL = url
-		t.Dialer = dialer
-		log.Infof("Connection test succeeded for url: %s on local address: %v, proxy: %v", url, localAddr, proxyURL)
-		return nil
+		return timings.PingTimings, demand, nil
+	}
+	return timings.PingTimings, false,
+		fmt.Errorf("Ping url %s returned status: %s", pingURL, resp.Status)
+}
+
+// attemptDialer returns a copy of the tested dialer bound to localAddr
+// and using a freshly built TLS configuration.
+func (t *WSTunnelClient) attemptDialer(localAddr net.IP) (*websocket.Dialer, error) {
+	tlsConfig, err := t.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxyURL := t.attemptProxy()
+	dialer := *t.Dialer
+	dialer.NetDialContext = t.netDial(proxyURL, localAddr)
+	dialer.Proxy = proxyFunc(proxyURL)
+	dialer.TLSClientConfig = tlsConfig
+	t.setWSBufferSizes(&dialer)
+	return &dialer, nil
+}
+
+// attemptContext returns the context of a single connection attempt,
+// which ends when the tunnel is stopped or after DialTimeout.
+func (t *WSTunnelClient) attemptContext() (context.Context, context.CancelFunc) {
+	return t.attemptContextFrom(t.ctx)
+}
+
+// attemptContextFrom is attemptContext within parent, e.g. to be
+// canceled once another attempt in parallel succeeded
+func (t *WSTunnelClient) attemptContextFrom(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx := parent
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timeout := t.DialTimeout
+	if timeout == 0 {
+		timeout = dialTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// tlsConfig returns the TLS configuration for a handshake with the
+// tunnel server including the client certificate if one was provided.
+func (t *WSTunnelClient) tlsConfig() (*tls.Config, error) {
+	tlsConfig := t.TLSConfig
+	if tlsConfig == nil {
+		var err error
+		tlsConfig, err = GetTlsConfig(t.TunnelServerName, t.ClientCert)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+		if t.ClientCert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*t.ClientCert}
+		}
+	}
+	if t.GetClientCertificate != nil {
+		tlsConfig.Certificates = nil
+		tlsConfig.GetClientCertificate = t.GetClientCertificate
+	}
+	if t.TLSServerNameOverride != "" {
+		tlsConfig.ServerName = t.TLSServerNameOverride
+	}
+	return tlsConfig, nil
+}
+
+// isValidHostname checks name is a syntactically valid DNS host name.
+// Literal IP addresses are not accepted since they can't be sent in SNI.
+func isValidHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > 253 || net.ParseIP(name) != nil {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 ||
+			label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') &&
+				!(c >= '0' && c <= '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// candidateAddrs returns the source addresses to try for the next
+// connection attempt with the preferred one first. A nil entry means
+// no source binding.
+func (t *WSTunnelClient) candidateAddrs() []net.IP {
+	addrs := t.LocalAddrs
+	if t.LocalAddrProvider != nil {
+		addrs = t.LocalAddrProvider()
+	}
+	t.mutex.Lock()
+	preferred := t.preferredAddr
+	t.mutex.Unlock()
+
+	var candidates []net.IP
+	for _, addr := range addrs {
+		if addr.Equal(preferred) {
+			candidates = append([]net.IP{addr}, candidates...)
+		} else {
+			candidates = append(candidates, addr)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, preferred)
+	}
+	return candidates
+}
+
+// Status returns a snapshot of the current tunnel client state
+func (t *WSTunnelClient) Status() WSTunnelStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var details *TLSDetails
+	if t.conn != nil && t.Connected {
+		details = t.conn.tls
+	}
+	readBufferSize, writeBufferSize := t.wsBufferSizes()
+	return WSTunnelStatus{
+		Connected:        t.Connected,
+		DestURL:          t.DestURL,
+		Capabilities:     t.capabilities,
+		LocalAddr:        t.localAddr,
+		PreferredAddr:    t.preferredAddr,
+		ResolvedAddrs:    t.resolvedAddrs,
+		TLSServerName:    t.TLSServerNameOverride,
+		RetryOnFailCount: t.retries.count(),
+		TerminalError:    errString(t.terminalErr),
+		LastPing:         t.lastPing,
+		Candidate:        t.testedCandidate,
+		Proxy:            redactedURL(t.attemptProxyURL),
+		TLS:              details,
+		Dormant:          t.dormant,
+		AlreadyConnected: t.sessionConflict,
+
+		ResponseBufferSize: t.responseBufferSize(),
+
+		LocalRelay:        t.LocalRelayServer,
+		LocalRelayChanged: t.relayChanged,
+		LocalRelayError:   errString(t.relayErr),
+		LocalRelayHealth:  t.relayHealth.health,
+
+		LastDialError:     errString(t.lastDialErr),
+		LastDialErrorKind: dialErrorKind(t.lastDialErr),
+
+		ReadBufferSize:  readBufferSize,
+		WriteBufferSize: writeBufferSize,
+	}
+}
+
+func (t *WSTunnelClient) setConnected(connected bool) {
+	t.mutex.Lock()
+	t.Connected = connected
+	t.statusChangedLocked()
+	t.mutex.Unlock()
+}
+
+// statusChangedLocked wakes up the callers of WaitConnected. The caller
+// holds the mutex.
+func (t *WSTunnelClient) statusChangedLocked() {
+	t.stateChangedLocked()
+	if t.statusChanged != nil {
+		close(t.statusChanged)
+		t.statusChanged = nil
+	}
+}
+
+// statusChangedChanLocked returns the channel closed on the next status
+// change. The caller holds the mutex.
+func (t *WSTunnelClient) statusChangedChanLocked() chan struct{} {
+	if t.statusChanged == nil {
+		t.statusChanged = make(chan struct{})
 	}
-	return err
+	return t.statusChanged
+}
+
+// StatusChanged returns a channel closed on the next change of the
+// connected, dormant or already connected state, of the local relay
+// health, or of the terminal error, in Status
+func (t *WSTunnelClient) StatusChanged() <-chan struct{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.statusChangedChanLocked()
+}
+
+// RetriesExhaustedError is the terminal error of a tunnel client which
+// gave up after MaxRetryAttempts consecutive failed connection attempts
+type RetriesExhaustedError struct {
+	Attempts int
+	LastErr  error // error of the last attempt
+}
+
+func (e *RetriesExhaustedError) Error() string {
+	return fmt.Sprintf("Gave up after %d failed connection attempts: %v",
+		e.Attempts, e.LastErr)
+}
+
+// WaitConnected blocks until the tunnel is connected to the server. It
+// returns ctx.Err() if ctx is done first, and the terminal error, e.g. a
+// *RetriesExhaustedError, if the client gives up reconnecting meanwhile.
+func (t *WSTunnelClient) WaitConnected(ctx context.Context) error {
+	for {
+		t.mutex.Lock()
+		connected, err := t.Connected, t.terminalErr
+		changed := t.statusChangedChanLocked()
+		t.mutex.Unlock()
+		if connected {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// WaitConnectedTimeout is WaitConnected with a context expiring after timeout
+func (t *WSTunnelClient) WaitConnectedTimeout(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return t.WaitConnected(ctx)
 }
 
 // startSession connects to configured backend on a
 // secure websocket and waits for commands from the backend
 // to forward to local relay.
-func (t *WSTunnelClient) startSession() error {
+func (t *WSTunnelClient) startSession() <-chan error {
 
 	// signal that tells tunnel client to exit instead of reopening
 	// a fresh connection.
-	t.exitChan = make(chan struct{}, 1)
-	t.requestSentChan = make(chan struct{}, 1)
+	t.exitChan = make(chan struct{})
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+
+	t.mutex.Lock()
+	t.retries = retryState{window: t.StabilityWindow}
+	t.terminalErr = nil
+	t.stopReason = ""
+	t.statusChangedLocked()
+	t.mutex.Unlock()
+
+	if t.ProbeInterval != 0 {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.prober()
+		}()
+	}
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.relayPool().reaper(t.exitChan)
+	}()
 
-	t.retryOnFailCount = 0
+	if t.RelayCheckInterval != 0 {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.relayChecker(t.exitChan)
+		}()
+	}
+
+	if t.LivenessFunc != nil {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.livenessReporter(t.exitChan)
+		}()
+	}
 
 	// Keep opening websocket connections to tunnel requests
+	errChan := make(chan error, 1)
+	t.wg.Add(1)
 	go func() {
-		log.Debug("Looping through websocket connection requests")
-		for {
-			if t.retryOnFailCount == maxRetryAttempts {
-				log.Errorf("Shutting down tunnel client after %d failed attempts.", maxRetryAttempts)
-				break
-			}
-			// Retry timer of 30 seconds between attempts.
-			timer := time.NewTimer(30 * time.Second)
+		defer t.wg.Done()
+		if err := t.connectLoop(); err != nil {
+			t.mutex.Lock()
+			t.terminalErr = err
+			t.statusChangedLocked()
+			t.mutex.Unlock()
+			errChan <- err
+		}
+		close(errChan)
+	}()
+	return errChan
+}
 
-			log.Debugf("Attempting WS connection to url: %s", t.DestURL)
+// connectLoop keeps opening websocket connections until the tunnel is
+// stopped or gives up. It returns the reason for giving up, nil when
+// stopped.
+func (t *WSTunnelClient) connectLoop() error {
+	log.Debug("Looping through websocket connection requests")
+	t.loopStarted(t)
+	defer t.loopEnded(t)
+	tick, stopTick := t.livenessTicker()
+	defer stopTick()
+	for {
+		select {
+		case <-t.exitChan:
+			return nil
+		default:
+		}
+		t.loopAlive(t)
+		maxAttempts := t.MaxRetryAttempts
+		if maxAttempts == 0 {
+			maxAttempts = maxRetryAttempts
+		}
+		t.mutex.Lock()
+		failures := t.retries.count()
+		t.mutex.Unlock()
+		if failures >= maxAttempts {
+			log.Errorf("Shutting down tunnel client after %d failed attempts.", maxAttempts)
+			t.mutex.Lock()
+			lastErr := t.lastDialErr
+			t.mutex.Unlock()
+			return &RetriesExhaustedError{Attempts: maxAttempts, LastErr: lastErr}
+		}
+		// Retry timer between attempts.
+		interval := t.RetryInterval
+		if interval == 0 {
+			interval = retryInterval
+		}
+		timer := time.NewTimer(interval)
 
-			ws, resp, err := t.Dialer.Dial(t.DestURL, nil)
-			if err != nil {
-				extra := ""
-				if resp != nil {
-					extra = resp.Status
-					buf := make([]byte, 80)
-					resp.Body.Read(buf)
-					if len(buf) > 0 {
-						extra = extra + " -- " + string(buf)
-					}
-					resp.Body.Close()
-					log.Errorf("Error opening connection: %v, response: %v", err.Error(), resp)
+		ws, caps, err := t.dial()
+		if err == nil && t.stopped() {
+			// Stopped while dialing
+			ws.Close()
+			timer.Stop()
+			return nil
+		}
+		_, rejected := err.(*AlreadyConnectedError)
+		t.setAlreadyConnected(rejected)
+		if rejected {
+			// Redialing sooner would only prolong the conflict
+			t.mutex.Lock()
+			delay := t.retries.delay(interval, t.alreadyConnectedDelay())
+			t.mutex.Unlock()
+			log.Warnf("%v, redialing in %v", err, delay)
+			timer.Stop()
+			timer = time.NewTimer(delay)
+		} else if err != nil {
+			t.mutex.Lock()
+			t.retries.dialFailed()
+			t.stats.Disconnects.DialFailures++
+			t.mutex.Unlock()
+		} else {
+			// Safety setting
+			ws.SetReadLimit(wsReadLimit)
+			// Request Loop
+			conn := newWSConnection(ws, t)
+			conn.caps = caps
+			conn.tls = tlsDetails(ws)
+			conn.remoteAddr = ws.RemoteAddr().String()
+			conn.localAddr = ws.LocalAddr().String()
+			conn.subprotocol = ws.Subprotocol()
+			checkCertExpiry(t.TunnelServerName, conn.tls)
+			t.mutex.Lock()
+			t.conn = conn
+			t.capabilities = caps.list()
+			t.Connected = true
+			t.retries.connected()
+			t.statusChangedLocked()
+			t.mutex.Unlock()
+			if t.stopped() {
+				// Stop missed the connection
+				ws.Close()
+			}
+			err := conn.handleRequests()
+			t.setConnected(false)
+			if t.stopped() {
+				timer.Stop()
+				return nil
+			}
+			if conn.wentIdle() {
+				t.mutex.Lock()
+				t.retries.disconnected(false)
+				t.mutex.Unlock()
+				timer.Stop()
+				if !t.sleep(tick) {
+					return nil
 				}
-				t.retryOnFailCount++
-			} else {
-				t.conn = &WSConnection{ws: ws, tun: t}
-				// Safety setting
-				ws.SetReadLimit(100 * 1024 * 1024)
-				// Request Loop
-				t.Connected = true
-				t.retryOnFailCount = 0
-				t.conn.handleRequests()
-				t.Connected = false
+				continue
+			}
+
+			switch action := closeActionFor(err); action {
+			case closeActionReconnect:
+				// e.g. the controller restarting, which does not count
+				// against the retry budget
+				log.Infof("Server closed connection (%v), reconnecting", err)
+				t.mutex.Lock()
+				t.retries.disconnected(false)
+				t.stats.Disconnects.CleanCloses++
+				t.mutex.Unlock()
+				timer.Stop()
+				timer = time.NewTimer(t.reconnectDelay())
+			case closeActionStop:
+				log.Errorf("Server refused connection (%v), giving up", err)
+				t.mutex.Lock()
+				t.retries.disconnected(false)
+				t.stats.Disconnects.Refusals++
+				t.mutex.Unlock()
+				timer.Stop()
+				return err
+			default:
+				t.recordError("Connection lost: %v", err)
+				t.mutex.Lock()
+				t.retries.disconnected(true)
+				t.stats.Disconnects.ReadErrors++
+				t.mutex.Unlock()
 			}
-			// check whether we need to exit
+		}
+
+		// check whether we need to exit, and
+		// ensure we don't open connections too rapidly
+	wait:
+		for {
 			select {
 			case <-t.exitChan:
-				break
-			default: // non-blocking receive
+				timer.Stop()
+				return nil
+			case <-tick:
+				t.loopAlive(t)
+			case <-timer.C:
+				break wait
 			}
+		}
+	}
+}
 
-			// ensure we don't open connections too rapidly,
-			<-timer.C
+// dial opens a websocket connection to DestURL trying each candidate
+// source address in turn until one succeeds, which then becomes the
+// preferred source address for subsequent attempts.
+func (t *WSTunnelClient) dial() (*websocket.Conn, capabilities, error) {
+	var err error
+	for _, localAddr := range t.candidateAddrs() {
+		log.Debugf("Attempting WS connection to url: %s on local address: %v",
+			t.DestURL, localAddr)
+		t.mutex.Lock()
+		t.localAddr = localAddr
+		t.mutex.Unlock()
+
+		var dialer *websocket.Dialer
+		dialer, err = t.attemptDialer(localAddr)
+		if err != nil {
+			log.Errorf("Error loading TLS configuration: %v", err)
+			return nil, nil, err
 		}
-	}()
+		var ws *websocket.Conn
+		var resp *http.Response
+		ctx, cancel := t.attemptContext()
+		offered := t.offeredCapabilities()
+		ws, resp, err = dialer.DialContext(ctx, t.DestURL, handshakeHeader(offered))
+		cancel()
+		if err == nil {
+			t.recordDialError(nil)
+			t.mutex.Lock()
+			t.preferredAddr = localAddr
+			t.mutex.Unlock()
+			return ws, negotiatedCapabilities(resp, offered), nil
+		}
+		extra := ""
+		if resp != nil {
+			extra = resp.Status
+			buf := make([]byte, 80)
+			n, _ := io.ReadFull(resp.Body, buf)
+			if n > 0 {
+				extra = extra + " -- " + string(buf[:n])
+			}
+			resp.Body.Close()
+			if alreadyConnected(resp.StatusCode, string(buf[:n])) {
+				// Any other source address would be rejected as well
+				err = &AlreadyConnectedError{Status: resp.Status, Body: string(buf[:n])}
+				t.recordDialError(err)
+				return nil, nil, err
+			}
+		}
+		t.recordDialError(err)
+		log.Errorf("Error opening connection on local address: %v: %v, response: %s",
+			localAddr, err.Error(), extra)
+		if t.stopped() {
+			return nil, nil, err
+		}
+	}
+	// Look up the server afresh on the next attempt
+	t.hostCache.flush()
+	return nil, nil, err
+}
 
-	return nil
+// ForceReconnect closes the current websocket connection, if any,
+// so that a fresh one is established.
+func (t *WSTunnelClient) ForceReconnect() {
+	t.mutex.Lock()
+	conn := t.conn
+	t.mutex.Unlock()
+	if conn != nil {
+		log.Infof("Forcing reconnect of websocket connection to: %s", t.DestURL)
+		conn.closeWithCode(websocket.CloseGoingAway, "reconnecting")
+		conn.ws.Close()
+	}
 }
 
-// Stop tunnel client
+// Reasons sent to the server in the close frame on StopWithReason
+const (
+	StopReasonShutdown     = "client shutdown"
+	StopReasonConfigChange = "config change"
+)
+
+// Stop tunnel client. The goroutines of the session end shortly
+// after, use Wait to block until they have.
 func (t *WSTunnelClient) Stop() {
-	log.Info("Shutting down WS tunnel client and exiting.")
-	t.exitChan <- struct{}{}
+	t.StopWithReason(StopReasonShutdown)
+}
+
+// StopWithReason stops the tunnel client like Stop, telling the server
+// why in the close frame. The requests in flight are given
+// stopDrainTimeout to complete, and the server closeReplyTimeout to
+// answer the close frame before the connection is closed.
+func (t *WSTunnelClient) StopWithReason(reason string) {
+	t.lifecycle.Lock()
+	defer t.lifecycle.Unlock()
+	if t.state != tunnelRunning {
+		return
+	}
+	t.state = tunnelStopped
+	log.Infof("Shutting down WS tunnel client (%s) and exiting.", reason)
+	t.mutex.Lock()
+	t.stopReason = reason
+	conn := t.conn
+	t.conn = nil
+	t.mutex.Unlock()
+	if conn != nil {
+		conn.drain(stopDrainTimeout)
+	}
+	close(t.exitChan)
+	t.cancel()
+	if conn != nil {
+		conn.closeWithCode(websocket.CloseNormalClosure, reason)
+		// The close frame of the server ends the read loop
+		select {
+		case <-conn.done:
+		case <-time.After(closeReplyTimeout):
+		}
+		conn.ws.Close()
+	}
+}
+
+// Wait blocks until the goroutines of a stopped tunnel client have ended
+func (t *WSTunnelClient) Wait() {
+	t.wg.Wait()
+}
+
+func (t *WSTunnelClient) stopped() bool {
+	select {
+	case <-t.exitChan:
+		return true
+	default:
+		return false
+	}
 }
 
 // handleRequests reads a request from the socket, then forks
 // a goroutine to relay the request locally and optionally
-// return the result if any.
-func (wsc *WSConnection) handleRequests() {
-	go wsc.pinger()
-	go wsc.processResponses()
+// return the result if any. It returns the error which ended
+// the websocket connection.
+func (wsc *WSConnection) handleRequests() error {
+	wsc.auditEstablished()
+	wsc.startIdleTimer()
+	wsc.tun.mutex.Lock()
+	health := wsc.tun.relayHealth
+	wsc.tun.mutex.Unlock()
+	wsc.reportRelayHealth(health)
+	wsc.tun.wg.Add(2)
+	go func() {
+		defer wsc.tun.wg.Done()
+		wsc.pinger()
+	}()
+	go func() {
+		defer wsc.tun.wg.Done()
+		wsc.forwardRequests()
+	}()
+	var readErr error
 	for {
 		wsc.ws.SetReadDeadline(time.Time{}) // separate ping-pong routine does timeout
 		messageType, reader, err := wsc.ws.NextReader()
 		if err != nil {
 			log.Debugf("WS ReadMessage Error: %s", err.Error())
+			readErr = err
 			break
 		}
+		if messageType == websocket.TextMessage && wsc.caps[capabilityControl] {
+			if err := wsc.handleControl(reader); err != nil {
+				log.Debugf("WS control message Error: %s", err.Error())
+				wsc.closeWithCode(websocket.CloseProtocolError, err.Error())
+				readErr = err
+				break
+			}
+			wsc.tun.loopAlive(wsc.tun)
+			continue
+		}
 		if messageType != websocket.BinaryMessage {
 			log.Debugf("WS ReadMessage Invalid message type: %d", messageType)
+			wsc.closeWithCode(websocket.CloseUnsupportedData,
+				"binary frames expected")
+			readErr = fmt.Errorf("Invalid message type: %d", messageType)
 			break
 		}
 		// give the sender a minute to produce the request
 		wsc.ws.SetReadDeadline(time.Now().Add(time.Minute))
+		if wsc.caps[capabilityChecksum] {
+			if reader, err = wsc.verifyFrame(reader); err != nil {
+				log.Debugf("WS cannot read frame Error: %s", err.Error())
+				readErr = err
+				break
+			}
+			if reader == nil {
+				wsc.tun.loopAlive(wsc.tun)
+				continue
+			}
+		}
+		if wsc.caps[capabilityStreams] {
+			var stream bool
+			stream, reader, err = isStreamFrame(reader)
+			if err == nil && stream {
+				err = wsc.handleStreamFrame(reader)
+				if err == nil {
+					wsc.tun.loopAlive(wsc.tun)
+					continue
+				}
+			}
+			if err != nil {
+				log.Debugf("WS stream frame Error: %s", err.Error())
+				readErr = err
+				break
+			}
+		}
 		// read request id
-		var id int16
-		_, err = fmt.Fscanf(io.LimitReader(reader, 4), "%04x", &id)
+		id, err := readFrameID(reader, wsc.caps.idLen())
+		flags := 0
+		if err == nil && wsc.caps[capabilityHalfClose] {
+			flags, err = readFrameFlags(reader)
+		}
+		dest := ""
+		if err == nil && wsc.caps[capabilityDestination] {
+			dest, err = readFrameDestination(reader)
+		}
 		if err != nil {
 			log.Debugf("WS cannot read request ID Error: %s", err.Error())
+			if _, ok := err.(*frameHeaderError); ok {
+				wsc.closeWithCode(websocket.CloseProtocolError, err.Error())
+			}
+			readErr = err
 			break
 		}
+		if wsc.duplicateRequest(id) {
+			if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+				readErr = err
+				break
+			}
+			wsc.replayResponse(id)
+			wsc.tun.loopAlive(wsc.tun)
+			continue
+		}
+		wsc.requestRead(id)
 		// read the whole message, this is bounded (to something large) by the
 		// SetReadLimit on the websocket. We have to do this because we want to handle
 		// the request in a goroutine (see "go process..Request" calls below) and the
@@ -234,231 +1251,423 @@ func (wsc *WSConnection) handleRequests() {
 		request, err := ioutil.ReadAll(reader)
 		if err != nil {
 			log.Debugf("[id=%d] WS cannot read request message Error: %s", id, err.Error())
+			readErr = err
 			break
 		}
-		log.Debugf("[id=%d] WS processing request payload: %v", id, string(request))
+		log.Debugf("[id=%d] WS processing request payload: %s", id,
+			wsc.tun.payloadLog(request))
+		wsc.counters.requestRead(len(request))
+		wsc.requestSeen()
+		wsc.tun.loopAlive(wsc.tun)
 
 		// Finish off while we read the next request
-		if len(request) > 0 {
-			if err := wsc.processRequest(id, request); err != nil {
-				log.Error(err)
+		eof := flags&frameFlagEOF != 0
+		if len(request) > 0 || eof {
+			req := tunnelRequest{id: id, payload: request, eof: eof, dest: dest}
+			switch wsc.admit(req) {
+			case admitted:
+				select {
+				case wsc.requests <- req:
+				case <-wsc.tun.exitChan:
+				}
+			case rejectedBusy:
+				log.Warnf("[id=%d] Too many requests in flight, rejecting request", id)
+				wsc.writeErrorMessage(id, frameErrorBusy, "too many requests in flight")
+				wsc.requestFinished(id, false)
+				wsc.forgetRequest(id)
 			}
 		} else {
 			log.Debugf("[id=%d] Encountered WS request to process with no payload", id)
+			wsc.requestFinished(id, false)
 		}
 
 	}
-	// delay a few seconds to allow for writes to drain and then force-close the socket
+	close(wsc.done)
+	wsc.stopIdleTimer()
+	wsc.closeStreams()
+	wsc.abandonRequests()
+	wsc.auditEnded(readErr)
+	// delay a few seconds to allow for writes to drain and then force-close
+	// the socket, at once if the tunnel is stopped
+	wsc.tun.wg.Add(1)
 	go func() {
+		defer wsc.tun.wg.Done()
 		log.Info("Closing websocket connection")
-		time.Sleep(5 * time.Second)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-wsc.tun.exitChan:
+		}
 		wsc.ws.Close()
 	}()
+	return readErr
 }
 
 // Pinger that keeps connections alive and terminates them if they seem stuck
 func (wsc *WSConnection) pinger() {
-	defer func() {
-		// panics may occur in WriteControl (in unit tests at least) for closed
-		// websocket connections
-		if x := recover(); x != nil {
-			log.Errorf("Panic in pinger: %s", x)
-		}
-	}()
 	log.Infof("pinger starting for websocket connection to: %s", wsc.tun.DestURL)
-	tunTimeout := wsc.tun.Timeout
+	settings := wsc.tun.settings()
 
 	// timeout handler sends a close message, waits a few seconds, then kills the socket
 	timeout := func() {
-		if wsc.ws == nil {
-			return
-		}
-		wsc.ws.WriteControl(websocket.CloseMessage, nil, time.Now().Add(1*time.Second))
+		wsc.closeWithCode(websocket.CloseGoingAway, "ping timeout")
 		log.Infof("ping timeout, closing websocket connection to: %s", wsc.tun.DestURL)
-		time.Sleep(15 * time.Second)
-		if wsc.ws != nil {
-			wsc.ws.Close()
+		select {
+		case <-time.After(15 * time.Second):
+		case <-wsc.done:
 		}
+		wsc.ws.Close()
 	}
 	// timeout timer
-	timer := time.AfterFunc(tunTimeout, timeout)
+	timer := time.AfterFunc(settings.pongTimeout, timeout)
+	defer timer.Stop()
 	// pong handler resets last pong time
 	ph := func(message string) error {
-		timer.Reset(tunTimeout)
+		timer.Reset(wsc.tun.settings().pongTimeout)
+		wsc.pongReceived([]byte(message))
+		// invoked by the websocket reader
+		wsc.tun.loopAlive(wsc.tun)
 		return nil
 	}
 	wsc.ws.SetPongHandler(ph)
 	// ping loop, ends when socket is closed...
+	defer func() {
+		log.Infof("pinger ending (WS errored or closed) for destination: %s", wsc.tun.DestURL)
+		wsc.ws.Close()
+		wsc.pingsEnded()
+	}()
 	for {
-		if wsc.ws == nil {
-			log.Errorf("WS not found for destination: %s", wsc.tun.DestURL)
-			break
-		}
-		err := wsc.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(tunTimeout/3))
+		// Settings updated by the server apply from the next ping
+		interval := wsc.tun.settings().pingInterval
+		err := wsc.ws.WriteControl(websocket.PingMessage, wsc.pingSent(), time.Now().Add(interval))
 		if err != nil {
 			log.Errorf("WS WriteControl Error: %s", err.Error())
-			break
+			return
+		}
+		select {
+		case <-time.After(interval):
+		case <-wsc.done:
+			return
 		}
-		time.Sleep(tunTimeout / 3)
 	}
-	log.Infof("pinger ending (WS errored or closed) for destination: %s", wsc.tun.DestURL)
-	wsc.ws.Close()
 }
 
-// processRequest forwards the received message to local relay
-// server and starts a separate go-routine to check for and return
-// any responses that are optionally received.
-func (wsc *WSConnection) processRequest(id int16, req []byte) (err error) {
+// forwardRequests hands the queued requests to the local relay one
+// at a time and relays each response back over the websocket.
+func (wsc *WSConnection) forwardRequests() {
 
-	host := wsc.tun.LocalRelayServer
-	if err := wsc.refreshLocalConnection(host, false); err != nil {
+	log.Infof("Processing responses from local relay: %s", wsc.tun.localRelay())
+	pool := wsc.tun.relayPool()
+	// The next websocket dials afresh on its first request
+	defer pool.closeAllIdle()
+	wsc.tun.loopStarted(wsc)
+	defer wsc.tun.loopEnded(wsc)
+	tick, stopTick := wsc.tun.livenessTicker()
+	defer stopTick()
+
+	var last time.Time // when the last request was forwarded
+	for {
+		wsc.tun.loopAlive(wsc)
+		var retry <-chan time.Time
+		if len(wsc.parked.requests) != 0 {
+			retry = time.After(parkRetryInterval)
+		}
+		select {
+		case <-tick:
+		case req := <-wsc.requests:
+			if !wsc.throttle(last) {
+				wsc.requestFinished(req.id, true)
+				return
+			}
+			last = time.Now()
+			if !wsc.interceptRequest(&req) {
+				break
+			}
+			if len(wsc.parked.requests) != 0 {
+				// Behind the parked ones to keep the order
+				wsc.park(req)
+				break
+			}
+			if err := wsc.forward(pool, req, wsc.tun.localAttempts()); err != nil {
+				if wsc.tun.MaxPending != 0 && isRefused(err.err) {
+					wsc.park(req)
+				} else {
+					wsc.failRequest(req.id, err)
+				}
+			}
+		case <-retry:
+			wsc.flushParked(pool)
+		case <-wsc.done:
+			return
+		case <-wsc.tun.exitChan:
+			return
+		}
+	}
+}
+
+// forward relays req to the local relay and its response back. It
+// returns the error when the request could not be written to the relay,
+// leaving it to the caller to report it.
+func (wsc *WSConnection) forward(pool *relayPool, req tunnelRequest, attempts int) *relayError {
+	conn, err := wsc.processRequest(req.id, req.dest, req.payload, attempts)
+	if err != nil {
 		return err
 	}
-	log.Debugf("[id=%d] Forwarding request: %v to local connection: %s", id, string(req), host)
-	for tries := 1; tries <= 3; tries++ {
-		_, err := wsc.localConnection.Write(req)
-		if err == nil {
-			log.Debugf("[id=%d] Completed writing request: \"%s\" to local connection",
-				id, string(req))
-			break
-		} else {
-			log.Debugf("[id=%d] Error encountered while writing request to local connection : %s",
-				id, err.Error())
-			if err := wsc.refreshLocalConnection(host, true); err != nil {
-				return err
-			}
+	if req.eof {
+		if err := conn.closeWrite(); err != nil {
+			log.Errorf("[id=%d] %v", req.id, err)
 		}
 	}
-	wsc.tun.requestSentChan <- struct{}{}
+	if wsc.processResponse(req.id, conn) {
+		pool.put(conn)
+	} else {
+		pool.discard(conn)
+	}
 	return nil
 }
 
-// refreshLocalConnection checks if the cached connection is still
-// valid or else creates & caches a new one. The forceCreate flag
-// can be used to forcily update the cached local connection.
-func (wsc *WSConnection) refreshLocalConnection(host string, forceCreate bool) (err error) {
+// failRequest answers request id with an error frame for err
+func (wsc *WSConnection) failRequest(id requestID, err *relayError) {
+	log.Error(err)
+	wsc.tun.recordError("%v", err)
+	wsc.writeErrorMessage(id, err.code, err.Error())
+	wsc.requestFinished(id, false)
+}
+
+// relayError is a failure to forward a request to the local relay
+// along with the code reported to the server in the error frame
+type relayError struct {
+	code string
+	err  error
+}
 
-	connMutex.Lock()
-	defer connMutex.Unlock()
+func (e *relayError) Error() string {
+	return e.err.Error()
+}
+
+// processRequest forwards the received message to local relay
+// server, or to dest when set, on a connection checked out from the
+// relay pool, which is returned for reading the response. It makes up
+// to attempts attempts.
+func (wsc *WSConnection) processRequest(id requestID, dest string, req []byte, attempts int) (*relayConn, *relayError) {
 
-	if wsc.localConnection != nil && !forceCreate {
-		c := wsc.localConnection
-		one := []byte{}
-		c.SetReadDeadline(time.Now())
-		_, err := c.Read(one)
+	host, err := wsc.tun.requestTarget(dest)
+	if err != nil {
+		log.Errorf("[id=%d] Security: denied tunnel request: %v", id, err)
+		return nil, &relayError{code: frameErrorDestinationDenied,
+			err: fmt.Errorf("[id=%d] %v", id, err)}
+	}
+	if !wsc.tun.destinationAllowed(host) {
+		log.Errorf("[id=%d] Security: denied tunnel request to local destination %s, not in the allowed destinations",
+			id, host)
+		return nil, &relayError{code: frameErrorDestinationDenied,
+			err: fmt.Errorf("[id=%d] Local destination %s not allowed", id, host)}
+	}
+	pool := wsc.tun.relayPool()
+	log.Debugf("[id=%d] Forwarding request: %s to local connection: %s", id,
+		wsc.tun.payloadLog(req), host)
+	var failure *relayError
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 && !wsc.tun.retryDelay(attempt-1) {
+			break
+		}
+		conn, err := pool.get(host, wsc.tun.exitChan)
 		if err != nil {
-			log.Errorf("Error encountered while testing local connection: %s", err.Error())
-			if err == io.EOF ||
-				err == io.ErrClosedPipe ||
-				err == io.ErrUnexpectedEOF {
-				log.Debug("Lost local server connection, reconnecting...")
-				if err := wsc.dialLocalConnection(); err != nil {
-					return err
+			log.Debugf("[id=%d] Attempt %d/%d at connecting to local server failed: %v",
+				id, attempt, attempts, err)
+			if permanentRelayError(err) {
+				// Retrying is pointless
+				if dest == "" {
+					wsc.tun.setRelayError(err)
 				}
+				return nil, &relayError{code: frameErrorRelayInvalid, err: err}
 			}
+			failure = &relayError{code: frameErrorRelayUnreachable, err: err}
+			continue
 		}
-	} else {
-		if err := wsc.dialLocalConnection(); err != nil {
-			return err
+		conn.routed = dest != ""
+		if !conn.routed {
+			wsc.tun.setRelayError(nil)
+		}
+		_, err = conn.Write(req)
+		if err == nil {
+			log.Debugf("[id=%d] Completed writing request of %d bytes to local connection",
+				id, len(req))
+			return conn, nil
 		}
+		log.Debugf("[id=%d] Attempt %d/%d at writing request to local connection failed: %s",
+			id, attempt, attempts, err.Error())
+		pool.discard(conn)
+		failure = &relayError{code: frameErrorRelayWrite,
+			err: fmt.Errorf("[id=%d] Could not write request to local server: %s: %s",
+				id, host, err.Error())}
 	}
-	return nil
+	return nil, failure
 }
 
-// dialLocalConnection creates a new connection to local relay server.
-func (wsc *WSConnection) dialLocalConnection() (err error) {
+// processResponse waits for the local relay to answer request id on
+// conn and forwards the answer on the websocket. The response is
+// whatever the relay sends until it goes quiet for responseReadWindow.
+// If nothing arrives within RequestTimeout a timeout error frame is sent
+// instead. It returns false when conn can't be reused.
+func (wsc *WSConnection) processResponse(id requestID, conn *relayConn) bool {
 
-	host := wsc.tun.LocalRelayServer
-	if host == "" {
-		log.Error("Local server not found for WS connection")
-		return
+	wait := responseReadWindow
+	if wsc.tun.RequestTimeout != 0 {
+		wait = wsc.tun.RequestTimeout
 	}
-
-	log.Debugf("Initializing local server connection: %s", host)
-	localConnection, err := net.Dial("tcp", host)
-	if err != nil {
-		log.Errorf("Could not connect to local server: %s, error: %s", host, err.Error())
-		return err
+	conn.SetReadDeadline(time.Now().Add(wait))
+	buf := getBuffer(&copyBuffers, wsc.tun.responseBufferSize())
+	defer copyBuffers.Put(buf)
+	num, err := conn.Read(*buf)
+	if num == 0 {
+		switch {
+		case err == io.EOF && wsc.caps[capabilityHalfClose]:
+			// The relay closed its side without answering
+			wsc.streamResponse(id, bytes.NewReader(nil), func() int { return frameFlagEOF })
+			return false
+		case !isTimeout(err):
+			log.Errorf("[id=%d] Error reading response from local relay: %v",
+				id, err)
+			wsc.writeErrorMessage(id, frameErrorRelayRead,
+				fmt.Sprintf("reading response from local relay: %v", err))
+			wsc.requestFinished(id, false)
+			return false
+		case wsc.tun.RequestTimeout != 0:
+			log.Errorf("[id=%d] No response from local relay within %v",
+				id, wsc.tun.RequestTimeout)
+			wsc.tun.mutex.Lock()
+			wsc.tun.stats.RequestsTimedOut++
+			wsc.tun.mutex.Unlock()
+			wsc.writeErrorMessage(id, frameErrorTimeout,
+				fmt.Sprintf("no response from local relay within %v",
+					wsc.tun.RequestTimeout))
+			wsc.requestFinished(id, false)
+			return false
+		default:
+			wsc.requestFinished(id, true)
+		}
+		return true
 	}
-	wsc.localConnection = localConnection
-	log.Debugf("Successfully connected to local server: %s", host)
-	return nil
+	// The rest of the response is streamed as it arrives
+	conn.SetReadDeadline(time.Now().Add(responseReadWindow))
+	rest := &quietReader{r: conn}
+	capped := wsc.tun.capResponse(io.MultiReader(bytes.NewReader((*buf)[:num]), rest))
+	var response io.Reader = capped
+	if interceptors := wsc.tun.getInterceptors(); len(interceptors) != 0 {
+		payload, ok := wsc.interceptResponse(id, capped, interceptors)
+		if !ok {
+			conn.SetReadDeadline(time.Time{})
+			return !rest.closed && !capped.truncated
+		}
+		response = bytes.NewReader(payload)
+	}
+	wsc.streamResponse(id, response, func() int {
+		flags := 0
+		if wsc.caps[capabilityHalfClose] && rest.closed {
+			flags |= frameFlagEOF
+		}
+		if capped.truncated {
+			flags |= frameFlagTruncated
+		}
+		return flags
+	})
+	conn.SetReadDeadline(time.Time{})
+	if capped.truncated {
+		wsc.responseTruncated(id, conn)
+		return false
+	}
+	return !rest.closed
 }
 
-// processResponses loops through waiting for responses from local relay
-// connection and forwards any received messages to the websocket.
-func (wsc *WSConnection) processResponses() {
-
-	host := wsc.tun.LocalRelayServer
-	log.Infof("Processing responses from local relay: %s", host)
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
 
-	var id int64
-	for {
-		select {
-		case <-wsc.tun.requestSentChan:
+// writeResponseMessage forwards the response message on the websocket,
+// compressed and split into chunks of at most MaxFrameSize if the server
+// supports it.
+func (wsc *WSConnection) writeResponseMessage(id requestID, resp *bytes.Buffer) {
+	// Get writer's lock
+	wsc.writeMutex.Lock()
+	defer wsc.writeMutex.Unlock()
+	wsc.writeResponseLocked(id, resp.Bytes(), 0)
+}
 
-			if err := wsc.refreshLocalConnection(host, false); err != nil {
-				log.Errorf("Error encountered while refreshing local connection: %s", err.Error())
-				break
-			}
-			wsc.localConnection.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-			responseBuffer := make([]byte, 524288)
-			responseBuffer, _ = ioutil.ReadAll(wsc.localConnection)
-			num := len(responseBuffer)
-			if num > 0 {
-				response := responseBuffer[:num]
-				log.Debugf("[id=%d] Read local connection payload: \"%s\"", id, string(response))
-
-				wsc.writeResponseMessage(id, bytes.NewBuffer(response))
-				id++
-			}
-		default:
+// writeResponseLocked is writeResponseMessage with the writer's lock
+// held. The last frame also gets the final flags.
+func (wsc *WSConnection) writeResponseLocked(id requestID, response []byte, final int) {
+	if !wsc.caps.framesHaveFlags() {
+		if wsc.writeDataFrame(id, formatFrameID(id, wsc.caps.idLen()), response) {
+			wsc.responseWritten(id)
 		}
-
-		// check whether we need to exit
-		select {
-		case <-wsc.tun.exitChan:
+		return
+	}
+	payload, payloadFlags := wsc.compressResponse(response)
+	chunkSize := len(payload)
+	if wsc.caps[capabilityChunked] {
+		chunkSize = wsc.tun.settings().maxFrameSize
+	}
+	for seq := 0; ; seq++ {
+		chunk := payload
+		flags := payloadFlags
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+			flags |= frameFlagMore
+		} else {
+			flags |= final
+		}
+		payload = payload[len(chunk):]
+		header := formatFrameID(id, wsc.caps.idLen()) +
+			fmt.Sprintf("%02x%04x", flags, uint16(seq))
+		if !wsc.writeDataFrame(id, header, chunk) {
+			return
+		}
+		if flags&frameFlagMore == 0 {
 			break
-		default: // non-blocking receive
 		}
 	}
+	wsc.responseWritten(id)
 }
 
-// writeResponseMessage forwards the response message on the websocket.
-func (wsc *WSConnection) writeResponseMessage(id int64, resp *bytes.Buffer) {
-	// Get writer's lock
-	wsWriterMutex.Lock()
-	defer wsWriterMutex.Unlock()
-	// Write response into the tunnel
-	wsc.ws.SetWriteDeadline(time.Now().Add(time.Minute))
-	writer, err := wsc.ws.NextWriter(websocket.BinaryMessage)
-	// got an error, reply with a "hey, retry" to the request handler
-	if err != nil {
-		log.Errorf("[id=%d] WS could not find writer: %s", id, err.Error())
-		wsc.ws.Close()
-		return
-	}
+// writeDataFrame writes a binary frame made of header and payload. The
+// websocket is closed if that fails. The caller holds writeMutex.
+func (wsc *WSConnection) writeDataFrame(id requestID, header string, payload []byte) bool {
+	return wsc.writeFrame(websocket.BinaryMessage, id, header, payload)
+}
 
-	// write the request Id
-	_, err = fmt.Fprintf(writer, "%04x", id)
-	if err != nil {
+// writeFrame writes a frame made of header and payload. The websocket is
+// closed if that fails, even on a timeout, since a *websocket.Conn fails
+// all the writes after one failed on the network. The caller holds
+// writeMutex.
+func (wsc *WSConnection) writeFrame(messageType int, id requestID, header string, payload []byte) bool {
+	if err := wsc.sendFrame(messageType, header, payload); err != nil {
+		log.Errorf("[id=%d] WS cannot write frame: %s", id, err.Error())
+		wsc.tun.mutex.Lock()
+		wsc.tun.stats.WriteGiveUps++
+		wsc.tun.mutex.Unlock()
 		wsc.ws.Close()
-		return
+		return false
 	}
+	wsc.recordFrame(id, messageType, header, payload)
+	log.Debugf("[id=%d] Completed writing frame of length: %d", id, len(payload))
+	wsc.counters.frameWritten(len(payload))
+	return true
+}
 
-	// write the response itself
-	num, err := io.Copy(writer, resp)
+// sendFrame writes the header then the payload in a single message
+func (wsc *WSConnection) sendFrame(messageType int, header string, payload []byte) error {
+	wsc.ws.SetWriteDeadline(time.Now().Add(time.Minute))
+	next, err := wsc.ws.NextWriter(messageType)
 	if err != nil {
-		log.Errorf("WS cannot write response: %s", err.Error())
-		wsc.ws.Close()
-		return
+		return err
 	}
-	log.Debugf("[id=%d] Completed writing response of length: %d", id, num)
-
-	// done
-	err = writer.Close()
-	if err != nil {
-		wsc.ws.Close()
-		return
+	writer := wsc.frameWriter(next, messageType)
+	if _, err := io.WriteString(writer, header); err != nil {
+		return err
+	}
+	if _, err := writer.Write(payload); err != nil {
+		return err
 	}
+	return writer.Close()
 }
@@ -0,0 +1,1670 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testTunnelServer is a fake tunnel backend answering the ping url and
+// accepting websocket connections on the tunnel url.
+type testTunnelServer struct {
+	*httptest.Server
+	mutex       sync.Mutex
+	remoteAddrs []string
+	conns       []*websocket.Conn
+	pingStatus  int // status returned on the ping url, 200 when zero
+	pingDelay   time.Duration
+	demand      bool // ping responses demand the tunnel
+	// capabilities accepted in the handshake response when offered
+	capabilities string
+	// called with each accepted websocket and the number of earlier ones
+	onConnect func(ws *websocket.Conn, count int)
+	// handshakes to reject as already connected before accepting any
+	rejections int
+}
+
+func newTestTunnelServer(t *testing.T) *testTunnelServer {
+	ts := newTestTunnelServerOn(t, "127.0.0.1:0")
+	ts.Server.Start()
+	return ts
+}
+
+// newTestTunnelServerOn starts the fake backend listening on addr
+func newTestTunnelServerOn(t *testing.T, addr string) *testTunnelServer {
+	ts := &testTunnelServer{}
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/edgedevice/connection/ping",
+		func(w http.ResponseWriter, r *http.Request) {
+			ts.mutex.Lock()
+			status, delay, demand := ts.pingStatus, ts.pingDelay, ts.demand
+			ts.mutex.Unlock()
+			time.Sleep(delay)
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if demand {
+				w.Header().Set(demandHeader, "true")
+			}
+			w.WriteHeader(status)
+		})
+	mux.HandleFunc("/api/v1/edgedevice/connection/tunnel",
+		func(w http.ResponseWriter, r *http.Request) {
+			var header http.Header
+			ts.mutex.Lock()
+			caps := ts.capabilities
+			reject := ts.rejections > 0
+			if reject {
+				ts.rejections--
+			}
+			ts.mutex.Unlock()
+			if reject {
+				http.Error(w, "device already connected", http.StatusConflict)
+				return
+			}
+			if caps != "" && r.Header.Get(capabilitiesHeader) != "" {
+				header = http.Header{capabilitiesHeader: []string{caps}}
+			}
+			ws, err := upgrader.Upgrade(w, r, header)
+			if err != nil {
+				t.Logf("upgrade failed: %v", err)
+				return
+			}
+			ts.mutex.Lock()
+			count := len(ts.remoteAddrs)
+			ts.remoteAddrs = append(ts.remoteAddrs, r.RemoteAddr)
+			ts.conns = append(ts.conns, ws)
+			onConnect := ts.onConnect
+			ts.mutex.Unlock()
+			if onConnect != nil {
+				onConnect(ws, count)
+			}
+		})
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen on %s failed: %v", addr, err)
+	}
+	ts.Server = httptest.NewUnstartedServer(mux)
+	ts.Server.Listener.Close()
+	ts.Server.Listener = listener
+	return ts
+}
+
+// newTestTunnelServerTLS starts a wss:// fake backend with tlsConfig
+func newTestTunnelServerTLS(t *testing.T, tlsConfig *tls.Config) *testTunnelServer {
+	ts := newTestTunnelServerOn(t, "127.0.0.1:0")
+	ts.Server.TLS = tlsConfig
+	ts.Server.StartTLS()
+	return ts
+}
+
+// connections returns the remote addresses of the accepted tunnels
+func (ts *testTunnelServer) connections() []string {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return append([]string{}, ts.remoteAddrs...)
+}
+
+// dropAll closes every accepted websocket from the server side
+func (ts *testTunnelServer) dropAll() {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	for _, ws := range ts.conns {
+		ws.Close()
+	}
+	ts.conns = nil
+}
+
+// waitConn returns the most recently accepted websocket
+func (ts *testTunnelServer) waitConn(t *testing.T) *websocket.Conn {
+	var ws *websocket.Conn
+	waitFor(5*time.Second, func() bool {
+		ts.mutex.Lock()
+		defer ts.mutex.Unlock()
+		if len(ts.conns) == 0 {
+			return false
+		}
+		ws = ts.conns[len(ts.conns)-1]
+		return true
+	})
+	if ws == nil {
+		t.Fatalf("tunnel never connected")
+	}
+	return ws
+}
+
+func (ts *testTunnelServer) setPingStatus(status int) {
+	ts.mutex.Lock()
+	ts.pingStatus = status
+	ts.mutex.Unlock()
+}
+
+func (ts *testTunnelServer) setCapabilities(caps string) {
+	ts.mutex.Lock()
+	ts.capabilities = caps
+	ts.mutex.Unlock()
+}
+
+func (ts *testTunnelServer) hostPort() string {
+	return strings.TrimPrefix(strings.TrimPrefix(ts.URL, "http://"), "https://")
+}
+
+// newTestTunnelClient returns a client for the plain ws:// server
+func newTestTunnelClient(ts *testTunnelServer) *WSTunnelClient {
+	client := InitializeTunnelClient(ts.hostPort(), "127.0.0.1:1")
+	client.Tunnel = "ws://" + ts.hostPort()
+	client.TLSConfig = &tls.Config{}
+	client.RetryInterval = 50 * time.Millisecond
+	return client
+}
+
+// sendRequest writes a request frame from the server side
+func sendRequest(t *testing.T, ws *websocket.Conn, id int, payload string) {
+	err := ws.WriteMessage(websocket.BinaryMessage,
+		[]byte(fmt.Sprintf("%04x%s", id, payload)))
+	if err != nil {
+		t.Fatalf("write request %d failed: %v", id, err)
+	}
+}
+
+// testFrame is a frame received by the fake server
+type testFrame struct {
+	messageType int
+	id          int
+	payload     string
+}
+
+// readFrame reads the next frame the client sent
+func readFrame(t *testing.T, ws *websocket.Conn) testFrame {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read frame failed: %v", err)
+	}
+	var id int
+	if _, err := fmt.Sscanf(string(data[:4]), "%04x", &id); err != nil {
+		t.Fatalf("bad frame header %q: %v", data, err)
+	}
+	return testFrame{messageType: messageType, id: id, payload: string(data[4:])}
+}
+
+// frameErrorCode returns the code of an error frame or "" for data
+func frameErrorCode(frame testFrame) string {
+	var errFrame errorFrame
+	if frame.messageType != websocket.TextMessage ||
+		json.Unmarshal([]byte(frame.payload), &errFrame) != nil {
+		return ""
+	}
+	return errFrame.Code
+}
+
+// testRelay is a fake local relay answering whatever it reads with
+// the result of handler, or swallowing it when that is nil.
+type testRelay struct {
+	net.Listener
+	mutex    sync.Mutex
+	received []string
+	accepted int
+}
+
+func newTestRelay(t *testing.T, handler func(req string) []byte) *testRelay {
+	return newTestRelayAt(t, "127.0.0.1:0", handler)
+}
+
+// newTestRelayAt starts a fake local relay listening on addr
+func newTestRelayAt(t *testing.T, addr string, handler func(req string) []byte) *testRelay {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("relay listen failed: %v", err)
+	}
+	relay := &testRelay{Listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			relay.mutex.Lock()
+			relay.accepted++
+			relay.mutex.Unlock()
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 65536)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					req := string(buf[:n])
+					relay.mutex.Lock()
+					relay.received = append(relay.received, req)
+					relay.mutex.Unlock()
+					if handler == nil {
+						continue
+					}
+					if resp := handler(req); resp != nil {
+						conn.Write(resp)
+					}
+				}
+			}(conn)
+		}
+	}()
+	return relay
+}
+
+// echoRelay answers every request with "reply:" and the request
+func echoRelay(req string) []byte {
+	return []byte("reply:" + req)
+}
+
+// connections returns the number of connections the relay accepted
+func (relay *testRelay) connections() int {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	return relay.accepted
+}
+
+func (relay *testRelay) requests() []string {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	return append([]string{}, relay.received...)
+}
+
+// startTestTunnel connects a client to ts relaying to relay
+func startTestTunnel(t *testing.T, ts *testTunnelServer, relay *testRelay,
+	setup func(*WSTunnelClient)) *WSTunnelClient {
+
+	client := newTestTunnelClient(ts)
+	if relay != nil {
+		client.LocalRelayServer = relay.Addr().String()
+	}
+	if setup != nil {
+		setup(client)
+	}
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	client.Start()
+	return client
+}
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestSourceAddrFailover(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+
+	// 192.0.2.1 is TEST-NET-1 and cannot be bound to locally
+	unroutable := net.ParseIP("192.0.2.1")
+	loopback := net.ParseIP("127.0.0.1")
+	client := newTestTunnelClient(ts)
+	client.LocalAddrProvider = func() []net.IP {
+		return []net.IP{unroutable, loopback}
+	}
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	client.Start()
+	defer client.Stop()
+
+	if !waitFor(5*time.Second, func() bool { return client.Status().Connected }) {
+		t.Fatalf("tunnel never connected")
+	}
+	status := client.Status()
+	if !status.LocalAddr.Equal(loopback) ||
+		!status.PreferredAddr.Equal(loopback) {
+		t.Errorf("expected source %v, got status %+v", loopback, status)
+	}
+	conns := ts.connections()
+	if len(conns) != 1 || !strings.HasPrefix(conns[0], "127.0.0.1:") {
+		t.Errorf("unexpected connections %v", conns)
+	}
+
+	// The working source is tried first from now on
+	candidates := client.candidateAddrs()
+	if len(candidates) != 2 || !candidates[0].Equal(loopback) {
+		t.Errorf("expected %v first, got %v", loopback, candidates)
+	}
+
+	// Reconnect sticks with the working source
+	ts.dropAll()
+	if !waitFor(5*time.Second, func() bool { return len(ts.connections()) == 2 }) {
+		t.Fatalf("tunnel never reconnected")
+	}
+	if status := client.Status(); !status.LocalAddr.Equal(loopback) {
+		t.Errorf("expected source %v after reconnect, got %v",
+			loopback, status.LocalAddr)
+	}
+}
+
+// stubResolver answers lookups from a replaceable address list
+type stubResolver struct {
+	mutex   sync.Mutex
+	addrs   []string
+	lookups int
+}
+
+func (r *stubResolver) set(addrs ...string) {
+	r.mutex.Lock()
+	r.addrs = addrs
+	r.mutex.Unlock()
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lookups++
+	var ipAddrs []net.IPAddr
+	for _, addr := range r.addrs {
+		ipAddrs = append(ipAddrs, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return ipAddrs, nil
+}
+
+func TestResolveOnReconnect(t *testing.T) {
+	first := newTestTunnelServerOn(t, "127.0.0.2:0")
+	_, port, _ := net.SplitHostPort(first.Listener.Addr().String())
+	second := newTestTunnelServerOn(t, "127.0.0.3:"+port)
+	first.Start()
+	second.Start()
+	defer second.Close()
+
+	resolver := &stubResolver{}
+	resolver.set("127.0.0.2")
+	client := newTestTunnelClient(first)
+	client.TunnelServerName = "tunnel.example.com:" + port
+	client.Tunnel = "ws://" + client.TunnelServerName
+	client.Resolver = resolver
+	client.ResolverCacheTTL = time.Hour
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	client.Start()
+	defer client.Stop()
+
+	if !waitFor(5*time.Second, func() bool { return len(first.connections()) == 1 }) {
+		t.Fatalf("tunnel never connected to first address")
+	}
+	if addrs := client.Status().ResolvedAddrs; len(addrs) != 1 ||
+		!addrs[0].Equal(net.ParseIP("127.0.0.2")) {
+		t.Errorf("unexpected resolved addresses %v", addrs)
+	}
+
+	// The controller moves; the cached answer is busted by the failed dial
+	resolver.set("127.0.0.3")
+	first.dropAll()
+	first.Close()
+	if !waitFor(5*time.Second, func() bool { return len(second.connections()) == 1 }) {
+		t.Fatalf("tunnel never connected to the new address")
+	}
+	if addrs := client.Status().ResolvedAddrs; len(addrs) != 1 ||
+		!addrs[0].Equal(net.ParseIP("127.0.0.3")) {
+		t.Errorf("unexpected resolved addresses %v", addrs)
+	}
+}
+
+func TestResolvedAddrsSkipProxy(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	proxy := newTestPlainProxy()
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	// The proxy resolves the server name, only the proxy is dialed
+	_, port, _ := net.SplitHostPort(ts.hostPort())
+	client := newTestTunnelClient(ts)
+	client.TunnelServerName = "localhost:" + port
+	client.Tunnel = "ws://" + client.TunnelServerName
+	if err := client.TestConnection(proxyURL, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	if addrs := client.Status().ResolvedAddrs; len(addrs) != 0 {
+		t.Errorf("proxy address reported as resolved: %v", addrs)
+	}
+}
+
+func TestHostCacheTTL(t *testing.T) {
+	resolver := &stubResolver{}
+	resolver.set("127.0.0.2")
+	client := &WSTunnelClient{Resolver: resolver, ResolverCacheTTL: time.Hour}
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.resolve(context.Background(), "tunnel.example.com"); err != nil {
+			t.Fatalf("resolve failed: %v", err)
+		}
+	}
+	if resolver.lookups != 1 {
+		t.Errorf("expected a single lookup, got %d", resolver.lookups)
+	}
+	client.hostCache.flush()
+	resolver.set("127.0.0.3")
+	addrs, _ := client.resolve(context.Background(), "tunnel.example.com")
+	if resolver.lookups != 2 || !addrs[0].Equal(net.ParseIP("127.0.0.3")) {
+		t.Errorf("expected a fresh lookup after flush, got %v", addrs)
+	}
+	if addrs, _ := client.resolve(context.Background(), "192.0.2.1"); len(addrs) != 1 || resolver.lookups != 2 {
+		t.Errorf("literal address looked up: %v", addrs)
+	}
+}
+
+// testCA issues certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+var testSerial int64
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for cn valid until notAfter. The cn is
+// also the only DNS name and ips become IP SANs.
+func (ca *testCA) issue(t *testing.T, cn string, ips []net.IP,
+	notAfter time.Time) tls.Certificate {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		IPAddresses:  ips,
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth,
+			x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert,
+		&key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	loopback := []net.IP{net.ParseIP("127.0.0.1")}
+	serverCert := ca.issue(t, "tunnel.example.com", loopback, time.Now().Add(time.Hour))
+	validCert := ca.issue(t, "device", nil, time.Now().Add(time.Hour))
+	expiredCert := ca.issue(t, "device", nil, time.Now().Add(-time.Minute))
+
+	ts := newTestTunnelServerTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	})
+	defer ts.Close()
+
+	newClient := func() *WSTunnelClient {
+		client := newTestTunnelClient(ts)
+		client.Tunnel = "wss://" + ts.hostPort()
+		client.TLSConfig = &tls.Config{RootCAs: ca.pool}
+		return client
+	}
+
+	// Missing certificate
+	client := newClient()
+	if err := client.TestConnection(nil, nil); err == nil {
+		t.Errorf("TestConnection succeeded without a client certificate")
+	}
+
+	// Expired certificate
+	client = newClient()
+	client.ClientCert = &expiredCert
+	if err := client.TestConnection(nil, nil); err == nil {
+		t.Errorf("TestConnection succeeded with an expired client certificate")
+	}
+
+	// Static certificate
+	client = newClient()
+	client.ClientCert = &validCert
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Errorf("TestConnection failed with a valid client certificate: %v", err)
+	}
+
+	// Callback is consulted on the ping and on every tunnel handshake
+	var mutex sync.Mutex
+	calls := 0
+	client = newClient()
+	client.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls++
+		return &validCert, nil
+	}
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed with a client certificate callback: %v", err)
+	}
+	client.Start()
+	defer client.Stop()
+	if !waitFor(5*time.Second, func() bool { return len(ts.connections()) == 1 }) {
+		t.Fatalf("tunnel never connected")
+	}
+	ts.dropAll()
+	if !waitFor(5*time.Second, func() bool { return len(ts.connections()) == 2 }) {
+		t.Fatalf("tunnel never reconnected")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if calls != 3 {
+		t.Errorf("expected 3 certificate callbacks, got %d", calls)
+	}
+}
+
+func TestTLSServerNameOverride(t *testing.T) {
+	ca := newTestCA(t)
+	// The certificate has no IP SAN so dialing 127.0.0.1 can't verify
+	serverCert := ca.issue(t, "tunnel.example.com", nil, time.Now().Add(time.Hour))
+	ts := newTestTunnelServerTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+	})
+	defer ts.Close()
+
+	newClient := func(override string) *WSTunnelClient {
+		client := newTestTunnelClient(ts)
+		client.Tunnel = "wss://" + ts.hostPort()
+		client.TLSConfig = &tls.Config{RootCAs: ca.pool}
+		client.TLSServerNameOverride = override
+		return client
+	}
+
+	client := newClient("")
+	if err := client.TestConnection(nil, nil); err == nil {
+		t.Errorf("TestConnection succeeded without server name override")
+	}
+
+	client = newClient("tunnel.example.com")
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed with server name override: %v", err)
+	}
+	client.Start()
+	defer client.Stop()
+	if !waitFor(5*time.Second, func() bool { return client.Status().Connected }) {
+		t.Fatalf("tunnel never connected")
+	}
+	if name := client.Status().TLSServerName; name != "tunnel.example.com" {
+		t.Errorf("unexpected TLS server name in status: %s", name)
+	}
+
+	for _, name := range []string{"127.0.0.1", "-bad.example.com",
+		"bad..example.com", "bad_name.example.com", strings.Repeat("a", 64)} {
+		client = newClient(name)
+		if err := client.TestConnection(nil, nil); err == nil {
+			t.Errorf("TestConnection accepted server name override %q", name)
+		}
+	}
+}
+
+func TestPingTimings(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.mutex.Lock()
+	ts.pingDelay = delay
+	ts.mutex.Unlock()
+
+	client := newTestTunnelClient(ts)
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	timings := client.Status().LastPing
+	if timings.Total < delay || timings.Upgrade < delay ||
+		timings.Connect <= 0 || timings.Connect >= delay ||
+		timings.TLSHandshake != 0 {
+		t.Errorf("unexpected timings %+v", timings)
+	}
+
+	// The TLS handshake is timed for wss://
+	ca := newTestCA(t)
+	loopback := []net.IP{net.ParseIP("127.0.0.1")}
+	tlsServer := newTestTunnelServerTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{
+			ca.issue(t, "tunnel.example.com", loopback, time.Now().Add(time.Hour))},
+	})
+	defer tlsServer.Close()
+	client = newTestTunnelClient(tlsServer)
+	client.Tunnel = "wss://" + tlsServer.hostPort()
+	client.TLSConfig = &tls.Config{RootCAs: ca.pool}
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	timings = client.Status().LastPing
+	if timings.TLSHandshake <= 0 || timings.Total < timings.Connect+timings.TLSHandshake {
+		t.Errorf("unexpected timings %+v", timings)
+	}
+}
+
+func TestProber(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+
+	client := newTestTunnelClient(ts)
+	client.ProbeInterval = 20 * time.Millisecond
+	client.ProbeFailureReconnect = true
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	client.Start()
+	defer client.Stop()
+
+	if !waitFor(5*time.Second, func() bool {
+		return client.Status().Connected && len(client.GetStats().ProbeHistory) >= 2
+	}) {
+		t.Fatalf("no probes recorded")
+	}
+	for _, result := range client.GetStats().ProbeHistory {
+		if !result.Success || result.RTT <= 0 {
+			t.Errorf("unexpected probe result %+v", result)
+		}
+	}
+
+	// Backend starts failing; the third failure forces a reconnect
+	ts.setPingStatus(http.StatusServiceUnavailable)
+	if !waitFor(5*time.Second, func() bool { return len(ts.connections()) == 2 }) {
+		t.Fatalf("probe failures did not force a reconnect")
+	}
+	stats := client.GetStats()
+	if stats.ConsecutiveProbeFailures < probeFailureLimit {
+		t.Errorf("expected at least %d failures, got %d",
+			probeFailureLimit, stats.ConsecutiveProbeFailures)
+	}
+	last := stats.ProbeHistory[len(stats.ProbeHistory)-1]
+	if last.Success || !strings.Contains(last.Error, "503") {
+		t.Errorf("unexpected last probe result %+v", last)
+	}
+	if !waitFor(5*time.Second, func() bool {
+		return len(client.GetStats().ProbeHistory) == probeHistorySize
+	}) {
+		t.Errorf("probe history not bounded to %d", probeHistorySize)
+	}
+}
+
+func TestProberKeepsTunnel(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+
+	client := newTestTunnelClient(ts)
+	client.ProbeInterval = 20 * time.Millisecond
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	ts.setPingStatus(http.StatusServiceUnavailable)
+	client.Start()
+	defer client.Stop()
+
+	if !waitFor(5*time.Second, func() bool {
+		return client.GetStats().ConsecutiveProbeFailures > probeFailureLimit
+	}) {
+		t.Fatalf("probe failures not recorded")
+	}
+	if conns := ts.connections(); len(conns) != 1 || !client.Status().Connected {
+		t.Errorf("probe failures tore down the tunnel: %v", conns)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityErrorFrames)
+	relay := newTestRelay(t, func(req string) []byte {
+		if req == "swallow" {
+			return nil
+		}
+		return echoRelay(req)
+	})
+	defer relay.Close()
+	client := startTestTunnel(t, ts, relay, func(client *WSTunnelClient) {
+		client.RequestTimeout = 200 * time.Millisecond
+	})
+	defer client.Stop()
+
+	ws := ts.waitConn(t)
+	sendRequest(t, ws, 1, "swallow")
+	sendRequest(t, ws, 2, "hello")
+
+	frame := readFrame(t, ws)
+	if code := frameErrorCode(frame); frame.id != 1 || code != frameErrorTimeout {
+		t.Errorf("expected timeout frame for request 1, got %+v", frame)
+	}
+	frame = readFrame(t, ws)
+	if frame.messageType != websocket.BinaryMessage || frame.id != 2 ||
+		frame.payload != "reply:hello" {
+		t.Errorf("expected response for request 2, got %+v", frame)
+	}
+	if timedOut := client.GetStats().RequestsTimedOut; timedOut != 1 {
+		t.Errorf("expected 1 timed out request, got %d", timedOut)
+	}
+}
+
+func TestRelayDownErrorFrames(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityErrorFrames)
+	// Nothing listens on port 1
+	client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+		client.LocalAttempts = 2
+		client.LocalRetryDelays = []time.Duration{10 * time.Millisecond}
+	})
+	defer client.Stop()
+
+	ws := ts.waitConn(t)
+	for id := 1; id <= 3; id++ {
+		sendRequest(t, ws, id, "hello")
+	}
+	for id := 1; id <= 3; id++ {
+		frame := readFrame(t, ws)
+		if code := frameErrorCode(frame); frame.id != id ||
+			code != frameErrorRelayUnreachable {
+			t.Errorf("expected unreachable error frame for request %d, got %+v",
+				id, frame)
+		}
+	}
+}
+
+func TestRelayClosedErrorFrame(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityErrorFrames)
+	// Relay that hangs up without answering
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 1024)
+			conn.Read(buf)
+			conn.Close()
+		}
+	}()
+	client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+		client.LocalRelayServer = listener.Addr().String()
+	})
+	defer client.Stop()
+
+	ws := ts.waitConn(t)
+	sendRequest(t, ws, 7, "hello")
+	frame := readFrame(t, ws)
+	if code := frameErrorCode(frame); frame.id != 7 || code != frameErrorRelayRead {
+		t.Errorf("expected read error frame, got %+v", frame)
+	}
+}
+
+func TestReadFrameID(t *testing.T) {
+	tests := []struct {
+		header    string
+		width     int
+		id        requestID
+		malformed bool
+	}{
+		{header: "0001hello", id: 1},
+		{header: "00ff", id: 0xff},
+		{header: "7FFF", id: 0x7fff},
+		{header: "8000", id: 0x8000},
+		{header: "ffff", id: 0xffff},
+		{header: "", malformed: true},
+		{header: "00", malformed: true},
+		{header: "zz12hello", malformed: true},
+		{header: "0x12", malformed: true},
+		{header: "-001", malformed: true},
+		{header: "00010000hello", width: wideFrameIDLen, id: 0x10000},
+		{header: "ffffffff", width: wideFrameIDLen, id: 0xffffffff},
+		{header: "0001", width: wideFrameIDLen, malformed: true},
+	}
+	for _, test := range tests {
+		width := test.width
+		if width == 0 {
+			width = frameIDLen
+		}
+		// Deliver the header one byte at a time
+		r := iotest.OneByteReader(strings.NewReader(test.header))
+		id, err := readFrameID(r, width)
+		_, malformed := err.(*frameHeaderError)
+		if malformed != test.malformed {
+			t.Errorf("%q: expected malformed %v, got error %v",
+				test.header, test.malformed, err)
+		} else if err == nil && id != test.id {
+			t.Errorf("%q: expected id %d, got %d", test.header, test.id, id)
+		}
+	}
+}
+
+func TestFrameIDWraparound(t *testing.T) {
+	for _, test := range []struct {
+		id     requestID
+		width  int
+		header string
+		read   requestID // id the server sends back once wrapped
+	}{
+		{0x7fff, frameIDLen, "7fff", 0x7fff},
+		{0x8000, frameIDLen, "8000", 0x8000},
+		{0xffff, frameIDLen, "ffff", 0xffff},
+		{0x10000, frameIDLen, "0000", 0},
+		{0x10001, frameIDLen, "0001", 1},
+		{0xffff, wideFrameIDLen, "0000ffff", 0xffff},
+		{0x10000, wideFrameIDLen, "00010000", 0x10000},
+		{0xffffffff, wideFrameIDLen, "ffffffff", 0xffffffff},
+	} {
+		header := formatFrameID(test.id, test.width)
+		if header != test.header {
+			t.Errorf("%#x: expected header %q, got %q", test.id, test.header, header)
+			continue
+		}
+		id, err := readFrameID(strings.NewReader(header), test.width)
+		if err != nil || id != test.read {
+			t.Errorf("%q: expected id %#x, got %#x, %v", header, test.read, id, err)
+		}
+	}
+}
+
+// readCloseCode reads from ws until the client's close frame arrives
+func readCloseCode(t *testing.T, ws *websocket.Conn) int {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := ws.ReadMessage()
+		if closeErr, ok := err.(*websocket.CloseError); ok {
+			return closeErr.Code
+		}
+		if err != nil {
+			t.Fatalf("expected close frame, got %v", err)
+		}
+	}
+}
+
+func TestFrameCloseCodes(t *testing.T) {
+	tests := []struct {
+		messageType int
+		frame       string
+		closeCode   int // zero when the frame is answered
+	}{
+		{messageType: websocket.BinaryMessage, frame: "0001hello"},
+		{messageType: websocket.BinaryMessage, frame: "00",
+			closeCode: websocket.CloseProtocolError},
+		{messageType: websocket.BinaryMessage, frame: "zz12hello",
+			closeCode: websocket.CloseProtocolError},
+		{messageType: websocket.TextMessage, frame: "0001hello",
+			closeCode: websocket.CloseUnsupportedData},
+	}
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	for _, test := range tests {
+		ts := newTestTunnelServer(t)
+		client := startTestTunnel(t, ts, relay, nil)
+		ws := ts.waitConn(t)
+		if err := ws.WriteMessage(test.messageType, []byte(test.frame)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if test.closeCode == 0 {
+			if frame := readFrame(t, ws); frame.payload != "reply:hello" {
+				t.Errorf("%q: unexpected response %+v", test.frame, frame)
+			}
+			// Normal shutdown
+			client.Stop()
+			if code := readCloseCode(t, ws); code != websocket.CloseNormalClosure {
+				t.Errorf("%q: expected close code %d on stop, got %d",
+					test.frame, websocket.CloseNormalClosure, code)
+			}
+		} else {
+			if code := readCloseCode(t, ws); code != test.closeCode {
+				t.Errorf("%q: expected close code %d, got %d",
+					test.frame, test.closeCode, code)
+			}
+			client.Stop()
+		}
+		ts.Close()
+	}
+}
+
+func TestCloseCodePolicy(t *testing.T) {
+	tests := []struct {
+		code        int
+		connections int  // expected connections after the first close
+		terminal    bool // expect a terminal error in the status
+	}{
+		{code: websocket.CloseGoingAway, connections: 2},
+		{code: websocket.CloseServiceRestart, connections: 2},
+		{code: websocket.ClosePolicyViolation, connections: 1, terminal: true},
+		{code: websocket.CloseNormalClosure, connections: 2},
+	}
+	// CloseTLSHandshake is reserved and can't be sent over the wire
+	if closeActionFor(&websocket.CloseError{Code: websocket.CloseTLSHandshake}) !=
+		closeActionStop {
+		t.Errorf("CloseTLSHandshake not terminal")
+	}
+	for _, test := range tests {
+		ts := newTestTunnelServer(t)
+		ts.onConnect = func(ws *websocket.Conn, count int) {
+			if count == 0 {
+				ws.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(test.code, "test"),
+					time.Now().Add(time.Second))
+			}
+		}
+		client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+			// Only a reconnect after a clean close can happen within the test
+			client.RetryInterval = time.Hour
+			client.ReconnectDelay = 10 * time.Millisecond
+		})
+
+		if test.connections > 1 {
+			if !waitFor(5*time.Second, func() bool {
+				return len(ts.connections()) == test.connections
+			}) {
+				t.Errorf("close %d: expected quick reconnect", test.code)
+			}
+		} else {
+			time.Sleep(200 * time.Millisecond)
+			if conns := ts.connections(); len(conns) != 1 {
+				t.Errorf("close %d: unexpected reconnect %v", test.code, conns)
+			}
+		}
+		status := client.Status()
+		if (status.TerminalError != "") != test.terminal {
+			t.Errorf("close %d: unexpected terminal error %q",
+				test.code, status.TerminalError)
+		}
+		if status.RetryOnFailCount != 0 {
+			t.Errorf("close %d: counted as failure", test.code)
+		}
+		client.Stop()
+		ts.Close()
+	}
+}
+
+func TestCleanClosesNotFailures(t *testing.T) {
+	const closes = 5
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.onConnect = func(ws *websocket.Conn, count int) {
+		if count < closes {
+			ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "restart"),
+				time.Now().Add(time.Second))
+		}
+	}
+	client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+		client.RetryInterval = time.Hour
+		client.ReconnectDelay = 10 * time.Millisecond
+	})
+	defer client.Stop()
+
+	if !waitFor(5*time.Second, func() bool {
+		return len(ts.connections()) == closes+1 && client.Status().Connected
+	}) {
+		t.Fatalf("expected %d connections, got %v", closes+1, ts.connections())
+	}
+	if count := client.Status().RetryOnFailCount; count != 0 {
+		t.Errorf("clean closes counted as %d failures", count)
+	}
+	expected := DisconnectStats{CleanCloses: closes}
+	if disconnects := client.GetStats().Disconnects; disconnects != expected {
+		t.Errorf("expected %+v, got %+v", expected, disconnects)
+	}
+
+	// A read error is a failure
+	ts.dropAll()
+	if !waitFor(5*time.Second, func() bool {
+		return client.GetStats().Disconnects.ReadErrors == 1
+	}) {
+		t.Errorf("read error not counted: %+v", client.GetStats().Disconnects)
+	}
+	if count := client.Status().RetryOnFailCount; count != 1 {
+		t.Errorf("expected read error counted as failure, got %d", count)
+	}
+}
+
+// fakeFrame is a frame read from, or written to, a fakeWSConn
+type fakeFrame struct {
+	messageType int
+	data        []byte
+	err         error // returned by NextReader instead of a frame
+}
+
+// fakeWSConn is a scriptable wsConn. Frames sent on incoming are
+// returned by NextReader, and NextReader fails once the conn is closed.
+type fakeWSConn struct {
+	incoming   chan fakeFrame
+	echoPongs  bool          // answer pings by calling the pong handler
+	pongDelay  time.Duration // before answering a ping
+	writerErrs []error       // errors returned by successive NextWriter calls
+
+	mutex       sync.Mutex
+	written     []fakeFrame
+	controls    []fakeFrame
+	pongHandler func(string) error
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func newFakeWSConn() *fakeWSConn {
+	return &fakeWSConn{
+		incoming: make(chan fakeFrame, 16),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (c *fakeWSConn) NextReader() (int, io.Reader, error) {
+	select {
+	case frame := <-c.incoming:
+		if frame.err != nil {
+			return 0, nil, frame.err
+		}
+		return frame.messageType, bytes.NewReader(frame.data), nil
+	case <-c.closed:
+		return 0, nil, errors.New("use of closed connection")
+	}
+}
+
+// fakeWriter buffers a message until it is closed
+type fakeWriter struct {
+	bytes.Buffer
+	conn        *fakeWSConn
+	messageType int
+}
+
+func (w *fakeWriter) Close() error {
+	w.conn.mutex.Lock()
+	defer w.conn.mutex.Unlock()
+	w.conn.written = append(w.conn.written,
+		fakeFrame{messageType: w.messageType, data: w.Bytes()})
+	return nil
+}
+
+func (c *fakeWSConn) NextWriter(messageType int) (io.WriteCloser, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.writerErrs) > 0 {
+		err := c.writerErrs[0]
+		c.writerErrs = c.writerErrs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &fakeWriter{conn: c, messageType: messageType}, nil
+}
+
+func (c *fakeWSConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	select {
+	case <-c.closed:
+		return websocket.ErrCloseSent
+	default:
+	}
+	c.mutex.Lock()
+	c.controls = append(c.controls, fakeFrame{messageType: messageType, data: data})
+	pongHandler := c.pongHandler
+	c.mutex.Unlock()
+	if messageType == websocket.PingMessage && c.echoPongs && pongHandler != nil {
+		if c.pongDelay != 0 {
+			go func() {
+				time.Sleep(c.pongDelay)
+				pongHandler(string(data))
+			}()
+			return nil
+		}
+		pongHandler(string(data))
+	}
+	return nil
+}
+
+func (c *fakeWSConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakeWSConn) SetWriteDeadline(t time.Time) error { return nil }
+func (c *fakeWSConn) SetReadLimit(limit int64)           {}
+
+func (c *fakeWSConn) SetPongHandler(h func(appData string) error) {
+	c.mutex.Lock()
+	c.pongHandler = h
+	c.mutex.Unlock()
+}
+
+func (c *fakeWSConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeWSConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *fakeWSConn) writtenFrames() []fakeFrame {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]fakeFrame{}, c.written...)
+}
+
+// closeCodes returns the codes of the close frames written
+func (c *fakeWSConn) closeCodes() []int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var codes []int
+	for _, frame := range c.controls {
+		if frame.messageType == websocket.CloseMessage && len(frame.data) >= 2 {
+			codes = append(codes, int(frame.data[0])<<8|int(frame.data[1]))
+		}
+	}
+	return codes
+}
+
+// newFakeTunnel returns a started tunnel client state without any
+// network connection to the server.
+func newFakeTunnel() *WSTunnelClient {
+	client := InitializeTunnelClient("tunnel.example.com", "127.0.0.1:1")
+	client.exitChan = make(chan struct{})
+	return client
+}
+
+func TestFakeFrameLoop(t *testing.T) {
+	client := newFakeTunnel()
+	defer close(client.exitChan)
+	ws := newFakeWSConn()
+	ws.echoPongs = true
+	wsc := newWSConnection(ws, client)
+
+	// The relay end of a pipe stands in for the pooled local connection
+	local, relay := net.Pipe()
+	target := client.LocalRelayServer
+	client.relayPool().idle[target] = []*relayConn{{Conn: local, target: target}}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := relay.Read(buf)
+			if err != nil {
+				return
+			}
+			relay.Write(append([]byte("reply:"), buf[:n]...))
+		}
+	}()
+
+	ws.incoming <- fakeFrame{messageType: websocket.BinaryMessage,
+		data: []byte("002ahello")}
+	ended := make(chan error)
+	go func() { ended <- wsc.handleRequests() }()
+
+	if !waitFor(5*time.Second, func() bool { return len(ws.writtenFrames()) == 1 }) {
+		t.Fatalf("no response written")
+	}
+	frame := ws.writtenFrames()[0]
+	if frame.messageType != websocket.BinaryMessage ||
+		string(frame.data) != "002areply:hello" {
+		t.Errorf("unexpected response frame %q", frame.data)
+	}
+
+	// An injected read error ends the loop and is returned
+	readErr := errors.New("injected")
+	ws.incoming <- fakeFrame{err: readErr}
+	select {
+	case err := <-ended:
+		if err != readErr {
+			t.Errorf("expected injected error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("frame loop did not end")
+	}
+	ws.Close()
+	relay.Close()
+}
+
+func TestFakePingTimeout(t *testing.T) {
+	client := newFakeTunnel()
+	defer close(client.exitChan)
+	client.Timeout = 90 * time.Millisecond
+
+	// Pongs keep the connection alive
+	alive := newFakeWSConn()
+	alive.echoPongs = true
+	go newWSConnection(alive, client).pinger()
+
+	// No pongs: a close frame is sent once the timeout expires
+	stuck := newFakeWSConn()
+	go newWSConnection(stuck, client).pinger()
+
+	if !waitFor(5*time.Second, func() bool { return len(stuck.closeCodes()) == 1 }) {
+		t.Fatalf("no close frame after ping timeout")
+	}
+	if code := stuck.closeCodes()[0]; code != websocket.CloseGoingAway {
+		t.Errorf("unexpected close code %d", code)
+	}
+	if codes := alive.closeCodes(); len(codes) != 0 {
+		t.Errorf("live connection closed: %v", codes)
+	}
+	alive.Close()
+	stuck.Close()
+}
+
+func TestFakeWriteResponse(t *testing.T) {
+	client := newFakeTunnel()
+	defer close(client.exitChan)
+
+	ws := newFakeWSConn()
+	wsc := newWSConnection(ws, client)
+	wsc.writeResponseMessage(0x1234, bytes.NewBufferString("payload"))
+	frames := ws.writtenFrames()
+	if len(frames) != 1 || string(frames[0].data) != "1234payload" {
+		t.Errorf("unexpected frames written %v", frames)
+	}
+	if ws.isClosed() {
+		t.Errorf("connection closed after successful write")
+	}
+
+	// A writer failure closes the connection
+	ws = newFakeWSConn()
+	ws.writerErrs = []error{errors.New("injected")}
+	wsc = newWSConnection(ws, client)
+	wsc.writeResponseMessage(1, bytes.NewBufferString("payload"))
+	if len(ws.writtenFrames()) != 0 || !ws.isClosed() {
+		t.Errorf("expected closed connection and no frames")
+	}
+}
+
+// fakeTimeoutError is a write deadline expiry
+type fakeTimeoutError struct{}
+
+func (fakeTimeoutError) Error() string   { return "i/o timeout" }
+func (fakeTimeoutError) Timeout() bool   { return true }
+func (fakeTimeoutError) Temporary() bool { return true }
+
+func TestFakeWriteTimeout(t *testing.T) {
+	client := newFakeTunnel()
+	defer close(client.exitChan)
+
+	// A timeout is not retried since the websocket fails all the writes
+	// after it
+	ws := newFakeWSConn()
+	ws.writerErrs = []error{fakeTimeoutError{}}
+	wsc := newWSConnection(ws, client)
+	wsc.caps[capabilityErrorFrames] = true
+	wsc.writeErrorMessage(2, frameErrorTimeout, "timeout")
+	if len(ws.writtenFrames()) != 0 || !ws.isClosed() {
+		t.Errorf("expected closed connection and no frames")
+	}
+	if stats := client.GetStats(); stats.WriteGiveUps != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// silentListener accepts connections and never answers on them
+func silentListener(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestStopInterruptsDial(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	silent := silentListener(t)
+	defer silent.Close()
+
+	client := newTestTunnelClient(ts)
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	// The TLS handshake with the silent server never completes
+	client.DestURL = "wss://" + silent.Addr().String() +
+		"/api/v1/edgedevice/connection/tunnel"
+	client.Start()
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	client.Stop()
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Stop did not interrupt the connection attempt")
+	}
+	t.Logf("stopped after %v", time.Since(start))
+}
+
+func TestDialTimeout(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	silent := silentListener(t)
+	defer silent.Close()
+
+	client := newTestTunnelClient(ts)
+	client.DialTimeout = 100 * time.Millisecond
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	client.DestURL = "ws://" + silent.Addr().String() +
+		"/api/v1/edgedevice/connection/tunnel"
+	client.Start()
+	defer client.Stop()
+	if !waitFor(2*time.Second, func() bool {
+		return client.Status().RetryOnFailCount >= 3
+	}) {
+		t.Errorf("connection attempts did not time out: %+v", client.Status())
+	}
+}
+
+func TestStartNotTested(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+
+	client := newTestTunnelClient(ts)
+	if _, err := client.StartNotify(); err == nil {
+		t.Fatalf("started without a connection test")
+	}
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	client.LocalRelayServer = ""
+	if _, err := client.StartNotify(); err == nil {
+		t.Fatalf("started without a local relay")
+	}
+}
+
+func TestStartRetriesExhausted(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+
+	client := newTestTunnelClient(ts)
+	client.RetryInterval = 10 * time.Millisecond
+	client.MaxRetryAttempts = 3
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	ts.Close()
+	errChan, err := client.StartNotify()
+	if err != nil {
+		t.Fatalf("StartNotify failed: %v", err)
+	}
+	defer client.Stop()
+
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Fatalf("expected the terminal error")
+		}
+		if status := client.Status(); status.TerminalError != err.Error() {
+			t.Errorf("expected terminal error %v, got status %+v", err, status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("retries exhausted not notified: %+v", client.Status())
+	}
+	if _, ok := <-errChan; ok {
+		t.Errorf("error channel not closed")
+	}
+	err = client.WaitConnectedTimeout(time.Second)
+	if _, ok := err.(*RetriesExhaustedError); !ok {
+		t.Errorf("expected retries exhausted, got %v", err)
+	}
+}
+
+func TestStartNotifyStopped(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+
+	client := newTestTunnelClient(ts)
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	errChan, err := client.StartNotify()
+	if err != nil {
+		t.Fatalf("StartNotify failed: %v", err)
+	}
+	if !waitFor(5*time.Second, func() bool { return client.Status().Connected }) {
+		t.Fatalf("tunnel never connected")
+	}
+	client.Stop()
+	select {
+	case err, ok := <-errChan:
+		if ok {
+			t.Errorf("unexpected error after Stop: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("error channel not closed after Stop")
+	}
+}
+
+func TestDoubleStart(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+
+	client := startTestTunnel(t, ts, nil, nil)
+	defer client.Stop()
+	if _, err := client.StartNotify(); err == nil {
+		t.Errorf("second start succeeded")
+	}
+	ts.waitConn(t)
+	time.Sleep(100 * time.Millisecond)
+	if conns := ts.connections(); len(conns) != 1 {
+		t.Errorf("expected a single connection, got %v", conns)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+
+	// Stopping a client which never started is harmless
+	client := newTestTunnelClient(ts)
+	client.Stop()
+
+	goroutines := runtime.NumGoroutine()
+	client = startTestTunnel(t, ts, relay, nil)
+	for cycle := 1; cycle <= 3; cycle++ {
+		if !waitFor(5*time.Second, func() bool {
+			return len(ts.connections()) == cycle
+		}) {
+			t.Fatalf("cycle %d: connections %v", cycle, ts.connections())
+		}
+		ws := ts.waitConn(t)
+		sendRequest(t, ws, cycle, "hello")
+		if frame := readFrame(t, ws); frame.payload != "reply:hello" {
+			t.Errorf("cycle %d: unexpected response %q", cycle, frame.payload)
+		}
+		client.Stop()
+		client.Wait()
+		if client.Status().Connected {
+			t.Errorf("cycle %d: still connected after Stop", cycle)
+		}
+		if cycle < 3 {
+			if _, err := client.StartNotify(); err != nil {
+				t.Fatalf("cycle %d: restart failed: %v", cycle, err)
+			}
+		}
+	}
+	// Only the goroutines of the test servers may remain
+	if !waitFor(5*time.Second, func() bool {
+		return runtime.NumGoroutine() <= goroutines+2
+	}) {
+		t.Errorf("goroutines leaked: %d before, %d after",
+			goroutines, runtime.NumGoroutine())
+	}
+}
+
+func TestWaitConnected(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	client := newTestTunnelClient(ts)
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	addr := ts.Listener.Addr().String()
+	ts.Close()
+	client.Start()
+	defer client.Stop()
+
+	err := client.WaitConnectedTimeout(100 * time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	// The server only starts listening after the wait began
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- client.WaitConnected(context.Background())
+	}()
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case err := <-waitErr:
+		t.Fatalf("returned before the server started: %v", err)
+	default:
+	}
+	ts = newTestTunnelServerOn(t, addr)
+	ts.Server.Start()
+	defer ts.Close()
+	select {
+	case err := <-waitErr:
+		if err != nil {
+			t.Errorf("WaitConnected failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("WaitConnected did not return once connected")
+	}
+
+	// Already connected
+	if err := client.WaitConnectedTimeout(10 * time.Millisecond); err != nil {
+		t.Errorf("WaitConnected failed while connected: %v", err)
+	}
+
+	// Reconnected
+	ts.dropAll()
+	if !waitFor(5*time.Second, func() bool { return len(ts.connections()) == 2 }) {
+		t.Fatalf("tunnel did not reconnect")
+	}
+	if err := client.WaitConnectedTimeout(5 * time.Second); err != nil {
+		t.Errorf("WaitConnected failed after reconnect: %v", err)
+	}
+}
+
+func TestStopCloseReason(t *testing.T) {
+	tests := []struct {
+		stop   func(*WSTunnelClient)
+		reason string
+	}{
+		{stop: (*WSTunnelClient).Stop, reason: StopReasonShutdown},
+		{stop: func(client *WSTunnelClient) {
+			client.StopWithReason(StopReasonConfigChange)
+		}, reason: StopReasonConfigChange},
+	}
+	for _, test := range tests {
+		ts := newTestTunnelServer(t)
+		relay := newTestRelay(t, func(req string) []byte {
+			time.Sleep(200 * time.Millisecond)
+			return echoRelay(req)
+		})
+		client := startTestTunnel(t, ts, relay, nil)
+		ws := ts.waitConn(t)
+
+		// The request in flight is answered before the close frame
+		sendRequest(t, ws, 1, "hello")
+		time.Sleep(50 * time.Millisecond)
+		stopped := make(chan struct{})
+		go func() {
+			test.stop(client)
+			close(stopped)
+		}()
+		if frame := readFrame(t, ws); frame.id != 1 || frame.payload != "reply:hello" {
+			t.Errorf("unexpected frame %+v", frame)
+		}
+		// Reading the close frame answers it, which lets Stop return
+		_, _, err := ws.ReadMessage()
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok || closeErr.Code != websocket.CloseNormalClosure || closeErr.Text != test.reason {
+			t.Errorf("expected close %d %q, got %v", websocket.CloseNormalClosure,
+				test.reason, err)
+		}
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Errorf("Stop did not return")
+		}
+		relay.Close()
+		ts.Close()
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// With the control capability the server sends control messages as
+// websocket text messages carrying a JSON encoded controlMessage, which
+// the client answers the same way. As the replies start with '{' the
+// server tells them apart from the error frames, which start with the
+// request id in hex.
+const (
+	controlConfig      = "config"       // server update of the tunnel settings
+	controlConfigReply = "config-reply" // client answer, with Error set on rejection
+)
+
+// controlMessage is a message on the control channel
+type controlMessage struct {
+	Type   string          `json:"type"`
+	ID     uint64          `json:"id,omitempty"` // echoed in the reply
+	Config json.RawMessage `json:"config,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Health RelayHealth     `json:"health,omitempty"` // of controlRelayHealth
+}
+
+// configUpdate holds the settings the server may tune, those not set
+// being left as is. Durations are in seconds.
+type configUpdate struct {
+	PingInterval *int     `json:"pingInterval,omitempty"`
+	PongTimeout  *int     `json:"pongTimeout,omitempty"`
+	MaxFrameSize *int     `json:"maxFrameSize,omitempty"`
+	RateLimit    *float64 `json:"rateLimit,omitempty"` // requests per second, 0 for no limit
+}
+
+// Bounds of the settings tuned by the server
+const (
+	minPingInterval = 5 * time.Second
+	maxPingInterval = 10 * time.Minute
+	minPongTimeout  = 10 * time.Second
+	maxPongTimeout  = 30 * time.Minute
+	minFrameSize    = 1024
+	maxMaxFrameSize = 1024 * 1024
+	minRateLimit    = 1
+	maxRateLimit    = 10000
+)
+
+// tunnelSettings are the effective settings of the tunnel which the
+// server may tune on the fly
+type tunnelSettings struct {
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	maxFrameSize int
+	rateLimit    float64
+}
+
+// settings returns the effective tunable settings
+func (t *WSTunnelClient) settings() tunnelSettings {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	s := tunnelSettings{
+		pingInterval: t.PingInterval,
+		pongTimeout:  t.Timeout,
+		maxFrameSize: t.MaxFrameSize,
+		rateLimit:    t.RequestRateLimit,
+	}
+	if s.pingInterval == 0 {
+		s.pingInterval = s.pongTimeout / 3
+	}
+	if s.maxFrameSize <= 0 {
+		s.maxFrameSize = maxFrameSize
+	}
+	return s
+}
+
+// applyConfig validates update and applies it to the client, which the
+// running connection picks up on its next ping or frame. Nothing is
+// changed when any of the settings is out of bounds.
+func (t *WSTunnelClient) applyConfig(update configUpdate) error {
+	s := t.settings()
+	if update.PingInterval != nil {
+		s.pingInterval = time.Duration(*update.PingInterval) * time.Second
+		if s.pingInterval < minPingInterval || s.pingInterval > maxPingInterval {
+			return fmt.Errorf("pingInterval %v out of range [%v, %v]",
+				s.pingInterval, minPingInterval, maxPingInterval)
+		}
+	}
+	if update.PongTimeout != nil {
+		s.pongTimeout = time.Duration(*update.PongTimeout) * time.Second
+		if s.pongTimeout < minPongTimeout || s.pongTimeout > maxPongTimeout {
+			return fmt.Errorf("pongTimeout %v out of range [%v, %v]",
+				s.pongTimeout, minPongTimeout, maxPongTimeout)
+		}
+	}
+	if s.pongTimeout <= s.pingInterval {
+		return fmt.Errorf("pongTimeout %v must exceed pingInterval %v",
+			s.pongTimeout, s.pingInterval)
+	}
+	if update.MaxFrameSize != nil {
+		s.maxFrameSize = *update.MaxFrameSize
+		if s.maxFrameSize < minFrameSize || s.maxFrameSize > maxMaxFrameSize {
+			return fmt.Errorf("maxFrameSize %d out of range [%d, %d]",
+				s.maxFrameSize, minFrameSize, maxMaxFrameSize)
+		}
+	}
+	if update.RateLimit != nil {
+		s.rateLimit = *update.RateLimit
+		if s.rateLimit != 0 && (s.rateLimit < minRateLimit || s.rateLimit > maxRateLimit) {
+			return fmt.Errorf("rateLimit %v out of range [%d, %d]",
+				s.rateLimit, minRateLimit, maxRateLimit)
+		}
+	}
+	t.mutex.Lock()
+	t.PingInterval = s.pingInterval
+	t.Timeout = s.pongTimeout
+	t.MaxFrameSize = s.maxFrameSize
+	t.RequestRateLimit = s.rateLimit
+	t.mutex.Unlock()
+	log.Infof("Tunnel settings updated by the server: %+v", s)
+	return nil
+}
+
+// handleControl handles a control message read off the websocket
+func (wsc *WSConnection) handleControl(reader io.Reader) error {
+	var msg controlMessage
+	if err := json.NewDecoder(reader).Decode(&msg); err != nil {
+		return fmt.Errorf("Invalid control message: %v", err)
+	}
+	reply := controlMessage{ID: msg.ID}
+	switch msg.Type {
+	case controlConfig:
+		reply.Type = controlConfigReply
+		var update configUpdate
+		decoder := json.NewDecoder(bytes.NewReader(msg.Config))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&update)
+		if err == nil {
+			err = wsc.tun.applyConfig(update)
+		}
+		if err != nil {
+			log.Warnf("Rejected tunnel settings from the server: %v", err)
+			reply.Error = err.Error()
+		}
+	default:
+		log.Warnf("Unknown control message type %q", msg.Type)
+		reply.Type = msg.Type + "-reply"
+		reply.Error = fmt.Sprintf("unknown control message type %q", msg.Type)
+	}
+	wsc.writeControlMessage(reply)
+	return nil
+}
+
+// writeControlMessage sends msg on the control channel
+func (wsc *WSConnection) writeControlMessage(msg controlMessage) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Errorf("Cannot encode control message: %s", err.Error())
+		return
+	}
+	wsc.writeMutex.Lock()
+	defer wsc.writeMutex.Unlock()
+	wsc.writeFrame(websocket.TextMessage, 0, "", payload)
+}
+
+// throttle waits until a request may be forwarded under the rate limit
+// given when the last one was, false if the connection ended meanwhile
+func (wsc *WSConnection) throttle(last time.Time) bool {
+	limit := wsc.tun.settings().rateLimit
+	if limit <= 0 || last.IsZero() {
+		return true
+	}
+	wait := time.Until(last.Add(time.Duration(float64(time.Second) / limit)))
+	if wait <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(wait):
+		return true
+	case <-wsc.done:
+		return false
+	case <-wsc.tun.exitChan:
+		return false
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sendConfig sends a config control message and returns the reply
+func sendConfig(t *testing.T, ws *websocket.Conn, id uint64, config string) controlMessage {
+	msg, _ := json.Marshal(controlMessage{Type: controlConfig, ID: id,
+		Config: json.RawMessage(config)})
+	if err := ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+		t.Fatalf("write control message failed: %v", err)
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, data, err := ws.ReadMessage()
+	if err != nil || messageType != websocket.TextMessage {
+		t.Fatalf("expected a control reply, got %d %q %v", messageType, data, err)
+	}
+	var reply controlMessage
+	if err := json.Unmarshal(data, &reply); err != nil {
+		t.Fatalf("bad control reply %q: %v", data, err)
+	}
+	if reply.Type != controlConfigReply || reply.ID != id {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+	return reply
+}
+
+func TestServerConfigUpdate(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 8*1024)
+	relay := newTestRelay(t, func(req string) []byte { return large })
+	defer relay.Close()
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityControl + "," + capabilityChunked)
+	client := startTestTunnel(t, ts, relay, nil)
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	if reply := sendConfig(t, ws, 1, `{"pingInterval": 120, "pongTimeout": 360,
+		"maxFrameSize": 2048, "rateLimit": 50}`); reply.Error != "" {
+		t.Errorf("valid update rejected: %s", reply.Error)
+	}
+	expected := tunnelSettings{
+		pingInterval: 120 * time.Second,
+		pongTimeout:  360 * time.Second,
+		maxFrameSize: 2048,
+		rateLimit:    50,
+	}
+	if settings := client.settings(); settings != expected {
+		t.Errorf("expected settings %+v, got %+v", expected, settings)
+	}
+
+	// Out of range or unknown settings are rejected as a whole
+	for i, config := range []string{
+		`{"maxFrameSize": 4096, "pongTimeout": 1}`,
+		`{"pingInterval": 3600}`,
+		`{"pongTimeout": 60}`, // below the ping interval
+		`{"rateLimit": -1}`,
+		`{"maxFrameSize": 4096, "readLimit": 1}`,
+		`"garbage"`,
+	} {
+		if reply := sendConfig(t, ws, uint64(i+2), config); reply.Error == "" {
+			t.Errorf("%s: not rejected", config)
+		}
+		if settings := client.settings(); settings != expected {
+			t.Errorf("%s: settings changed to %+v", config, settings)
+		}
+	}
+
+	// The live connection uses the new frame size
+	sendRequest(t, ws, 1, "large")
+	response, frames := readChunkedResponse(t, ws, 1)
+	if !bytes.Equal(response, large) || frames != len(large)/2048 {
+		t.Errorf("unexpected response of %d bytes in %d frames", len(response), frames)
+	}
+}
+
+func TestControlNotNegotiated(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	client := startTestTunnel(t, ts, nil, nil)
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	// Without the capability text messages are a protocol violation
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"type": "config", "config": {}}`))
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := ws.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); !ok ||
+		closeErr.Code != websocket.CloseUnsupportedData {
+		t.Errorf("expected unsupported data close, got %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	client := newFakeTunnel()
+	defer close(client.exitChan)
+	client.RequestRateLimit = 10
+	wsc := newWSConnection(newFakeWSConn(), client)
+
+	start := time.Now()
+	if !wsc.throttle(time.Time{}) || time.Since(start) > 50*time.Millisecond {
+		t.Errorf("first request throttled")
+	}
+	last := time.Now()
+	if !wsc.throttle(last) {
+		t.Errorf("throttle failed")
+	}
+	if elapsed := time.Since(last); elapsed < 90*time.Millisecond {
+		t.Errorf("second request after %v at 10/s", elapsed)
+	}
+	// Requests waiting for their turn end with the connection
+	close(wsc.done)
+	if wsc.throttle(time.Now()) {
+		t.Errorf("throttle did not end with the connection")
+	}
+}
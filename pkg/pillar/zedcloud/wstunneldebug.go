@@ -0,0 +1,146 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	debugEventsSize = 32 // state changes kept for the debug handler
+	debugErrorsSize = 32 // error messages kept for the debug handler
+)
+
+// debugEvent is a state change or an error kept for the debug handler
+type debugEvent struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// debugConnection describes the current websocket connection
+type debugConnection struct {
+	SessionRecord
+	Uptime       string      `json:"uptime"`
+	Subprotocol  string      `json:"subprotocol"`
+	Capabilities []string    `json:"capabilities"`
+	TLS          *TLSDetails `json:"tls"`
+	Pending      int         `json:"pending"` // requests read and not answered
+	Streams      int         `json:"streams"`
+}
+
+// debugState is the document served by the debug handler
+type debugState struct {
+	Time       time.Time        `json:"time"`
+	Status     WSTunnelStatus   `json:"status"`
+	Stats      WSTunnelStats    `json:"stats"`
+	Connection *debugConnection `json:"connection"` // nil while disconnected
+	Events     []debugEvent     `json:"events"`     // oldest first
+	Errors     []debugEvent     `json:"errors"`     // oldest first
+}
+
+// appendDebugEvent appends message to events, keeping the last size
+func appendDebugEvent(events []debugEvent, size int, message string) []debugEvent {
+	events = append(events, debugEvent{Time: time.Now(), Message: message})
+	if len(events) > size {
+		events = events[len(events)-size:]
+	}
+	return events
+}
+
+// stateLocked summarizes the state shown in Status for the debug
+// events. The caller holds the mutex.
+func (t *WSTunnelClient) stateLocked() string {
+	state := "disconnected"
+	switch {
+	case t.terminalErr != nil:
+		state = "gave up: " + t.terminalErr.Error()
+	case t.Connected:
+		state = "connected"
+	case t.dormant:
+		state = "dormant"
+	case t.sessionConflict:
+		state = "rejected as already connected"
+	}
+	if t.relayHealth.health != RelayHealthUnknown {
+		state += ", local relay " + string(t.relayHealth.health)
+	}
+	return state
+}
+
+// stateChangedLocked records the state in the debug events when it
+// changed. The caller holds the mutex.
+func (t *WSTunnelClient) stateChangedLocked() {
+	state := t.stateLocked()
+	if n := len(t.debugEvents); n != 0 && t.debugEvents[n-1].Message == state {
+		return
+	}
+	t.debugEvents = appendDebugEvent(t.debugEvents, debugEventsSize, state)
+}
+
+// recordError keeps an error message for the debug handler
+func (t *WSTunnelClient) recordError(format string, args ...interface{}) {
+	t.mutex.Lock()
+	t.debugErrors = appendDebugEvent(t.debugErrors, debugErrorsSize,
+		fmt.Sprintf(format, args...))
+	t.mutex.Unlock()
+}
+
+// debugState returns a snapshot of the tunnel internals. Like Status
+// it only holds the locks to copy them, the encoding happens after.
+func (t *WSTunnelClient) debugState() debugState {
+	state := debugState{
+		Time:   time.Now(),
+		Status: t.Status(),
+		Stats:  t.GetStats(),
+	}
+	t.mutex.Lock()
+	conn := t.conn
+	if !t.Connected {
+		conn = nil
+	}
+	capabilities := t.capabilities
+	state.Events = append([]debugEvent{}, t.debugEvents...)
+	state.Errors = append([]debugEvent{}, t.debugErrors...)
+	t.mutex.Unlock()
+	if conn != nil {
+		conn.pendingMutex.Lock()
+		pending := len(conn.pending)
+		conn.pendingMutex.Unlock()
+		state.Connection = &debugConnection{
+			SessionRecord: conn.sessionRecord(""),
+			Uptime:        time.Since(conn.established).Round(time.Second).String(),
+			Subprotocol:   conn.subprotocol,
+			Capabilities:  capabilities,
+			TLS:           conn.tls,
+			Pending:       pending,
+			Streams:       conn.activeStreams(),
+		}
+	}
+	return state
+}
+
+// DebugHandler returns a handler serving the live internals of the
+// tunnel client as JSON for field debugging, e.g. mounted by the agent
+// on /debug/tunnel of a local port. It never blocks the tunnel.
+func (t *WSTunnelClient) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "GET only", http.StatusMethodNotAllowed)
+			return
+		}
+		payload, err := json.MarshalIndent(t.debugState(), "", "  ")
+		if err != nil {
+			log.Errorf("Cannot encode tunnel debug state: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(payload, '\n'))
+	})
+}
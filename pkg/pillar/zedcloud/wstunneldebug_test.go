@@ -0,0 +1,139 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDebugEventsRing(t *testing.T) {
+	client := InitializeTunnelClient("tunnel.example.com", "127.0.0.1:22")
+	for i := 0; i < debugErrorsSize+5; i++ {
+		client.recordError("error %d", i)
+	}
+	errors := client.debugState().Errors
+	if len(errors) != debugErrorsSize || errors[0].Message != "error 5" ||
+		errors[len(errors)-1].Message != fmt.Sprintf("error %d", debugErrorsSize+4) {
+		t.Errorf("unexpected errors kept: %+v", errors)
+	}
+	// Only changes of the state are kept
+	client.setConnected(true)
+	client.setConnected(true)
+	client.setDormant(true)
+	var messages []string
+	for _, event := range client.debugState().Events {
+		messages = append(messages, event.Message)
+	}
+	if strings.Join(messages, ";") != "connected" {
+		t.Errorf("unexpected events %q", messages)
+	}
+	client.setConnected(false)
+	if events := client.debugState().Events; events[len(events)-1].Message != "dormant" {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
+
+// getDebugState fetches the debug state from server
+func getDebugState(t *testing.T, server *httptest.Server) map[string]json.RawMessage {
+	resp, err := http.Get(server.URL + "/debug/tunnel")
+	if err != nil {
+		t.Fatalf("debug request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected debug response %s %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	var state map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		t.Fatalf("bad debug state: %v", err)
+	}
+	return state
+}
+
+func TestDebugHandler(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityErrorFrames)
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	client := startTestTunnel(t, ts, relay, nil)
+	defer client.Stop()
+	ws := ts.waitConn(t)
+	server := httptest.NewServer(client.DebugHandler())
+	defer server.Close()
+
+	// Requests flow while the state is fetched
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for id := 1; id <= 10; id++ {
+			err := ws.WriteMessage(websocket.BinaryMessage, []byte(fmt.Sprintf("%04xhello", id)))
+			if err == nil {
+				ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+				_, _, err = ws.ReadMessage()
+			}
+			if err != nil {
+				t.Errorf("request %d failed: %v", id, err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		getDebugState(t, server)
+	}
+	<-done
+
+	state := getDebugState(t, server)
+	for _, key := range []string{"time", "status", "stats", "connection", "events", "errors"} {
+		if _, ok := state[key]; !ok {
+			t.Errorf("debug state without %q", key)
+		}
+	}
+	var conn map[string]interface{}
+	if err := json.Unmarshal(state["connection"], &conn); err != nil || conn == nil {
+		t.Fatalf("bad connection %s: %v", state["connection"], err)
+	}
+	for _, key := range []string{"uptime", "subprotocol", "capabilities", "tls", "pending",
+		"streams", "requests", "remoteAddr", "established"} {
+		if _, ok := conn[key]; !ok {
+			t.Errorf("connection without %q", key)
+		}
+	}
+	if requests := conn["requests"].(float64); requests != 10 {
+		t.Errorf("expected 10 requests, got %v", requests)
+	}
+	var decoded debugState
+	if err := json.Unmarshal(mustMarshal(t, state), &decoded); err != nil {
+		t.Fatalf("bad debug state: %v", err)
+	}
+	if !decoded.Status.Connected || len(decoded.Events) == 0 ||
+		decoded.Events[len(decoded.Events)-1].Message != "connected" {
+		t.Errorf("unexpected status or events: %+v %+v", decoded.Status, decoded.Events)
+	}
+
+	resp, err := http.Post(server.URL, "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatalf("debug request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST answered %s", resp.Status)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// With the destination capability, which the client only offers when
+// AllowedDestinations are set, request frames carry the local
+// destination of the request after the request id and any flags: 2 hex
+// digits of its length followed by the destination, either a port on
+// the host of LocalRelayServer or a hostOrIP:port. A zero length sends
+// the request to LocalRelayServer. Destinations must match
+// AllowedDestinations, and the connections to each are pooled like
+// those to LocalRelayServer.
+const (
+	destinationLenLen = 2
+	// Host of the destinations given as a port when LocalRelayServer is
+	// a unix socket
+	destinationHost = "127.0.0.1"
+)
+
+// readFrameDestination reads the destination which follows the request
+// id and flags of a request frame with the destination capability
+func readFrameDestination(r io.Reader) (string, error) {
+	header := make([]byte, destinationLenLen)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "", &frameHeaderError{header: header[:n], err: io.ErrUnexpectedEOF}
+	}
+	if err != nil {
+		return "", err
+	}
+	length, err := strconv.ParseUint(string(header), 16, 8)
+	if err != nil {
+		return "", &frameHeaderError{header: header, err: err.(*strconv.NumError).Err}
+	}
+	dest := make([]byte, length)
+	n, err = io.ReadFull(r, dest)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "", &frameHeaderError{header: append(header, dest[:n]...), err: io.ErrUnexpectedEOF}
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(dest), nil
+}
+
+// requestTarget returns the local relay target of a request for the
+// destination read from its frame, LocalRelayServer when empty
+func (t *WSTunnelClient) requestTarget(dest string) (string, error) {
+	relay := t.localRelay()
+	if dest == "" {
+		return relay, nil
+	}
+	if strings.HasPrefix(dest, "unix:") {
+		// Only LocalRelayServer may be a unix socket
+		return "", fmt.Errorf("Invalid destination %q", dest)
+	}
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		// Only a port
+		host, port = destinationHost, dest
+		if network, addr := relayNetwork(relay); network == "tcp" {
+			host, _, _ = net.SplitHostPort(addr)
+		}
+	}
+	if number, err := strconv.ParseUint(port, 10, 16); err != nil || number == 0 {
+		return "", fmt.Errorf("Invalid destination %q", dest)
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// sendDestinationRequest writes a request frame to dest from the
+// server side
+func sendDestinationRequest(t *testing.T, ws *websocket.Conn, id int, dest, payload string) {
+	err := ws.WriteMessage(websocket.BinaryMessage,
+		[]byte(fmt.Sprintf("%04x%02x%s%s", id, len(dest), dest, payload)))
+	if err != nil {
+		t.Fatalf("write request %d failed: %v", id, err)
+	}
+}
+
+func TestReadFrameDestination(t *testing.T) {
+	for _, test := range []struct {
+		frame string
+		dest  string
+		ok    bool
+	}{
+		{"00hello", "", true},
+		{"0222hello", "22", true},
+		{"0e127.0.0.1:5900", "127.0.0.1:5900", true},
+		{"0", "", false},
+		{"zz22", "", false},
+		{"0522", "", false},
+	} {
+		dest, err := readFrameDestination(strings.NewReader(test.frame))
+		if _, malformed := err.(*frameHeaderError); dest != test.dest || malformed == test.ok {
+			t.Errorf("%q: expected %q ok %v, got %q %v", test.frame, test.dest, test.ok, dest, err)
+		}
+	}
+}
+
+func TestRequestTarget(t *testing.T) {
+	client := InitializeTunnelClient("tunnel.example.com", "127.0.0.2:8080")
+	for _, test := range []struct {
+		dest   string
+		target string
+	}{
+		{"", "127.0.0.2:8080"},
+		{"22", "127.0.0.2:22"},
+		{"10.0.0.1:5900", "10.0.0.1:5900"},
+		{"[::1]:22", "[::1]:22"},
+		{"0", ""},
+		{"70000", ""},
+		{"ssh", ""},
+		{"unix:/run/relay.sock", ""},
+		{"unix:22", ""},
+	} {
+		target, err := client.requestTarget(test.dest)
+		if target != test.target || (err == nil) != (test.target != "") {
+			t.Errorf("%q: expected %q, got %q %v", test.dest, test.target, target, err)
+		}
+	}
+	client.LocalRelayServer = "unix:/run/relay.sock"
+	if target, _ := client.requestTarget("22"); target != destinationHost+":22" {
+		t.Errorf("unexpected target %q for a port with a unix socket relay", target)
+	}
+}
+
+func TestDestinationRouting(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityDestination + "," + capabilityErrorFrames)
+	shell := newTestRelay(t, func(req string) []byte { return []byte("shell:" + req) })
+	defer shell.Close()
+	vnc := newTestRelay(t, func(req string) []byte { return []byte("vnc:" + req) })
+	defer vnc.Close()
+	_, vncPort, _ := net.SplitHostPort(vnc.Addr().String())
+	client := startTestTunnel(t, ts, shell, func(client *WSTunnelClient) {
+		client.AllowedDestinations = []string{"127.0.0.1:*"}
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	for i, test := range []struct {
+		dest  string
+		reply string
+	}{
+		{vncPort, "vnc:hello"},
+		{"", "shell:hello"},
+		{vnc.Addr().String(), "vnc:hello"},
+		{shell.Addr().String(), "shell:hello"},
+	} {
+		sendDestinationRequest(t, ws, i+1, test.dest, "hello")
+		if frame := readFrame(t, ws); frame.id != i+1 || frame.payload != test.reply {
+			t.Errorf("request to %q: expected %q, got %+v", test.dest, test.reply, frame)
+		}
+	}
+	// The connection to each destination is reused
+	if shell.connections() != 1 || vnc.connections() != 1 {
+		t.Errorf("expected a connection per destination, got %d and %d",
+			shell.connections(), vnc.connections())
+	}
+
+	for i, dest := range []string{"10.0.0.1:22", "ssh"} {
+		sendDestinationRequest(t, ws, 10+i, dest, "hello")
+		if frame := readFrame(t, ws); frame.id != 10+i ||
+			frameErrorCode(frame) != frameErrorDestinationDenied {
+			t.Errorf("request to %q: expected destination denied error frame, got %+v", dest, frame)
+		}
+	}
+}
+
+func TestDestinationOffered(t *testing.T) {
+	client := InitializeTunnelClient("tunnel.example.com", "127.0.0.1:22")
+	for _, name := range client.offeredCapabilities() {
+		if name == capabilityDestination {
+			t.Errorf("destination offered without allowed destinations")
+		}
+	}
+	client.AllowedDestinations = []string{"127.0.0.1:*"}
+	offered := strings.Join(client.offeredCapabilities(), ",")
+	if !strings.Contains(offered, capabilityDestination) {
+		t.Errorf("destination not offered: %s", offered)
+	}
+}
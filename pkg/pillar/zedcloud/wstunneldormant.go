@@ -0,0 +1,149 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	dormantPokeInterval = 5 * time.Minute
+	dormantInterval     = time.Hour
+
+	// demandHeader in the ping url response tells a dormant client to
+	// reconnect, when it parses as true
+	demandHeader = "X-Tunnel-Demand"
+)
+
+func (t *WSTunnelClient) dormantPokeInterval() time.Duration {
+	if t.DormantPokeInterval == 0 {
+		return dormantPokeInterval
+	}
+	return t.DormantPokeInterval
+}
+
+func (t *WSTunnelClient) dormantInterval() time.Duration {
+	if t.DormantInterval == 0 {
+		return dormantInterval
+	}
+	return t.DormantInterval
+}
+
+// demanded tells whether a ping url response header asks for the tunnel
+func demanded(value string) bool {
+	demand, err := strconv.ParseBool(value)
+	return err == nil && demand
+}
+
+// startIdleTimer closes the websocket once no request was read or
+// answered for IdleTimeout, if set
+func (wsc *WSConnection) startIdleTimer() {
+	timeout := wsc.tun.IdleTimeout
+	if timeout == 0 {
+		return
+	}
+	wsc.idleTimer = time.AfterFunc(timeout, func() {
+		wsc.pendingMutex.Lock()
+		pending := len(wsc.pending)
+		wsc.pendingMutex.Unlock()
+		if pending != 0 || wsc.activeStreams() != 0 {
+			// Restarted once they are answered or closed
+			return
+		}
+		log.Infof("No request for %v, closing idle websocket connection to: %s",
+			timeout, wsc.tun.DestURL)
+		close(wsc.idled)
+		wsc.closeWithCode(websocket.CloseNormalClosure, "idle")
+		select {
+		case <-wsc.done:
+		case <-time.After(closeReplyTimeout):
+		}
+		wsc.ws.Close()
+	})
+}
+
+// requestSeen restarts the idle timer when a request is read or answered
+func (wsc *WSConnection) requestSeen() {
+	if wsc.idleTimer != nil {
+		wsc.idleTimer.Reset(wsc.tun.IdleTimeout)
+	}
+}
+
+// stopIdleTimer stops the idle timer once the websocket ended
+func (wsc *WSConnection) stopIdleTimer() {
+	if wsc.idleTimer != nil {
+		wsc.idleTimer.Stop()
+	}
+}
+
+// wentIdle tells whether the websocket was closed for being idle
+func (wsc *WSConnection) wentIdle() bool {
+	select {
+	case <-wsc.idled:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *WSTunnelClient) setDormant(dormant bool) {
+	t.mutex.Lock()
+	t.dormant = dormant
+	t.statusChangedLocked()
+	t.mutex.Unlock()
+}
+
+// sleep keeps the tunnel dormant, poking the ping url every
+// DormantPokeInterval, until the server signals demand or
+// DormantInterval elapses. It returns false if the tunnel was stopped
+// meanwhile. tick is the liveness tick of the connection loop.
+func (t *WSTunnelClient) sleep(tick <-chan time.Time) bool {
+	log.Infof("Tunnel to %s dormant", t.DestURL)
+	t.setDormant(true)
+	defer t.setDormant(false)
+	deadline := time.NewTimer(t.dormantInterval())
+	defer deadline.Stop()
+	pokes := time.NewTicker(t.dormantPokeInterval())
+	defer pokes.Stop()
+	for {
+		select {
+		case <-t.exitChan:
+			return false
+		case <-tick:
+			t.loopAlive(t)
+		case <-deadline.C:
+			log.Infof("Tunnel to %s dormant for %v, reconnecting",
+				t.DestURL, t.dormantInterval())
+			return true
+		case <-pokes.C:
+			t.loopAlive(t)
+			if t.poke() {
+				log.Infof("Server demands the tunnel to %s, reconnecting", t.DestURL)
+				return true
+			}
+		}
+	}
+}
+
+// poke checks on the ping url whether the server demands the tunnel
+func (t *WSTunnelClient) poke() bool {
+	t.mutex.Lock()
+	localAddr := t.preferredAddr
+	t.mutex.Unlock()
+	dialer, err := t.attemptDialer(localAddr)
+	if err != nil {
+		log.Warnf("Cannot poke tunnel server: %v", err)
+		return false
+	}
+	_, demand, err := t.pingDemand(dialer)
+	if err != nil {
+		log.Warnf("Poking tunnel server failed: %v", err)
+		return false
+	}
+	return demand
+}
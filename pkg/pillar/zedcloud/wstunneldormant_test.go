@@ -0,0 +1,104 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func (ts *testTunnelServer) setDemand(demand bool) {
+	ts.mutex.Lock()
+	ts.demand = demand
+	ts.mutex.Unlock()
+}
+
+func TestDemanded(t *testing.T) {
+	for value, demand := range map[string]bool{
+		"": false, "true": true, "1": true, "false": false, "maybe": false,
+	} {
+		if demanded(value) != demand {
+			t.Errorf("%q: expected %t", value, demand)
+		}
+	}
+}
+
+func TestIdleDormant(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	client := startTestTunnel(t, ts, relay, func(client *WSTunnelClient) {
+		client.IdleTimeout = 300 * time.Millisecond
+		client.DormantPokeInterval = 50 * time.Millisecond
+		client.DormantInterval = time.Hour
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+	if err := client.WaitConnectedTimeout(5 * time.Second); err != nil {
+		t.Fatalf("not connected: %v", err)
+	}
+	changed := client.StatusChanged()
+
+	// Requests keep the tunnel up
+	for id := 1; id <= 4; id++ {
+		time.Sleep(100 * time.Millisecond)
+		sendRequest(t, ws, id, "hello")
+		readFrame(t, ws)
+	}
+	if status := client.Status(); !status.Connected || status.Dormant {
+		t.Errorf("busy tunnel torn down: %+v", status)
+	}
+
+	// Without any it is closed cleanly and turns dormant
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := ws.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); !ok ||
+		closeErr.Code != websocket.CloseNormalClosure || closeErr.Text != "idle" {
+		t.Errorf("expected idle close, got %v", err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("no status change notified")
+	}
+	if !waitFor(5*time.Second, func() bool { return client.Status().Dormant }) {
+		t.Fatalf("tunnel not dormant: %+v", client.Status())
+	}
+	time.Sleep(200 * time.Millisecond)
+	if status := client.Status(); status.Connected || !status.Dormant ||
+		len(ts.connections()) != 1 || status.RetryOnFailCount != 0 {
+		t.Errorf("dormant tunnel reconnected: %+v", status)
+	}
+
+	// The next poke demanding the tunnel brings it back
+	ts.setDemand(true)
+	if err := client.WaitConnectedTimeout(5 * time.Second); err != nil {
+		t.Fatalf("not reconnected: %v", err)
+	}
+	if status := client.Status(); status.Dormant || len(ts.connections()) != 2 {
+		t.Errorf("unexpected status %+v after demand", status)
+	}
+}
+
+func TestDormantInterval(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+		client.IdleTimeout = 100 * time.Millisecond
+		client.DormantPokeInterval = time.Hour
+		client.DormantInterval = 300 * time.Millisecond
+	})
+	defer client.Stop()
+
+	// Without demand the tunnel comes back after the dormant interval
+	if !waitFor(2*time.Second, func() bool { return client.Status().Dormant }) {
+		t.Fatalf("tunnel not dormant: %+v", client.Status())
+	}
+	if !waitFor(2*time.Second, func() bool { return len(ts.connections()) == 2 }) {
+		t.Errorf("not reconnected after the dormant interval: %v", ts.connections())
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	duplicateWindow     = 128       // request ids remembered per connection
+	duplicateCacheLimit = 64 * 1024 // bytes of frames kept for each remembered request
+)
+
+// recentRequests remembers the last request ids read on a connection
+// along with the frames answering them, so a request the server sends
+// again is not forwarded to the local relay twice
+type recentRequests struct {
+	mutex   sync.Mutex
+	order   *list.List // of *recentRequest, most recent last
+	entries map[requestID]*list.Element
+}
+
+type recentRequest struct {
+	id       requestID
+	frames   []cachedFrame
+	size     int
+	uncached bool // the response is not kept, e.g. when too large
+}
+
+// cachedFrame is a frame written for a request, without any trailer
+type cachedFrame struct {
+	messageType int
+	header      string
+	payload     []byte
+}
+
+func (t *WSTunnelClient) duplicateWindow() int {
+	if t.DuplicateWindow == 0 {
+		return duplicateWindow
+	}
+	return t.DuplicateWindow
+}
+
+// duplicateRequest tells whether request id is still in flight or was
+// read recently, remembering it otherwise
+func (wsc *WSConnection) duplicateRequest(id requestID) bool {
+	if !wsc.tun.DetectDuplicates {
+		return false
+	}
+	wsc.pendingMutex.Lock()
+	_, inflight := wsc.pending[id]
+	wsc.pendingMutex.Unlock()
+	r := &wsc.recent
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.entries == nil {
+		r.order = list.New()
+		r.entries = make(map[requestID]*list.Element)
+	}
+	if _, ok := r.entries[id]; ok || inflight {
+		return true
+	}
+	r.entries[id] = r.order.PushBack(&recentRequest{id: id})
+	for r.order.Len() > wsc.tun.duplicateWindow() {
+		oldest := r.order.Remove(r.order.Front()).(*recentRequest)
+		delete(r.entries, oldest.id)
+	}
+	return false
+}
+
+// forgetRequest lets the server send request id again, e.g. once it
+// was rejected before reaching the local relay
+func (wsc *WSConnection) forgetRequest(id requestID) {
+	r := &wsc.recent
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if elem, ok := r.entries[id]; ok {
+		r.order.Remove(elem)
+		delete(r.entries, id)
+	}
+}
+
+// recordFrame keeps a frame written for request id while it is in
+// flight. The caller holds writeMutex.
+func (wsc *WSConnection) recordFrame(id requestID, messageType int, header string, payload []byte) {
+	if len(header) == 0 || header[0] == streamFramePrefix {
+		return
+	}
+	entry := wsc.inflightEntry(id)
+	if entry == nil {
+		return
+	}
+	r := &wsc.recent
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if entry.uncached {
+		return
+	}
+	if entry.size+len(payload) > duplicateCacheLimit {
+		entry.uncached = true
+		entry.frames = nil
+		return
+	}
+	entry.size += len(payload)
+	entry.frames = append(entry.frames, cachedFrame{messageType: messageType,
+		header: header, payload: append([]byte(nil), payload...)})
+}
+
+// keptFrame collects the payload of a frame streamed for a request in
+// flight, up to duplicateCacheLimit
+type keptFrame struct {
+	payload  []byte
+	overflow bool
+}
+
+func (k *keptFrame) Write(p []byte) (int, error) {
+	if !k.overflow && len(k.payload)+len(p) > duplicateCacheLimit {
+		k.overflow = true
+		k.payload = nil
+	}
+	if !k.overflow {
+		k.payload = append(k.payload, p...)
+	}
+	return len(p), nil
+}
+
+// keepStreamed records the frame streamed for request id once written
+func (wsc *WSConnection) keepStreamed(id requestID, header string, kept *keptFrame) {
+	if kept.overflow {
+		wsc.responseNotKept(id)
+	} else {
+		wsc.recordFrame(id, websocket.BinaryMessage, header, kept.payload)
+	}
+}
+
+// responseNotKept drops the frames of request id, whose response is
+// too large to keep for duplicates
+func (wsc *WSConnection) responseNotKept(id requestID) {
+	entry := wsc.inflightEntry(id)
+	if entry == nil {
+		return
+	}
+	r := &wsc.recent
+	r.mutex.Lock()
+	entry.uncached = true
+	entry.frames = nil
+	r.mutex.Unlock()
+}
+
+// inflightEntry returns the entry of request id while it is in flight
+func (wsc *WSConnection) inflightEntry(id requestID) *recentRequest {
+	if !wsc.tun.DetectDuplicates {
+		return nil
+	}
+	wsc.pendingMutex.Lock()
+	_, inflight := wsc.pending[id]
+	wsc.pendingMutex.Unlock()
+	if !inflight {
+		return nil
+	}
+	r := &wsc.recent
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	elem, ok := r.entries[id]
+	if !ok {
+		return nil
+	}
+	return elem.Value.(*recentRequest)
+}
+
+// replayResponse answers request id read again with the frames which
+// answered it, or a duplicate error frame when they are not available
+func (wsc *WSConnection) replayResponse(id requestID) {
+	wsc.tun.mutex.Lock()
+	wsc.tun.stats.DuplicateRequests++
+	wsc.tun.mutex.Unlock()
+
+	var frames []cachedFrame
+	wsc.pendingMutex.Lock()
+	_, inflight := wsc.pending[id]
+	wsc.pendingMutex.Unlock()
+	r := &wsc.recent
+	r.mutex.Lock()
+	if elem, ok := r.entries[id]; ok && !inflight {
+		entry := elem.Value.(*recentRequest)
+		if !entry.uncached {
+			frames = entry.frames
+		}
+	}
+	r.mutex.Unlock()
+	if len(frames) == 0 {
+		log.Warnf("[id=%d] Duplicate request, not forwarding it again", id)
+		wsc.writeErrorMessage(id, frameErrorDuplicate, "duplicate request id")
+		return
+	}
+	log.Warnf("[id=%d] Duplicate request, sending its response again", id)
+	wsc.writeMutex.Lock()
+	defer wsc.writeMutex.Unlock()
+	for _, frame := range frames {
+		if !wsc.writeFrame(frame.messageType, id, frame.header, frame.payload) {
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDuplicateRequests(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	client := startTestTunnel(t, ts, relay, func(client *WSTunnelClient) {
+		client.DetectDuplicates = true
+		client.DuplicateWindow = 2
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	// The replayed request gets the same response from the cache
+	for i := 0; i < 2; i++ {
+		sendRequest(t, ws, 1, "rm -rf /tmp/x")
+		if frame := readFrame(t, ws); frame.id != 1 || frame.payload != "reply:rm -rf /tmp/x" {
+			t.Errorf("expected response %d to request 1, got %+v", i, frame)
+		}
+		// Until then the request is still in flight, not replayed
+		waitFor(time.Second, func() bool {
+			return client.GetStats().RequestLatency.Count == 1
+		})
+	}
+	if requests := relay.requests(); len(requests) != 1 {
+		t.Errorf("expected the relay to see the request once, got %q", requests)
+	}
+	if duplicates := client.GetStats().DuplicateRequests; duplicates != 1 {
+		t.Errorf("expected 1 duplicate, got %d", duplicates)
+	}
+
+	// Out of the window the id is forwarded again
+	for id := 2; id <= 3; id++ {
+		sendRequest(t, ws, id, "next")
+		readFrame(t, ws)
+	}
+	sendRequest(t, ws, 1, "again")
+	if frame := readFrame(t, ws); frame.id != 1 || frame.payload != "reply:again" {
+		t.Errorf("expected request 1 forwarded again, got %+v", frame)
+	}
+}
+
+func TestDuplicateInflightRequest(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityErrorFrames)
+	// The relay never answers, so the request stays in flight
+	relay := newTestRelay(t, nil)
+	defer relay.Close()
+	client := startTestTunnel(t, ts, relay, func(client *WSTunnelClient) {
+		client.DetectDuplicates = true
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	sendRequest(t, ws, 5, "reboot")
+	sendRequest(t, ws, 5, "reboot")
+	if frame := readFrame(t, ws); frame.id != 5 || frameErrorCode(frame) != frameErrorDuplicate {
+		t.Errorf("expected duplicate error frame, got %+v", frame)
+	}
+	if !waitFor(2*responseReadWindow, func() bool { return len(relay.requests()) == 1 }) {
+		t.Errorf("relay did not see the request")
+	}
+	if requests := relay.requests(); len(requests) != 1 {
+		t.Errorf("expected the relay to see the request once, got %q", requests)
+	}
+}
+
+func TestDuplicatesDisabled(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	client := startTestTunnel(t, ts, relay, nil)
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	for i := 0; i < 2; i++ {
+		sendRequest(t, ws, 1, "hello")
+		readFrame(t, ws)
+	}
+	if requests := relay.requests(); len(requests) != 2 {
+		t.Errorf("expected both requests forwarded, got %q", requests)
+	}
+}
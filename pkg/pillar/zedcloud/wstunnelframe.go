@@ -0,0 +1,140 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	frameIDLen        = 4 // hex digits of the request id heading every frame
+	wideFrameIDLen    = 8 // hex digits of the request id with the wide-ids capability
+	closeWriteTimeout = time.Second
+	closeReplyTimeout = 250 * time.Millisecond
+	stopDrainTimeout  = time.Second
+	maxFrameSize      = 64 * 1024
+)
+
+// requestID identifies a request and its response on the websocket.
+// Frame headers carry its low 16 bits as 4 hex digits, so the server
+// wraps around from 0xffff to 0 on long lived sessions and so do the ids
+// read. With the wide-ids capability the headers carry all of its 32
+// bits as 8 hex digits.
+type requestID uint32
+
+// formatFrameID formats id for a frame header of width hex digits
+func formatFrameID(id requestID, width int) string {
+	if width == frameIDLen {
+		return fmt.Sprintf("%04x", uint16(id))
+	}
+	return fmt.Sprintf("%08x", uint32(id))
+}
+
+// With the chunked or gzip capability every response frame carries 2 hex
+// digits of flags and a 4 hex digit sequence number after the request id.
+// The sequence number counts the frames of a response from zero and all
+// but the last frame have frameFlagMore set. Compressed responses have
+// frameFlagGzip set on all of their frames, the server inflates the
+// payload once reassembled.
+const (
+	frameFlagMore      = 0x01 // more frames of the response follow
+	frameFlagGzip      = 0x02 // response payload is gzip compressed
+	frameFlagEOF       = 0x04 // sender closed its side of the stream, see wstunnelhalfclose.go
+	frameFlagTruncated = 0x08 // response cut at MaxResponseBytes
+)
+
+// frameHeaderError reports a frame whose header can't be parsed
+type frameHeaderError struct {
+	header []byte
+	err    error
+}
+
+func (e *frameHeaderError) Error() string {
+	return fmt.Sprintf("malformed frame header %q: %v", e.header, e.err)
+}
+
+// readFrameID reads the request id of width hex digits heading a frame.
+// The header may arrive split across any number of reads. Short or non
+// hex headers are reported as a *frameHeaderError, other errors are
+// returned as is.
+func readFrameID(r io.Reader, width int) (requestID, error) {
+	header := make([]byte, width)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, &frameHeaderError{header: header[:n], err: io.ErrUnexpectedEOF}
+	}
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(string(header), 16, 4*width)
+	if err != nil {
+		return 0, &frameHeaderError{header: header, err: err.(*strconv.NumError).Err}
+	}
+	return requestID(id), nil
+}
+
+// closeWithCode sends a websocket close frame with code and reason.
+// The caller still has to close the underlying connection.
+func (wsc *WSConnection) closeWithCode(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	err := wsc.ws.WriteControl(websocket.CloseMessage, msg,
+		time.Now().Add(closeWriteTimeout))
+	if err != nil && err != websocket.ErrCloseSent {
+		log.Debugf("WS cannot send close frame %d: %s", code, err.Error())
+	}
+}
+
+// Error frames tell the server that a request failed on the device.
+// They are sent as websocket text messages, unlike the binary data
+// frames, and carry the same request id header followed by a JSON
+// encoded errorFrame.
+type errorFrame struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes in error frames
+const (
+	frameErrorTimeout           = "timeout"            // local relay did not answer in time
+	frameErrorRelayUnreachable  = "relay-unreachable"  // could not connect to local relay
+	frameErrorRelayInvalid      = "relay-invalid"      // local relay can't be reached as configured, not retried
+	frameErrorRelayWrite        = "relay-write"        // could not write request to local relay
+	frameErrorRelayRead         = "relay-read"         // could not read response from local relay
+	frameErrorDestinationDenied = "destination-denied" // local relay not in the allowed destinations
+	frameErrorBusy              = "busy"               // too many requests in flight
+	frameErrorCorrupt           = "corrupt"            // request frame failed its checksum, retransmit
+	frameErrorDuplicate         = "duplicate"          // request id read again, not forwarded twice
+	frameErrorTruncated         = "truncated"          // response cut at MaxResponseBytes, data sent is partial
+	frameErrorBlocked           = "blocked"            // request or response vetoed by an interceptor
+)
+
+// writeErrorMessage sends an error frame for request id on the websocket.
+// Servers which did not accept the error frames get no answer at all,
+// as they don't expect text messages.
+func (wsc *WSConnection) writeErrorMessage(id requestID, code string, message string) {
+	if !wsc.caps[capabilityErrorFrames] {
+		log.Debugf("[id=%d] Server does not accept error frames, dropping %s: %s",
+			id, code, message)
+		return
+	}
+	payload, err := json.Marshal(errorFrame{Code: code, Message: message})
+	if err != nil {
+		log.Errorf("[id=%d] Cannot encode error frame: %s", id, err.Error())
+		return
+	}
+
+	wsc.writeMutex.Lock()
+	defer wsc.writeMutex.Unlock()
+	header := formatFrameID(id, wsc.caps.idLen())
+	if wsc.writeFrame(websocket.TextMessage, id, header, payload) {
+		log.Debugf("[id=%d] Completed writing error frame: %s", id, payload)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"compress/gzip"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	compressThreshold = 4 * 1024
+)
+
+// compressResponse gzips payload if the server accepts compressed
+// responses and the payload is large enough and shrinks. It returns the
+// payload to send along with the frame flags describing it.
+func (wsc *WSConnection) compressResponse(payload []byte) ([]byte, int) {
+	threshold := wsc.tun.CompressThreshold
+	if threshold <= 0 {
+		threshold = compressThreshold
+	}
+	if !wsc.caps[capabilityGzip] || len(payload) < threshold {
+		return payload, 0
+	}
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(payload); err != nil {
+		log.Errorf("Cannot compress response: %v", err)
+		return payload, 0
+	}
+	if err := writer.Close(); err != nil {
+		log.Errorf("Cannot compress response: %v", err)
+		return payload, 0
+	}
+	if buf.Len() >= len(payload) {
+		wsc.tun.mutex.Lock()
+		wsc.tun.stats.UncompressibleResponses++
+		wsc.tun.mutex.Unlock()
+		return payload, 0
+	}
+	wsc.tun.mutex.Lock()
+	wsc.tun.stats.CompressedResponses++
+	wsc.tun.stats.CompressionSavedBytes += uint64(len(payload) - buf.Len())
+	wsc.tun.mutex.Unlock()
+	return buf.Bytes(), frameFlagGzip
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func gunzip(t *testing.T, data []byte) []byte {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("bad gzip data: %v", err)
+	}
+	inflated, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("bad gzip data: %v", err)
+	}
+	return inflated
+}
+
+// writeFakeResponse writes payload on a fake connection with caps and
+// returns the flags and payload of the single frame written
+func writeFakeResponse(t *testing.T, client *WSTunnelClient, caps []string,
+	payload []byte) (int, []byte) {
+
+	ws := newFakeWSConn()
+	wsc := newWSConnection(ws, client)
+	for _, name := range caps {
+		wsc.caps[name] = true
+	}
+	wsc.writeResponseMessage(1, bytes.NewBuffer(payload))
+	frames := ws.writtenFrames()
+	if len(frames) != 1 {
+		t.Fatalf("expected a single frame, got %d", len(frames))
+	}
+	var id, flags, seq int
+	data := frames[0].data
+	if _, err := fmt.Sscanf(string(data[:10]), "%04x%02x%04x", &id, &flags, &seq); err != nil {
+		t.Fatalf("bad frame header %q: %v", data[:10], err)
+	}
+	return flags, data[10:]
+}
+
+func TestCompressResponse(t *testing.T) {
+	client := newFakeTunnel()
+	defer close(client.exitChan)
+	client.CompressResponses = true
+	gzipOnly := []string{capabilityGzip}
+
+	compressible := bytes.Repeat([]byte("compress me "), 1024)
+	flags, data := writeFakeResponse(t, client, gzipOnly, compressible)
+	if flags != frameFlagGzip || !bytes.Equal(gunzip(t, data), compressible) {
+		t.Errorf("unexpected compressed frame flags %x", flags)
+	}
+	stats := client.GetStats()
+	if stats.CompressedResponses != 1 ||
+		stats.CompressionSavedBytes != uint64(len(compressible)-len(data)) {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Random data does not shrink and is sent as is
+	random := make([]byte, 8*1024)
+	rand.Read(random)
+	flags, data = writeFakeResponse(t, client, gzipOnly, random)
+	if flags != 0 || !bytes.Equal(data, random) {
+		t.Errorf("uncompressible payload sent with flags %x", flags)
+	}
+	if stats := client.GetStats(); stats.UncompressibleResponses != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Small payloads are below the threshold
+	flags, data = writeFakeResponse(t, client, gzipOnly, []byte("small small small"))
+	if flags != 0 || string(data) != "small small small" {
+		t.Errorf("small payload sent with flags %x", flags)
+	}
+	client.CompressThreshold = 512
+	if flags, _ = writeFakeResponse(t, client, gzipOnly, bytes.Repeat([]byte("a"), 1024)); flags != frameFlagGzip {
+		t.Errorf("payload above lowered threshold sent with flags %x", flags)
+	}
+
+	// Without the capability nothing is compressed
+	flags, data = writeFakeResponse(t, client, []string{capabilityChunked}, compressible)
+	if flags != 0 || !bytes.Equal(data, compressible) {
+		t.Errorf("payload compressed without the capability")
+	}
+}
+
+func TestCompressedChunkedResponse(t *testing.T) {
+	large := bytes.Repeat([]byte("a compressible line of text\n"), 64*1024)
+	relay := newTestRelay(t, func(req string) []byte { return large })
+	defer relay.Close()
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityChunked + "," + capabilityGzip)
+
+	// Compression disabled: gzip is not negotiated
+	client := startTestTunnel(t, ts, relay, nil)
+	ws := ts.waitConn(t)
+	sendRequest(t, ws, 1, "large")
+	response, _ := readChunkedResponse(t, ws, 1)
+	if !bytes.Equal(response, large) {
+		t.Errorf("unexpected uncompressed response of %d bytes", len(response))
+	}
+	if caps := client.Status().Capabilities; !reflect.DeepEqual(caps, []string{capabilityChunked}) {
+		t.Errorf("unexpected capabilities %v", caps)
+	}
+	client.Stop()
+
+	client = startTestTunnel(t, ts, relay, func(client *WSTunnelClient) {
+		client.CompressResponses = true
+		client.MaxFrameSize = 4096
+	})
+	defer client.Stop()
+	if !waitFor(5*time.Second, func() bool { return len(ts.connections()) == 2 }) {
+		t.Fatalf("tunnel never connected")
+	}
+	ws = ts.waitConn(t)
+	sendRequest(t, ws, 2, "large")
+	var compressed []byte
+	for seq := 0; ; seq++ {
+		chunk := readChunk(t, ws)
+		if chunk.id != 2 || chunk.seq != seq || chunk.flags&frameFlagGzip == 0 {
+			t.Fatalf("unexpected chunk %d/%d flags %x", chunk.id, chunk.seq, chunk.flags)
+		}
+		compressed = append(compressed, chunk.data...)
+		if chunk.flags&frameFlagMore == 0 {
+			break
+		}
+	}
+	if !bytes.Equal(gunzip(t, compressed), large) {
+		t.Errorf("compressed response does not inflate to the original")
+	}
+	if saved := client.GetStats().CompressionSavedBytes; saved == 0 {
+		t.Errorf("no saved bytes recorded")
+	}
+}
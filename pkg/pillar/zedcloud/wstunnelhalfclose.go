@@ -0,0 +1,50 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// With the half-close capability request frames carry 2 hex digits of
+// flags after the request id, and response frames carry flags as with
+// the chunked capability. frameFlagEOF on a request tells the server
+// is done sending for that request, so the client closes the write side
+// of the local relay connection once the request is written, and the
+// relay sees EOF while its response still flows back. frameFlagEOF on
+// the last frame of a response tells the relay closed its side.
+const frameFlagsLen = 2
+
+// readFrameFlags reads the hex flags which follow the request id of a
+// request frame with the half-close capability
+func readFrameFlags(r io.Reader) (int, error) {
+	header := make([]byte, frameFlagsLen)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, &frameHeaderError{header: header[:n], err: io.ErrUnexpectedEOF}
+	}
+	if err != nil {
+		return 0, err
+	}
+	flags, err := strconv.ParseUint(string(header), 16, 8)
+	if err != nil {
+		return 0, &frameHeaderError{header: header, err: err.(*strconv.NumError).Err}
+	}
+	return int(flags), nil
+}
+
+// closeWrite half-closes a connection to the local relay, sending a FIN
+// on TCP, while its read side stays open for the response
+func (c *relayConn) closeWrite() error {
+	conn, ok := c.Conn.(interface {
+		CloseWrite() error
+	})
+	if !ok {
+		return fmt.Errorf("Cannot half-close local relay connection to %s", c.target)
+	}
+	c.writeClosed = true
+	return conn.CloseWrite()
+}
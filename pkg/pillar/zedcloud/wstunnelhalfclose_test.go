@@ -0,0 +1,114 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// eofRelay serves listener with a fake local relay which only answers
+// once it reads EOF, with "got:" and all it read, unless it is mute,
+// and then closes the connection
+func eofRelay(listener net.Listener, mute bool) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			req, err := ioutil.ReadAll(conn)
+			if err == nil && !mute {
+				conn.Write(append([]byte("got:"), req...))
+			}
+		}(conn)
+	}
+}
+
+// sendFlaggedRequest sends a request frame with flags
+func sendFlaggedRequest(t *testing.T, ws *websocket.Conn, id int, flags int, payload string) {
+	err := ws.WriteMessage(websocket.BinaryMessage,
+		[]byte(fmt.Sprintf("%04x%02x%s", id, flags, payload)))
+	if err != nil {
+		t.Fatalf("write request %d failed: %v", id, err)
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wstunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "relay.sock")
+
+	for _, test := range []struct {
+		network, addr string
+		mute          bool
+		response      string
+	}{
+		{"tcp", "127.0.0.1:0", false, "040000got:hello"},
+		{"unix", socket, false, "040000got:hello"},
+		{"tcp", "127.0.0.1:0", true, "040000"},
+	} {
+		listener, err := net.Listen(test.network, test.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go eofRelay(listener, test.mute)
+		target := listener.Addr().String()
+		if test.network == "unix" {
+			target = "unix:" + target
+		}
+
+		ts := newTestTunnelServer(t)
+		ts.setCapabilities(capabilityHalfClose)
+		client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+			client.LocalRelayServer = target
+		})
+		ws := ts.waitConn(t)
+		sendFlaggedRequest(t, ws, 1, frameFlagEOF, "hello")
+		frame := readFrame(t, ws)
+		if frame.id != 1 || frame.payload != test.response {
+			t.Errorf("%s relay: expected %q, got %+v", target, test.response, frame)
+		}
+		// The half-closed connection is not reused
+		if stats := client.relayPool().stats(); stats.Idle != 0 {
+			t.Errorf("%s relay: half-closed connection kept: %+v", target, stats)
+		}
+		client.Stop()
+		ts.Close()
+		listener.Close()
+	}
+}
+
+func TestHalfCloseOpenStream(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityHalfClose)
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	client := startTestTunnel(t, ts, relay, nil)
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	// Without the flag the relay connection stays open both ways
+	for id := 1; id <= 2; id++ {
+		sendFlaggedRequest(t, ws, id, 0, "hello")
+		frame := readFrame(t, ws)
+		if frame.id != id || frame.payload != "000000reply:hello" {
+			t.Errorf("expected response without end of stream, got %+v", frame)
+		}
+	}
+	if created := client.relayPool().stats().Created; created != 1 {
+		t.Errorf("expected the relay connection reused, %d created", created)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// InflightPolicy is what happens to a request read off the websocket
+// while MaxInflightRequests are in flight
+type InflightPolicy int
+
+const (
+	// InflightBusy answers the request with a busy error frame at once
+	InflightBusy InflightPolicy = iota
+	// InflightQueue holds up to InflightQueueSize requests until others
+	// complete, answering the requests beyond with a busy error frame
+	InflightQueue
+)
+
+// admission is the fate of a request subject to the inflight limit
+type admission int
+
+const (
+	admitted admission = iota
+	queued
+	rejectedBusy
+)
+
+func (t *WSTunnelClient) inflightQueueSize() int {
+	if t.InflightQueueSize == 0 {
+		return requestQueueSize
+	}
+	return t.InflightQueueSize
+}
+
+// inflightLocked returns the requests in flight, those read and not
+// yet answered apart from the queued ones. Requires pendingMutex.
+func (wsc *WSConnection) inflightLocked() int {
+	return len(wsc.pending) - len(wsc.queued)
+}
+
+// admit decides the fate of req, which was just read
+func (wsc *WSConnection) admit(req tunnelRequest) admission {
+	limit := wsc.tun.MaxInflightRequests
+	wsc.pendingMutex.Lock()
+	// req itself is pending already
+	inflight := wsc.inflightLocked()
+	result := admitted
+	switch {
+	case limit == 0 || inflight <= limit:
+	case wsc.tun.InflightPolicy == InflightQueue && len(wsc.queued) < wsc.tun.inflightQueueSize():
+		wsc.queued = append(wsc.queued, req)
+		inflight--
+		result = queued
+	default:
+		inflight--
+		result = rejectedBusy
+	}
+	wsc.pendingMutex.Unlock()
+	wsc.inflightChanged(inflight, result == rejectedBusy)
+	return result
+}
+
+// admitQueued hands the queued requests to the local relay as the ones
+// in flight complete
+func (wsc *WSConnection) admitQueued() {
+	limit := wsc.tun.MaxInflightRequests
+	wsc.pendingMutex.Lock()
+	var admit []tunnelRequest
+	for len(wsc.queued) > 0 && (limit == 0 || wsc.inflightLocked() < limit) {
+		admit = append(admit, wsc.queued[0])
+		wsc.queued = wsc.queued[1:]
+	}
+	inflight := wsc.inflightLocked()
+	wsc.pendingMutex.Unlock()
+	wsc.inflightChanged(inflight, false)
+	for _, req := range admit {
+		// The queue of the relay has room for all requests in flight
+		select {
+		case wsc.requests <- req:
+		default:
+			log.Errorf("[id=%d] Request queue full, dropping request", req.id)
+			wsc.requestFinished(req.id, true)
+		}
+	}
+}
+
+// inflightChanged updates the inflight stats
+func (wsc *WSConnection) inflightChanged(inflight int, busy bool) {
+	wsc.tun.mutex.Lock()
+	defer wsc.tun.mutex.Unlock()
+	stats := &wsc.tun.stats
+	stats.Inflight = inflight
+	if inflight > stats.PeakInflight {
+		stats.PeakInflight = inflight
+	}
+	if busy {
+		stats.RequestsBusy++
+	}
+}
+
+// requestQueueLen is the capacity of the queue of requests waiting for
+// the local relay, enough for all the requests allowed in flight
+func requestQueueLen(tun *WSTunnelClient) int {
+	if tun.MaxInflightRequests > requestQueueSize {
+		return tun.MaxInflightRequests
+	}
+	return requestQueueSize
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowRelay answers a single request per connection after delay and
+// closes the connection, which ends the response at once
+func slowRelay(t *testing.T, delay time.Duration) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				time.Sleep(delay)
+				conn.Write(echoRelay(string(buf[:n])))
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+// pushParallel sends requests 1 to count from parallel goroutines and
+// returns the replies and the busy error frames read back
+func pushParallel(t *testing.T, ts *testTunnelServer, count int) (int, int) {
+	ws := ts.waitConn(t)
+	var writeMutex sync.Mutex
+	var wg sync.WaitGroup
+	for id := 1; id <= count; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			sendRequest(t, ws, id, "hello")
+		}(id)
+	}
+	wg.Wait()
+	replies, busy := 0, 0
+	for i := 0; i < count; i++ {
+		frame := readFrame(t, ws)
+		switch {
+		case frame.payload == "reply:hello":
+			replies++
+		case frameErrorCode(frame) == frameErrorBusy:
+			busy++
+		default:
+			t.Errorf("unexpected frame %+v", frame)
+		}
+	}
+	return replies, busy
+}
+
+func TestInflightLimit(t *testing.T) {
+	const requests = 100
+	const limit = 8
+	for _, test := range []struct {
+		policy    InflightPolicy
+		queueSize int
+	}{
+		{policy: InflightBusy},
+		{policy: InflightQueue, queueSize: 20},
+	} {
+		relay := slowRelay(t, 20*time.Millisecond)
+		ts := newTestTunnelServer(t)
+		ts.setCapabilities(capabilityErrorFrames)
+		client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+			client.LocalRelayServer = relay.Addr().String()
+			client.MaxInflightRequests = limit
+			client.InflightPolicy = test.policy
+			client.InflightQueueSize = test.queueSize
+		})
+
+		replies, busy := pushParallel(t, ts, requests)
+		stats := client.GetStats()
+		if stats.PeakInflight > limit {
+			t.Errorf("policy %d: %d requests in flight", test.policy, stats.PeakInflight)
+		}
+		if replies+busy != requests || uint64(busy) != stats.RequestsBusy || busy == 0 {
+			t.Errorf("policy %d: %d replies and %d busy, stats %+v",
+				test.policy, replies, busy, stats)
+		}
+		// Queued requests get through once the ones in flight complete
+		if replies < limit+test.queueSize {
+			t.Errorf("policy %d: only %d replies", test.policy, replies)
+		}
+		if stats.Inflight != 0 {
+			t.Errorf("policy %d: %d requests still in flight", test.policy, stats.Inflight)
+		}
+		client.Stop()
+		ts.Close()
+		relay.Close()
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Interceptor observes the requests and responses relayed by a tunnel
+// client and may change or veto them. The payload it returns replaces
+// the one it was given, and an error from OnRequest stops the request
+// from being forwarded while an error from OnResponse drops the
+// response, answering the server with an error frame instead. They are
+// called from the request forwarding goroutine, one at a time.
+type Interceptor interface {
+	OnRequest(id uint32, payload []byte) ([]byte, error)
+	OnResponse(id uint32, payload []byte) ([]byte, error)
+}
+
+// AddInterceptor registers i after the interceptors already
+// registered, which see the traffic first
+func (t *WSTunnelClient) AddInterceptor(i Interceptor) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.interceptors = append(t.interceptors, i)
+}
+
+func (t *WSTunnelClient) getInterceptors() []Interceptor {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.interceptors
+}
+
+// interceptRequest passes the payload of req through the interceptors.
+// It returns false when one of them blocked it, after answering the
+// request with an error frame.
+func (wsc *WSConnection) interceptRequest(req *tunnelRequest) bool {
+	for _, i := range wsc.tun.getInterceptors() {
+		payload, err := i.OnRequest(uint32(req.id), req.payload)
+		if err != nil {
+			log.Warnf("[id=%d] Request blocked by interceptor: %v", req.id, err)
+			wsc.failRequest(req.id, &relayError{code: frameErrorBlocked,
+				err: fmt.Errorf("[id=%d] Request blocked: %v", req.id, err)})
+			return false
+		}
+		req.payload = payload
+	}
+	return true
+}
+
+// interceptResponse reads the response to request id from r and passes
+// it through the interceptors, which need it whole. It returns false
+// when one of them dropped it, after answering with an error frame.
+func (wsc *WSConnection) interceptResponse(id requestID, r io.Reader,
+	interceptors []Interceptor) ([]byte, bool) {
+
+	payload, _ := ioutil.ReadAll(r)
+	for _, i := range interceptors {
+		var err error
+		if payload, err = i.OnResponse(uint32(id), payload); err != nil {
+			log.Warnf("[id=%d] Response blocked by interceptor: %v", id, err)
+			wsc.writeErrorMessage(id, frameErrorBlocked,
+				fmt.Sprintf("response blocked: %v", err))
+			wsc.requestFinished(id, false)
+			return nil, false
+		}
+	}
+	return payload, true
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// testInterceptor appends its tag to the requests and responses, and
+// blocks the requests containing block when set
+type testInterceptor struct {
+	tag   string
+	block string
+}
+
+func (i testInterceptor) OnRequest(id uint32, payload []byte) ([]byte, error) {
+	if i.block != "" && bytes.Contains(payload, []byte(i.block)) {
+		return nil, errors.New("looks like a shell command")
+	}
+	return append(payload, i.tag...), nil
+}
+
+func (i testInterceptor) OnResponse(id uint32, payload []byte) ([]byte, error) {
+	return append(payload, i.tag...), nil
+}
+
+func TestInterceptors(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityErrorFrames)
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	client := startTestTunnel(t, ts, relay, func(client *WSTunnelClient) {
+		client.AddInterceptor(testInterceptor{tag: "+a", block: "rm -rf"})
+		client.AddInterceptor(testInterceptor{tag: "+b"})
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	// Mutated in registration order both ways
+	sendRequest(t, ws, 1, "ls")
+	if frame := readFrame(t, ws); frame.id != 1 || frame.payload != "reply:ls+a+b+a+b" {
+		t.Errorf("expected mutated response, got %+v", frame)
+	}
+
+	// Blocked before reaching the relay
+	sendRequest(t, ws, 2, "rm -rf /")
+	if frame := readFrame(t, ws); frame.id != 2 || frameErrorCode(frame) != frameErrorBlocked {
+		t.Errorf("expected blocked error frame, got %+v", frame)
+	}
+	if requests := relay.requests(); len(requests) != 1 || requests[0] != "ls+a+b" {
+		t.Errorf("expected the relay to see the mutated request only, got %q", requests)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	livenessInterval = 10 * time.Second
+)
+
+// livenessMonitor tracks when the loops of the tunnel last made
+// progress. Each loop is keyed by its owner: the tunnel client for the
+// connection loop, which also reads the websocket while connected, and
+// the websocket connection for its request forwarding loop.
+type livenessMonitor struct {
+	mutex sync.Mutex
+	loops map[interface{}]*loopLiveness
+}
+
+type loopLiveness struct {
+	last  time.Time     // last report of progress
+	quiet time.Duration // longest expected blocking call, on top of the interval
+}
+
+func (t *WSTunnelClient) livenessInterval() time.Duration {
+	if t.LivenessInterval == 0 {
+		return livenessInterval
+	}
+	return t.LivenessInterval
+}
+
+// livenessQuiet is how long a loop may block in a single call, e.g. a
+// connection attempt or a websocket read between two pongs, without
+// being considered stuck
+func (t *WSTunnelClient) livenessQuiet() time.Duration {
+	quiet := t.DialTimeout
+	if quiet == 0 {
+		quiet = dialTimeout
+	}
+	if timeout := t.settings().pongTimeout; timeout > quiet {
+		quiet = timeout
+	}
+	return quiet
+}
+
+// loopStarted starts tracking the loop owned by key
+func (t *WSTunnelClient) loopStarted(key interface{}) {
+	if t.LivenessFunc == nil {
+		return
+	}
+	l := &t.liveness
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.loops == nil {
+		l.loops = make(map[interface{}]*loopLiveness)
+	}
+	l.loops[key] = &loopLiveness{last: time.Now(), quiet: t.livenessQuiet()}
+}
+
+// loopAlive records progress of the loop owned by key
+func (t *WSTunnelClient) loopAlive(key interface{}) {
+	if t.LivenessFunc == nil {
+		return
+	}
+	l := &t.liveness
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if loop, ok := l.loops[key]; ok {
+		loop.last = time.Now()
+	}
+}
+
+// loopEnded stops tracking the loop owned by key
+func (t *WSTunnelClient) loopEnded(key interface{}) {
+	if t.LivenessFunc == nil {
+		return
+	}
+	l := &t.liveness
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.loops, key)
+}
+
+// loopsAlive tells whether some loops are running and all of them made
+// progress recently
+func (t *WSTunnelClient) loopsAlive() bool {
+	interval := t.livenessInterval()
+	l := &t.liveness
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.loops) == 0 {
+		return false
+	}
+	for _, loop := range l.loops {
+		if time.Since(loop.last) > interval+loop.quiet {
+			return false
+		}
+	}
+	return true
+}
+
+// livenessTicker returns the channel on which the loops wake up to
+// report progress while idle, nil when no LivenessFunc is set
+func (t *WSTunnelClient) livenessTicker() (<-chan time.Time, func()) {
+	if t.LivenessFunc == nil {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(t.livenessInterval())
+	return ticker.C, ticker.Stop
+}
+
+// livenessReporter invokes LivenessFunc every interval for as long as
+// the loops make progress, until exitChan is closed. Being the only
+// caller it never invokes it concurrently.
+func (t *WSTunnelClient) livenessReporter(exitChan chan struct{}) {
+	ticker := time.NewTicker(t.livenessInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-exitChan:
+			return
+		case <-ticker.C:
+			if t.loopsAlive() {
+				t.LivenessFunc()
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// livenessCounter counts the invocations of a LivenessFunc and fails
+// the test if they overlap
+type livenessCounter struct {
+	t       *testing.T
+	calls   int64
+	running int32
+}
+
+func (c *livenessCounter) touch() {
+	if !atomic.CompareAndSwapInt32(&c.running, 0, 1) {
+		c.t.Errorf("LivenessFunc invoked concurrently")
+	}
+	time.Sleep(time.Millisecond)
+	atomic.AddInt64(&c.calls, 1)
+	atomic.StoreInt32(&c.running, 0)
+}
+
+func (c *livenessCounter) count() int64 {
+	return atomic.LoadInt64(&c.calls)
+}
+
+// keepsFiring checks the counter increases by a few calls
+func (c *livenessCounter) keepsFiring() bool {
+	start := c.count()
+	return waitFor(2*time.Second, func() bool { return c.count() >= start+3 })
+}
+
+// staysQuiet checks the counter no longer increases, once a call that
+// may have been in progress is over
+func (c *livenessCounter) staysQuiet() bool {
+	time.Sleep(50 * time.Millisecond)
+	start := c.count()
+	time.Sleep(200 * time.Millisecond)
+	return c.count() == start
+}
+
+func TestLiveness(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+
+	counter := &livenessCounter{t: t}
+	client := startTestTunnel(t, ts, relay, func(client *WSTunnelClient) {
+		client.LivenessFunc = counter.touch
+		client.LivenessInterval = 20 * time.Millisecond
+	})
+	ws := ts.waitConn(t)
+
+	// idle
+	if !counter.keepsFiring() {
+		t.Errorf("liveness not reported while idle")
+	}
+
+	// traffic
+	start := counter.count()
+	deadline := time.Now().Add(2 * time.Second)
+	for id := 1; counter.count() < start+3; id++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("liveness not reported during traffic")
+		}
+		sendRequest(t, ws, id, "hello")
+		readFrame(t, ws)
+	}
+
+	client.Stop()
+	client.Wait()
+	if !counter.staysQuiet() {
+		t.Errorf("liveness reported after the tunnel stopped")
+	}
+}
+
+func TestLivenessRetriesExhausted(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+
+	counter := &livenessCounter{t: t}
+	client := newTestTunnelClient(ts)
+	client.LivenessFunc = counter.touch
+	client.LivenessInterval = 20 * time.Millisecond
+	client.MaxRetryAttempts = 2
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	ts.Close()
+	errChan, err := client.StartNotify()
+	if err != nil {
+		t.Fatalf("StartNotify failed: %v", err)
+	}
+	defer client.Stop()
+	select {
+	case <-errChan:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("retries not exhausted")
+	}
+	if !counter.staysQuiet() {
+		t.Errorf("liveness reported after the connection loop ended")
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TunnelManager runs several tunnel clients concurrently, e.g. to a
+// primary and a standby controller, keyed by their TunnelServerName.
+// The clients share no state so one failing does not affect the others.
+type TunnelManager struct {
+	mutex   sync.Mutex
+	tunnels map[string]*WSTunnelClient
+}
+
+// NewTunnelManager returns a manager without any tunnels
+func NewTunnelManager() *TunnelManager {
+	return &TunnelManager{tunnels: make(map[string]*WSTunnelClient)}
+}
+
+// Add starts a tested tunnel client and adds it to the manager. It
+// fails if a tunnel to the same server is already managed or if the
+// client cannot be started.
+func (m *TunnelManager) Add(client *WSTunnelClient) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	name := client.TunnelServerName
+	if _, ok := m.tunnels[name]; ok {
+		return fmt.Errorf("Tunnel to %s already exists", name)
+	}
+	if _, err := client.StartNotify(); err != nil {
+		return err
+	}
+	log.Infof("Adding tunnel to %s", name)
+	m.tunnels[name] = client
+	return nil
+}
+
+// Get returns the tunnel client for serverName, nil if there is none
+func (m *TunnelManager) Get(serverName string) *WSTunnelClient {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.tunnels[serverName]
+}
+
+// Remove stops the tunnel to serverName and waits until all of its
+// goroutines have ended and its connections are closed.
+func (m *TunnelManager) Remove(serverName string) error {
+	m.mutex.Lock()
+	client, ok := m.tunnels[serverName]
+	delete(m.tunnels, serverName)
+	m.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("No tunnel to %s", serverName)
+	}
+	log.Infof("Removing tunnel to %s", serverName)
+	client.Stop()
+	client.Wait()
+	return nil
+}
+
+// StopAll removes all the tunnels
+func (m *TunnelManager) StopAll() {
+	m.mutex.Lock()
+	tunnels := m.tunnels
+	m.tunnels = make(map[string]*WSTunnelClient)
+	m.mutex.Unlock()
+	for _, client := range tunnels {
+		client.Stop()
+	}
+	for _, client := range tunnels {
+		client.Wait()
+	}
+}
+
+// Status returns the status of every tunnel keyed by server name
+func (m *TunnelManager) Status() map[string]WSTunnelStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	status := make(map[string]WSTunnelStatus, len(m.tunnels))
+	for name, client := range m.tunnels {
+		status[name] = client.Status()
+	}
+	return status
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// expectClosed checks the client closed ws from its side
+func expectClosed(t *testing.T, ws *websocket.Conn) {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); !ok ||
+				closeErr.Code != websocket.CloseNormalClosure {
+				t.Errorf("expected normal closure, got %v", err)
+			}
+			return
+		}
+	}
+}
+
+func TestTunnelManager(t *testing.T) {
+	primary := newTestTunnelServer(t)
+	defer primary.Close()
+	standby := newTestTunnelServer(t)
+	defer standby.Close()
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+
+	manager := NewTunnelManager()
+	for _, ts := range []*testTunnelServer{primary, standby} {
+		client := newTestTunnelClient(ts)
+		client.LocalRelayServer = relay.Addr().String()
+		if err := client.TestConnection(nil, nil); err != nil {
+			t.Fatalf("TestConnection failed: %v", err)
+		}
+		if err := manager.Add(client); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if err := manager.Add(newTestTunnelClient(primary)); err == nil {
+		t.Errorf("duplicate tunnel added")
+	}
+	primaryWS := primary.waitConn(t)
+	standbyWS := standby.waitConn(t)
+	if !waitFor(5*time.Second, func() bool {
+		status := manager.Status()
+		return len(status) == 2 && status[primary.hostPort()].Connected &&
+			status[standby.hostPort()].Connected
+	}) {
+		t.Fatalf("tunnels not connected: %+v", manager.Status())
+	}
+	for i, ws := range []*websocket.Conn{primaryWS, standbyWS} {
+		sendRequest(t, ws, i, "hello")
+		if frame := readFrame(t, ws); frame.id != i || frame.payload != "reply:hello" {
+			t.Errorf("unexpected response %+v", frame)
+		}
+	}
+
+	// Removing the primary leaves the standby working
+	if err := manager.Remove(primary.hostPort()); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	expectClosed(t, primaryWS)
+	if manager.Get(primary.hostPort()) != nil {
+		t.Errorf("removed tunnel still managed")
+	}
+	if err := manager.Remove(primary.hostPort()); err == nil {
+		t.Errorf("removed tunnel removed twice")
+	}
+	sendRequest(t, standbyWS, 7, "still there")
+	if frame := readFrame(t, standbyWS); frame.id != 7 || frame.payload != "reply:still there" {
+		t.Errorf("unexpected response %+v", frame)
+	}
+	if status := manager.Status(); len(status) != 1 || !status[standby.hostPort()].Connected {
+		t.Errorf("unexpected status after remove: %+v", status)
+	}
+
+	standbyClient := manager.Get(standby.hostPort())
+	done := make(chan struct{})
+	go func() {
+		manager.StopAll()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("StopAll did not return")
+	}
+	expectClosed(t, standbyWS)
+	if len(manager.Status()) != 0 {
+		t.Errorf("tunnels left after StopAll")
+	}
+	if standbyClient.Status().Connected {
+		t.Errorf("stopped tunnel still connected")
+	}
+	if len(primary.connections()) != 1 || len(standby.connections()) != 1 {
+		t.Errorf("stopped tunnels reconnected")
+	}
+}
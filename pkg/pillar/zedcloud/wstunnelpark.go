@@ -0,0 +1,103 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pendingBytes      = 1024 * 1024
+	pendingAge        = 30 * time.Second
+	parkRetryInterval = 250 * time.Millisecond
+)
+
+// parkedRequests are the requests held while the local relay is down,
+// oldest first
+type parkedRequests struct {
+	requests []parkedRequest
+	bytes    int
+}
+
+type parkedRequest struct {
+	req    tunnelRequest
+	parked time.Time
+}
+
+func (t *WSTunnelClient) pendingBytes() int {
+	if t.MaxPendingBytes == 0 {
+		return pendingBytes
+	}
+	return t.MaxPendingBytes
+}
+
+func (t *WSTunnelClient) pendingAge() time.Duration {
+	if t.MaxPendingAge == 0 {
+		return pendingAge
+	}
+	return t.MaxPendingAge
+}
+
+// isRefused tells whether a connection to the local relay failed as
+// nothing accepts it, which is the case while it restarts
+func isRefused(err error) bool {
+	if permanentRelayError(err) {
+		return false
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	// A unix socket is missing until the relay listens again
+	return err == syscall.ECONNREFUSED || err == syscall.ENOENT
+}
+
+// park holds req until the local relay is back, or answers it with an
+// error frame when too many requests are held already
+func (wsc *WSConnection) park(req tunnelRequest) {
+	p := &wsc.parked
+	if len(p.requests) >= wsc.tun.MaxPending ||
+		p.bytes+len(req.payload) > wsc.tun.pendingBytes() {
+		wsc.failRequest(req.id, &relayError{code: frameErrorRelayUnreachable,
+			err: fmt.Errorf("[id=%d] Local relay down and too many requests pending", req.id)})
+		return
+	}
+	log.Infof("[id=%d] Local relay down, holding request", req.id)
+	p.requests = append(p.requests, parkedRequest{req: req, parked: time.Now()})
+	p.bytes += len(req.payload)
+	wsc.tun.mutex.Lock()
+	wsc.tun.stats.RequestsParked++
+	wsc.tun.mutex.Unlock()
+}
+
+// flushParked forwards the held requests in order for as long as the
+// local relay accepts them, after failing those held for too long
+func (wsc *WSConnection) flushParked(pool *relayPool) {
+	p := &wsc.parked
+	maxAge := wsc.tun.pendingAge()
+	for len(p.requests) != 0 {
+		parked := p.requests[0]
+		if time.Since(parked.parked) > maxAge {
+			wsc.failRequest(parked.req.id, &relayError{code: frameErrorRelayUnreachable,
+				err: fmt.Errorf("[id=%d] Local relay still down after %v",
+					parked.req.id, maxAge)})
+		} else if err := wsc.forward(pool, parked.req, 1); err != nil {
+			if isRefused(err.err) {
+				return
+			}
+			wsc.failRequest(parked.req.id, err)
+		}
+		p.requests = p.requests[1:]
+		p.bytes -= len(parked.req.payload)
+		wsc.tun.loopAlive(wsc)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// downRelayAddr returns an address nothing listens on
+func downRelayAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestParkedRequestsFlushed(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityErrorFrames)
+	addr := downRelayAddr(t)
+	// The relay is down for 2 seconds
+	restarted := make(chan *testRelay, 1)
+	go func() {
+		time.Sleep(2 * time.Second)
+		restarted <- newTestRelayAt(t, addr, echoRelay)
+	}()
+	defer func() {
+		(<-restarted).Close()
+	}()
+
+	client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+		client.LocalRelayServer = addr
+		client.LocalAttempts = 1
+		client.MaxPending = 10
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	for id := 1; id <= 3; id++ {
+		sendRequest(t, ws, id, fmt.Sprintf("req%d", id))
+	}
+	for id := 1; id <= 3; id++ {
+		frame := readFrame(t, ws)
+		if expected := fmt.Sprintf("reply:req%d", id); frame.id != id ||
+			frame.payload != expected {
+			t.Errorf("expected %q for request %d, got %+v", expected, id, frame)
+		}
+	}
+	if parked := client.GetStats().RequestsParked; parked != 3 {
+		t.Errorf("expected 3 requests held, got %d", parked)
+	}
+}
+
+func TestParkedRequestsLimits(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityErrorFrames)
+	client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+		client.LocalRelayServer = downRelayAddr(t)
+		client.LocalAttempts = 1
+		client.MaxPending = 1
+		client.MaxPendingAge = 300 * time.Millisecond
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	// The second request overflows the queue, the first one expires
+	start := time.Now()
+	sendRequest(t, ws, 1, "first")
+	sendRequest(t, ws, 2, "second")
+	for _, id := range []int{2, 1} {
+		frame := readFrame(t, ws)
+		if frame.id != id || frameErrorCode(frame) != frameErrorRelayUnreachable {
+			t.Errorf("expected unreachable error frame for request %d, got %+v", id, frame)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("held request failed after %v only", elapsed)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	payloadLogLimit = 256
+)
+
+// payloadLog describes a request or response payload for the debug
+// log: its length only, unless PayloadLogging is set
+func (t *WSTunnelClient) payloadLog(payload []byte) string {
+	if !t.PayloadLogging {
+		return fmt.Sprintf("%d bytes", len(payload))
+	}
+	limit := t.PayloadLogLimit
+	if limit == 0 {
+		limit = payloadLogLimit
+	}
+	return payloadDump(payload, limit)
+}
+
+// payloadDump returns the length of payload and its first limit bytes,
+// printable ASCII as is and any other byte in hex, so binary payloads
+// don't put control characters in the log
+func payloadDump(payload []byte, limit int) string {
+	var dump strings.Builder
+	fmt.Fprintf(&dump, "%d bytes: \"", len(payload))
+	shown := payload
+	if len(shown) > limit {
+		shown = shown[:limit]
+	}
+	for _, b := range shown {
+		switch {
+		case b == '"' || b == '\\':
+			dump.WriteByte('\\')
+			dump.WriteByte(b)
+		case b >= 0x20 && b < 0x7f:
+			dump.WriteByte(b)
+		default:
+			fmt.Fprintf(&dump, "\\x%02x", b)
+		}
+	}
+	dump.WriteByte('"')
+	if len(shown) < len(payload) {
+		fmt.Fprintf(&dump, "... (%d more)", len(payload)-len(shown))
+	}
+	return dump.String()
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPayloadDump(t *testing.T) {
+	for _, test := range []struct {
+		payload string
+		limit   int
+		dump    string
+	}{
+		{"", 8, `0 bytes: ""`},
+		{"GET / HTTP/1.1", 64, `14 bytes: "GET / HTTP/1.1"`},
+		{"a\x00\r\n\x1b[2J\xff", 64, `9 bytes: "a\x00\x0d\x0a\x1b[2J\xff"`},
+		{`say "hi" \o/`, 64, `12 bytes: "say \"hi\" \\o/"`},
+		{"0123456789", 4, `10 bytes: "0123"... (6 more)`},
+	} {
+		if dump := payloadDump([]byte(test.payload), test.limit); dump != test.dump {
+			t.Errorf("payloadDump(%q, %d): expected %s, got %s",
+				test.payload, test.limit, test.dump, dump)
+		}
+	}
+}
+
+func TestPayloadLog(t *testing.T) {
+	client := InitializeTunnelClient("tunnel.example.com", "localhost:4822")
+	payload := append([]byte("secret"), bytes.Repeat([]byte{0}, 1000)...)
+
+	// Only the length unless enabled
+	if logged := client.payloadLog(payload); logged != "1006 bytes" {
+		t.Errorf("expected the length only, got %s", logged)
+	}
+
+	client.PayloadLogging = true
+	logged := client.payloadLog(payload)
+	if !strings.HasPrefix(logged, `1006 bytes: "secret\x00`) ||
+		!strings.HasSuffix(logged, `"... (750 more)`) {
+		t.Errorf("expected the first %d bytes, got %s", payloadLogLimit, logged)
+	}
+
+	client.PayloadLogLimit = 3
+	if logged := client.payloadLog(payload); logged != `1006 bytes: "sec"... (1003 more)` {
+		t.Errorf("expected the first 3 bytes, got %s", logged)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	probeFailureLimit = 3
+)
+
+// PingTimings break down the time taken by a ping url handshake. The
+// phases the handshake did not reach are zero.
+type PingTimings struct {
+	Total        time.Duration // dial to response, or failure
+	Connect      time.Duration // TCP connect, through the proxy if any
+	TLSHandshake time.Duration
+	Upgrade      time.Duration // request sent to first response byte
+}
+
+// pingTrace collects PingTimings through httptrace hooks which the
+// websocket dialer invokes
+type pingTrace struct {
+	PingTimings
+	mutex     sync.Mutex
+	start     time.Time
+	connStart time.Time
+	tlsStart  time.Time
+	sent      time.Time // connection ready for the upgrade request
+}
+
+// tracePing returns ctx with hooks recording the timings of a handshake
+func tracePing(ctx context.Context) (context.Context, *pingTrace) {
+	trace := &pingTrace{start: time.Now()}
+	hooks := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			trace.mutex.Lock()
+			trace.connStart = time.Now()
+			trace.mutex.Unlock()
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			trace.mutex.Lock()
+			trace.Connect = time.Since(trace.connStart)
+			trace.sent = time.Now()
+			trace.mutex.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			trace.mutex.Lock()
+			trace.tlsStart = time.Now()
+			trace.mutex.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			trace.mutex.Lock()
+			trace.TLSHandshake = time.Since(trace.tlsStart)
+			trace.sent = time.Now()
+			trace.mutex.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			trace.mutex.Lock()
+			trace.Upgrade = time.Since(trace.sent)
+			trace.mutex.Unlock()
+		},
+	}
+	return httptrace.WithClientTrace(ctx, hooks), trace
+}
+
+// done records the total time once the handshake is over
+func (trace *pingTrace) done() {
+	trace.mutex.Lock()
+	trace.Total = time.Since(trace.start)
+	trace.mutex.Unlock()
+}
+
+// prober periodically repeats the ping url handshake on the preferred
+// source address and records the outcome. Failures never close a
+// healthy tunnel unless ProbeFailureReconnect is set.
+func (t *WSTunnelClient) prober() {
+	ticker := time.NewTicker(t.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.exitChan:
+			return
+		case <-ticker.C:
+		}
+		failures := t.recordProbe(t.probe())
+		if failures > 0 {
+			log.Warnf("Ping url probe failed %d times in a row", failures)
+		}
+		if failures == probeFailureLimit && t.ProbeFailureReconnect {
+			t.ForceReconnect()
+		}
+	}
+}
+
+// probe performs a single ping url handshake
+func (t *WSTunnelClient) probe() ProbeResult {
+	t.mutex.Lock()
+	localAddr := t.preferredAddr
+	t.mutex.Unlock()
+
+	result := ProbeResult{Time: time.Now()}
+	dialer, err := t.attemptDialer(localAddr)
+	if err == nil {
+		_, err = t.ping(dialer)
+	}
+	result.RTT = time.Since(result.Time)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Success = true
+	}
+	return result
+}
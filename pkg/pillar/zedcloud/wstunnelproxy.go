@@ -0,0 +1,211 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	proxyHandshakeTimeout = 30 * time.Second
+)
+
+// ProxyError reports a failure to reach the tunnel server through a
+// proxy, as opposed to a failure of the tunnel server itself.
+type ProxyError struct {
+	Proxy string // proxy host:port
+	Op    string // "dial", "tls" or "connect"
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s %s: %v", e.Proxy, e.Op, e.Err)
+}
+
+// DialErrorKind tells where the last connection attempt failed
+type DialErrorKind string
+
+// Kinds of connection attempt failures
+const (
+	DialErrorNone      DialErrorKind = ""
+	DialErrorProxyTLS  DialErrorKind = "proxy-tls"  // proxy certificate or handshake
+	DialErrorProxy     DialErrorKind = "proxy"      // proxy unreachable or CONNECT refused
+	DialErrorServerTLS DialErrorKind = "server-tls" // tunnel server certificate or handshake
+	DialErrorOther     DialErrorKind = "other"
+
+	DialErrorAlreadyConnected DialErrorKind = "already-connected" // server holds an earlier session
+)
+
+// dialErrorKind classifies an error returned by a connection attempt
+func dialErrorKind(err error) DialErrorKind {
+	switch e := err.(type) {
+	case nil:
+		return DialErrorNone
+	case *ProxyError:
+		if e.Op == "tls" {
+			return DialErrorProxyTLS
+		}
+		return DialErrorProxy
+	case *AlreadyConnectedError:
+		return DialErrorAlreadyConnected
+	case *CandidatesError:
+		// That of the last resort
+		return dialErrorKind(e.Errs[len(e.Errs)-1])
+	case x509.UnknownAuthorityError, x509.HostnameError,
+		x509.CertificateInvalidError, tls.RecordHeaderError:
+		return DialErrorServerTLS
+	}
+	if strings.HasPrefix(err.Error(), "tls: ") ||
+		strings.HasPrefix(err.Error(), "x509: ") {
+		return DialErrorServerTLS
+	}
+	return DialErrorOther
+}
+
+// recordDialError remembers the outcome of the last connection attempt
+func (t *WSTunnelClient) recordDialError(err error) {
+	t.mutex.Lock()
+	t.lastDialErr = err
+	t.mutex.Unlock()
+	if err != nil {
+		t.recordError("Connection attempt failed: %v", err)
+	}
+}
+
+// attemptProxy returns the proxy for the next connection attempt, from
+// ProxyProvider when set, and records it for the status
+func (t *WSTunnelClient) attemptProxy() *url.URL {
+	t.mutex.Lock()
+	proxyURL := t.proxyURL
+	t.mutex.Unlock()
+	if t.ProxyProvider != nil {
+		provided, err := t.ProxyProvider()
+		if err != nil {
+			log.Warnf("Proxy lookup failed, using last known proxy %v: %v",
+				redactedURL(proxyURL), err)
+		} else {
+			proxyURL = provided
+		}
+	}
+	t.mutex.Lock()
+	t.proxyURL = proxyURL
+	t.attemptProxyURL = proxyURL
+	t.mutex.Unlock()
+	return proxyURL
+}
+
+// redactedURL formats a proxy URL without its password, if any
+func redactedURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	if _, ok := u.User.Password(); ok {
+		redacted := *u
+		redacted.User = url.UserPassword(u.User.Username(), "xxxxx")
+		return redacted.String()
+	}
+	return u.String()
+}
+
+// netDial returns the NetDialContext function for a dialer bound to localAddr.
+// Plain http:// proxies are handled by the websocket dialer itself but
+// https:// ones need the CONNECT request to be sent over TLS, which is
+// done here.
+func (t *WSTunnelClient) netDial(proxyURL *url.URL, localAddr net.IP) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	netDial := t.netDialFrom(localAddr)
+	if proxyURL == nil || proxyURL.Scheme != "https" {
+		return netDial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return t.dialHTTPSProxy(ctx, proxyURL, netDial, network, addr)
+	}
+}
+
+// proxyFunc returns the Proxy function for the websocket dialer
+func proxyFunc(proxyURL *url.URL) func(*http.Request) (*url.URL, error) {
+	if proxyURL == nil || proxyURL.Scheme == "https" {
+		return nil
+	}
+	return http.ProxyURL(proxyURL)
+}
+
+// dialHTTPSProxy connects to addr through a CONNECT request sent to
+// the proxy over TLS. The tunnel server TLS handshake then happens
+// inside the returned connection.
+func (t *WSTunnelClient) dialHTTPSProxy(ctx context.Context, proxyURL *url.URL,
+	netDial func(ctx context.Context, network, addr string) (net.Conn, error),
+	network, addr string) (net.Conn, error) {
+
+	proxyHost := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyHost = net.JoinHostPort(proxyURL.Hostname(), "443")
+	}
+	log.Debugf("Connecting to %s through https proxy %s", addr, proxyHost)
+	conn, err := netDial(ctx, network, proxyHost)
+	if err != nil {
+		return nil, &ProxyError{Proxy: proxyHost, Op: "dial", Err: err}
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(proxyHandshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	tlsConfig := &tls.Config{}
+	if t.ProxyTLSConfig != nil {
+		tlsConfig = t.ProxyTLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = proxyURL.Hostname()
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, &ProxyError{Proxy: proxyHost, Op: "tls", Err: err}
+	}
+
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credential := base64.StdEncoding.EncodeToString(
+			[]byte(user.Username() + ":" + password))
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+credential)
+	}
+	if err := connectReq.Write(tlsConn); err != nil {
+		tlsConn.Close()
+		return nil, &ProxyError{Proxy: proxyHost, Op: "connect", Err: err}
+	}
+	// The server does not speak until spoken to so nothing past the
+	// response is buffered.
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), connectReq)
+	if err != nil {
+		tlsConn.Close()
+		return nil, &ProxyError{Proxy: proxyHost, Op: "connect", Err: err}
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		tlsConn.Close()
+		return nil, &ProxyError{Proxy: proxyHost, Op: "connect",
+			Err: fmt.Errorf("CONNECT returned status: %s", resp.Status)}
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
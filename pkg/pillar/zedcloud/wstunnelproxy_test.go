@@ -0,0 +1,243 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConnectProxy is an http:// or https:// proxy accepting CONNECT requests
+type testConnectProxy struct {
+	*httptest.Server
+	mutex       sync.Mutex
+	remoteAddrs []string // of the CONNECT requests
+}
+
+// newTestConnectProxy starts an https:// proxy presenting cert
+func newTestConnectProxy(t *testing.T, cert tls.Certificate) *testConnectProxy {
+	proxy := newUnstartedConnectProxy()
+	proxy.Server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	proxy.Server.StartTLS()
+	return proxy
+}
+
+// newTestPlainProxy starts an http:// proxy
+func newTestPlainProxy() *testConnectProxy {
+	proxy := newUnstartedConnectProxy()
+	proxy.Server.Start()
+	return proxy
+}
+
+func newUnstartedConnectProxy() *testConnectProxy {
+	proxy := &testConnectProxy{}
+	proxy.Server = httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "CONNECT" {
+				http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+				return
+			}
+			proxy.mutex.Lock()
+			proxy.remoteAddrs = append(proxy.remoteAddrs, r.RemoteAddr)
+			proxy.mutex.Unlock()
+			target, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				target.Close()
+				return
+			}
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			go func() {
+				io.Copy(target, conn)
+				target.Close()
+			}()
+			io.Copy(conn, target)
+			conn.Close()
+		}))
+	return proxy
+}
+
+func (proxy *testConnectProxy) connects() []string {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return append([]string{}, proxy.remoteAddrs...)
+}
+
+func TestHTTPSProxy(t *testing.T) {
+	loopback := []net.IP{net.ParseIP("127.0.0.1")}
+	serverCA := newTestCA(t)
+	proxyCA := newTestCA(t)
+	ts := newTestTunnelServerTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{
+			serverCA.issue(t, "tunnel.example.com", loopback, time.Now().Add(time.Hour))},
+	})
+	defer ts.Close()
+	proxy := newTestConnectProxy(t,
+		proxyCA.issue(t, "proxy.example.com", loopback, time.Now().Add(time.Hour)))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+
+	newClient := func(serverRoots, proxyRoots *testCA) *WSTunnelClient {
+		client := newTestTunnelClient(ts)
+		client.Tunnel = "wss://" + ts.hostPort()
+		client.LocalRelayServer = relay.Addr().String()
+		client.TLSConfig = &tls.Config{RootCAs: serverRoots.pool}
+		client.ProxyTLSConfig = &tls.Config{RootCAs: proxyRoots.pool}
+		return client
+	}
+
+	// Untrusted proxy certificate
+	client := newClient(serverCA, serverCA)
+	err := client.TestConnection(proxyURL, nil)
+	if proxyErr, ok := err.(*ProxyError); !ok || proxyErr.Op != "tls" {
+		t.Errorf("expected proxy TLS error, got %v", err)
+	}
+	if kind := client.Status().LastDialErrorKind; kind != DialErrorProxyTLS {
+		t.Errorf("unexpected error kind %q", kind)
+	}
+
+	// Untrusted tunnel server certificate behind a trusted proxy
+	client = newClient(proxyCA, proxyCA)
+	err = client.TestConnection(proxyURL, nil)
+	if _, ok := err.(*ProxyError); ok || err == nil {
+		t.Errorf("expected server TLS error, got %v", err)
+	}
+	if kind := client.Status().LastDialErrorKind; kind != DialErrorServerTLS {
+		t.Errorf("unexpected error kind %q", kind)
+	}
+
+	// Both trusted, the source address is kept for the proxy hop
+	client = newClient(serverCA, proxyCA)
+	localAddr := net.ParseIP("127.0.0.2")
+	if err := client.TestConnection(proxyURL, localAddr); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	if kind := client.Status().LastDialErrorKind; kind != DialErrorNone {
+		t.Errorf("unexpected error kind %q after success", kind)
+	}
+	client.Start()
+	defer client.Stop()
+	ws := ts.waitConn(t)
+	sendRequest(t, ws, 3, "through proxy")
+	if frame := readFrame(t, ws); frame.payload != "reply:through proxy" {
+		t.Errorf("unexpected response %+v", frame)
+	}
+	connects := proxy.connects()
+	if len(connects) < 2 {
+		t.Fatalf("expected CONNECTs for ping and tunnel, got %v", connects)
+	}
+	for _, addr := range connects[len(connects)-2:] {
+		if host, _, _ := net.SplitHostPort(addr); host != "127.0.0.2" {
+			t.Errorf("CONNECT from unexpected address %s", addr)
+		}
+	}
+}
+
+func TestDialErrorKind(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		kind DialErrorKind
+	}{
+		{nil, DialErrorNone},
+		{&ProxyError{Op: "dial", Err: io.EOF}, DialErrorProxy},
+		{&ProxyError{Op: "connect", Err: io.EOF}, DialErrorProxy},
+		{&ProxyError{Op: "tls", Err: io.EOF}, DialErrorProxyTLS},
+		{x509.UnknownAuthorityError{}, DialErrorServerTLS},
+		{&AlreadyConnectedError{}, DialErrorAlreadyConnected},
+		{io.EOF, DialErrorOther},
+	} {
+		if kind := dialErrorKind(test.err); kind != test.kind {
+			t.Errorf("%v: expected %q, got %q", test.err, test.kind, kind)
+		}
+	}
+}
+
+func TestProxyProvider(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	first := newTestPlainProxy()
+	defer first.Close()
+	second := newTestPlainProxy()
+	defer second.Close()
+	firstURL, _ := url.Parse(first.URL)
+	secondURL, _ := url.Parse(second.URL)
+	secondURL.User = url.UserPassword("user", "secret")
+
+	var mutex sync.Mutex
+	provided, providerErr := firstURL, error(nil)
+	setProxy := func(proxyURL *url.URL, err error) {
+		mutex.Lock()
+		provided, providerErr = proxyURL, err
+		mutex.Unlock()
+	}
+
+	client := newTestTunnelClient(ts)
+	client.ProxyProvider = func() (*url.URL, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return provided, providerErr
+	}
+	if err := client.TestConnection(firstURL, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	client.Start()
+	defer client.Stop()
+
+	// reconnect waits for connection count tunnels, and returns the
+	// proxy they went through according to the status
+	reconnect := func(count int) string {
+		ts.dropAll()
+		if !waitFor(5*time.Second, func() bool {
+			return len(ts.connections()) >= count && client.Status().Connected
+		}) {
+			t.Fatalf("tunnel %d never connected: %+v", count, client.Status())
+		}
+		return client.Status().Proxy
+	}
+	if !waitFor(5*time.Second, func() bool { return client.Status().Connected }) {
+		t.Fatalf("tunnel never connected")
+	}
+	if connects := first.connects(); len(connects) != 2 {
+		t.Errorf("expected ping and tunnel through the first proxy, got %v", connects)
+	}
+
+	setProxy(secondURL, nil)
+	if proxy := reconnect(2); proxy != "http://user:xxxxx@"+secondURL.Host {
+		t.Errorf("unexpected proxy in status %q", proxy)
+	}
+	if connects := second.connects(); len(connects) != 1 {
+		t.Errorf("expected a tunnel through the second proxy, got %v", connects)
+	}
+
+	// A failing provider keeps the last known proxy
+	setProxy(nil, errors.New("no PAC file"))
+	reconnect(3)
+	if connects := second.connects(); len(connects) != 2 {
+		t.Errorf("expected the last known proxy, got %v", connects)
+	}
+
+	// No proxy means a direct connection
+	setProxy(nil, nil)
+	if proxy := reconnect(4); proxy != "" {
+		t.Errorf("unexpected proxy in status %q", proxy)
+	}
+	if len(first.connects()) != 2 || len(second.connects()) != 2 {
+		t.Errorf("direct connection went through a proxy")
+	}
+}
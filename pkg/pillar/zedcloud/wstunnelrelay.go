@@ -0,0 +1,478 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	relayMaxIdle      = 2
+	relayIdleTimeout  = time.Minute
+	relayHealthWindow = time.Millisecond
+	localDialTimeout  = 5 * time.Second
+	localAttempts     = 4
+)
+
+// localRetryDelays are the default delays between the attempts at
+// relaying a request
+var localRetryDelays = []time.Duration{
+	100 * time.Millisecond, 500 * time.Millisecond, 2 * time.Second}
+
+// RelayPoolStats describes the connections to the local relay
+type RelayPoolStats struct {
+	Active     int    // checked out for a request
+	Idle       int    // waiting in the pool
+	Created    uint64 // dialed since the client was created
+	Closed     uint64 // closed since the client was created, ClosedIdle included
+	ClosedIdle uint64 // closed after idling for IdleTimeout
+}
+
+// validateLocalRelay checks a local relay target, hostOrIP:port or
+// unix:path, and returns it normalized
+func validateLocalRelay(target string) (string, error) {
+	if target == "" {
+		return "", fmt.Errorf("Must specify local relay server hostOrIP:port")
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return "", fmt.Errorf("Local server relay must not begin with http:// or https://")
+	}
+	target = strings.TrimSuffix(target, "/")
+	if strings.HasPrefix(target, "unix:") {
+		if target == "unix:" {
+			return "", fmt.Errorf("Missing path of local relay socket")
+		}
+		return target, nil
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return "", fmt.Errorf("Invalid local relay server %s: %v", target, err)
+	}
+	return target, nil
+}
+
+// validateDestinations checks the patterns of the allowed destinations
+func validateDestinations(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid allowed destination %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// destinationAllowed tells whether the local relay target matches the
+// allowed destinations
+func (t *WSTunnelClient) destinationAllowed(target string) bool {
+	if len(t.AllowedDestinations) == 0 {
+		return true
+	}
+	for _, pattern := range t.AllowedDestinations {
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *WSTunnelClient) localAttempts() int {
+	if t.LocalAttempts == 0 {
+		return localAttempts
+	}
+	return t.LocalAttempts
+}
+
+// retryDelay waits before the attempt following the failed attempt
+// number failed. It returns false when the client stops meanwhile.
+func (t *WSTunnelClient) retryDelay(failed int) bool {
+	delays := t.LocalRetryDelays
+	if len(delays) == 0 {
+		delays = localRetryDelays
+	}
+	if failed > len(delays) {
+		failed = len(delays)
+	}
+	select {
+	case <-time.After(delays[failed-1]):
+		return true
+	case <-t.exitChan:
+		return false
+	}
+}
+
+// localRelay returns the current local relay target
+func (t *WSTunnelClient) localRelay() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.LocalRelayServer
+}
+
+// SetLocalRelay changes the local server the requests are sent to,
+// hostOrIP:port or unix:path for a unix socket. The next requests use
+// connections to the new target while requests in flight complete on
+// the old ones, which are then closed.
+func (t *WSTunnelClient) SetLocalRelay(target string) error {
+	target, err := validateLocalRelay(target)
+	if err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	old := t.LocalRelayServer
+	t.LocalRelayServer = target
+	if old != target {
+		t.relayChanged = time.Now()
+		t.relayErr = nil
+	}
+	t.mutex.Unlock()
+	if old != target {
+		log.Infof("Local relay changed from %s to %s", old, target)
+		t.relayPool().closeIdle(old)
+	}
+	return nil
+}
+
+// relayConn is a pooled connection to a local relay target. Between
+// get and put or discard it is owned by a single goroutine, which alone
+// writes the request and reads the response, so it needs no locking.
+type relayConn struct {
+	net.Conn
+	target    string
+	pending   []byte // read by the health check, returned first by Read
+	idleSince time.Time
+	closed    bool // closed by the pool while checked out
+
+	writeClosed bool // half-closed after the request, can't be reused
+	routed      bool // to a destination from the request frame
+}
+
+func (c *relayConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// healthy checks the relay has not closed or reset the connection by
+// reading it for relayHealthWindow: a timeout means it is idle and
+// healthy, while EOF or any other error means it is dead. Anything the
+// relay sent meanwhile is kept for the next Read.
+func (c *relayConn) healthy() bool {
+	buf := make([]byte, 4096)
+	c.Conn.SetReadDeadline(time.Now().Add(relayHealthWindow))
+	n, err := c.Conn.Read(buf)
+	c.Conn.SetReadDeadline(time.Time{})
+	c.pending = append(c.pending, buf[:n]...)
+	if err != nil && !isTimeout(err) {
+		log.Debugf("Lost local relay connection to %s: %v", c.target, err)
+		return false
+	}
+	return true
+}
+
+// relayPool keeps connections to the local relay targets for reuse.
+// Its limits are read from the MaxIdle, MaxActive and IdleTimeout
+// settings of the tunnel client. Connections are only dialed for a
+// request and, to hold no local socket while the websocket is down,
+// the idle ones are closed when the websocket closes.
+type relayPool struct {
+	tun        *WSTunnelClient
+	mutex      sync.Mutex
+	idle       map[string][]*relayConn // most recently used last
+	inUse      map[*relayConn]bool     // checked out connections
+	active     int
+	created    uint64
+	closed     uint64
+	closedIdle uint64
+	released   chan struct{} // closed when a connection is checked in
+}
+
+// relayPool returns the pool of connections to the local relay
+func (t *WSTunnelClient) relayPool() *relayPool {
+	t.relaysOnce.Do(func() {
+		t.relays = &relayPool{
+			tun:      t,
+			idle:     make(map[string][]*relayConn),
+			inUse:    make(map[*relayConn]bool),
+			released: make(chan struct{}),
+		}
+	})
+	return t.relays
+}
+
+func (p *relayPool) maxIdle() int {
+	if p.tun.RelayMaxIdle == 0 {
+		return relayMaxIdle
+	}
+	return p.tun.RelayMaxIdle
+}
+
+func (p *relayPool) idleTimeout() time.Duration {
+	if p.tun.RelayIdleTimeout == 0 {
+		return relayIdleTimeout
+	}
+	return p.tun.RelayIdleTimeout
+}
+
+// get checks out a connection to target, reusing a healthy idle one
+// when possible. It waits while RelayMaxActive connections are checked
+// out, until one is checked in or cancel is closed.
+func (p *relayPool) get(target string, cancel <-chan struct{}) (*relayConn, error) {
+	if target == "" {
+		log.Error("Local server not found for WS connection")
+		return nil, fmt.Errorf("Local server not found for WS connection")
+	}
+	p.mutex.Lock()
+	for p.tun.RelayMaxActive != 0 && p.active >= p.tun.RelayMaxActive {
+		released := p.released
+		p.mutex.Unlock()
+		select {
+		case <-released:
+		case <-cancel:
+			return nil, fmt.Errorf("Gave up waiting for a local server connection to %s", target)
+		}
+		p.mutex.Lock()
+	}
+	p.active++
+	for {
+		conns := p.idle[target]
+		if len(conns) == 0 {
+			break
+		}
+		conn := conns[len(conns)-1]
+		p.idle[target] = conns[:len(conns)-1]
+		p.inUse[conn] = true
+		p.mutex.Unlock()
+		if conn.healthy() {
+			return conn, nil
+		}
+		p.discard(conn)
+		p.mutex.Lock()
+		p.active++
+	}
+	p.mutex.Unlock()
+
+	conn, err := p.dial(target)
+	if err != nil {
+		p.mutex.Lock()
+		p.active--
+		p.signal()
+		p.mutex.Unlock()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p *relayPool) dial(target string) (*relayConn, error) {
+	conn, err := p.tun.dialLocal(target)
+	if err != nil {
+		return nil, err
+	}
+	relayConn := &relayConn{Conn: conn, target: target}
+	p.mutex.Lock()
+	p.created++
+	p.inUse[relayConn] = true
+	p.mutex.Unlock()
+	log.Debugf("Successfully connected to local server: %s", target)
+	return relayConn, nil
+}
+
+// dialLocal opens a connection to the local relay target
+func (t *WSTunnelClient) dialLocal(target string) (net.Conn, error) {
+	log.Debugf("Initializing local server connection: %s", target)
+	network, addr := relayNetwork(target)
+	timeout := t.LocalDialTimeout
+	if timeout == 0 {
+		timeout = localDialTimeout
+	}
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		log.Errorf("Could not connect to local server: %s, error: %s", target, err.Error())
+		return nil, err
+	}
+	if err := t.setSocketOptions(conn); err != nil {
+		log.Warnf("Could not set socket options of local server connection %s: %v",
+			target, err)
+	}
+	return conn, nil
+}
+
+// relayNetwork returns the network and address to dial for the local
+// relay target
+func relayNetwork(target string) (string, string) {
+	if strings.HasPrefix(target, "unix:") {
+		return "unix", strings.TrimPrefix(target, "unix:")
+	}
+	return "tcp", target
+}
+
+// setSocketOptions applies the socket options of the local relay
+// connections to conn. TCP_NODELAY only applies to TCP connections.
+func (t *WSTunnelClient) setSocketOptions(conn net.Conn) error {
+	if tcpConn, ok := conn.(*net.TCPConn); ok && t.LocalNoDelay {
+		if err := tcpConn.SetNoDelay(true); err != nil {
+			return err
+		}
+	}
+	buffered, ok := conn.(interface {
+		SetReadBuffer(int) error
+		SetWriteBuffer(int) error
+	})
+	if !ok {
+		return nil
+	}
+	if t.LocalSendBuffer != 0 {
+		if err := buffered.SetWriteBuffer(t.LocalSendBuffer); err != nil {
+			return err
+		}
+	}
+	if t.LocalReceiveBuffer != 0 {
+		if err := buffered.SetReadBuffer(t.LocalReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put checks a healthy connection back in for reuse
+func (p *relayPool) put(conn *relayConn) {
+	// Connections to a former local relay are not reused
+	current := p.tun.localRelay()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.checkIn(conn)
+	conns := p.idle[conn.target]
+	if conn.closed || conn.writeClosed || len(conns) >= p.maxIdle() ||
+		(conn.target != current && !conn.routed) {
+		conn.Close()
+		p.closed++
+		return
+	}
+	conn.idleSince = time.Now()
+	p.idle[conn.target] = append(conns, conn)
+}
+
+// discard closes a checked out connection which can't be reused
+func (p *relayPool) discard(conn *relayConn) {
+	conn.Close()
+	p.mutex.Lock()
+	p.checkIn(conn)
+	p.closed++
+	p.mutex.Unlock()
+}
+
+// checkIn ends the checkout of conn, which must be done once only
+func (p *relayPool) checkIn(conn *relayConn) {
+	delete(p.inUse, conn)
+	p.active--
+	p.signal()
+}
+
+// signal wakes up the callers of get waiting for a connection
+func (p *relayPool) signal() {
+	close(p.released)
+	p.released = make(chan struct{})
+}
+
+// reap closes the connections idle for longer than the idle timeout
+func (p *relayPool) reap() {
+	timeout := p.idleTimeout()
+	p.mutex.Lock()
+	var expired []*relayConn
+	for target, conns := range p.idle {
+		var kept []*relayConn
+		for _, conn := range conns {
+			if time.Since(conn.idleSince) >= timeout {
+				expired = append(expired, conn)
+			} else {
+				kept = append(kept, conn)
+			}
+		}
+		p.idle[target] = kept
+	}
+	p.closedIdle += uint64(len(expired))
+	p.closed += uint64(len(expired))
+	p.mutex.Unlock()
+	for _, conn := range expired {
+		log.Debugf("Closing idle local server connection: %s", conn.target)
+		conn.Close()
+	}
+}
+
+// reaper reaps idle connections until exitChan is closed, and then
+// closes all of them including the checked out ones, which ends any
+// read from the relay in progress.
+func (p *relayPool) reaper(exitChan chan struct{}) {
+	for {
+		select {
+		case <-exitChan:
+			p.closeAll()
+			return
+		case <-time.After(p.idleTimeout() / 2):
+			p.reap()
+		}
+	}
+}
+
+// closeIdle closes the idle connections to target
+func (p *relayPool) closeIdle(target string) {
+	p.mutex.Lock()
+	conns := p.idle[target]
+	delete(p.idle, target)
+	p.closed += uint64(len(conns))
+	p.mutex.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// closeAllIdle closes the idle connections to all targets
+func (p *relayPool) closeAllIdle() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closeAllIdleLocked()
+}
+
+func (p *relayPool) closeAllIdleLocked() {
+	for _, conns := range p.idle {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		p.closed += uint64(len(conns))
+	}
+	p.idle = make(map[string][]*relayConn)
+}
+
+func (p *relayPool) closeAll() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closeAllIdleLocked()
+	// The owners still put or discard the checked out connections
+	for conn := range p.inUse {
+		conn.closed = true
+		conn.Close()
+	}
+}
+
+func (p *relayPool) stats() RelayPoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	stats := RelayPoolStats{
+		Active:     p.active,
+		Created:    p.created,
+		Closed:     p.closed,
+		ClosedIdle: p.closedIdle,
+	}
+	for _, conns := range p.idle {
+		stats.Idle += len(conns)
+	}
+	return stats
+}
@@ -0,0 +1,615 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestRelayPool(relay *testRelay, setup func(*WSTunnelClient)) (*relayPool, string) {
+	client := InitializeTunnelClient("tunnel.example.com", relay.Addr().String())
+	client.exitChan = make(chan struct{})
+	if setup != nil {
+		setup(client)
+	}
+	return client.relayPool(), client.LocalRelayServer
+}
+
+func TestRelayPoolConcurrency(t *testing.T) {
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	pool, target := newTestRelayPool(relay, func(client *WSTunnelClient) {
+		client.RelayMaxActive = 3
+	})
+
+	var mutex sync.Mutex
+	maxActive := 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := pool.get(target, nil)
+			if err != nil {
+				t.Errorf("get failed: %v", err)
+				return
+			}
+			mutex.Lock()
+			if active := pool.stats().Active; active > maxActive {
+				maxActive = active
+			}
+			mutex.Unlock()
+			buf := make([]byte, 64)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Errorf("write failed: %v", err)
+			} else if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "reply:ping" {
+				t.Errorf("unexpected reply %q: %v", buf[:n], err)
+			}
+			pool.put(conn)
+		}()
+	}
+	wg.Wait()
+
+	stats := pool.stats()
+	if maxActive > 3 {
+		t.Errorf("%d connections active at once", maxActive)
+	}
+	if stats.Active != 0 || stats.Idle > relayMaxIdle || stats.Created < 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRelayPoolHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	client := InitializeTunnelClient("tunnel.example.com", listener.Addr().String())
+	pool, target := client.relayPool(), client.LocalRelayServer
+
+	conn, err := pool.get(target, nil)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	relaySide := <-accepted
+	pool.put(conn)
+
+	// Data sent while idle is kept for the next reader
+	relaySide.Write([]byte("late"))
+	time.Sleep(20 * time.Millisecond)
+	reused, err := pool.get(target, nil)
+	if err != nil || reused != conn {
+		t.Fatalf("idle connection not reused: %v", err)
+	}
+	buf := make([]byte, 16)
+	if n, _ := reused.Read(buf); string(buf[:n]) != "late" {
+		t.Errorf("unexpected data %q", buf[:n])
+	}
+	pool.put(reused)
+
+	// The relay closes the connection while idle
+	relaySide.Close()
+	time.Sleep(20 * time.Millisecond)
+	fresh, err := pool.get(target, nil)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if fresh == conn {
+		t.Errorf("dead connection checked out")
+	}
+	pool.put(fresh)
+	if stats := pool.stats(); stats.Created != 2 || stats.Idle != 1 || stats.Active != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRelayPoolIdleReaping(t *testing.T) {
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	exitChan := make(chan struct{})
+	pool, target := newTestRelayPool(relay, func(client *WSTunnelClient) {
+		client.RelayIdleTimeout = 50 * time.Millisecond
+		client.exitChan = exitChan
+	})
+	done := make(chan struct{})
+	go func() {
+		pool.reaper(exitChan)
+		close(done)
+	}()
+
+	first, _ := pool.get(target, nil)
+	second, _ := pool.get(target, nil)
+	if first == nil || second == nil {
+		t.Fatalf("get failed")
+	}
+	pool.put(first)
+	pool.put(second)
+	if stats := pool.stats(); stats.Idle != 2 || stats.Created != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if !waitFor(time.Second, func() bool { return pool.stats().ClosedIdle == 2 }) {
+		t.Errorf("idle connections not reaped: %+v", pool.stats())
+	}
+	if stats := pool.stats(); stats.Idle != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	close(exitChan)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("reaper did not end")
+	}
+}
+
+func TestRelayConnectedOnDemand(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	client := startTestTunnel(t, ts, relay, func(client *WSTunnelClient) {
+		client.RelayIdleTimeout = 200 * time.Millisecond
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	time.Sleep(50 * time.Millisecond)
+	if n := relay.connections(); n != 0 {
+		t.Fatalf("%d relay connections before the first request", n)
+	}
+	sendRequest(t, ws, 1, "hello")
+	readFrame(t, ws)
+	if n := relay.connections(); n != 1 {
+		t.Errorf("expected 1 relay connection, got %d", n)
+	}
+
+	// Idle for RelayIdleTimeout
+	if !waitFor(2*time.Second, func() bool { return client.GetStats().RelayPool.ClosedIdle == 1 }) {
+		t.Errorf("idle relay connection not closed: %+v", client.GetStats().RelayPool)
+	}
+
+	// Closing the websocket closes the idle connections
+	sendRequest(t, ws, 2, "hello")
+	readFrame(t, ws)
+	if !waitFor(time.Second, func() bool { return client.GetStats().RelayPool.Idle == 1 }) {
+		t.Fatalf("relay connection not kept: %+v", client.GetStats().RelayPool)
+	}
+	ts.dropAll()
+	if !waitFor(2*time.Second, func() bool { return client.GetStats().RelayPool.Idle == 0 }) {
+		t.Errorf("relay connection kept after the websocket closed: %+v", client.GetStats().RelayPool)
+	}
+	stats := client.GetStats().RelayPool
+	if stats.Created != 2 || stats.Closed != 2 || stats.Active != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// droppingRelay echoes requests and closes its side of the connection
+// after every third one.
+func droppingRelay(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	var mutex sync.Mutex
+	count := 0
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					conn.Write(echoRelay(string(buf[:n])))
+					mutex.Lock()
+					count++
+					drop := count%3 == 0
+					mutex.Unlock()
+					if drop {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+// TestRelayDropsUnderLoad is mostly useful with go test -race
+func TestRelayDropsUnderLoad(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityErrorFrames)
+	relay := droppingRelay(t)
+	defer relay.Close()
+	client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+		client.LocalRelayServer = relay.Addr().String()
+		client.RequestTimeout = time.Second
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	const requests = 12
+	var writeMutex sync.Mutex
+	var wg sync.WaitGroup
+	for sender := 0; sender < 3; sender++ {
+		wg.Add(1)
+		go func(sender int) {
+			defer wg.Done()
+			for id := sender; id < requests; id += 3 {
+				writeMutex.Lock()
+				sendRequest(t, ws, id, fmt.Sprintf("request %d", id))
+				writeMutex.Unlock()
+				client.Status()
+				client.GetStats()
+			}
+		}(sender)
+	}
+
+	// Every request is answered, with data or with an error frame
+	seen := make(map[int]bool)
+	replies := 0
+	for len(seen) < requests {
+		frame := readFrame(t, ws)
+		if seen[frame.id] {
+			t.Fatalf("second frame for request %d", frame.id)
+		}
+		seen[frame.id] = true
+		if frame.payload == fmt.Sprintf("reply:request %d", frame.id) {
+			replies++
+		} else if code := frameErrorCode(frame); code == "" {
+			t.Errorf("unexpected frame %+v", frame)
+		}
+	}
+	wg.Wait()
+	if replies < requests/2 {
+		t.Errorf("only %d of %d requests answered", replies, requests)
+	}
+	if stats := client.GetStats().RelayPool; stats.Created < requests/3 {
+		t.Errorf("dropped connections not replaced: %+v", stats)
+	}
+}
+
+func TestValidateLocalRelay(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+		valid  bool
+	}{
+		{"127.0.0.1:22", "127.0.0.1:22", true},
+		{"localhost:8080/", "localhost:8080", true},
+		{"unix:/run/sshd.sock", "unix:/run/sshd.sock", true},
+		{"", "", false},
+		{"unix:", "", false},
+		{"http://127.0.0.1:22", "", false},
+		{"https://127.0.0.1:22", "", false},
+		{"127.0.0.1", "", false},
+	}
+	for _, test := range tests {
+		got, err := validateLocalRelay(test.target)
+		if (err == nil) != test.valid || got != test.want {
+			t.Errorf("%q: got %q, %v", test.target, got, err)
+		}
+	}
+}
+
+func TestSetLocalRelay(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	first := newTestRelay(t, func(req string) []byte {
+		// slow enough for the switch to happen meanwhile
+		time.Sleep(100 * time.Millisecond)
+		return []byte("first:" + req)
+	})
+	defer first.Close()
+	second := newTestRelay(t, func(req string) []byte {
+		return []byte("second:" + req)
+	})
+	defer second.Close()
+
+	client := startTestTunnel(t, ts, first, nil)
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	sendRequest(t, ws, 1, "before")
+	time.Sleep(20 * time.Millisecond)
+	if err := client.SetLocalRelay("http://" + second.Addr().String()); err == nil {
+		t.Errorf("invalid relay accepted")
+	}
+	if err := client.SetLocalRelay(second.Addr().String()); err != nil {
+		t.Fatalf("SetLocalRelay failed: %v", err)
+	}
+	// The request in flight completes on the old relay
+	if frame := readFrame(t, ws); frame.payload != "first:before" {
+		t.Errorf("unexpected response %q", frame.payload)
+	}
+	for id := 2; id <= 3; id++ {
+		sendRequest(t, ws, id, "after")
+		if frame := readFrame(t, ws); frame.payload != "second:after" {
+			t.Errorf("request %d: unexpected response %q", id, frame.payload)
+		}
+	}
+	if requests := first.requests(); len(requests) != 1 {
+		t.Errorf("old relay received %v", requests)
+	}
+	status := client.Status()
+	if status.LocalRelay != second.Addr().String() ||
+		status.LocalRelayChanged.IsZero() {
+		t.Errorf("relay change not in status: %+v", status)
+	}
+	// The connection returns to the pool after the response is written
+	waitFor(time.Second, func() bool { return client.relayPool().stats().Idle == 1 })
+	if idle := client.relayPool().stats().Idle; idle != 1 {
+		t.Errorf("expected the new relay connection only to idle, got %d", idle)
+	}
+}
+
+func TestLocalDialTimeout(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityErrorFrames)
+
+	client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+		// 192.0.2.1 is TEST-NET-1, connections to it hang or fail
+		client.LocalRelayServer = "192.0.2.1:22"
+		client.LocalDialTimeout = 100 * time.Millisecond
+		client.LocalAttempts = 1
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	// Every request is answered promptly instead of blocking the loop
+	start := time.Now()
+	for id := 1; id <= 3; id++ {
+		sendRequest(t, ws, id, "hello")
+		frame := readFrame(t, ws)
+		if code := frameErrorCode(frame); frame.id != id || code != frameErrorRelayUnreachable {
+			t.Errorf("expected unreachable error frame, got %+v", frame)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("requests took %v", elapsed)
+	}
+}
+
+func TestRelayRestartRetries(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityErrorFrames)
+	// The relay refuses connections for a second while it restarts
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	restarted := make(chan *testRelay, 1)
+	go func() {
+		time.Sleep(time.Second)
+		restarted <- newTestRelayAt(t, addr, echoRelay)
+	}()
+	defer func() {
+		(<-restarted).Close()
+	}()
+
+	client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+		client.LocalRelayServer = addr
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	start := time.Now()
+	sendRequest(t, ws, 1, "hello")
+	frame := readFrame(t, ws)
+	if frame.id != 1 || frame.payload != "reply:hello" {
+		t.Errorf("expected request delivered after the restart, got %+v", frame)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("answered after %v, before the relay restarted", elapsed)
+	}
+}
+
+// socketOption reads an integer socket option of conn
+func socketOption(t *testing.T, conn net.Conn, level, option int) int {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn failed: %v", err)
+	}
+	var value int
+	var optErr error
+	err = raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, option)
+	})
+	if err != nil || optErr != nil {
+		t.Fatalf("getsockopt failed: %v %v", err, optErr)
+	}
+	return value
+}
+
+func TestLocalSocketOptions(t *testing.T) {
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	pool, target := newTestRelayPool(relay, func(client *WSTunnelClient) {
+		client.LocalNoDelay = true
+		client.LocalSendBuffer = 256 * 1024
+		client.LocalReceiveBuffer = 128 * 1024
+	})
+
+	// Every new connection gets the options, including after a change
+	// of the local relay
+	other := newTestRelay(t, echoRelay)
+	defer other.Close()
+	for _, target := range []string{target, other.Addr().String()} {
+		conn, err := pool.get(target, nil)
+		if err != nil {
+			t.Fatalf("get failed: %v", err)
+		}
+		if socketOption(t, conn.Conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0 {
+			t.Errorf("%s: TCP_NODELAY not set", target)
+		}
+		// Linux doubles the requested sizes for bookkeeping
+		if size := socketOption(t, conn.Conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF); size < 256*1024 {
+			t.Errorf("%s: unexpected send buffer %d", target, size)
+		}
+		if size := socketOption(t, conn.Conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF); size < 128*1024 {
+			t.Errorf("%s: unexpected receive buffer %d", target, size)
+		}
+		pool.discard(conn)
+	}
+}
+
+func TestDestinationAllowed(t *testing.T) {
+	client := InitializeTunnelClient("tunnel.example.com", "127.0.0.1:22")
+	for _, test := range []struct {
+		allowed []string
+		target  string
+		ok      bool
+	}{
+		{nil, "192.168.1.10:80", true},
+		{[]string{"127.0.0.1:22"}, "127.0.0.1:22", true},
+		{[]string{"127.0.0.1:22"}, "127.0.0.1:2222", false},
+		{[]string{"127.0.0.1:22", "unix:/run/*.sock"}, "unix:/run/console.sock", true},
+		{[]string{"unix:/run/*.sock"}, "unix:/run/sub/console.sock", false},
+		{[]string{"127.0.0.1:*"}, "127.0.0.1:4822", true},
+		{[]string{"127.0.0.1:*"}, "192.168.1.10:4822", false},
+		{[]string{"[::1]:*"}, "[::1]:22", false}, // brackets are a character class
+		{[]string{"\\[::1\\]:*"}, "[::1]:22", true},
+	} {
+		client.AllowedDestinations = test.allowed
+		if ok := client.destinationAllowed(test.target); ok != test.ok {
+			t.Errorf("%v %s: expected %t", test.allowed, test.target, test.ok)
+		}
+	}
+	if err := validateDestinations([]string{"127.0.0.1:22", "[127.0.0.1:22"}); err == nil {
+		t.Errorf("bad pattern accepted")
+	}
+}
+
+func TestDeniedDestination(t *testing.T) {
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	for _, test := range []struct {
+		allowed []string
+		denied  bool
+	}{
+		{[]string{"127.0.0.1:22", "unix:/run/*.sock"}, true},
+		{[]string{"127.0.0.1:22", "127.0.0.1:*"}, false},
+	} {
+		ts := newTestTunnelServer(t)
+		ts.setCapabilities(capabilityErrorFrames)
+		client := startTestTunnel(t, ts, relay, func(client *WSTunnelClient) {
+			client.AllowedDestinations = test.allowed
+		})
+		ws := ts.waitConn(t)
+
+		sendRequest(t, ws, 1, "hello")
+		frame := readFrame(t, ws)
+		created := client.relayPool().stats().Created
+		if test.denied {
+			if code := frameErrorCode(frame); frame.id != 1 || code != frameErrorDestinationDenied {
+				t.Errorf("%v: expected destination denied error frame, got %+v",
+					test.allowed, frame)
+			}
+			if created != 0 {
+				t.Errorf("%v: %d local connections opened", test.allowed, created)
+			}
+		} else if frame.id != 1 || frame.payload != "reply:hello" {
+			t.Errorf("%v: unexpected frame %+v", test.allowed, frame)
+		}
+		client.Stop()
+		ts.Close()
+	}
+}
+
+// resetConn is a connection whose peer reset it
+type resetConn struct {
+	net.Conn
+}
+
+func (c resetConn) Read([]byte) (int, error) {
+	return 0, &net.OpError{Op: "read", Net: "tcp",
+		Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+}
+
+func TestRelayConnHealth(t *testing.T) {
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	for _, test := range []struct {
+		name      string
+		peer      func(relaySide net.Conn)
+		wrap      func(net.Conn) net.Conn
+		reconnect bool
+		pending   string
+	}{
+		{name: "healthy idle"},
+		{name: "healthy with data", peer: func(relaySide net.Conn) {
+			go relaySide.Write([]byte("late"))
+			time.Sleep(20 * time.Millisecond)
+		}, pending: "late"},
+		{name: "peer closed", peer: func(relaySide net.Conn) {
+			relaySide.Close()
+		}, reconnect: true},
+		{name: "peer reset", wrap: func(conn net.Conn) net.Conn {
+			return resetConn{conn}
+		}, reconnect: true},
+	} {
+		pool, target := newTestRelayPool(relay, nil)
+		relaySide, deviceSide := net.Pipe()
+		var conn net.Conn = deviceSide
+		if test.wrap != nil {
+			conn = test.wrap(conn)
+		}
+		idle := &relayConn{Conn: conn, target: target, idleSince: time.Now()}
+		pool.mutex.Lock()
+		pool.idle[target] = []*relayConn{idle}
+		pool.mutex.Unlock()
+		if test.peer != nil {
+			test.peer(relaySide)
+		}
+
+		checkedOut, err := pool.get(target, nil)
+		if err != nil {
+			t.Fatalf("%s: get failed: %v", test.name, err)
+		}
+		created := pool.stats().Created
+		if test.reconnect {
+			if checkedOut == idle || created != 1 {
+				t.Errorf("%s: dead connection reused, %d created", test.name, created)
+			}
+		} else {
+			if checkedOut != idle || created != 0 {
+				t.Errorf("%s: healthy connection replaced, %d created", test.name, created)
+			}
+			if string(checkedOut.pending) != test.pending {
+				t.Errorf("%s: unexpected pending data %q", test.name, checkedOut.pending)
+			}
+		}
+		pool.discard(checkedOut)
+		relaySide.Close()
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	relayCheckThreshold = 2
+	// controlRelayHealth reports the health of the local relay to the
+	// server, in Health and with the failure of the last check in Error
+	controlRelayHealth = "relay-health"
+)
+
+// RelayHealth is the state of the local relay found by the checker
+type RelayHealth string
+
+// States of the local relay
+const (
+	RelayHealthUnknown RelayHealth = "" // not checked yet, or no checker
+	RelayHealthUp      RelayHealth = "up"
+	RelayHealthDown    RelayHealth = "down"
+)
+
+// relayHealthState damps the flapping of the health of the local relay:
+// the first check sets it, and it only changes once threshold checks in
+// a row disagree with it
+type relayHealthState struct {
+	health  RelayHealth
+	streak  int    // consecutive checks disagreeing with health
+	lastErr string // of the last failed check
+}
+
+// observe records the outcome of a check and tells whether the health
+// changed
+func (s *relayHealthState) observe(err error, threshold int) bool {
+	result := RelayHealthUp
+	if err != nil {
+		result = RelayHealthDown
+		s.lastErr = err.Error()
+	}
+	if result == s.health {
+		s.streak = 0
+		return false
+	}
+	s.streak++
+	if s.health != RelayHealthUnknown && s.streak < threshold {
+		return false
+	}
+	s.health = result
+	s.streak = 0
+	return true
+}
+
+func (t *WSTunnelClient) relayCheckThreshold() int {
+	if t.RelayCheckThreshold == 0 {
+		return relayCheckThreshold
+	}
+	return t.RelayCheckThreshold
+}
+
+// relayChecker checks the local relay every RelayCheckInterval until
+// exitChan is closed. It skips the checks while the tunnel is dormant.
+func (t *WSTunnelClient) relayChecker(exitChan chan struct{}) {
+	ticker := time.NewTicker(t.RelayCheckInterval)
+	defer ticker.Stop()
+	for {
+		t.mutex.Lock()
+		dormant := t.dormant
+		t.mutex.Unlock()
+		if !dormant {
+			t.recordRelayCheck(t.checkRelay())
+		}
+		select {
+		case <-exitChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkRelay connects to the local relay and closes the connection
+// right away
+func (t *WSTunnelClient) checkRelay() error {
+	network, addr := relayNetwork(t.localRelay())
+	timeout := t.LocalDialTimeout
+	if timeout == 0 {
+		timeout = localDialTimeout
+	}
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// recordRelayCheck updates the health of the local relay with the
+// outcome of a check, reporting changes
+func (t *WSTunnelClient) recordRelayCheck(err error) {
+	t.mutex.Lock()
+	changed := t.relayHealth.observe(err, t.relayCheckThreshold())
+	health := t.relayHealth
+	conn := t.conn
+	if changed {
+		t.statusChangedLocked()
+	}
+	t.mutex.Unlock()
+	if !changed {
+		return
+	}
+	if health.health == RelayHealthDown {
+		log.Errorf("Local relay %s down: %s", t.localRelay(), health.lastErr)
+	} else {
+		log.Infof("Local relay %s up", t.localRelay())
+	}
+	if conn != nil {
+		conn.reportRelayHealth(health)
+	}
+}
+
+// reportRelayHealth tells the server about the health of the local
+// relay, when RelayCheckReport is set and it supports control messages
+func (wsc *WSConnection) reportRelayHealth(health relayHealthState) {
+	if !wsc.tun.RelayCheckReport || !wsc.caps[capabilityControl] ||
+		health.health == RelayHealthUnknown {
+		return
+	}
+	msg := controlMessage{Type: controlRelayHealth, Health: health.health}
+	if health.health == RelayHealthDown {
+		msg.Error = health.lastErr
+	}
+	wsc.writeControlMessage(msg)
+}
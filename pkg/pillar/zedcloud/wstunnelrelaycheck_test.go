@@ -0,0 +1,132 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRelayHealthDamping(t *testing.T) {
+	var s relayHealthState
+	for i, test := range []struct {
+		err     error
+		changed bool
+		health  RelayHealth
+	}{
+		{nil, true, RelayHealthUp}, // the first check sets it
+		{io.EOF, false, RelayHealthUp},
+		{nil, false, RelayHealthUp},
+		{io.EOF, false, RelayHealthUp},
+		{io.EOF, true, RelayHealthDown},
+		{io.EOF, false, RelayHealthDown},
+		{nil, false, RelayHealthDown},
+		{nil, true, RelayHealthUp},
+	} {
+		if changed := s.observe(test.err, 2); changed != test.changed || s.health != test.health {
+			t.Errorf("check %d: expected %q changed %v, got %q changed %v",
+				i, test.health, test.changed, s.health, changed)
+		}
+	}
+	if s.lastErr != io.EOF.Error() {
+		t.Errorf("unexpected last error %q", s.lastErr)
+	}
+}
+
+// waitRelayHealth waits for the local relay health of client to be health
+func waitRelayHealth(t *testing.T, client *WSTunnelClient, health RelayHealth) {
+	timeout := time.After(5 * time.Second)
+	for {
+		changed := client.StatusChanged()
+		if client.Status().LocalRelayHealth == health {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("local relay never %q: %+v", health, client.Status())
+		}
+	}
+}
+
+// readRelayHealth reads relay health control messages until one reports
+// health. The health is reported again when the websocket connects.
+func readRelayHealth(t *testing.T, ws *websocket.Conn, health RelayHealth) controlMessage {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil || messageType != websocket.TextMessage {
+			t.Fatalf("expected a control message, got %d %q %v", messageType, data, err)
+		}
+		var msg controlMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Type != controlRelayHealth {
+			t.Fatalf("expected a relay health message, got %q %v", data, err)
+		}
+		if msg.Health == health {
+			return msg
+		}
+	}
+}
+
+func TestRelayChecker(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityControl)
+	relay := newTestRelay(t, echoRelay)
+	addr := relay.Addr().String()
+	client := startTestTunnel(t, ts, relay, func(client *WSTunnelClient) {
+		client.RelayCheckInterval = 20 * time.Millisecond
+		client.RelayCheckReport = true
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	waitRelayHealth(t, client, RelayHealthUp)
+	readRelayHealth(t, ws, RelayHealthUp)
+	relay.Close()
+	waitRelayHealth(t, client, RelayHealthDown)
+	if msg := readRelayHealth(t, ws, RelayHealthDown); msg.Error == "" {
+		t.Errorf("expected down reported with the error, got %+v", msg)
+	}
+	relay = newTestRelayAt(t, addr, echoRelay)
+	defer relay.Close()
+	waitRelayHealth(t, client, RelayHealthUp)
+	readRelayHealth(t, ws, RelayHealthUp)
+}
+
+func TestRelayCheckerDormant(t *testing.T) {
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	client := InitializeTunnelClient("tunnel.example.com", relay.Addr().String())
+	client.RelayCheckInterval = 10 * time.Millisecond
+	exitChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		client.relayChecker(exitChan)
+		close(done)
+	}()
+	defer func() {
+		close(exitChan)
+		<-done
+	}()
+
+	if !waitFor(time.Second, func() bool { return relay.connections() >= 2 }) {
+		t.Fatalf("relay not checked")
+	}
+	client.setDormant(true)
+	time.Sleep(20 * time.Millisecond)
+	checks := relay.connections()
+	time.Sleep(100 * time.Millisecond)
+	if n := relay.connections(); n != checks {
+		t.Errorf("relay checked %d times while dormant", n-checks)
+	}
+	client.setDormant(false)
+	if !waitFor(time.Second, func() bool { return relay.connections() > checks }) {
+		t.Errorf("relay checks not resumed")
+	}
+}
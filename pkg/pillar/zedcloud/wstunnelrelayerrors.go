@@ -0,0 +1,56 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// permanentRelayError tells whether err, a failure to connect to the
+// local relay, won't go away by retrying: the relay host does not
+// resolve, its address is invalid or the directory of its unix socket
+// does not exist. Refused and reset connections and timeouts are
+// temporary, as is a missing unix socket in an existing directory,
+// which the relay creates again when it restarts.
+func permanentRelayError(err error) bool {
+	var addr net.Addr
+	if opErr, ok := err.(*net.OpError); ok {
+		addr = opErr.Addr
+		err = opErr.Err
+	}
+	switch e := err.(type) {
+	case *net.DNSError:
+		return !e.IsTimeout && !e.IsTemporary
+	case *net.AddrError, *net.ParseError, net.UnknownNetworkError, net.InvalidAddrError:
+		return true
+	case *os.SyscallError:
+		err = e.Err
+	}
+	if err != syscall.ENOENT {
+		return false
+	}
+	unixAddr, ok := addr.(*net.UnixAddr)
+	if !ok {
+		return false
+	}
+	_, statErr := os.Stat(filepath.Dir(unixAddr.Name))
+	return os.IsNotExist(statErr)
+}
+
+// setRelayError records the permanent error connecting to the local
+// relay for the status, nil once a request reached it
+func (t *WSTunnelClient) setRelayError(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err != nil && t.relayErr == nil {
+		log.Errorf("Local relay %s can't be reached as configured: %v",
+			t.LocalRelayServer, err)
+	}
+	t.relayErr = err
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPermanentRelayError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dial := func(network, addr string) error {
+		conn, err := net.DialTimeout(network, addr, time.Second)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("connected to %s", addr)
+		}
+		return err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := listener.Addr().String()
+	listener.Close()
+
+	for _, test := range []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{"refused", dial("tcp", closedPort), false},
+		{"socket missing", dial("unix", filepath.Join(dir, "relay.sock")), false},
+		{"socket directory missing", dial("unix", filepath.Join(dir, "gone", "relay.sock")), true},
+		{"missing port", dial("tcp", "127.0.0.1"), true},
+		{"unknown port", dial("tcp", "127.0.0.1:nope"), true},
+		{"unknown network", dial("udx", closedPort), true},
+		{"reset", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, false},
+		{"timeout", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}, false},
+		{"no such host", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "relay.invalid"}}, true},
+		{"resolver down", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}}, false},
+		{"other", os.ErrPermission, false},
+	} {
+		if permanent := permanentRelayError(test.err); permanent != test.permanent {
+			t.Errorf("%s (%v): expected permanent %v", test.name, test.err, test.permanent)
+		}
+	}
+}
+
+func TestPermanentRelayErrorFrame(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityErrorFrames)
+	dir, err := ioutil.TempDir("", "relay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+		client.LocalRelayServer = "unix:" + filepath.Join(dir, "gone", "relay.sock")
+		client.LocalRetryDelays = []time.Duration{time.Minute}
+		client.MaxPending = 4
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	// Answered at once, neither retried nor held
+	sendRequest(t, ws, 1, "hello")
+	if frame := readFrame(t, ws); frame.id != 1 || frameErrorCode(frame) != frameErrorRelayInvalid {
+		t.Errorf("expected relay invalid error frame, got %+v", frame)
+	}
+	if status := client.Status(); status.LocalRelayError == "" {
+		t.Errorf("relay error not reported: %+v", status)
+	}
+
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	if err := client.SetLocalRelay(relay.Addr().String()); err != nil {
+		t.Fatalf("SetLocalRelay failed: %v", err)
+	}
+	sendRequest(t, ws, 2, "hello")
+	if frame := readFrame(t, ws); frame.id != 2 || frame.payload != "reply:hello" {
+		t.Errorf("expected response to request 2, got %+v", frame)
+	}
+	if status := client.Status(); status.LocalRelayError != "" {
+		t.Errorf("relay error still reported: %q", status.LocalRelayError)
+	}
+}
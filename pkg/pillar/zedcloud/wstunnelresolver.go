@@ -0,0 +1,155 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	resolverCacheTTL = 30 * time.Second
+	resolveTimeout   = 10 * time.Second
+)
+
+// HostResolver looks up the addresses of a host name. It is satisfied
+// by *net.Resolver and allows tests to supply canned answers.
+type HostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type resolvedEntry struct {
+	addrs   []net.IP
+	expires time.Time
+}
+
+// hostCache remembers successful lookups for a short time. Failures
+// are never cached so a controller moving IPs is noticed on the very
+// next attempt.
+type hostCache struct {
+	mutex   sync.Mutex
+	entries map[string]resolvedEntry
+}
+
+func (c *hostCache) get(host string) []net.IP {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[host]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry.addrs
+}
+
+func (c *hostCache) put(host string, addrs []net.IP, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]resolvedEntry)
+	}
+	c.entries[host] = resolvedEntry{addrs: addrs, expires: time.Now().Add(ttl)}
+}
+
+func (c *hostCache) flush() {
+	c.mutex.Lock()
+	c.entries = nil
+	c.mutex.Unlock()
+}
+
+// resolve returns the addresses for host, from the cache when fresh.
+// Literal IP addresses are returned as is.
+func (t *WSTunnelClient) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if addrs := t.hostCache.get(host); addrs != nil {
+		return addrs, nil
+	}
+	resolver := t.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	ipAddrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ipAddrs) == 0 {
+		return nil, fmt.Errorf("No addresses found for %s", host)
+	}
+	addrs := make([]net.IP, len(ipAddrs))
+	for i, ipAddr := range ipAddrs {
+		addrs[i] = ipAddr.IP
+	}
+	ttl := t.ResolverCacheTTL
+	if ttl == 0 {
+		ttl = resolverCacheTTL
+	}
+	t.hostCache.put(host, addrs, ttl)
+	log.Debugf("Resolved %s to %v", host, addrs)
+	return addrs, nil
+}
+
+// serverHost returns TunnelServerName without the port, if any
+func (t *WSTunnelClient) serverHost() string {
+	if host, _, err := net.SplitHostPort(t.TunnelServerName); err == nil {
+		return host
+	}
+	return t.TunnelServerName
+}
+
+// netDialFrom returns a NetDialContext function binding the connection
+// to localAddr, or leaving the source to the kernel when it is nil.
+// Host names are resolved explicitly through the client's resolver
+// and each resulting address is tried in turn.
+func (t *WSTunnelClient) netDialFrom(localAddr net.IP) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := t.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		// Not the addresses of the proxy, which is dialed here too
+		if host == t.serverHost() {
+			t.mutex.Lock()
+			t.resolvedAddrs = addrs
+			t.mutex.Unlock()
+		}
+
+		localTCPAddr := net.TCPAddr{IP: localAddr}
+		netDialer := &net.Dialer{LocalAddr: &localTCPAddr}
+		var conn net.Conn
+		for _, ip := range addrs {
+			target := net.JoinHostPort(ip.String(), port)
+			log.Debugf("Dialing %s (%s) from local address: %v", target, host, localAddr)
+			conn, err = netDialer.DialContext(ctx, network, target)
+			if err == nil {
+				go closeOnStop(ctx, conn, t.exitChan)
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// closeOnStop closes conn if exitChan is closed before the attempt
+// ctx belongs to ends, which aborts a TLS or websocket handshake that
+// would otherwise only give up at its deadline.
+func closeOnStop(ctx context.Context, conn net.Conn, exitChan chan struct{}) {
+	<-ctx.Done()
+	select {
+	case <-exitChan:
+		conn.Close()
+	default:
+	}
+}
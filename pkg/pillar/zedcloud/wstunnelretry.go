@@ -0,0 +1,195 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	reconnectDelay  = time.Second
+	stabilityWindow = time.Minute
+	// About the time the server takes to notice a lost connection and
+	// end its session
+	alreadyConnectedDelay = 90 * time.Second
+)
+
+// closeAction is what the connection loop does when a websocket ends
+type closeAction int
+
+const (
+	closeActionRetry     closeAction = iota // a failure, redial after the retry interval
+	closeActionReconnect                    // a clean close, redial after ReconnectDelay
+	closeActionStop                         // server refuses us, stop retrying
+)
+
+// DisconnectStats count why the connections to the server ended or
+// could not be opened. Only clean closes by the server don't count
+// against the retry budget.
+type DisconnectStats struct {
+	CleanCloses  uint64 // normal, going away or restart close codes
+	ReadErrors   uint64 // read failures and other close codes
+	DialFailures uint64 // failed connection attempts
+	Refusals     uint64 // policy violation close codes, which stop the client
+
+	// Handshakes rejected since the server still holds the session of
+	// an earlier connection, which don't count against the retry budget
+	AlreadyConnected uint64
+}
+
+// AlreadyConnectedError is the error of a connection attempt the server
+// rejected since it still holds the session of an earlier connection of
+// the device, typically one lost without the server noticing yet
+type AlreadyConnectedError struct {
+	Status string // of the handshake response
+	Body   string // start of the handshake response body
+}
+
+func (e *AlreadyConnectedError) Error() string {
+	return fmt.Sprintf("tunnel already established: %s -- %s", e.Status, e.Body)
+}
+
+// alreadyConnected tells whether the handshake response with status and
+// the start of body rejects the connection as already established
+func alreadyConnected(status int, body string) bool {
+	return status == http.StatusConflict ||
+		strings.Contains(strings.ToLower(body), "already connected")
+}
+
+// retryState counts the consecutive failures against the retry budget.
+// A connection lost before it stayed up for the stability window counts
+// as a failure like a failed attempt, so a server dropping connections
+// right after accepting them still exhausts the budget. Only a
+// connection up for the whole window resets the count.
+type retryState struct {
+	window      time.Duration    // stabilityWindow when zero
+	now         func() time.Time // time.Now when nil
+	failures    int
+	connectedAt time.Time // zero while not connected
+	rejectedAt  time.Time // last already connected rejection, zero once connected
+}
+
+func (r *retryState) clock() time.Time {
+	if r.now == nil {
+		return time.Now()
+	}
+	return r.now()
+}
+
+// stable tells whether the current connection is up for the window
+func (r *retryState) stable() bool {
+	window := r.window
+	if window == 0 {
+		window = stabilityWindow
+	}
+	return !r.connectedAt.IsZero() && r.clock().Sub(r.connectedAt) >= window
+}
+
+// count returns the consecutive failures
+func (r *retryState) count() int {
+	if r.stable() {
+		return 0
+	}
+	return r.failures
+}
+
+// dialFailed records a failed connection attempt
+func (r *retryState) dialFailed() {
+	r.failures++
+}
+
+// rejected records a connection attempt rejected as already connected,
+// which is not a failure
+func (r *retryState) rejected() {
+	r.rejectedAt = r.clock()
+}
+
+// delay returns how long to wait before the next attempt, what remains
+// of rejectedDelay after a rejection and interval otherwise
+func (r *retryState) delay(interval, rejectedDelay time.Duration) time.Duration {
+	if r.rejectedAt.IsZero() {
+		return interval
+	}
+	if left := rejectedDelay - r.clock().Sub(r.rejectedAt); left > interval {
+		return left
+	}
+	return interval
+}
+
+// connected records a successful connection attempt
+func (r *retryState) connected() {
+	r.connectedAt = r.clock()
+	r.rejectedAt = time.Time{}
+}
+
+// disconnected records the end of the connection, counted as a failure
+// when failure is set
+func (r *retryState) disconnected(failure bool) {
+	if r.stable() {
+		r.failures = 0
+	}
+	r.connectedAt = time.Time{}
+	if failure {
+		r.failures++
+	}
+}
+
+func (t *WSTunnelClient) alreadyConnectedDelay() time.Duration {
+	if t.AlreadyConnectedDelay == 0 {
+		return alreadyConnectedDelay
+	}
+	return t.AlreadyConnectedDelay
+}
+
+// setAlreadyConnected records whether the last attempt was rejected as
+// already connected, which is a status change
+func (t *WSTunnelClient) setAlreadyConnected(rejected bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if rejected {
+		t.retries.rejected()
+		t.stats.Disconnects.AlreadyConnected++
+	}
+	if t.sessionConflict != rejected {
+		t.sessionConflict = rejected
+		t.statusChangedLocked()
+	}
+}
+
+func (t *WSTunnelClient) reconnectDelay() time.Duration {
+	if t.ReconnectDelay == 0 {
+		return reconnectDelay
+	}
+	return t.ReconnectDelay
+}
+
+// closeActionFor classifies the error that ended a websocket
+// connection based on the close code the server sent, if any.
+func closeActionFor(err error) closeAction {
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		return closeActionRetry
+	}
+	switch closeErr.Code {
+	case websocket.CloseNormalClosure, websocket.CloseGoingAway,
+		websocket.CloseServiceRestart:
+		return closeActionReconnect
+	case websocket.ClosePolicyViolation, websocket.CloseTLSHandshake:
+		return closeActionStop
+	default:
+		return closeActionRetry
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeClock is advanced by hand
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestRetryStateFlapping(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	r := retryState{window: time.Minute, now: clock.Now}
+	r.dialFailed()
+	for i := 0; i < 3; i++ {
+		r.connected()
+		clock.advance(10 * time.Second)
+		if r.count() != i+1 {
+			t.Errorf("reset on connect: %d failures", r.count())
+		}
+		r.disconnected(true)
+	}
+	if r.count() != 4 {
+		t.Errorf("expected 4 failures, got %d", r.count())
+	}
+	// A clean close neither counts nor resets
+	r.connected()
+	clock.advance(time.Second)
+	r.disconnected(false)
+	if r.count() != 4 {
+		t.Errorf("clean close changed failures to %d", r.count())
+	}
+}
+
+func TestRetryStateRecovered(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	r := retryState{window: time.Minute, now: clock.Now}
+	r.dialFailed()
+	r.dialFailed()
+	r.connected()
+	clock.advance(59 * time.Second)
+	if r.count() != 2 {
+		t.Errorf("reset before the window: %d failures", r.count())
+	}
+	clock.advance(time.Second)
+	if r.count() != 0 {
+		t.Errorf("not reset after the window: %d failures", r.count())
+	}
+	// The loss of a stable connection is the first failure
+	r.disconnected(true)
+	if r.count() != 1 {
+		t.Errorf("expected 1 failure, got %d", r.count())
+	}
+	r.connected()
+	clock.advance(time.Hour)
+	r.disconnected(false)
+	if r.count() != 0 {
+		t.Errorf("expected no failures, got %d", r.count())
+	}
+}
+
+func TestFlappingServerExhaustsRetries(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+
+	client := newTestTunnelClient(ts)
+	client.RetryInterval = 10 * time.Millisecond
+	client.MaxRetryAttempts = 3
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	// Accept every connection and drop it right away
+	ts.onConnect = func(ws *websocket.Conn, count int) {
+		ws.UnderlyingConn().Close()
+	}
+	errChan, err := client.StartNotify()
+	if err != nil {
+		t.Fatalf("StartNotify failed: %v", err)
+	}
+	defer client.Stop()
+
+	select {
+	case err := <-errChan:
+		if _, ok := err.(*RetriesExhaustedError); !ok {
+			t.Errorf("expected retries exhausted, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("retries not exhausted: %+v", client.Status())
+	}
+	if conns := ts.connections(); len(conns) != 3 {
+		t.Errorf("expected 3 connections, got %v", conns)
+	}
+}
+
+func TestRetryStateRejected(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	r := retryState{now: clock.Now}
+	if d := r.delay(time.Second, time.Minute); d != time.Second {
+		t.Errorf("expected the retry interval, got %v", d)
+	}
+	r.rejected()
+	if r.count() != 0 {
+		t.Errorf("rejection counted as a failure")
+	}
+	if d := r.delay(time.Second, time.Minute); d != time.Minute {
+		t.Errorf("expected the rejected delay, got %v", d)
+	}
+	clock.advance(45 * time.Second)
+	if d := r.delay(time.Second, time.Minute); d != 15*time.Second {
+		t.Errorf("expected the rest of the rejected delay, got %v", d)
+	}
+	clock.advance(15 * time.Second)
+	if d := r.delay(time.Second, time.Minute); d != time.Second {
+		t.Errorf("expected the retry interval after the rejected delay, got %v", d)
+	}
+	r.rejected()
+	r.connected()
+	if d := r.delay(time.Second, time.Minute); d != time.Second {
+		t.Errorf("rejection not cleared on connect, got %v", d)
+	}
+}
+
+func TestAlreadyConnected(t *testing.T) {
+	for _, test := range []struct {
+		status int
+		body   string
+		match  bool
+	}{
+		{http.StatusConflict, "", true},
+		{http.StatusForbidden, "Device Already Connected\n", true},
+		{http.StatusForbidden, "forbidden", false},
+		{http.StatusServiceUnavailable, "", false},
+	} {
+		if match := alreadyConnected(test.status, test.body); match != test.match {
+			t.Errorf("%d %q: expected %v, got %v", test.status, test.body, test.match, match)
+		}
+	}
+}
+
+func TestAlreadyConnectedBackoff(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+
+	client := newTestTunnelClient(ts)
+	client.RetryInterval = 10 * time.Millisecond
+	client.AlreadyConnectedDelay = 300 * time.Millisecond
+	client.MaxRetryAttempts = 1
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	ts.mutex.Lock()
+	ts.rejections = 2
+	ts.mutex.Unlock()
+	start := time.Now()
+	client.Start()
+	defer client.Stop()
+
+	// The rejection is a status change
+	timeout := time.After(5 * time.Second)
+	for {
+		changed := client.StatusChanged()
+		if client.Status().AlreadyConnected {
+			break
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("no status change on the rejection: %+v", client.Status())
+		}
+	}
+	status := client.Status()
+	if !status.AlreadyConnected || status.LastDialErrorKind != DialErrorAlreadyConnected {
+		t.Errorf("rejection not reported: %+v", status)
+	}
+	ts.waitConn(t)
+	// Two rejections, neither against the retry budget of one attempt
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+		t.Errorf("connected after %v, before backing off twice", elapsed)
+	}
+	if !waitFor(2*time.Second, func() bool { return !client.Status().AlreadyConnected }) {
+		t.Errorf("rejection still reported once connected: %+v", client.Status())
+	}
+	if n := client.GetStats().Disconnects.AlreadyConnected; n != 2 {
+		t.Errorf("expected 2 rejections, got %d", n)
+	}
+}
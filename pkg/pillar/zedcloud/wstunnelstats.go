@@ -0,0 +1,306 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"encoding/binary"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	probeHistorySize = 16
+)
+
+// Upper bounds of the request latency histogram buckets, the last
+// bucket counts everything slower.
+var latencyBucketBounds = []time.Duration{
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// ProbeResult is the outcome of a single ping url probe
+type ProbeResult struct {
+	Time    time.Time
+	Success bool
+	RTT     time.Duration
+	Error   string
+}
+
+// WSTunnelStats holds the counters and measurements of a tunnel client
+type WSTunnelStats struct {
+	ProbeHistory             []ProbeResult // oldest first, at most probeHistorySize
+	ConsecutiveProbeFailures int
+	RequestsTimedOut         uint64 // requests answered with a timeout error frame
+	RequestsNoResponse       uint64 // requests never answered by the local relay
+	RequestsBusy             uint64 // requests rejected as over the inflight limit
+	Inflight                 int    // requests in flight on the current connection
+	PeakInflight             int
+	RequestLatency           LatencyHistogram
+	CompressedResponses      uint64 // responses sent gzip compressed
+	UncompressibleResponses  uint64 // responses sent as is since gzip did not shrink them
+	CompressionSavedBytes    uint64
+	WriteGiveUps             uint64 // frame writes abandoned, closing the websocket
+	StreamsOpened            uint64 // streams opened by the server
+	CorruptFrames            uint64 // frames dropped as failing their checksum
+	DuplicateRequests        uint64 // requests read again and not forwarded
+	RequestsParked           uint64 // requests held while the local relay was down
+	ResponsesTruncated       uint64 // responses cut at MaxResponseBytes
+	Ping                     PingStats
+	Disconnects              DisconnectStats
+	RelayPool                RelayPoolStats
+}
+
+// PingStats measure the round trip of the websocket pings. A ping whose
+// pong never came back is counted as missed once a later pong arrives
+// or the connection closes.
+type PingStats struct {
+	Sent        uint64
+	Received    uint64
+	Missed      uint64
+	LastRTT     time.Duration
+	MinRTT      time.Duration
+	MaxRTT      time.Duration
+	SmoothedRTT time.Duration // moving average weighing each sample by pingRTTWeight
+}
+
+// pingPayloadLen is the size of a ping payload: a big endian sequence
+// number followed by the send time in unix nanoseconds
+const pingPayloadLen = 16
+
+// pingRTTWeight is the weight of a new sample in the smoothed RTT, as in
+// the TCP SRTT
+const pingRTTWeight = 8
+
+func encodePing(seq uint64, sent time.Time) []byte {
+	payload := make([]byte, pingPayloadLen)
+	binary.BigEndian.PutUint64(payload, seq)
+	binary.BigEndian.PutUint64(payload[8:], uint64(sent.UnixNano()))
+	return payload
+}
+
+func decodePing(payload []byte) (uint64, time.Time, bool) {
+	if len(payload) != pingPayloadLen {
+		return 0, time.Time{}, false
+	}
+	seq := binary.BigEndian.Uint64(payload)
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload[8:])))
+	return seq, sent, true
+}
+
+// pingSent returns the payload of the next ping
+func (wsc *WSConnection) pingSent() []byte {
+	wsc.pingMutex.Lock()
+	wsc.pingSeq++
+	seq := wsc.pingSeq
+	wsc.pingMutex.Unlock()
+	wsc.tun.mutex.Lock()
+	wsc.tun.stats.Ping.Sent++
+	wsc.tun.mutex.Unlock()
+	return encodePing(seq, time.Now())
+}
+
+// pongReceived records the round trip of the ping whose payload came
+// back. Malformed payloads are ignored and out of order ones still give
+// an RTT sample without affecting the missed count.
+func (wsc *WSConnection) pongReceived(payload []byte) {
+	seq, sent, ok := decodePing(payload)
+	if !ok {
+		log.Debugf("Ignoring pong with malformed payload %x", payload)
+		return
+	}
+	rtt := time.Since(sent)
+	var missed uint64
+	wsc.pingMutex.Lock()
+	if seq > wsc.pingSeq {
+		// never sent
+		wsc.pingMutex.Unlock()
+		log.Debugf("Ignoring pong for unknown ping %d", seq)
+		return
+	}
+	if seq > wsc.pongSeq {
+		missed = seq - wsc.pongSeq - 1
+		wsc.pongSeq = seq
+	}
+	wsc.pingMutex.Unlock()
+
+	wsc.tun.mutex.Lock()
+	defer wsc.tun.mutex.Unlock()
+	stats := &wsc.tun.stats.Ping
+	stats.Missed += missed
+	if rtt < 0 {
+		// the clock was stepped back
+		return
+	}
+	stats.Received++
+	stats.LastRTT = rtt
+	if stats.Received == 1 || rtt < stats.MinRTT {
+		stats.MinRTT = rtt
+	}
+	if rtt > stats.MaxRTT {
+		stats.MaxRTT = rtt
+	}
+	if stats.SmoothedRTT == 0 {
+		stats.SmoothedRTT = rtt
+	} else {
+		stats.SmoothedRTT += (rtt - stats.SmoothedRTT) / pingRTTWeight
+	}
+}
+
+// pingsEnded counts the pings still unanswered when the pinger ends
+func (wsc *WSConnection) pingsEnded() {
+	wsc.pingMutex.Lock()
+	missed := wsc.pingSeq - wsc.pongSeq
+	wsc.pongSeq = wsc.pingSeq
+	wsc.pingMutex.Unlock()
+	wsc.tun.mutex.Lock()
+	wsc.tun.stats.Ping.Missed += missed
+	wsc.tun.mutex.Unlock()
+}
+
+// LatencyHistogram accumulates the time from reading a request off
+// the websocket to writing its response back.
+type LatencyHistogram struct {
+	Buckets [5]uint64 // counts per latencyBucketBounds, then slower
+	Count   uint64
+	Min     time.Duration
+	Max     time.Duration
+	Total   time.Duration
+}
+
+// Avg returns the mean latency, zero without samples
+func (h LatencyHistogram) Avg() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(h.Count)
+}
+
+func (h *LatencyHistogram) add(latency time.Duration) {
+	bucket := len(latencyBucketBounds)
+	for i, bound := range latencyBucketBounds {
+		if latency < bound {
+			bucket = i
+			break
+		}
+	}
+	h.Buckets[bucket]++
+	if h.Count == 0 || latency < h.Min {
+		h.Min = latency
+	}
+	if latency > h.Max {
+		h.Max = latency
+	}
+	h.Count++
+	h.Total += latency
+}
+
+// GetStats returns a copy of the tunnel client statistics
+func (t *WSTunnelClient) GetStats() WSTunnelStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	stats := t.stats
+	stats.ProbeHistory = append([]ProbeResult{}, t.stats.ProbeHistory...)
+	stats.RelayPool = t.relayPool().stats()
+	return stats
+}
+
+// recordProbe adds result to the probe history and returns the number
+// of consecutive failures including this one.
+func (t *WSTunnelClient) recordProbe(result ProbeResult) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	history := append(t.stats.ProbeHistory, result)
+	if len(history) > probeHistorySize {
+		history = history[len(history)-probeHistorySize:]
+	}
+	t.stats.ProbeHistory = history
+	if result.Success {
+		t.stats.ConsecutiveProbeFailures = 0
+	} else {
+		t.stats.ConsecutiveProbeFailures++
+	}
+	return t.stats.ConsecutiveProbeFailures
+}
+
+// requestRead notes when request id was read off the websocket
+func (wsc *WSConnection) requestRead(id requestID) {
+	wsc.pendingMutex.Lock()
+	wsc.pending[id] = time.Now()
+	wsc.pendingMutex.Unlock()
+}
+
+// responseWritten records the latency of request id once its response
+// has been written back.
+func (wsc *WSConnection) responseWritten(id requestID) {
+	wsc.pendingMutex.Lock()
+	start, ok := wsc.pending[id]
+	delete(wsc.pending, id)
+	wsc.pendingMutex.Unlock()
+	if !ok {
+		return
+	}
+	wsc.requestSeen()
+	wsc.admitQueued()
+	latency := time.Since(start)
+	wsc.tun.mutex.Lock()
+	wsc.tun.stats.RequestLatency.add(latency)
+	wsc.tun.mutex.Unlock()
+}
+
+// requestFinished forgets request id without a latency sample, counting
+// it as unanswered when noResponse is set.
+func (wsc *WSConnection) requestFinished(id requestID, noResponse bool) {
+	wsc.pendingMutex.Lock()
+	_, ok := wsc.pending[id]
+	delete(wsc.pending, id)
+	wsc.pendingMutex.Unlock()
+	if ok {
+		wsc.requestSeen()
+		wsc.admitQueued()
+	}
+	if ok && noResponse {
+		wsc.tun.mutex.Lock()
+		wsc.tun.stats.RequestsNoResponse++
+		wsc.tun.mutex.Unlock()
+	}
+}
+
+// drain waits up to timeout for the requests in flight to be answered,
+// or for the websocket read loop to end
+func (wsc *WSConnection) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		wsc.pendingMutex.Lock()
+		pending := len(wsc.pending)
+		wsc.pendingMutex.Unlock()
+		if pending == 0 {
+			return
+		}
+		select {
+		case <-wsc.done:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// abandonRequests counts the requests still waiting for a response
+// when the websocket connection closes as unanswered.
+func (wsc *WSConnection) abandonRequests() {
+	wsc.pendingMutex.Lock()
+	abandoned := len(wsc.pending)
+	wsc.pending = make(map[requestID]time.Time)
+	wsc.queued = nil
+	wsc.pendingMutex.Unlock()
+	wsc.inflightChanged(0, false)
+	if abandoned != 0 {
+		wsc.tun.mutex.Lock()
+		wsc.tun.stats.RequestsNoResponse += uint64(abandoned)
+		wsc.tun.mutex.Unlock()
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h LatencyHistogram
+	for _, latency := range []time.Duration{
+		time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond,
+		time.Second, 11 * time.Second,
+	} {
+		h.add(latency)
+	}
+	if h.Buckets != [5]uint64{1, 2, 0, 1, 1} {
+		t.Errorf("unexpected buckets %v", h.Buckets)
+	}
+	if h.Count != 5 || h.Min != time.Millisecond || h.Max != 11*time.Second {
+		t.Errorf("unexpected count/min/max %d/%v/%v", h.Count, h.Min, h.Max)
+	}
+	if avg := h.Avg(); avg != h.Total/5 {
+		t.Errorf("unexpected average %v", avg)
+	}
+	if (LatencyHistogram{}).Avg() != 0 {
+		t.Errorf("average without samples")
+	}
+}
+
+func TestRequestLatency(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	relay := newTestRelay(t, func(req string) []byte {
+		time.Sleep(150 * time.Millisecond)
+		return echoRelay(req)
+	})
+	defer relay.Close()
+	client := startTestTunnel(t, ts, relay, nil)
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	for id := 1; id <= 2; id++ {
+		sendRequest(t, ws, id, "slow")
+		if frame := readFrame(t, ws); frame.id != id {
+			t.Fatalf("unexpected response %+v", frame)
+		}
+	}
+	if !waitFor(time.Second, func() bool {
+		return client.GetStats().RequestLatency.Count == 2
+	}) {
+		t.Fatalf("latency not recorded: %+v", client.GetStats().RequestLatency)
+	}
+	latency := client.GetStats().RequestLatency
+	if latency.Buckets != [5]uint64{0, 0, 2, 0, 0} {
+		t.Errorf("samples in unexpected buckets %v", latency.Buckets)
+	}
+	if latency.Min < 150*time.Millisecond || latency.Avg() < latency.Min ||
+		latency.Max < latency.Avg() {
+		t.Errorf("unexpected min/avg/max %v/%v/%v",
+			latency.Min, latency.Avg(), latency.Max)
+	}
+	if stats := client.GetStats(); stats.RequestsNoResponse != 0 {
+		t.Errorf("unexpected unanswered requests %d", stats.RequestsNoResponse)
+	}
+}
+
+func TestRequestNoResponse(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	relay := newTestRelay(t, func(req string) []byte { return nil })
+	defer relay.Close()
+	client := startTestTunnel(t, ts, relay, func(client *WSTunnelClient) {
+		client.RequestTimeout = 5 * time.Second
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	// The connection closes while the relay is still silent
+	sendRequest(t, ws, 1, "lost")
+	if !waitFor(5*time.Second, func() bool { return len(relay.requests()) == 1 }) {
+		t.Fatalf("request not relayed")
+	}
+	ts.dropAll()
+	if !waitFor(5*time.Second, func() bool {
+		return client.GetStats().RequestsNoResponse == 1
+	}) {
+		t.Errorf("unanswered request not counted: %+v", client.GetStats())
+	}
+	if count := client.GetStats().RequestLatency.Count; count != 0 {
+		t.Errorf("unexpected latency samples %d", count)
+	}
+}
+
+func TestPingRTT(t *testing.T) {
+	const delay = 20 * time.Millisecond
+	client := newFakeTunnel()
+	defer close(client.exitChan)
+	client.Timeout = 150 * time.Millisecond
+
+	ws := newFakeWSConn()
+	ws.echoPongs = true
+	ws.pongDelay = delay
+	wsc := newWSConnection(ws, client)
+	go wsc.pinger()
+	if !waitFor(5*time.Second, func() bool { return client.GetStats().Ping.Received >= 3 }) {
+		t.Fatalf("no pongs: %+v", client.GetStats().Ping)
+	}
+	ws.Close()
+
+	stats := client.GetStats().Ping
+	if stats.MinRTT < delay || stats.MaxRTT < stats.MinRTT ||
+		stats.LastRTT < delay || stats.SmoothedRTT < delay ||
+		stats.SmoothedRTT > stats.MaxRTT || stats.Sent < stats.Received {
+		t.Errorf("unexpected ping stats %+v", stats)
+	}
+}
+
+func TestPongPayloads(t *testing.T) {
+	client := newFakeTunnel()
+	defer close(client.exitChan)
+	wsc := newWSConnection(newFakeWSConn(), client)
+
+	var payloads [][]byte
+	for i := 0; i < 4; i++ {
+		payloads = append(payloads, wsc.pingSent())
+	}
+	wsc.pongReceived(nil)
+	wsc.pongReceived([]byte("garbage"))
+	wsc.pongReceived(encodePing(10, time.Now())) // never sent
+	wsc.pongReceived(payloads[1])                // the first one is missed
+	wsc.pongReceived(payloads[0])                // out of order
+	wsc.pongReceived(payloads[3])                // the third one is missed
+	stats := client.GetStats().Ping
+	if stats.Sent != 4 || stats.Received != 3 || stats.Missed != 2 {
+		t.Errorf("unexpected ping stats %+v", stats)
+	}
+
+	// Pings unanswered when the connection ends are missed
+	wsc.pingSent()
+	wsc.pingsEnded()
+	if missed := client.GetStats().Ping.Missed; missed != 3 {
+		t.Errorf("expected 3 missed pings, got %d", missed)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	streamBufferSize      = 32 * 1024
+	minResponseBufferSize = 4 * 1024
+	maxPooledBuffer       = 4 * 1024 * 1024 // larger gzip staging buffers are not reused
+)
+
+// Staging buffers of the response path, reused across requests
+var (
+	copyBuffers  = sync.Pool{New: func() interface{} { return new([]byte) }}
+	gzipBuffers  = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	chunkBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+)
+
+// validateResponseBufferSize checks the ResponseBufferSize setting
+func validateResponseBufferSize(size int) error {
+	if size != 0 && (size < minResponseBufferSize || size > wsReadLimit) {
+		return fmt.Errorf("Response buffer size %d not between %d and %d bytes",
+			size, minResponseBufferSize, wsReadLimit)
+	}
+	return nil
+}
+
+func (t *WSTunnelClient) responseBufferSize() int {
+	if t.ResponseBufferSize == 0 {
+		return streamBufferSize
+	}
+	return t.ResponseBufferSize
+}
+
+// getBuffer returns a buffer of size bytes from pool
+func getBuffer(pool *sync.Pool, size int) *[]byte {
+	buf := pool.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, size)
+	}
+	*buf = (*buf)[:size]
+	return buf
+}
+
+// quietReader ends the stream of a response at the first error, which
+// is usually the read deadline expiring once the relay went quiet
+type quietReader struct {
+	r      io.Reader
+	closed bool // the relay closed its side
+}
+
+func (q *quietReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	if err == io.EOF {
+		q.closed = true
+	} else if err != nil {
+		log.Debugf("Response from local relay ends: %v", err)
+		err = io.EOF
+	}
+	return n, err
+}
+
+// finalFlags returns the flags final gives the last frame of a response
+func finalFlags(final func() int) int {
+	if final == nil {
+		return 0
+	}
+	return final()
+}
+
+// streamResponse forwards the response read from r on the websocket.
+// Without flags in the frames it is copied straight into a single
+// frame, and with chunked responses it is sent chunk by chunk as it
+// comes. Only gzip compression, or flags without chunks, need the whole
+// response at once. Once r is drained final, which may be nil, returns
+// the flags of the last frame.
+func (wsc *WSConnection) streamResponse(id requestID, r io.Reader, final func() int) {
+	wsc.writeMutex.Lock()
+	defer wsc.writeMutex.Unlock()
+
+	switch {
+	case wsc.caps[capabilityGzip] ||
+		wsc.caps.framesHaveFlags() && !wsc.caps[capabilityChunked]:
+		buf := gzipBuffers.Get().(*bytes.Buffer)
+		buf.Reset()
+		buf.ReadFrom(r)
+		wsc.writeResponseLocked(id, buf.Bytes(), finalFlags(final))
+		if buf.Cap() <= maxPooledBuffer {
+			gzipBuffers.Put(buf)
+		}
+	case wsc.caps[capabilityChunked]:
+		if wsc.streamChunks(id, r, wsc.tun.settings().maxFrameSize, final) {
+			wsc.responseWritten(id)
+		}
+	default:
+		if wsc.streamFrame(id, formatFrameID(id, wsc.caps.idLen()), r) {
+			wsc.responseWritten(id)
+		}
+	}
+}
+
+// streamFrame copies r into a single binary frame following header.
+// As with writeDataFrame any failure closes the websocket.
+func (wsc *WSConnection) streamFrame(id requestID, header string, r io.Reader) bool {
+	buf := getBuffer(&copyBuffers, streamBufferSize)
+	defer copyBuffers.Put(buf)
+	var kept *keptFrame
+	if wsc.inflightEntry(id) != nil {
+		kept = &keptFrame{}
+		r = io.TeeReader(r, kept)
+	}
+	var written int64
+	err := func() error {
+		wsc.ws.SetWriteDeadline(time.Now().Add(time.Minute))
+		next, err := wsc.ws.NextWriter(websocket.BinaryMessage)
+		if err != nil {
+			return err
+		}
+		writer := wsc.frameWriter(next, websocket.BinaryMessage)
+		if _, err := io.WriteString(writer, header); err != nil {
+			return err
+		}
+		// Read errors end the response, so an error is a write error
+		if written, err = io.CopyBuffer(writer, r, *buf); err != nil {
+			return err
+		}
+		return writer.Close()
+	}()
+	if err != nil {
+		log.Errorf("[id=%d] WS cannot write frame: %s", id, err.Error())
+		wsc.tun.mutex.Lock()
+		wsc.tun.stats.WriteGiveUps++
+		wsc.tun.mutex.Unlock()
+		wsc.ws.Close()
+		return false
+	}
+	log.Debugf("[id=%d] Completed writing frame of length: %d", id, written)
+	wsc.counters.frameWritten(int(written))
+	if kept != nil {
+		wsc.keepStreamed(id, header, kept)
+	}
+	return true
+}
+
+// streamChunks sends r in frames of at most chunkSize bytes, reading a
+// chunk ahead to tell whether more follow
+func (wsc *WSConnection) streamChunks(id requestID, r io.Reader, chunkSize int,
+	final func() int) bool {
+	cur := getBuffer(&chunkBuffers, chunkSize)
+	defer chunkBuffers.Put(cur)
+	next := getBuffer(&chunkBuffers, chunkSize)
+	defer chunkBuffers.Put(next)
+
+	chunk, ahead := *cur, *next
+	n, _ := io.ReadFull(r, chunk)
+	for seq := 0; ; seq++ {
+		more := 0
+		if n == chunkSize {
+			more, _ = io.ReadFull(r, ahead)
+		}
+		flags := 0
+		if more > 0 {
+			flags |= frameFlagMore
+		} else {
+			flags |= finalFlags(final)
+		}
+		header := formatFrameID(id, wsc.caps.idLen()) +
+			fmt.Sprintf("%02x%04x", flags, uint16(seq))
+		if !wsc.writeDataFrame(id, header, chunk[:n]) {
+			return false
+		}
+		if more == 0 {
+			return true
+		}
+		chunk, ahead = ahead, chunk
+		n = more
+	}
+}
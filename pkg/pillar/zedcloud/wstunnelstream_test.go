@@ -0,0 +1,205 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// piecemealRelay answers every request with response, written in
+// random pieces with short pauses in between
+func piecemealRelay(t *testing.T, response []byte) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				if _, err := conn.Read(buf); err != nil {
+					return
+				}
+				rest := response
+				for len(rest) > 0 {
+					n := 1 + rand.Intn(100*1024)
+					if n > len(rest) {
+						n = len(rest)
+					}
+					conn.Write(rest[:n])
+					rest = rest[n:]
+					time.Sleep(time.Millisecond)
+				}
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+func TestStreamedResponseIntegrity(t *testing.T) {
+	response := make([]byte, 1024*1024+123)
+	rand.Read(response)
+	relay := piecemealRelay(t, response)
+	defer relay.Close()
+
+	for _, caps := range []string{"", capabilityChunked} {
+		ts := newTestTunnelServer(t)
+		ts.setCapabilities(caps)
+		client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+			client.LocalRelayServer = relay.Addr().String()
+		})
+		ws := ts.waitConn(t)
+
+		sendRequest(t, ws, 1, "get")
+		var received []byte
+		if caps == capabilityChunked {
+			var frames int
+			received, frames = readChunkedResponse(t, ws, 1)
+			if expected := len(response)/maxFrameSize + 1; frames != expected {
+				t.Errorf("expected %d frames, got %d", expected, frames)
+			}
+		} else {
+			received = []byte(readFrame(t, ws).payload)
+		}
+		if !bytes.Equal(received, response) {
+			t.Errorf("%q: received %d bytes differing from the %d sent",
+				caps, len(received), len(response))
+		}
+		client.Stop()
+		ts.Close()
+	}
+}
+
+// discardWSConn is a websocket discarding everything written
+type discardWSConn struct {
+	fakeWSConn
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (c *discardWSConn) NextWriter(int) (io.WriteCloser, error) {
+	return nopWriteCloser{ioutil.Discard}, nil
+}
+
+func benchmarkConn() *WSConnection {
+	return newWSConnection(&discardWSConn{*newFakeWSConn()}, newFakeTunnel())
+}
+
+// BenchmarkResponseBuffered measures the former response path, reading
+// the whole response in memory before writing it
+func BenchmarkResponseBuffered(b *testing.B) {
+	response := make([]byte, 1024*1024)
+	wsc := benchmarkConn()
+	defer close(wsc.tun.exitChan)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := bytes.NewReader(response)
+		responseBuffer := make([]byte, 524288)
+		num, _ := r.Read(responseBuffer)
+		rest, _ := ioutil.ReadAll(r)
+		wsc.writeResponseMessage(1, bytes.NewBuffer(append(responseBuffer[:num], rest...)))
+	}
+}
+
+func BenchmarkResponseStreamed(b *testing.B) {
+	response := make([]byte, 1024*1024)
+	wsc := benchmarkConn()
+	defer close(wsc.tun.exitChan)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		wsc.streamResponse(1, &quietReader{r: bytes.NewReader(response)}, nil)
+	}
+}
+
+func BenchmarkResponseStreamedChunked(b *testing.B) {
+	response := make([]byte, 1024*1024)
+	wsc := benchmarkConn()
+	defer close(wsc.tun.exitChan)
+	wsc.caps[capabilityChunked] = true
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		wsc.streamResponse(1, &quietReader{r: bytes.NewReader(response)}, nil)
+	}
+}
+
+func TestResponseBufferSize(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+
+	client := newTestTunnelClient(ts)
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	if size := client.Status().ResponseBufferSize; size != streamBufferSize {
+		t.Errorf("default response buffer size %d, expected %d", size, streamBufferSize)
+	}
+	for _, size := range []int{minResponseBufferSize - 1, wsReadLimit + 1} {
+		client.ResponseBufferSize = size
+		if _, err := client.StartNotify(); err == nil {
+			client.Stop()
+			t.Fatalf("started with a response buffer size of %d", size)
+		}
+	}
+	client.ResponseBufferSize = 8192
+	if size := client.Status().ResponseBufferSize; size != 8192 {
+		t.Errorf("response buffer size %d, expected 8192", size)
+	}
+}
+
+// smallResponseConn is a local relay connection answering a small
+// response before closing
+type smallResponseConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (c *smallResponseConn) Read(p []byte) (int, error)      { return c.r.Read(p) }
+func (c *smallResponseConn) SetReadDeadline(time.Time) error { return nil }
+
+// BenchmarkSmallResponsesUnpooled measures the former small response
+// path, allocating the 512KB read buffer for each response
+func BenchmarkSmallResponsesUnpooled(b *testing.B) {
+	response := make([]byte, 512)
+	wsc := benchmarkConn()
+	defer close(wsc.tun.exitChan)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r := bytes.NewReader(response)
+		responseBuffer := make([]byte, 524288)
+		num, _ := r.Read(responseBuffer)
+		wsc.streamResponse(1, bytes.NewReader(responseBuffer[:num]), nil)
+	}
+}
+
+func BenchmarkSmallResponses(b *testing.B) {
+	for _, size := range []int{minResponseBufferSize, streamBufferSize, 524288} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			response := make([]byte, 512)
+			wsc := benchmarkConn()
+			defer close(wsc.tun.exitChan)
+			wsc.tun.ResponseBufferSize = size
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				conn := &relayConn{Conn: &smallResponseConn{r: bytes.NewReader(response)}}
+				wsc.processResponse(1, conn)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// With the streams capability the websocket also carries streams, long
+// lived byte streams for interactive protocols such as ssh or VNC, side
+// by side with the requests. Stream frames are binary frames in both
+// directions starting with streamFramePrefix, which can't start a
+// request id, then 8 hex digits of the stream id and 2 hex digits of
+// the operation. The server opens a stream, which the client maps to a
+// fresh connection to the local relay, data frames carry the bytes as
+// they come both ways, and either side closes it, the client with the
+// reason as payload of the close frame.
+const (
+	streamFramePrefix = 's'
+	streamWriteQueue  = 64 // data frames waiting to be written to a stream
+)
+
+// Operations of the stream frames
+const (
+	streamOpData  = 0x00
+	streamOpOpen  = 0x01
+	streamOpClose = 0x02
+)
+
+// streamID identifies a stream on the websocket
+type streamID uint32
+
+// tunnelStream is a stream opened by the server and the connection to
+// the local relay it is mapped to
+type tunnelStream struct {
+	id     streamID
+	writes chan []byte   // data for the relay, closed when the server closes the stream
+	ended  chan struct{} // closed once the stream is removed
+	conn   net.Conn      // nil until connected, under streamsMutex
+}
+
+// handleStreamFrame handles a stream frame read off the websocket
+// after its prefix. It returns an error when the frame can't be read,
+// closing the websocket when it is malformed.
+func (wsc *WSConnection) handleStreamFrame(r io.Reader) error {
+	id, err := readFrameID(r, wideFrameIDLen)
+	if err == nil {
+		var op int
+		if op, err = readFrameFlags(r); err == nil {
+			err = wsc.streamOperation(streamID(id), op, r)
+		}
+	}
+	switch err.(type) {
+	case *frameHeaderError, *streamError:
+		wsc.closeWithCode(websocket.CloseProtocolError, err.Error())
+	}
+	return err
+}
+
+// streamError reports a stream frame the stream can't accept
+type streamError struct {
+	id  streamID
+	err string
+}
+
+func (e *streamError) Error() string {
+	return fmt.Sprintf("stream %d: %s", e.id, e.err)
+}
+
+// streamOperation applies op to stream sid, with the payload read from r
+func (wsc *WSConnection) streamOperation(sid streamID, op int, r io.Reader) error {
+	payload, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	wsc.requestSeen()
+	switch op {
+	case streamOpOpen:
+		return wsc.openStream(sid)
+	case streamOpData:
+		wsc.streamsMutex.Lock()
+		stream := wsc.streams[sid]
+		wsc.streamsMutex.Unlock()
+		if stream == nil {
+			log.Debugf("[stream=%d] Dropping %d bytes for a closed stream", sid, len(payload))
+			return nil
+		}
+		select {
+		case stream.writes <- payload:
+		case <-stream.ended:
+		case <-wsc.tun.exitChan:
+		}
+	case streamOpClose:
+		wsc.streamsMutex.Lock()
+		stream := wsc.streams[sid]
+		delete(wsc.streams, sid)
+		wsc.streamsMutex.Unlock()
+		if stream != nil {
+			log.Debugf("[stream=%d] Closed by the server", sid)
+			// The relay connection closes once the writes are flushed
+			close(stream.writes)
+		}
+	default:
+		return &streamError{id: sid, err: fmt.Sprintf("unknown operation %02x", op)}
+	}
+	return nil
+}
+
+// openStream opens stream id to the local relay
+func (wsc *WSConnection) openStream(id streamID) error {
+	stream := &tunnelStream{
+		id:     id,
+		writes: make(chan []byte, streamWriteQueue),
+		ended:  make(chan struct{}),
+	}
+	wsc.streamsMutex.Lock()
+	if _, ok := wsc.streams[id]; ok {
+		wsc.streamsMutex.Unlock()
+		return &streamError{id: id, err: "already open"}
+	}
+	wsc.streams[id] = stream
+	wsc.streamsMutex.Unlock()
+	wsc.tun.mutex.Lock()
+	wsc.tun.stats.StreamsOpened++
+	wsc.tun.mutex.Unlock()
+	wsc.tun.wg.Add(1)
+	go func() {
+		defer wsc.tun.wg.Done()
+		wsc.runStream(stream)
+	}()
+	return nil
+}
+
+// runStream connects stream to the local relay and writes the data
+// from the server to it while relayStream sends back what it reads
+func (wsc *WSConnection) runStream(stream *tunnelStream) {
+	target := wsc.tun.localRelay()
+	if !wsc.tun.destinationAllowed(target) {
+		log.Errorf("[stream=%d] Security: denied tunnel stream to local destination %s, not in the allowed destinations",
+			stream.id, target)
+		wsc.endStream(stream, fmt.Sprintf("local destination %s not allowed", target))
+		return
+	}
+	conn, err := wsc.tun.dialLocal(target)
+	if err != nil {
+		wsc.endStream(stream, fmt.Sprintf("connecting to local relay: %v", err))
+		return
+	}
+	wsc.streamsMutex.Lock()
+	stream.conn = conn
+	wsc.streamsMutex.Unlock()
+	select {
+	case <-stream.ended:
+		// The websocket closed meanwhile
+		conn.Close()
+		return
+	default:
+	}
+	log.Debugf("[stream=%d] Connected to local relay %s", stream.id, target)
+	wsc.tun.wg.Add(1)
+	go func() {
+		defer wsc.tun.wg.Done()
+		wsc.relayStream(stream, conn)
+	}()
+
+	for {
+		select {
+		case data, ok := <-stream.writes:
+			if !ok {
+				wsc.endStream(stream, "")
+				conn.Close()
+				return
+			}
+			if _, err := conn.Write(data); err != nil {
+				wsc.endStream(stream, fmt.Sprintf("writing to local relay: %v", err))
+				conn.Close()
+				return
+			}
+		case <-stream.ended:
+			return
+		}
+	}
+}
+
+// relayStream sends what the local relay writes to stream in data
+// frames until the relay closes it
+func (wsc *WSConnection) relayStream(stream *tunnelStream, conn net.Conn) {
+	buf := getBuffer(&copyBuffers, streamBufferSize)
+	defer copyBuffers.Put(buf)
+	for {
+		n, err := conn.Read(*buf)
+		if n > 0 && !wsc.writeStreamFrame(stream.id, streamOpData, (*buf)[:n]) {
+			err = fmt.Errorf("websocket closed")
+		}
+		if err != nil {
+			reason := ""
+			if err != io.EOF {
+				reason = fmt.Sprintf("reading from local relay: %v", err)
+			}
+			wsc.endStream(stream, reason)
+			conn.Close()
+			return
+		}
+	}
+}
+
+// endStream removes stream, telling the server unless it closed the
+// stream itself. It does nothing once the stream ended.
+func (wsc *WSConnection) endStream(stream *tunnelStream, reason string) {
+	wsc.streamsMutex.Lock()
+	select {
+	case <-stream.ended:
+		wsc.streamsMutex.Unlock()
+		return
+	default:
+	}
+	close(stream.ended)
+	_, open := wsc.streams[stream.id]
+	delete(wsc.streams, stream.id)
+	wsc.streamsMutex.Unlock()
+	wsc.requestSeen()
+	if !open {
+		return
+	}
+	if reason != "" {
+		log.Errorf("[stream=%d] Closing stream: %s", stream.id, reason)
+	} else {
+		log.Debugf("[stream=%d] Closed by the local relay", stream.id)
+	}
+	wsc.writeStreamFrame(stream.id, streamOpClose, []byte(reason))
+}
+
+// closeStreams ends all the streams when the websocket closes
+func (wsc *WSConnection) closeStreams() {
+	wsc.streamsMutex.Lock()
+	var streams []*tunnelStream
+	for _, stream := range wsc.streams {
+		streams = append(streams, stream)
+	}
+	wsc.streams = make(map[streamID]*tunnelStream)
+	wsc.streamsMutex.Unlock()
+	for _, stream := range streams {
+		wsc.endStream(stream, "")
+		wsc.streamsMutex.Lock()
+		conn := stream.conn
+		wsc.streamsMutex.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// activeStreams returns the number of open streams
+func (wsc *WSConnection) activeStreams() int {
+	wsc.streamsMutex.Lock()
+	defer wsc.streamsMutex.Unlock()
+	return len(wsc.streams)
+}
+
+// writeStreamFrame sends a stream frame with op and payload
+func (wsc *WSConnection) writeStreamFrame(id streamID, op int, payload []byte) bool {
+	wsc.writeMutex.Lock()
+	defer wsc.writeMutex.Unlock()
+	header := fmt.Sprintf("%c%08x%02x", streamFramePrefix, uint32(id), op)
+	return wsc.writeDataFrame(requestID(id), header, payload)
+}
+
+// isStreamFrame reads the first byte of a binary frame and tells whether
+// it is a stream frame, otherwise returning the reader of the whole
+// frame
+func isStreamFrame(r io.Reader) (bool, io.Reader, error) {
+	prefix := make([]byte, 1)
+	n, err := io.ReadFull(r, prefix)
+	if err != nil && err != io.EOF {
+		return false, nil, err
+	}
+	if n == 1 && prefix[0] == streamFramePrefix {
+		return true, r, nil
+	}
+	return false, io.MultiReader(bytes.NewReader(prefix[:n]), r), nil
+}
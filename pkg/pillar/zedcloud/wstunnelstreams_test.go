@@ -0,0 +1,198 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamEchoRelay serves listener with a fake local relay echoing back
+// the bytes of each connection until it is closed
+func streamEchoRelay(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}(conn)
+	}
+}
+
+// sendStreamFrame sends a stream frame from the fake server
+func sendStreamFrame(t *testing.T, ws *websocket.Conn, id int, op int, payload string) {
+	err := ws.WriteMessage(websocket.BinaryMessage,
+		[]byte(fmt.Sprintf("s%08x%02x%s", id, op, payload)))
+	if err != nil {
+		t.Fatalf("write stream frame %d failed: %v", id, err)
+	}
+}
+
+// testStreamFrame is a stream frame received by the fake server
+type testStreamFrame struct {
+	id      int
+	op      int
+	payload string
+}
+
+// readStreamFrame reads the next stream frame the client sent
+func readStreamFrame(t *testing.T, ws *websocket.Conn) testStreamFrame {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read stream frame failed: %v", err)
+	}
+	if messageType != websocket.BinaryMessage || len(data) < 11 ||
+		data[0] != streamFramePrefix {
+		t.Fatalf("expected a stream frame, got %d %q", messageType, data)
+	}
+	return parseStreamFrame(t, data)
+}
+
+func parseStreamFrame(t *testing.T, data []byte) testStreamFrame {
+	var frame testStreamFrame
+	if _, err := fmt.Sscanf(string(data[1:11]), "%08x%02x", &frame.id, &frame.op); err != nil {
+		t.Fatalf("bad stream frame header %q: %v", data, err)
+	}
+	frame.payload = string(data[11:])
+	return frame
+}
+
+func TestInterleavedStreams(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go streamEchoRelay(listener)
+
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityStreams)
+	client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+		client.LocalRelayServer = listener.Addr().String()
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	sendStreamFrame(t, ws, 1, streamOpOpen, "")
+	sendStreamFrame(t, ws, 2, streamOpOpen, "")
+	sent := map[int]string{}
+	for i := 0; i < 20; i++ {
+		id := 1 + i%2
+		data := fmt.Sprintf("%d:%d,", id, i)
+		sendStreamFrame(t, ws, id, streamOpData, data)
+		sent[id] += data
+	}
+	// Requests still work side by side
+	sendRequest(t, ws, 3, "hello")
+
+	received := map[int]string{}
+	response := ""
+	for received[1] != sent[1] || received[2] != sent[2] || response == "" {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("read frame failed: %v", err)
+		}
+		if data[0] != streamFramePrefix {
+			response = string(data)
+			continue
+		}
+		frame := parseStreamFrame(t, data)
+		if frame.op != streamOpData {
+			t.Fatalf("unexpected stream frame %+v", frame)
+		}
+		received[frame.id] += frame.payload
+		if !strings.HasPrefix(sent[frame.id], received[frame.id]) {
+			t.Fatalf("stream %d: expected %q, got %q", frame.id, sent[frame.id],
+				received[frame.id])
+		}
+	}
+	if response != "0003hello" {
+		t.Errorf("expected the echoed request, got %q", response)
+	}
+
+	// Closed by the server, the stream takes no more data
+	sendStreamFrame(t, ws, 1, streamOpClose, "")
+	sendStreamFrame(t, ws, 1, streamOpData, "late")
+	sendStreamFrame(t, ws, 2, streamOpData, "more")
+	if frame := readStreamFrame(t, ws); frame.id != 2 || frame.payload != "more" {
+		t.Errorf("expected more data on stream 2 only, got %+v", frame)
+	}
+	if opened := client.GetStats().StreamsOpened; opened != 2 {
+		t.Errorf("expected 2 streams opened, got %d", opened)
+	}
+}
+
+func TestStreamClosedByRelay(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		// Says goodbye and hangs up
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Write([]byte("bye"))
+			conn.Close()
+		}
+	}()
+
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityStreams)
+	client := startTestTunnel(t, ts, nil, func(client *WSTunnelClient) {
+		client.LocalRelayServer = listener.Addr().String()
+	})
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	sendStreamFrame(t, ws, 7, streamOpOpen, "")
+	if frame := readStreamFrame(t, ws); frame.id != 7 || frame.op != streamOpData ||
+		frame.payload != "bye" {
+		t.Errorf("expected data on stream 7, got %+v", frame)
+	}
+	if frame := readStreamFrame(t, ws); frame.id != 7 || frame.op != streamOpClose ||
+		frame.payload != "" {
+		t.Errorf("expected clean close of stream 7, got %+v", frame)
+	}
+
+	// Nothing listens anymore, the next stream is closed with the reason
+	listener.Close()
+	sendStreamFrame(t, ws, 8, streamOpOpen, "")
+	if frame := readStreamFrame(t, ws); frame.id != 8 || frame.op != streamOpClose ||
+		!strings.Contains(frame.payload, "connecting to local relay") {
+		t.Errorf("expected stream 8 closed with the reason, got %+v", frame)
+	}
+}
+
+func TestDuplicateStream(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+	ts.setCapabilities(capabilityStreams)
+	relay := newTestRelay(t, echoRelay)
+	defer relay.Close()
+	client := startTestTunnel(t, ts, relay, nil)
+	defer client.Stop()
+	ws := ts.waitConn(t)
+
+	sendStreamFrame(t, ws, 1, streamOpOpen, "")
+	sendStreamFrame(t, ws, 1, streamOpOpen, "")
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+		t.Errorf("expected protocol error close, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	certExpiryWarning = 30 * 24 * time.Hour
+)
+
+// TLSDetails describes what the TLS handshake of the tunnel connection
+// negotiated. Version and CipherSuite hold the crypto/tls constants.
+type TLSDetails struct {
+	Version      uint16
+	CipherSuite  uint16
+	ALPN         string    // negotiated application protocol, if any
+	LeafSHA256   string    // hex SHA-256 fingerprint of the server certificate
+	LeafNotAfter time.Time // expiry of the server certificate
+	Chain        []string  // subjects of the presented certificates, leaf first
+}
+
+// tlsDetails returns the negotiated TLS details of ws, nil when it does
+// not use TLS
+func tlsDetails(ws *websocket.Conn) *TLSDetails {
+	tlsConn, ok := ws.UnderlyingConn().(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	details := &TLSDetails{
+		Version:     state.Version,
+		CipherSuite: state.CipherSuite,
+		ALPN:        state.NegotiatedProtocol,
+	}
+	for _, cert := range state.PeerCertificates {
+		details.Chain = append(details.Chain, cert.Subject.String())
+	}
+	if len(state.PeerCertificates) != 0 {
+		leaf := state.PeerCertificates[0]
+		sum := sha256.Sum256(leaf.Raw)
+		details.LeafSHA256 = hex.EncodeToString(sum[:])
+		details.LeafNotAfter = leaf.NotAfter
+	}
+	return details
+}
+
+// checkCertExpiry warns when the server certificate expires soon
+func checkCertExpiry(serverName string, details *TLSDetails) {
+	if details == nil || details.LeafNotAfter.IsZero() {
+		return
+	}
+	if left := time.Until(details.LeafNotAfter); left < certExpiryWarning {
+		log.Warnf("Certificate of tunnel server %s expires in %v, on %v",
+			serverName, left.Round(time.Hour), details.LeafNotAfter)
+	}
+}
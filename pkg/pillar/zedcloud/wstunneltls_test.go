@@ -0,0 +1,71 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTLSDetails(t *testing.T) {
+	ca := newTestCA(t)
+	loopback := []net.IP{net.ParseIP("127.0.0.1")}
+	// Expiring within certExpiryWarning, which only logs a warning
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	serverCert := ca.issue(t, "tunnel.example.com", loopback, notAfter)
+	ts := newTestTunnelServerTLS(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		NextProtos:   []string{"http/1.1"},
+	})
+	defer ts.Close()
+
+	client := newTestTunnelClient(ts)
+	client.Tunnel = "wss://" + ts.hostPort()
+	client.TLSConfig = &tls.Config{
+		RootCAs:    ca.pool,
+		NextProtos: []string{"http/1.1"},
+	}
+	if err := client.TestConnection(nil, nil); err != nil {
+		t.Fatalf("TestConnection failed: %v", err)
+	}
+	client.Start()
+	defer client.Stop()
+	if !waitFor(5*time.Second, func() bool { return client.Status().Connected }) {
+		t.Fatalf("tunnel never connected")
+	}
+
+	details := client.Status().TLS
+	if details == nil {
+		t.Fatalf("no TLS details in status")
+	}
+	sum := sha256.Sum256(serverCert.Certificate[0])
+	if details.Version != tls.VersionTLS12 ||
+		details.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 ||
+		details.ALPN != "http/1.1" ||
+		details.LeafSHA256 != hex.EncodeToString(sum[:]) ||
+		!details.LeafNotAfter.Equal(notAfter) ||
+		len(details.Chain) != 1 || details.Chain[0] != "CN=tunnel.example.com" {
+		t.Errorf("unexpected TLS details %+v", details)
+	}
+}
+
+func TestTLSDetailsPlain(t *testing.T) {
+	ts := newTestTunnelServer(t)
+	defer ts.Close()
+
+	client := startTestTunnel(t, ts, nil, nil)
+	defer client.Stop()
+	if !waitFor(5*time.Second, func() bool { return client.Status().Connected }) {
+		t.Fatalf("tunnel never connected")
+	}
+	if details := client.Status().TLS; details != nil {
+		t.Errorf("TLS details without TLS: %+v", details)
+	}
+}
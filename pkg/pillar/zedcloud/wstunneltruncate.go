@@ -0,0 +1,63 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cappedReader ends a response after its first max bytes, noting
+// whether the relay had more to send
+type cappedReader struct {
+	r         io.Reader
+	left      int
+	truncated bool
+}
+
+// capResponse caps the response read from r at MaxResponseBytes
+func (t *WSTunnelClient) capResponse(r io.Reader) *cappedReader {
+	max := t.MaxResponseBytes
+	if max == 0 {
+		max = math.MaxInt32
+	}
+	return &cappedReader{r: r, left: max}
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if c.left <= 0 {
+		if !c.truncated {
+			var probe [1]byte
+			n, _ := c.r.Read(probe[:])
+			c.truncated = n > 0
+		}
+		return 0, io.EOF
+	}
+	if len(p) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	c.left -= n
+	return n, err
+}
+
+// responseTruncated tells the server the response to request id was
+// cut at MaxResponseBytes, which the last frame also flags when frames
+// have flags, and resets the relay connection still sending it
+func (wsc *WSConnection) responseTruncated(id requestID, conn *relayConn) {
+	log.Warnf("[id=%d] Response from local relay over %d bytes, truncated",
+		id, wsc.tun.MaxResponseBytes)
+	wsc.tun.mutex.Lock()
+	wsc.tun.stats.ResponsesTruncated++
+	wsc.tun.mutex.Unlock()
+	if tcpConn, ok := conn.Conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	wsc.writeErrorMessage(id, frameErrorTruncated,
+		fmt.Sprintf("response truncated at %d bytes", wsc.tun.MaxResponseBytes))
+}
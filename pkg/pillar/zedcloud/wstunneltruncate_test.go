@@ -0,0 +1,79 @@
+// Copyright (c) 2019 Zededa, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package zedcloud
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// bigRelay answers "big" with 10MB and anything else as echoRelay
+func bigRelay(req string) []byte {
+	if req == "big" {
+		return bytes.Repeat([]byte("x"), 10*1024*1024)
+	}
+	return echoRelay(req)
+}
+
+func TestTruncatedResponse(t *testing.T) {
+	const maxResponse = 1024 * 1024
+	for _, chunked := range []bool{false, true} {
+		ts := newTestTunnelServer(t)
+		caps := capabilityErrorFrames
+		if chunked {
+			caps += "," + capabilityChunked
+		}
+		ts.setCapabilities(caps)
+		relay := newTestRelay(t, bigRelay)
+		client := startTestTunnel(t, ts, relay, func(client *WSTunnelClient) {
+			client.MaxResponseBytes = maxResponse
+		})
+		ws := ts.waitConn(t)
+
+		sendRequest(t, ws, 1, "big")
+		received := 0
+		flags := 0
+		for {
+			frame := readFrame(t, ws)
+			if frame.id != 1 || frameErrorCode(frame) != "" {
+				t.Fatalf("chunked %v: unexpected frame %.16q", chunked, frame.payload)
+			}
+			payload := frame.payload
+			if chunked {
+				fmt.Sscanf(payload[:2], "%02x", &flags)
+				payload = payload[6:]
+			}
+			received += len(payload)
+			if flags&frameFlagMore == 0 {
+				break
+			}
+		}
+		if received != maxResponse {
+			t.Errorf("chunked %v: expected %d bytes, got %d", chunked, maxResponse, received)
+		}
+		if chunked && flags&frameFlagTruncated == 0 {
+			t.Errorf("chunked %v: last frame not flagged truncated: %02x", chunked, flags)
+		}
+		if frame := readFrame(t, ws); frame.id != 1 || frameErrorCode(frame) != frameErrorTruncated {
+			t.Errorf("chunked %v: expected truncated error frame, got %+v", chunked, frame)
+		}
+		if truncated := client.GetStats().ResponsesTruncated; truncated != 1 {
+			t.Errorf("chunked %v: expected 1 truncated response, got %d", chunked, truncated)
+		}
+
+		// The next request gets a fresh connection and a full response
+		sendRequest(t, ws, 2, "small")
+		expected := "reply:small"
+		if chunked {
+			expected = "000000" + expected
+		}
+		if frame := readFrame(t, ws); frame.id != 2 || frame.payload != expected {
+			t.Errorf("chunked %v: expected %q, got %+v", chunked, expected, frame)
+		}
+		client.Stop()
+		relay.Close()
+		ts.Close()
+	}
+}
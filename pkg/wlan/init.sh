@@ -7,6 +7,11 @@
 
 ip link set wlan0 up
 while true ; do
-  [ -f /config/wpa_supplicant.conf ] && wpa_supplicant -Dwext -iwlan0 -c /config/wpa_supplicant.conf -d
+  # Written by nim from the Wireless of the DeviceNetworkConfig
+  if [ -f /run/wlan/wlan0.conf ] ; then
+    wpa_supplicant -Dnl80211,wext -iwlan0 -c /run/wlan/wlan0.conf
+  elif [ -f /config/wpa_supplicant.conf ] ; then
+    wpa_supplicant -Dwext -iwlan0 -c /config/wpa_supplicant.conf -d
+  fi
   sleep 10
 done